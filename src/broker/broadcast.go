@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// broadcast is a reader of a topic shared by the SSE clients of the topic. Its messages are fanned out
+// to every client without a subscription or an acknowledgement per client.
+type broadcast struct {
+	key         string
+	topic       string
+	client      pulsar.Client
+	reader      pulsar.Reader
+	cancel      context.CancelFunc
+	subscribers map[chan pulsar.ConsumerMessage]bool
+	sync.Mutex
+}
+
+// broadcastDial is a reader of a broadcast being created, the other clients of the topic wait for it
+type broadcastDial struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	broadcasts     = make(map[string]*broadcast)
+	broadcastDials = make(map[string]*broadcastDial)
+	broadcastsLock sync.Mutex
+)
+
+// broadcastKey identifies a broadcast by the cluster, token, and topic,
+// so that a reader created with one token is never shared with another token
+func broadcastKey(url, token, topic string) string {
+	return fmt.Sprintf("%s|%s|%s", url, token, topic)
+}
+
+// JoinBroadcast subscribes to the broadcast of the topic. The reader of the broadcast is created by the first
+// client from the latest message, so a client receives the messages published from its join onwards.
+// A message is dropped for a client whose buffer of size messages is full, so that a slow client never holds
+// up the others. The messages are ConsumerMessage without a Consumer, and the channel is closed if the reader fails.
+// The returned leave function must be called once the client is gone, the reader is closed with the last client.
+func JoinBroadcast(url, token, topic string, size int) (<-chan pulsar.ConsumerMessage, func(), error) {
+	if size < 0 {
+		size = 0
+	}
+	key := broadcastKey(url, token, topic)
+
+	for {
+		broadcastsLock.Lock()
+		if b, ok := broadcasts[key]; ok {
+			ch, leave := b.join(size)
+			broadcastsLock.Unlock()
+			return ch, leave, nil
+		}
+		if dial, ok := broadcastDials[key]; ok {
+			// another client is creating the reader, the broadcast is looked up again once it is done
+			broadcastsLock.Unlock()
+			<-dial.done
+			if dial.err != nil {
+				return nil, nil, dial.err
+			}
+			continue
+		}
+		dial := &broadcastDial{done: make(chan struct{})}
+		broadcastDials[key] = dial
+		broadcastsLock.Unlock()
+
+		// the reader is created without the lock so that a slow cluster never blocks the other topics
+		client, reader, err := DialReader(url, token, topic, pulsar.LatestMessageID(), time.Time{})
+
+		broadcastsLock.Lock()
+		delete(broadcastDials, key)
+		dial.err = err
+		close(dial.done)
+		if err != nil {
+			broadcastsLock.Unlock()
+			return nil, nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		b := &broadcast{
+			key:         key,
+			topic:       topic,
+			client:      client,
+			reader:      reader,
+			cancel:      cancel,
+			subscribers: make(map[chan pulsar.ConsumerMessage]bool),
+		}
+		broadcasts[key] = b
+		go b.run(ctx)
+		ch, leave := b.join(size)
+		broadcastsLock.Unlock()
+		return ch, leave, nil
+	}
+}
+
+// join adds a client with a buffer of size messages, it is called with broadcastsLock held so that
+// the broadcast is not stopped by the last client leaving in the meantime
+func (b *broadcast) join(size int) (<-chan pulsar.ConsumerMessage, func()) {
+	ch := make(chan pulsar.ConsumerMessage, size)
+	b.Lock()
+	b.subscribers[ch] = true
+	b.Unlock()
+
+	var once sync.Once
+	leave := func() {
+		once.Do(func() { b.leave(ch) })
+	}
+	return ch, leave
+}
+
+// leave removes a client, and stops the broadcast without a client
+func (b *broadcast) leave(ch chan pulsar.ConsumerMessage) {
+	broadcastsLock.Lock()
+	defer broadcastsLock.Unlock()
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, ch)
+	if len(b.subscribers) == 0 && broadcasts[b.key] == b {
+		delete(broadcasts, b.key)
+		b.cancel()
+	}
+}
+
+// run fans out the messages of the reader until the broadcast is stopped or the reader fails
+func (b *broadcast) run(ctx context.Context) {
+	defer b.client.Close()
+	defer b.reader.Close()
+	dropped := util.BroadcastDroppedMessages.WithLabelValues(util.TopicTenant(b.topic))
+	for {
+		msg, err := b.reader.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("broadcast reader on topic %s failed to read the next message %v", b.topic, err)
+				b.close()
+			}
+			return
+		}
+		b.Lock()
+		for ch := range b.subscribers {
+			select {
+			case ch <- pulsar.ConsumerMessage{Message: msg}:
+			default:
+				dropped.Inc()
+			}
+		}
+		b.Unlock()
+	}
+}
+
+// close removes a failed broadcast and closes the channels of its clients, a new client creates a new reader
+func (b *broadcast) close() {
+	broadcastsLock.Lock()
+	if broadcasts[b.key] == b {
+		delete(broadcasts, b.key)
+	}
+	broadcastsLock.Unlock()
+	b.cancel()
+
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = make(map[chan pulsar.ConsumerMessage]bool)
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+)
+
+// DialReader creates the client and reader of a replay
+var DialReader = GetPulsarClientReader
+
+// ReplayRange is the end position and the caps of a replay. The replay ends after the message EndMessageID,
+// or before the first message published after EndTime, or at the last message of the topic if neither is set.
+type ReplayRange struct {
+	EndMessageID pulsar.MessageID
+	EndTime      time.Time
+	MaxMessages  int
+	MaxBytes     int
+}
+
+// pastEnd returns true if the message is beyond the end position
+func (r ReplayRange) pastEnd(msg pulsar.Message) bool {
+	if r.EndMessageID != nil && compareMessageID(msg.ID(), r.EndMessageID) > 0 {
+		return true
+	}
+	return !r.EndTime.IsZero() && msg.PublishTime().After(r.EndTime)
+}
+
+// compareMessageID compares the message IDs of the same topic partition by the ledger, entry, and batch index
+func compareMessageID(a, b pulsar.MessageID) int {
+	switch {
+	case a.LedgerID() != b.LedgerID():
+		return compareInt64(a.LedgerID(), b.LedgerID())
+	case a.EntryID() != b.EntryID():
+		return compareInt64(a.EntryID(), b.EntryID())
+	default:
+		return compareInt64(int64(a.BatchIdx()), int64(b.BatchIdx()))
+	}
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// ReplayMessages reads the messages of a topic from the start position to the end of the range with a reader,
+// so that no subscription is created. The start message itself is not returned, so a truncated replay is
+// continued from the ID of its last message. The reply is truncated if the range has more messages than
+// the caps or the context is done before the end is reached. The first message is returned even if its
+// payload exceeds MaxBytes.
+func ReplayMessages(ctx context.Context, url, token, topic string, startMessageID pulsar.MessageID, startTime time.Time, rng ReplayRange) (model.ReplayMessages, error) {
+	replay := model.ReplayMessages{PulsarMessages: model.NewPulsarMessages(rng.MaxMessages)}
+
+	client, reader, err := DialReader(url, token, topic, startMessageID, startTime)
+	if err != nil {
+		return replay, err
+	}
+	defer client.Close()
+	defer reader.Close()
+
+	bytes := 0
+	for reader.HasNext() {
+		msg, err := reader.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				replay.Truncated = true
+				return replay, nil
+			}
+			return replay, err
+		}
+		if rng.pastEnd(msg) {
+			return replay, nil
+		}
+		// a message larger than MaxBytes is still returned alone, so that a replay always makes progress
+		if replay.Size >= rng.MaxMessages || (replay.Size > 0 && bytes+len(msg.Payload()) > rng.MaxBytes) {
+			replay.Truncated = true
+			return replay, nil
+		}
+		bytes += len(msg.Payload())
+		replay.AddPulsarMessage(msg)
+		if rng.EndMessageID != nil && compareMessageID(msg.ID(), rng.EndMessageID) == 0 {
+			return replay, nil
+		}
+	}
+	return replay, nil
+}
@@ -1,61 +1,448 @@
 package broker
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
 	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
 	log "github.com/sirupsen/logrus"
 )
 
+// seekedSubscriptions tracks the start time that a durable subscription was last seeked to
+var seekedSubscriptions = util.NewCache(util.CacheOption{
+	TTL:            24 * time.Hour,
+	CleanInterval:  1 * time.Hour,
+	ExpireCallback: func(key string, value interface{}) {},
+})
+
+// ErrPollConsumerNotFound is returned when a subscription has no consumer cached by a poll
+var ErrPollConsumerNotFound = errors.New("no consumer is polling the subscription")
+
+// DialConsumer creates the client and consumer of a poll consumer that is not cached yet
+var DialConsumer = GetPulsarClientConsumer
+
+// ErrPollConsumerMismatch is returned when a poll requests different consumer settings than the cached consumer
+var ErrPollConsumerMismatch = errors.New("the subscription is polled with different consumer settings, " +
+	"the settings apply after the cached consumer is idle for PollConsumerIdleTimeout")
+
+// pollConsumer is a consumer cached by a poll on a durable subscription for the next poll and ack
+type pollConsumer struct {
+	client   pulsar.Client
+	consumer pulsar.Consumer
+	settings string
+}
+
+var (
+	pollConsumers     *util.Cache
+	pollConsumersOnce sync.Once
+	pollConsumersLock sync.Mutex
+)
+
+// getPollConsumers returns the cache of consumers of durable subscriptions polled over HTTP
+func getPollConsumers() *util.Cache {
+	pollConsumersOnce.Do(func() {
+		ttl, err := time.ParseDuration(util.GetConfig().PollConsumerIdleTimeout)
+		if err != nil || ttl <= 0 {
+			ttl = 5 * time.Minute
+		}
+		pollConsumers = util.NewCache(util.CacheOption{
+			TTL:           ttl,
+			CleanInterval: 30 * time.Second,
+			ExpireCallback: func(key string, value interface{}) {
+				c := value.(*pollConsumer)
+				c.consumer.Close()
+				c.client.Close()
+			},
+		})
+	})
+	return pollConsumers
+}
+
+// pollConsumerKey identifies a cached consumer by the cluster, topics, subscription name and type.
+// The token is part of the key so a consumer created with one token is never used by another token.
+func pollConsumerKey(url, token, topic string, cfg model.ConsumerConfig) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d", url, token, topic, strings.Join(cfg.Topics, ","), cfg.SubscriptionName, cfg.SubscriptionType)
+}
+
+// pollConsumerSettings are the consumer settings that are not part of the key, a poll with other settings
+// than the cached consumer is rejected rather than silently ignoring them
+func pollConsumerSettings(cfg model.ConsumerConfig) string {
+	properties := make([]string, 0, len(cfg.Filter.Properties))
+	for k, v := range cfg.Filter.Properties {
+		properties = append(properties, k+"="+v)
+	}
+	sort.Strings(properties)
+	return fmt.Sprintf("%d|%s|%d|%s|%s|%t", cfg.MaxRedeliveries, cfg.DeadLetterTopic, cfg.ReceiverQueueSize,
+		cfg.TopicsPattern, strings.Join(properties, ","), cfg.Filter.Nack)
+}
+
+// getPollConsumer returns the cached consumer of the subscription, or creates one.
+// NonResumable subscriptions are never cached since they are removed after a single poll.
+// It returns ErrPollConsumerMismatch if the cached consumer has other settings than cfg.
+func getPollConsumer(url, token, topic string, cfg model.ConsumerConfig) (pulsar.Consumer, error) {
+	if cfg.IsNonResumable() {
+		return nil, errors.New("an auto-generated subscription cannot be cached")
+	}
+	cache := getPollConsumers()
+	key := pollConsumerKey(url, token, topic, cfg)
+
+	pollConsumersLock.Lock()
+	defer pollConsumersLock.Unlock()
+	if item, ok := cache.Get(key); ok {
+		if item.(*pollConsumer).settings != pollConsumerSettings(cfg) {
+			return nil, ErrPollConsumerMismatch
+		}
+		consumer := item.(*pollConsumer).consumer
+		TrackSubscription(url, token, topic, cfg)
+		if err := SeekByStartTime(consumer, url+topic, cfg); err != nil {
+			return nil, err
+		}
+		return consumer, nil
+	}
+
+	client, consumer, err := DialConsumer(url, token, topic, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cache.Set(key, &pollConsumer{client: client, consumer: consumer, settings: pollConsumerSettings(cfg)})
+	return consumer, nil
+}
+
+// FlushPollConsumers closes and evicts every cached poll consumer and returns the number of evicted consumers.
+// The next poll of a subscription creates a new consumer.
+func FlushPollConsumers() int {
+	pollConsumersLock.Lock()
+	defer pollConsumersLock.Unlock()
+	return getPollConsumers().Flush()
+}
+
 // GetPulsarClientConsumer returns Puslar client and consumer interface objects
-func GetPulsarClientConsumer(url, token, topic, subscriptionName string, subType pulsar.SubscriptionType, subInitPos pulsar.SubscriptionInitialPosition) (pulsar.Client, pulsar.Consumer, error) {
+// The initial position is only applied when the subscription is created. A consumer attached to
+// an existing durable subscription always resumes from the subscription's committed cursor,
+// unless a start time is requested, see SeekByStartTime.
+// The use of a durable subscription is tracked for the auto-unsubscribe on inactivity, see TrackSubscription.
+// A multi-topic consumer subscribes to the topic and the additional cfg.Topics with the same subscription.
+// A regex consumer subscribes to the topics matching cfg.TopicsPattern instead of the topic.
+func GetPulsarClientConsumer(url, token, topic string, cfg model.ConsumerConfig) (pulsar.Client, pulsar.Consumer, error) {
 	client, err := pulsardriver.NewPulsarClient(url, token)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
+	opts := pulsar.ConsumerOptions{
 		Topic:                       topic,
-		SubscriptionName:            subscriptionName,
-		SubscriptionInitialPosition: subInitPos,
-		Type:                        subType,
-	})
+		SubscriptionName:            cfg.SubscriptionName,
+		SubscriptionInitialPosition: cfg.InitialPosition,
+		Type:                        cfg.SubscriptionType,
+		KeySharedPolicy:             model.KeySharedPolicy(cfg.SubscriptionType),
+		ReceiverQueueSize:           cfg.ReceiverQueueSize,
+	}
+	if cfg.MaxRedeliveries > 0 {
+		opts.DLQ = &pulsar.DLQPolicy{
+			MaxDeliveries:   cfg.MaxRedeliveries,
+			DeadLetterTopic: cfg.DeadLetterTopic,
+		}
+	}
+	if len(cfg.Topics) > 0 {
+		opts.Topic = ""
+		opts.Topics = append([]string{topic}, cfg.Topics...)
+	} else if cfg.TopicsPattern != "" {
+		// new topics matching the pattern are discovered by the client periodically
+		opts.Topic = ""
+		opts.TopicsPattern = cfg.TopicsPattern
+	}
+	created, err := pulsardriver.CreateWithTimeout(func() (pulsardriver.Closer, error) { return client.Subscribe(opts) })
 	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	consumer := created.(pulsar.Consumer)
+
+	if cfg.StartMessageID != nil {
+		// a message ID seek is best effort, the consumer of a multi-partition topic cannot seek
+		if err = consumer.Seek(cfg.StartMessageID); err != nil {
+			log.Warnf("failed to seek subscription %s on topic %s to %v error %v", cfg.SubscriptionName, topic, cfg.StartMessageID, err)
+		}
+	} else if err = SeekByStartTime(consumer, url+topic, cfg); err != nil {
+		closeConsumer(client, consumer, cfg.IsNonResumable())
 		return nil, nil, err
 	}
+	if cfg.TopicsPattern == "" {
+		TrackSubscription(url, token, topic, cfg)
+	}
+	for _, t := range cfg.Topics {
+		TrackSubscription(url, token, t, cfg)
+	}
 
 	return client, consumer, nil
 }
 
+// MessageIDAfter returns the message ID of the entry following a SSE event id, see model.FormatMessageID,
+// so that a subscription seeked to it resumes just after the event. The id identifies the entry, the remaining
+// messages of a batch entry are not redelivered.
+func MessageIDAfter(eventID string) (pulsar.MessageID, error) {
+	id, err := model.ParseMessageID(eventID)
+	if err != nil {
+		return nil, err
+	}
+	// a consumer cannot seek to a message ID without a partition
+	if id.PartitionIdx() < 0 || id.EntryID() == math.MaxInt64 {
+		return nil, fmt.Errorf("invalid event id %s", eventID)
+	}
+	return model.NewMessageID(id.LedgerID(), id.EntryID()+1, id.PartitionIdx(), -1)
+}
+
+// SeekByStartTime seeks the subscription to the requested start time.
+// A durable subscription is only seeked again when the start time differs from the last seek,
+// so that repeated calls with the same start time resume from the committed cursor.
+func SeekByStartTime(consumer pulsar.Consumer, topicKey string, cfg model.ConsumerConfig) error {
+	if cfg.StartTime.IsZero() {
+		return nil
+	}
+	if cfg.IsNonResumable() {
+		return consumer.SeekByTime(cfg.StartTime)
+	}
+
+	key := topicKey + cfg.SubscriptionName
+	if last, ok := seekedSubscriptions.Get(key); ok && last.(time.Time).Equal(cfg.StartTime) {
+		return nil
+	}
+	if err := consumer.SeekByTime(cfg.StartTime); err != nil {
+		return err
+	}
+	seekedSubscriptions.Set(key, cfg.StartTime)
+	return nil
+}
+
 // PollBatchMessages polls a batch of consumer messages
-func PollBatchMessages(url, token, topic, subscriptionName string, subType pulsar.SubscriptionType, size, perMessageTimeoutMs int) (model.PulsarMessages, error) {
-	log.Infof("getbatchmessages called")
-	client, consumer, err := GetPulsarClientConsumer(url, token, topic, subscriptionName, subType, pulsar.SubscriptionPositionEarliest)
+// The initial position only applies to a new subscription, see GetPulsarClientConsumer.
+// It collects up to size messages, but returns the messages collected so far, fewer than size or none,
+// as soon as no new message arrives within perMessageTimeoutMs. It waits up to waitMs for the first
+// message to arrive if waitMs is longer than perMessageTimeoutMs.
+// The consumer of a durable subscription is cached and reused by the next poll until it is idle
+// for PollConsumerIdleTimeout.
+func PollBatchMessages(ctx context.Context, url, token, topic string, cfg model.ConsumerConfig, size, perMessageTimeoutMs, waitMs int) (model.PulsarMessages, error) {
+	if !cfg.IsNonResumable() {
+		consumer, err := getPollConsumer(url, token, topic, cfg)
+		if err != nil {
+			return model.NewPulsarMessages(size), err
+		}
+		return receiveBatch(ctx, consumer, size, perMessageTimeoutMs, waitMs, true, cfg.Filter), nil
+	}
+
+	client, consumer, err := DialConsumer(url, token, topic, cfg)
+	if err != nil {
+		return model.NewPulsarMessages(size), err
+	}
+	defer closeConsumer(client, consumer, cfg.IsNonResumable())
+
+	return receiveBatch(ctx, consumer, size, perMessageTimeoutMs, waitMs, true, cfg.Filter), nil
+}
+
+// PeekBatchMessages reads a batch of messages with a short-lived exclusive subscription
+// without acknowledging them. The subscription is always removed afterwards so that
+// no cursor is left behind on the topic.
+func PeekBatchMessages(ctx context.Context, url, token, topic string, cfg model.ConsumerConfig, size, perMessageTimeoutMs, waitMs int) (model.PulsarMessages, error) {
+	if !cfg.IsNonResumable() {
+		return model.NewPulsarMessages(size), errors.New("peek requires an auto-generated subscription")
+	}
+	cfg.SubscriptionType = pulsar.Exclusive
+	client, consumer, err := DialConsumer(url, token, topic, cfg)
+	if err != nil {
+		return model.NewPulsarMessages(size), err
+	}
+	defer closeConsumer(client, consumer, true)
+
+	return receiveBatch(ctx, consumer, size, perMessageTimeoutMs, waitMs, false, cfg.Filter), nil
+}
+
+// closeConsumer closes the consumer and its client. The subscription is removed before
+// the consumer is closed if unsubscribe is true, since a closed consumer cannot unsubscribe.
+func closeConsumer(client pulsar.Client, consumer pulsar.Consumer, unsubscribe bool) {
+	if unsubscribe {
+		if err := consumer.Unsubscribe(); err != nil {
+			log.Errorf("failed to unsubscribe %s error %v", consumer.Subscription(), err)
+		}
+	}
+	consumer.Close()
+	client.Close()
+}
+
+// PollBatchMessagesNoAck polls a batch of messages without acknowledging them.
+// The consumer is cached by the subscription so that the messages can be acknowledged later by AckMessages.
+// The cached consumer is closed after PollConsumerIdleTimeout without poll or ack, and its
+// unacknowledged messages are redelivered.
+func PollBatchMessagesNoAck(ctx context.Context, url, token, topic string, cfg model.ConsumerConfig, size, perMessageTimeoutMs, waitMs int) (model.PulsarMessages, error) {
+	consumer, err := getPollConsumer(url, token, topic, cfg)
 	if err != nil {
 		return model.NewPulsarMessages(size), err
 	}
-	if strings.HasPrefix(subscriptionName, model.NonResumable) {
-		defer consumer.Unsubscribe()
+
+	return receiveBatch(ctx, consumer, size, perMessageTimeoutMs, waitMs, false, cfg.Filter), nil
+}
+
+// AckMessages acknowledges messages on the cached consumer of a subscription polled with PollBatchMessagesNoAck
+func AckMessages(url, token, topic string, cfg model.ConsumerConfig, msgIDs []pulsar.MessageID) error {
+	item, ok := getPollConsumers().Get(pollConsumerKey(url, token, topic, cfg))
+	if !ok {
+		return ErrPollConsumerNotFound
 	}
-	defer consumer.Close()
-	defer client.Close()
+	consumer := item.(*pollConsumer).consumer
+	for _, id := range msgIDs {
+		consumer.AckID(id)
+	}
+	return nil
+}
 
+// receiveBatch receives up to size messages from the consumer, a partial batch is returned once the
+// consumer has no message within the timeout. Only the messages matching the filter are returned and count
+// toward size, the others are acknowledged or negatively acknowledged by the filter regardless of ack.
+// The messages collected so far are returned once the context is done, such as by a poll deadline.
+// The returned messages are only acknowledged once the batch is complete. If the context is cancelled because
+// the client is gone, they are negatively acknowledged instead, so that they are redelivered.
+func receiveBatch(ctx context.Context, consumer pulsar.Consumer, size, perMessageTimeoutMs, waitMs int, ack bool, filter model.MessageFilter) model.PulsarMessages {
 	messages := model.NewPulsarMessages(size)
+	var collected []pulsar.Message
+	complete := func() model.PulsarMessages {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			for _, msg := range collected {
+				consumer.Nack(msg)
+			}
+		} else if ack {
+			for _, msg := range collected {
+				consumer.Ack(msg)
+			}
+		}
+		return messages
+	}
 	consumChan := consumer.Chan()
-	for i := 0; i < size; i++ {
+	// the per-message timeout runs from the last matching message, a message removed by the filter
+	// neither counts toward the batch size nor extends the poll
+	timeoutMs := perMessageTimeoutMs
+	if waitMs > timeoutMs {
+		// long poll for the first message
+		timeoutMs = waitMs
+	}
+	timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timer.Stop()
+	for len(collected) < size {
 		select {
 		case msg := <-consumChan:
 			// log.Infof("received message %s on topic %s", string(msg.Payload()), msg.Topic())
+			if !filter.Match(msg.Properties()) {
+				if filter.Nack {
+					consumer.Nack(msg)
+				} else {
+					consumer.Ack(msg)
+				}
+				continue
+			}
 			messages.AddPulsarMessage(msg)
-			consumer.Ack(msg)
+			collected = append(collected, msg)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(time.Duration(perMessageTimeoutMs) * time.Millisecond)
 
-		case <-time.After(time.Duration(perMessageTimeoutMs) * time.Millisecond): //TODO: this should be configurable
-			i = size
+		case <-timer.C:
+			// the messages collected so far are kept as a partial batch
+			return complete()
+		case <-ctx.Done():
+			return complete()
 		}
 	}
 
-	return messages, nil
+	return complete()
+}
+
+// BufferConsumerMessages relays messages from the consumer channel to a bounded buffer.
+// When the buffer is full, it stops reading from the consumer so that the consumer's
+// receiver queue backs up and the broker stops dispatching to this consumer.
+// The relay exits when the context is done.
+func BufferConsumerMessages(ctx context.Context, consumer pulsar.Consumer, size int) <-chan pulsar.ConsumerMessage {
+	if size < 0 {
+		size = 0
+	}
+	buffer := make(chan pulsar.ConsumerMessage, size)
+	consumChan := consumer.Chan()
+	go func() {
+		for {
+			select {
+			case msg := <-consumChan:
+				select {
+				case buffer <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return buffer
+}
+
+// GetPulsarClientReader creates a Pulsar client and a reader on the topic starting from the message ID.
+// A non-zero startTime seeks the reader to the first message published at or after the time.
+func GetPulsarClientReader(url, token, topic string, startMessageID pulsar.MessageID, startTime time.Time) (pulsar.Client, pulsar.Reader, error) {
+	client, err := pulsardriver.NewPulsarClient(url, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, err := pulsardriver.CreateWithTimeout(func() (pulsardriver.Closer, error) {
+		return client.CreateReader(pulsar.ReaderOptions{
+			Topic:          topic,
+			StartMessageID: startMessageID,
+		})
+	})
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	reader := created.(pulsar.Reader)
+
+	if !startTime.IsZero() {
+		if err = reader.SeekByTime(startTime); err != nil {
+			reader.Close()
+			client.Close()
+			return nil, nil, err
+		}
+	}
+	return client, reader, nil
+}
+
+// BufferReaderMessages relays messages from the reader to a bounded buffer.
+// The reader does not read ahead of the buffer. The relay exits when the context is done.
+func BufferReaderMessages(ctx context.Context, reader pulsar.Reader, size int) <-chan pulsar.Message {
+	if size < 0 {
+		size = 0
+	}
+	buffer := make(chan pulsar.Message, size)
+	go func() {
+		for {
+			msg, err := reader.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("reader on topic %s failed to read the next message %v", reader.Topic(), err)
+				}
+				return
+			}
+			select {
+			case buffer <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return buffer
 }
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// trackedSubscription is a durable subscription created by pulsar-beam that is subject to auto-unsubscribe
+type trackedSubscription struct {
+	url              string
+	token            string
+	topic            string
+	subscriptionName string
+	subscriptionType pulsar.SubscriptionType
+	permanent        bool
+}
+
+var (
+	inactiveSubscriptions     *util.Cache
+	inactiveSubscriptionsOnce sync.Once
+	inactivityTimeout         time.Duration
+)
+
+// subscriptionTracker returns the cache of durable subscriptions keyed by the last use,
+// it returns nil if the auto-unsubscribe on inactivity is disabled.
+func subscriptionTracker() *util.Cache {
+	inactiveSubscriptionsOnce.Do(func() {
+		timeout := util.GetConfig().SubscriptionInactivityTimeout
+		if timeout == "" {
+			return
+		}
+		var err error
+		inactivityTimeout, err = time.ParseDuration(timeout)
+		if err != nil || inactivityTimeout <= 0 {
+			log.Errorf("invalid SubscriptionInactivityTimeout %s, auto-unsubscribe is disabled", timeout)
+			return
+		}
+		cleanInterval := inactivityTimeout / 10
+		if cleanInterval > time.Minute {
+			cleanInterval = time.Minute
+		}
+		inactiveSubscriptions = util.NewCache(util.CacheOption{
+			TTL:           inactivityTimeout,
+			CleanInterval: cleanInterval,
+			ExpireCallback: func(key string, value interface{}) {
+				// the callback is invoked under the cache lock
+				go unsubscribeInactive(value.(trackedSubscription))
+			},
+		})
+	})
+	return inactiveSubscriptions
+}
+
+// TrackSubscription records the last use of a durable subscription for the auto-unsubscribe on inactivity.
+// A subscription marked as permanent is excluded until a client uses it without the mark again.
+func TrackSubscription(url, token, topic string, cfg model.ConsumerConfig) {
+	if cfg.IsNonResumable() || util.IsNonPersistentTopic(topic) {
+		return
+	}
+	tracker := subscriptionTracker()
+	if tracker == nil {
+		return
+	}
+	tracker.Set(url+topic+cfg.SubscriptionName, trackedSubscription{
+		url:              url,
+		token:            token,
+		topic:            topic,
+		subscriptionName: cfg.SubscriptionName,
+		subscriptionType: cfg.SubscriptionType,
+		permanent:        cfg.Permanent,
+	})
+}
+
+// unsubscribeInactive removes a durable subscription that has not been used within the inactivity timeout.
+// The broker rejects the unsubscribe while another consumer is still attached, in which case
+// the subscription is tracked for another inactivity period.
+func unsubscribeInactive(sub trackedSubscription) {
+	if sub.permanent {
+		return
+	}
+	client, err := pulsardriver.NewPulsarClient(sub.url, util.ClusterToken(sub.url, sub.token))
+	if err != nil {
+		log.Errorf("failed to create client to unsubscribe inactive subscription %s on topic %s error %v", sub.subscriptionName, sub.topic, err)
+		return
+	}
+	defer client.Close()
+
+	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
+		Topic:            sub.topic,
+		SubscriptionName: sub.subscriptionName,
+		Type:             sub.subscriptionType,
+	})
+	if err == nil {
+		err = consumer.Unsubscribe()
+		consumer.Close()
+	}
+	if err != nil {
+		log.Warnf("failed to unsubscribe inactive subscription %s on topic %s, will retry after %v, error %v",
+			sub.subscriptionName, sub.topic, inactivityTimeout, err)
+		inactiveSubscriptions.Set(sub.url+sub.topic+sub.subscriptionName, sub)
+		return
+	}
+	log.Infof("unsubscribed subscription %s on topic %s due to no consumer activity in %v", sub.subscriptionName, sub.topic, inactivityTimeout)
+	util.SubscriptionBacklog.DeleteLabelValues(sub.topic, sub.subscriptionName)
+}
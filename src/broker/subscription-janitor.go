@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// NonResumableJanitor unsubscribes the auto-generated NonResumable subscriptions that have no consumer.
+// Such a subscription is normally removed when its SSE, poll, or websocket consumer closes, but it is left
+// behind if beam restarts in the middle of a stream. A subscription is only unsubscribed when it has no
+// consumer on two consecutive scans, so that a consumer reconnecting to the broker keeps its subscription.
+// Only the subscriptions with the reserved NonResumable prefix are touched.
+type NonResumableJanitor struct {
+	Clusters   []string
+	Namespaces []string
+	// candidates are the subscriptions without a consumer in the previous scan
+	candidates map[string]bool
+}
+
+// NewNonResumableJanitor creates a janitor scanning the topics of the namespaces on the clusters
+func NewNonResumableJanitor(clusters, namespaces []string) *NonResumableJanitor {
+	return &NonResumableJanitor{
+		Clusters:   clusters,
+		Namespaces: namespaces,
+		candidates: map[string]bool{},
+	}
+}
+
+// Run scans the namespaces once and returns the number of unsubscribed subscriptions
+func (j *NonResumableJanitor) Run() int {
+	reaped := 0
+	candidates := map[string]bool{}
+	for _, cluster := range j.Clusters {
+		token := util.ClusterTokens[cluster]
+		for _, namespace := range j.Namespaces {
+			topics, err := pulsardriver.GetNamespaceTopics(cluster, token, namespace)
+			if err != nil {
+				log.Errorf("janitor failed to list topics of namespace %s on %s error %v", namespace, cluster, err)
+				continue
+			}
+			for _, topic := range topics {
+				subs, err := pulsardriver.GetIdleSubscriptions(cluster, token, topic, model.NonResumable)
+				if err != nil {
+					log.Errorf("janitor failed to get the subscriptions of topic %s on %s error %v", topic, cluster, err)
+					continue
+				}
+				for _, sub := range subs {
+					key := cluster + topic + sub
+					if !j.candidates[key] {
+						candidates[key] = true
+						continue
+					}
+					// the broker rejects the deletion if a consumer has attached since the scan
+					if err := pulsardriver.DeleteSubscription(cluster, token, topic, sub); err != nil {
+						if err != pulsardriver.ErrSubscriptionInUse && err != pulsardriver.ErrSubscriptionNotFound {
+							log.Errorf("janitor failed to unsubscribe %s on topic %s error %v", sub, topic, err)
+							candidates[key] = true
+						}
+						continue
+					}
+					log.Infof("janitor unsubscribed orphaned subscription %s on topic %s", sub, topic)
+					util.ReapedSubscriptions.WithLabelValues(util.TopicTenant(topic)).Inc()
+					util.SubscriptionBacklog.DeleteLabelValues(topic, sub)
+					reaped++
+				}
+			}
+		}
+	}
+	j.candidates = candidates
+	return reaped
+}
+
+// StartNonResumableJanitor runs the janitor every NonResumableJanitorInterval, it is disabled if the interval
+// or the namespaces are not configured
+func StartNonResumableJanitor() {
+	cfg := util.GetConfig()
+	if cfg.NonResumableJanitorInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(cfg.NonResumableJanitorInterval)
+	if err != nil || interval <= 0 {
+		log.Errorf("invalid NonResumableJanitorInterval %s, the janitor is disabled", cfg.NonResumableJanitorInterval)
+		return
+	}
+	namespaces := []string{}
+	for _, ns := range strings.Split(cfg.NonResumableJanitorNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	clusters := []string{}
+	for _, cluster := range util.AllowedPulsarURLs {
+		if cluster != "" {
+			clusters = append(clusters, cluster)
+		}
+	}
+	if len(namespaces) == 0 || len(clusters) == 0 {
+		log.Errorf("NonResumableJanitorNamespaces and the allowed clusters are required, the janitor is disabled")
+		return
+	}
+
+	log.Infof("start NonResumable subscription janitor every %v on namespaces %v", interval, namespaces)
+	janitor := NewNonResumableJanitor(clusters, namespaces)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			janitor.Run()
+		}
+	}()
+}
@@ -1,6 +1,8 @@
 package broker
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -87,15 +89,54 @@ func NewDbHandler() {
 	singleDb = db.NewDbWithPanic(util.GetConfig().PbDbType)
 }
 
+// the default minimum webhook body size to be compressed
+const defaultCompressionMinSize = 1024
+
+// compressBody gzips the webhook body if compression is enabled and the body is large enough
+// It returns the original data if the body is not compressed.
+func compressBody(data []byte, whCfg model.WebhookConfig) ([]byte, bool) {
+	if whCfg.Compression != model.GzipCompression {
+		return data, false
+	}
+	minSize := whCfg.CompressionMinSize
+	if minSize == 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if len(data) < minSize {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	g := gzip.NewWriter(&buf)
+	if _, err := g.Write(data); err != nil {
+		log.Errorf("failed to gzip webhook body %v", err)
+		return data, false
+	}
+	if err := g.Close(); err != nil {
+		log.Errorf("failed to gzip webhook body %v", err)
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
 // pushWebhook sends data to a webhook interface
-func pushWebhook(url string, data []byte, headers []string) (int, *http.Response) {
+func pushWebhook(whCfg model.WebhookConfig, data []byte, headers []string) (int, *http.Response) {
+	url := whCfg.URL
 
 	client := retryablehttp.NewClient()
-	client.RetryWaitMin = 2 * time.Second
-	client.RetryWaitMax = 28 * time.Second
-	client.RetryMax = 1
+	// retryablehttp backs off exponentially from RetryWaitMin up to RetryWaitMax
+	maxRetries, initialBackoff, maxBackoff, err := whCfg.RetryPolicy()
+	if err != nil {
+		// an invalid policy is rejected by the topic config validation, this only guards stale documents
+		log.Errorf("webhook %s retry policy error %v, the default is used", url, err)
+		maxRetries, initialBackoff, maxBackoff = model.DefaultWebhookMaxRetries, model.DefaultWebhookInitialBackoff, model.DefaultWebhookMaxBackoff
+	}
+	client.RetryWaitMin = initialBackoff
+	client.RetryWaitMax = maxBackoff
+	client.RetryMax = maxRetries
 
-	req, err := retryablehttp.NewRequest("POST", url, data)
+	body, compressed := compressBody(data, whCfg)
+	req, err := retryablehttp.NewRequest("POST", url, body)
 	if err != nil {
 		log.Errorf("url request error %s", err.Error())
 		return http.StatusInternalServerError, nil
@@ -110,6 +151,9 @@ func pushWebhook(url string, data []byte, headers []string) (int, *http.Response
 		}
 		//discard any misformed headers
 	}
+	if compressed {
+		req.Header.Set("Content-Encoding", model.GzipCompression)
+	}
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -123,11 +167,23 @@ func pushWebhook(url string, data []byte, headers []string) (int, *http.Response
 	return res.StatusCode, res
 }
 
-func toPulsar(r *http.Response) {
+// SendToPulsar sends the body of a webhook response to Pulsar
+var SendToPulsar = pulsardriver.SendToPulsar
+
+// ToPulsar sends the body of a webhook response to the topic of its TopicFn header.
+// It only uses the Pulsar token of the response, the cluster token never stands in for a webhook endpoint.
+func ToPulsar(r *http.Response) {
 	token, topicFN, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
 	if err != nil {
 		return
 	}
+	if topicFN == "" {
+		return
+	}
+	if topicFN, err = util.NormalizeTopicFn(topicFN); err != nil {
+		log.Errorf("webhook response TopicFn header %v", err)
+		return
+	}
 	if log.GetLevel() == log.DebugLevel {
 		log.Debugf("topicURL %s pulsarURL %s", topicFN, pulsarURL)
 	}
@@ -139,31 +195,45 @@ func toPulsar(r *http.Response) {
 		return
 	}
 
-	err3 := pulsardriver.SendToPulsar(pulsarURL, token, topicFN, b, true, false, 0)
+	_, err3 := SendToPulsar(pulsarURL, token, topicFN, b, pulsardriver.SendOptions{}, true, false, 0)
 	if err3 != nil {
 		return
 	}
 }
 
-func pushAndAck(c pulsar.Consumer, msg pulsar.Message, url string, data []byte, headers []string) {
-	code, res := pushWebhook(url, data, headers)
+func pushAndAck(url, token string, c pulsar.Consumer, msg pulsar.Message, whCfg model.WebhookConfig, data []byte, headers []string) {
+	code, res := pushWebhook(whCfg, data, headers)
 	if (code >= 200 && code < 300) || code == http.StatusUnprocessableEntity {
 		c.Ack(msg)
 
 		if code >= 200 && code < 300 {
-			go toPulsar(res)
+			go ToPulsar(res)
 		}
-	} else {
-		if log.GetLevel() == log.DebugLevel {
-			// replying on Pulsar to redeliver
-			log.Errorf("webhook returns non-OK statuscode %d\n", code)
+		return
+	}
+
+	util.WebhookDeliveryFailures.WithLabelValues(util.TopicTenant(msg.Topic())).Inc()
+	if whCfg.FailureTopic != "" {
+		// the message is only acknowledged once it is safe in the failure topic
+		opts := pulsardriver.SendOptions{Key: msg.Key(), EventTime: msg.EventTime()}
+		if _, err := pulsardriver.SendToPulsar(url, token, whCfg.FailureTopic, data, opts, false, false, 0); err != nil {
+			log.Errorf("failed to send the failed webhook delivery to %s error %v", whCfg.FailureTopic, err)
+			return
 		}
+		c.Ack(msg)
+		return
+	}
+	if log.GetLevel() == log.DebugLevel {
+		// replying on Pulsar to redeliver
+		log.Errorf("webhook returns non-OK statuscode %d\n", code)
 	}
 }
 
 // ConsumeLoop consumes data from Pulsar topic
 // Do not use context since go vet will puke that requires cancel invoked in the same function
 func ConsumeLoop(url, token, topic, subscriptionKey string, whCfg model.WebhookConfig) error {
+	// the topic config is registered by a subject verified on the topic's tenant
+	token = util.ClusterToken(url, token)
 	headers := whCfg.Headers
 	_, err := model.GetSubscriptionType(whCfg.SubscriptionType)
 	if err != nil {
@@ -232,7 +302,7 @@ func ConsumeLoop(url, token, topic, subscriptionKey string, whCfg model.WebhookC
 			if log.GetLevel() == log.DebugLevel {
 				log.Debug(string(data))
 			}
-			pushAndAck(c, msg, whCfg.URL, data, headers)
+			pushAndAck(url, token, c, msg, whCfg, data, headers)
 		}
 	}
 
@@ -243,6 +313,10 @@ func run() {
 	subscriptionSet := make(map[string]bool)
 
 	for _, cfg := range LoadConfig() {
+		// the webhooks of an expired config are cancelled before the sweeper deletes it
+		if cfg.IsExpired(time.Now()) {
+			continue
+		}
 		for _, whCfg := range cfg.Webhooks {
 			topic := cfg.TopicFullName
 			token := cfg.Token
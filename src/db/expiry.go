@@ -0,0 +1,57 @@
+package db
+
+import (
+	"time"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReapExpiredTopics deletes the topic configs expired before now and returns the number of deleted configs
+func ReapExpiredTopics(store Crud, now time.Time) (int, error) {
+	docs, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, doc := range docs {
+		if !doc.IsExpired(now) {
+			continue
+		}
+		// another beam instance may have deleted the config first
+		if _, err := store.DeleteByKey(doc.Key); err != nil {
+			if err.Error() != DocNotFound {
+				log.Errorf("failed to delete expired topic config %s error %v", doc.Key, err)
+			}
+			continue
+		}
+		log.Infof("deleted topic config %s of topic %s expired at %v", doc.Key, doc.TopicFullName, doc.ExpiresAt)
+		util.ExpiredTopicConfigs.WithLabelValues(util.TopicTenant(doc.TopicFullName)).Inc()
+		reaped++
+	}
+	return reaped, nil
+}
+
+// StartTopicExpirySweeper deletes the expired topic configs every TopicExpirySweepInterval,
+// it is disabled if the interval is not configured
+func StartTopicExpirySweeper(store Crud) {
+	str := util.GetConfig().TopicExpirySweepInterval
+	if str == "" {
+		return
+	}
+	interval, err := time.ParseDuration(str)
+	if err != nil || interval <= 0 {
+		log.Errorf("invalid TopicExpirySweepInterval %s, the sweeper is disabled", str)
+		return
+	}
+
+	log.Infof("start topic config expiry sweeper every %v", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if _, err := ReapExpiredTopics(store, time.Now()); err != nil {
+				log.Errorf("failed to load topic configs for the expiry sweeper error %v", err)
+			}
+		}
+	}()
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
@@ -17,14 +18,17 @@ import (
 
 // InMemoryHandler is the in memory cache driver
 type InMemoryHandler struct {
-	topics map[string]model.TopicConfig
-	logger *log.Entry
+	topics          map[string]model.TopicConfig
+	revocations     map[string]model.RevokedToken
+	revocationsLock sync.RWMutex
+	logger          *log.Entry
 }
 
 //Init is a Db interface method.
 func (s *InMemoryHandler) Init() error {
 	s.logger = log.WithFields(log.Fields{"app": "inmemory-db"})
 	s.topics = make(map[string]model.TopicConfig)
+	s.revocations = make(map[string]model.RevokedToken)
 	return nil
 }
 
@@ -80,7 +84,7 @@ func (s *InMemoryHandler) GetByTopic(topicFullName, pulsarURL string) (*model.To
 
 // GetByKey gets a document by the key
 func (s *InMemoryHandler) GetByKey(hashedTopicKey string) (*model.TopicConfig, error) {
-	if v, ok := s.topics[hashedTopicKey]; ok {
+	if v, ok := s.topics[hashedTopicKey]; ok && !v.IsExpired(time.Now()) {
 		return &v, nil
 	}
 	return &model.TopicConfig{}, errors.New(DocNotFound)
@@ -90,11 +94,22 @@ func (s *InMemoryHandler) GetByKey(hashedTopicKey string) (*model.TopicConfig, e
 func (s *InMemoryHandler) Load() ([]*model.TopicConfig, error) {
 	results := []*model.TopicConfig{}
 	for _, v := range s.topics {
-		results = append(results, &v)
+		doc := v
+		results = append(results, &doc)
 	}
 	return results, nil
 }
 
+// List returns a page of the documents accepted by the filter ordered by key
+func (s *InMemoryHandler) List(filter func(*model.TopicConfig) bool, limit, offset int) ([]*model.TopicConfig, int, error) {
+	docs := make([]model.TopicConfig, 0, len(s.topics))
+	for _, v := range s.topics {
+		docs = append(docs, v)
+	}
+	results, total := paginate(docs, filter, limit, offset)
+	return results, total, nil
+}
+
 // Update updates or creates a topic config document
 func (s *InMemoryHandler) Update(topicCfg *model.TopicConfig) (string, error) {
 	key, err := getKey(topicCfg)
@@ -113,6 +128,10 @@ func (s *InMemoryHandler) Update(topicCfg *model.TopicConfig) (string, error) {
 	v.TopicStatus = topicCfg.TopicStatus
 	v.UpdatedAt = time.Now()
 	v.Webhooks = topicCfg.Webhooks
+	v.JSONSchema = topicCfg.JSONSchema
+	v.RoutingRules = topicCfg.RoutingRules
+	v.ExpiresAt = topicCfg.ExpiresAt
+	v.AllowedSubjects = topicCfg.AllowedSubjects
 
 	s.logger.Infof("upsert %s", key)
 	s.topics[topicCfg.Key] = *topicCfg
@@ -138,3 +157,21 @@ func (s *InMemoryHandler) DeleteByKey(hashedTopicKey string) (string, error) {
 	delete(s.topics, hashedTopicKey)
 	return hashedTopicKey, nil
 }
+
+// Revoke upserts a revoked token or subject document
+func (s *InMemoryHandler) Revoke(doc *model.RevokedToken) error {
+	s.revocationsLock.Lock()
+	defer s.revocationsLock.Unlock()
+	s.revocations[doc.Key] = *doc
+	return nil
+}
+
+// GetRevocation gets a revoked token or subject document by the revocation key
+func (s *InMemoryHandler) GetRevocation(key string) (*model.RevokedToken, error) {
+	s.revocationsLock.RLock()
+	defer s.revocationsLock.RUnlock()
+	if v, ok := s.revocations[key]; ok {
+		return &v, nil
+	}
+	return &model.RevokedToken{}, errors.New(DocNotFound)
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"sort"
 
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
 
@@ -22,6 +23,17 @@ type Crud interface {
 
 	// Load is invoked by the webhook.go to start new wekbooks and stop deleted ones
 	Load() ([]*model.TopicConfig, error)
+
+	// List returns a page of the documents accepted by the filter ordered by key, and the total number of accepted documents
+	List(filter func(*model.TopicConfig) bool, limit, offset int) ([]*model.TopicConfig, int, error)
+}
+
+// Revocation interface specifies token revocation operations
+type Revocation interface {
+	// Revoke upserts a revoked token or subject document
+	Revoke(doc *model.RevokedToken) error
+	// GetRevocation gets a revoked token or subject document by the revocation key
+	GetRevocation(key string) (*model.RevokedToken, error)
 }
 
 // Ops interface specifies required database access operations
@@ -32,9 +44,10 @@ type Ops interface {
 	Health() bool
 }
 
-// Db interface embeds two other database interfaces
+// Db interface embeds other database interfaces
 type Db interface {
 	Crud
+	Revocation
 	Ops
 }
 
@@ -72,3 +85,24 @@ var DocNotFound = "no document found"
 
 // DocAlreadyExisted means document already existed in the database when a new creation is requested
 var DocAlreadyExisted = "document already existed"
+
+// paginate filters the documents, sorts them by key, and returns the page with the total number of filtered documents
+func paginate(docs []model.TopicConfig, filter func(*model.TopicConfig) bool, limit, offset int) ([]*model.TopicConfig, int) {
+	results := []*model.TopicConfig{}
+	for i := range docs {
+		if filter == nil || filter(&docs[i]) {
+			results = append(results, &docs[i])
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+
+	total := len(results)
+	if offset >= total {
+		return []*model.TopicConfig{}, total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return results[offset:end], total
+}
@@ -18,14 +18,16 @@ import (
 
 // MongoDb is the mongo database driver
 type MongoDb struct {
-	client     *mongo.Client
-	collection *mongo.Collection
-	logger     *log.Entry
+	client      *mongo.Client
+	collection  *mongo.Collection
+	revocations *mongo.Collection
+	logger      *log.Entry
 }
 
 var connectionString string = "mongodb://localhost:27017"
 var dbName string = "localhost"
 var collectionName string = "topics"
+var revocationCollectionName string = "revokedtokens"
 
 //Init is a Db interface method.
 func (s *MongoDb) Init() error {
@@ -62,6 +64,13 @@ func (s *MongoDb) Init() error {
 		return err
 	}
 
+	s.revocations = s.client.Database(dbName).Collection(revocationCollectionName)
+	_, err = s.revocations.Indexes().CreateOne(context.Background(), indexMode)
+	if err != nil {
+		s.logger.Errorf("database revocation index creation failed %s", err.Error())
+		return err
+	}
+
 	s.logger.Infof("mongo database name %v, collection %v", dbName, collectionName)
 	return nil
 }
@@ -138,6 +147,9 @@ func (s *MongoDb) GetByKey(hashedTopicKey string) (*model.TopicConfig, error) {
 		}
 		return &model.TopicConfig{}, err
 	}
+	if doc.IsExpired(time.Now()) {
+		return &model.TopicConfig{}, errors.New(DocNotFound)
+	}
 	return &doc, nil
 }
 
@@ -169,6 +181,27 @@ func (s *MongoDb) Load() ([]*model.TopicConfig, error) {
 	return results, nil
 }
 
+// List returns a page of the documents accepted by the filter ordered by key
+func (s *MongoDb) List(filter func(*model.TopicConfig) bool, limit, offset int) ([]*model.TopicConfig, int, error) {
+	cursor, err := s.collection.Find(context.TODO(), bson.D{{}})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	docs := []model.TopicConfig{}
+	for cursor.Next(context.TODO()) {
+		var ele model.TopicConfig
+		if err := cursor.Decode(&ele); err != nil {
+			s.logger.Errorf("failed to decode document %s", err.Error())
+			continue
+		}
+		docs = append(docs, ele)
+	}
+	results, total := paginate(docs, filter, limit, offset)
+	return results, total, nil
+}
+
 // Update updates or creates a topic config document
 func (s *MongoDb) Update(topicCfg *model.TopicConfig) (string, error) {
 	key, err := getKey(topicCfg)
@@ -195,12 +228,16 @@ func (s *MongoDb) Update(topicCfg *model.TopicConfig) (string, error) {
 	}
 	update := bson.M{
 		"$set": bson.M{
-			"token":       topicCfg.Token,
-			"tenant":      topicCfg.Tenant,
-			"notes":       topicCfg.Notes,
-			"topicstatus": topicCfg.TopicStatus,
-			"updatedat":   time.Now(),
-			"webhooks":    topicCfg.Webhooks,
+			"token":           topicCfg.Token,
+			"tenant":          topicCfg.Tenant,
+			"notes":           topicCfg.Notes,
+			"topicstatus":     topicCfg.TopicStatus,
+			"updatedat":       time.Now(),
+			"webhooks":        topicCfg.Webhooks,
+			"jsonschema":      topicCfg.JSONSchema,
+			"routingrules":    topicCfg.RoutingRules,
+			"expiresat":       topicCfg.ExpiresAt,
+			"allowedsubjects": topicCfg.AllowedSubjects,
 		},
 	}
 	result, err := s.collection.UpdateOne(
@@ -243,6 +280,32 @@ func (s *MongoDb) DeleteByKey(hashedTopicKey string) (string, error) {
 	return hashedTopicKey, nil
 }
 
+// Revoke upserts a revoked token or subject document
+func (s *MongoDb) Revoke(doc *model.RevokedToken) error {
+	_, err := s.revocations.UpdateOne(
+		context.TODO(),
+		bson.M{"key": doc.Key},
+		bson.M{"$set": doc},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetRevocation gets a revoked token or subject document by the revocation key
+func (s *MongoDb) GetRevocation(key string) (*model.RevokedToken, error) {
+	var doc model.RevokedToken
+	result := s.revocations.FindOne(context.TODO(), bson.M{"key": key})
+
+	err := result.Decode(&doc)
+	if err != nil {
+		if err.Error() == "mongo: no documents in result" {
+			err = errors.New(DocNotFound)
+		}
+		return &model.RevokedToken{}, err
+	}
+	return &doc, nil
+}
+
 func exists(key string, coll *mongo.Collection) (bool, error) {
 	var doc model.TopicConfig
 	result := coll.FindOne(context.TODO(), bson.M{"key": key})
@@ -41,12 +41,21 @@ type PulsarHandler struct {
 	producer    pulsar.Producer
 	topics      map[string]model.TopicConfig
 	logger      *log.Entry
+
+	// revoked tokens are stored in a separate compacted topic
+	revocationsLock    sync.RWMutex
+	revocationProducer pulsar.Producer
+	revocations        map[string]model.RevokedToken
 }
 
+// revocationTopicSuffix is appended to the database topic name as the revoked token topic
+const revocationTopicSuffix = "-revoked-tokens"
+
 //Init is a Db interface method.
 func (s *PulsarHandler) Init() error {
 	s.logger = log.WithFields(log.Fields{"app": "pulsardb"})
 	s.topics = make(map[string]model.TopicConfig)
+	s.revocations = make(map[string]model.RevokedToken)
 
 	s.logger.Infof("database pulsar URL: %s", s.PulsarURL)
 	if log.GetLevel() == log.DebugLevel {
@@ -54,7 +63,7 @@ func (s *PulsarHandler) Init() error {
 	}
 
 	var err error
-	s.client, err = pulsardriver.NewPulsarClient(s.PulsarURL, s.PulsarToken)
+	s.client, err = pulsardriver.NewPulsarClient(s.PulsarURL, util.ClusterToken(s.PulsarURL, s.PulsarToken))
 	if err != nil {
 		// this would be a serious problem so that we return with error
 		return err
@@ -67,6 +76,15 @@ func (s *PulsarHandler) Init() error {
 		return err
 	}
 
+	s.revocationProducer, err = s.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           s.TopicName + revocationTopicSuffix,
+		DisableBatching: true,
+	})
+	if err != nil {
+		log.Errorf("failed to create revocation producer error %v", err)
+		return err
+	}
+
 	// a loop to receive and recover from failure
 	go func() {
 		sig := make(chan *liveSignal)
@@ -79,6 +97,17 @@ func (s *PulsarHandler) Init() error {
 		}
 	}()
 
+	go func() {
+		sig := make(chan *liveSignal)
+		go s.revocationListener(sig)
+		for {
+			select {
+			case <-sig:
+				go s.revocationListener(sig)
+			}
+		}
+	}()
+
 	return nil
 }
 
@@ -126,6 +155,41 @@ func (s *PulsarHandler) dbListener(sig chan *liveSignal) error {
 	}
 }
 
+// revocationListener listens revoked token updates
+func (s *PulsarHandler) revocationListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		s.logger.Errorf("revocation db listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          s.TopicName + revocationTopicSuffix,
+		StartMessageID: pulsar.EarliestMessageID(),
+		ReadCompacted:  true,
+	})
+	if err != nil {
+		log.Errorf("revocationListener failed to create reader, error %v", err)
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		data, err := reader.Next(ctx)
+		if err != nil {
+			log.Errorf("revocationListener reader.Next() error %v", err)
+			return err
+		}
+		doc := model.RevokedToken{}
+		if err = json.Unmarshal(data.Payload(), &doc); err != nil {
+			s.logger.Errorf("revocationListener reader unmarshal error %v", err)
+			continue
+		}
+		s.revocationsLock.Lock()
+		s.revocations[doc.Key] = doc
+		s.revocationsLock.Unlock()
+	}
+}
+
 func (s *PulsarHandler) createProducer() error {
 	var err error
 	s.producer, err = s.client.CreateProducer(pulsar.ProducerOptions{
@@ -148,6 +212,7 @@ func (s *PulsarHandler) Health() bool {
 // Close closes database
 func (s *PulsarHandler) Close() error {
 	s.producer.Close()
+	s.revocationProducer.Close()
 	// s.client.Close()
 	// Here is a Client object leak
 	return nil
@@ -220,7 +285,7 @@ func (s *PulsarHandler) GetByTopic(topicFullName, pulsarURL string) (*model.Topi
 
 // GetByKey gets a document by the key
 func (s *PulsarHandler) GetByKey(hashedTopicKey string) (*model.TopicConfig, error) {
-	if v, ok := s.topics[hashedTopicKey]; ok {
+	if v, ok := s.topics[hashedTopicKey]; ok && !v.IsExpired(time.Now()) {
 		return &v, nil
 	}
 	return &model.TopicConfig{}, errors.New(DocNotFound)
@@ -230,11 +295,24 @@ func (s *PulsarHandler) GetByKey(hashedTopicKey string) (*model.TopicConfig, err
 func (s *PulsarHandler) Load() ([]*model.TopicConfig, error) {
 	results := []*model.TopicConfig{}
 	for _, v := range s.topics {
-		results = append(results, &v)
+		doc := v
+		results = append(results, &doc)
 	}
 	return results, nil
 }
 
+// List returns a page of the documents accepted by the filter ordered by key
+func (s *PulsarHandler) List(filter func(*model.TopicConfig) bool, limit, offset int) ([]*model.TopicConfig, int, error) {
+	s.topicsLock.RLock()
+	docs := make([]model.TopicConfig, 0, len(s.topics))
+	for _, v := range s.topics {
+		docs = append(docs, v)
+	}
+	s.topicsLock.RUnlock()
+	results, total := paginate(docs, filter, limit, offset)
+	return results, total, nil
+}
+
 // Update updates or creates a topic config document
 func (s *PulsarHandler) Update(topicCfg *model.TopicConfig) (string, error) {
 	key, err := getKey(topicCfg)
@@ -253,6 +331,10 @@ func (s *PulsarHandler) Update(topicCfg *model.TopicConfig) (string, error) {
 	v.TopicStatus = topicCfg.TopicStatus
 	v.UpdatedAt = time.Now()
 	v.Webhooks = topicCfg.Webhooks
+	v.JSONSchema = topicCfg.JSONSchema
+	v.RoutingRules = topicCfg.RoutingRules
+	v.ExpiresAt = topicCfg.ExpiresAt
+	v.AllowedSubjects = topicCfg.AllowedSubjects
 
 	s.logger.Infof("upsert %s", key)
 	return s.updateCacheAndPulsar(topicCfg)
@@ -295,3 +377,33 @@ func (s *PulsarHandler) DeleteByKey(hashedTopicKey string) (string, error) {
 	delete(s.topics, v.Key)
 	return hashedTopicKey, nil
 }
+
+// Revoke upserts a revoked token or subject document
+func (s *PulsarHandler) Revoke(doc *model.RevokedToken) error {
+	data, err := json.Marshal(*doc)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     doc.Key,
+	}
+	if _, err = s.revocationProducer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+
+	s.revocationsLock.Lock()
+	s.revocations[doc.Key] = *doc
+	s.revocationsLock.Unlock()
+	return nil
+}
+
+// GetRevocation gets a revoked token or subject document by the revocation key
+func (s *PulsarHandler) GetRevocation(key string) (*model.RevokedToken, error) {
+	s.revocationsLock.RLock()
+	defer s.revocationsLock.RUnlock()
+	if v, ok := s.revocations[key]; ok {
+		return &v, nil
+	}
+	return &model.RevokedToken{}, errors.New(DocNotFound)
+}
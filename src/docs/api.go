@@ -102,6 +102,16 @@ import (
 //   description: Per message time out in milliseconds to wait the message from the Pulsar topic. The default is 300 millisecond
 //   type: integer
 //   required: false
+// - name: waitMs
+//   in: query
+//   description: Long poll time in milliseconds to wait for the first message. The default is 0 and the maximum is 30000 millisecond
+//   type: integer
+//   required: false
+// - name: startTimestampMs
+//   in: query
+//   description: Unix epoch time in milliseconds to seek the subscription to. A durable subscription is only seeked again when the value changes
+//   type: integer
+//   required: false
 // responses:
 //   '200':
 //     description: successfully subscribed and received messages from a Pulsar topic
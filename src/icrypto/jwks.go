@@ -0,0 +1,229 @@
+package icrypto
+
+// This is JWT verification with the public keys of an external identity provider's JWKS endpoint.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+// jwksMinRefreshInterval limits how often a token with an unknown key ID can trigger a JWKS fetch
+const jwksMinRefreshInterval = 30 * time.Second
+
+const jwksRequestTimeout = 10 * time.Second
+
+// JWKS verifies JWT with the public keys of a JWKS endpoint, the issuer, and the audience.
+// The keys are cached and fetched again after the refresh interval, or earlier when a token
+// is signed by a key ID not in the cache, such as after a key rotation.
+type JWKS struct {
+	URL             string
+	Issuer          string
+	Audience        string
+	RefreshInterval time.Duration
+
+	client    *http.Client
+	lock      sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// jsonWebKey is a public key in a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWKS creates a JWKS token verifier, the issuer and the audience are not verified if they are empty
+func NewJWKS(url, issuer, audience string, refreshInterval time.Duration) *JWKS {
+	return &JWKS{
+		URL:             url,
+		Issuer:          issuer,
+		Audience:        audience,
+		RefreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: jwksRequestTimeout},
+	}
+}
+
+// DecodeToken decodes a token string and verifies its signature, expiration, issuer, and audience
+func (j *JWKS) DecodeToken(tokenStr string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unsupported signing method %s", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return j.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if j.Issuer != "" && !claims.VerifyIssuer(j.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if j.Audience != "" && !claims.VerifyAudience(j.Audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+	return token, nil
+}
+
+// GetTokenSubject gets the subjects from a token
+func (j *JWKS) GetTokenSubject(tokenStr string) (string, error) {
+	token, err := j.DecodeToken(tokenStr)
+	if err != nil {
+		return "", err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if subjects, ok := claims["sub"].(string); ok {
+		return subjects, nil
+	}
+	return "", errors.New("missing subjects")
+}
+
+// key returns the public key of a key ID, an empty key ID matches the only key of the JWKS
+func (j *JWKS) key(kid string) (interface{}, error) {
+	j.lock.RLock()
+	key, ok := j.lookup(kid)
+	age := time.Since(j.fetchedAt)
+	j.lock.RUnlock()
+	if ok && age < j.RefreshInterval {
+		return key, nil
+	}
+	if !ok && age < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("unknown key ID %s", kid)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	// another request may have refreshed the keys in the meantime
+	if time.Since(j.fetchedAt) >= jwksMinRefreshInterval {
+		keys, err := j.fetch()
+		if err != nil {
+			if ok {
+				log.Warnf("failed to refresh JWKS from %s, keep the cached keys %v", j.URL, err)
+				return key, nil
+			}
+			return nil, err
+		}
+		j.keys = keys
+		j.fetchedAt = time.Now()
+	}
+	if key, ok = j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %s", kid)
+}
+
+func (j *JWKS) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// fetch downloads and parses the public keys of the JWKS endpoint
+func (j *JWKS) fetch() (map[string]interface{}, error) {
+	res, err := j.client.Get(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS from %s status code %d", j.URL, res.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skip JWKS key %s %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key in JWKS from %s", j.URL)
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
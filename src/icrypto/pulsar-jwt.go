@@ -57,7 +57,30 @@ func (keys *RSAKeyPair) GenerateToken(userSubject string) (string, error) {
 	return tokenString, nil
 }
 
+// GenerateTokenWithExpiry generates token with user defined subject that expires after the duration.
+// A zero duration generates a token without expiration. It returns the expiration time.
+func (keys *RSAKeyPair) GenerateTokenWithExpiry(userSubject string, expiry time.Duration) (string, time.Time, error) {
+	if expiry <= 0 {
+		tokenString, err := keys.GenerateToken(userSubject)
+		return tokenString, time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Claims = jwt.MapClaims{
+		"exp": expiresAt.Unix(),
+		"iat": time.Now().Unix(),
+		"sub": userSubject,
+	}
+	tokenString, err := token.SignedString(keys.PrivateKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
 // DecodeToken decodes a token string
+// An expired token is rejected by the claims validation.
 func (keys *RSAKeyPair) DecodeToken(tokenStr string) (*jwt.Token, error) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		return jwtRsaKeys.PublicKey, nil
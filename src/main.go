@@ -1,20 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/google/gops/agent"
 	"github.com/kafkaesque-io/pulsar-beam/src/broker"
+	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
 	"github.com/kafkaesque-io/pulsar-beam/src/route"
 	"github.com/kafkaesque-io/pulsar-beam/src/util"
-	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 
 	_ "github.com/kafkaesque-io/pulsar-beam/src/docs" // This line is required for go-swagger to find docs
 )
 
+// shutdownTimeout is the time to wait for the in-flight requests to complete on shutdown
+var shutdownTimeout = time.Duration(util.GetEnvInt("ShutdownTimeout", 30)) * time.Second
+
 var mode = util.AssignString(os.Getenv("ProcessMode"), *flag.String("mode", "hybrid", "server running mode"))
 
 func main() {
@@ -42,20 +51,45 @@ func main() {
 	if util.IsHTTPRouterRequired(&mode) {
 		route.Init()
 
-		c := cors.New(cors.Options{
-			AllowedOrigins:   []string{"http://localhost:8085", "http://localhost:8080"},
-			AllowCredentials: true,
-			AllowedHeaders:   []string{"Authorization", "PulsarTopicUrl"},
-		})
-
-		router := route.NewRouter(&mode)
-
-		handler := c.Handler(router)
+		// the CORS headers and preflights are served by the router's CORS middleware
 		config := util.GetConfig()
 		port := util.AssignString(config.PORT, "8085")
+		// the request contexts are cancelled once the shutdown starts, so that the SSE, WebSocket, and poll
+		// streams end instead of holding the shutdown for the ShutdownTimeout, the hijacked WebSocket
+		// connections are not tracked by the server
+		baseCtx, cancelRequests := context.WithCancel(context.Background())
+		server := &http.Server{
+			Addr:        ":" + port,
+			Handler:     route.NewRouter(&mode),
+			BaseContext: func(net.Listener) context.Context { return baseCtx },
+		}
+		server.RegisterOnShutdown(cancelRequests)
+
+		// stop accepting requests, drain the messages in the receiver worker pool, and flush the
+		// cached producers before the process exits
+		stopped := make(chan struct{})
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+			sig := <-sigs
+			log.Warnf("received signal %v, shutting down the server", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Errorf("failed to shut down the server gracefully %v", err)
+			}
+			route.Shutdown()
+			log.Warnf("flushed and closed %d producers", pulsardriver.CloseProducers())
+			close(stopped)
+		}()
+
 		certFile := util.GetConfig().CertFile
 		keyFile := util.GetConfig().KeyFile
-		log.Fatal(util.ListenAndServeTLS(":"+port, certFile, keyFile, handler))
+		if err := util.ListenAndServeTLS(server, certFile, keyFile); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-stopped
+		os.Exit(0)
 	}
 
 	for util.IsBroker(&mode) {
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// corsExposedHeaders are the response headers readable by a cross-origin client
+const corsExposedHeaders = "X-Pulsar-Message-Id, X-Request-Id, Retry-After"
+
+// corsMaxAge is how long in seconds a browser can cache the result of a preflight request
+const corsMaxAge = "600"
+
+// CORS sets the CORS response headers on a request from an allowed origin.
+// A request without the Origin header is not a cross-origin request and passes through as is.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if setAllowOrigin(w, r) {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CORSPreflight replies to the preflight OPTIONS request of a path with the methods allowed on the path.
+// The requested headers are allowed as they are since the headers are verified by the actual request.
+func CORSPreflight(methods []string) http.Handler {
+	allowMethods := strings.Join(append(methods, http.MethodOptions), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !setAllowOrigin(w, r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setAllowOrigin sets Access-Control-Allow-Origin if the request origin is allowed. The wildcard origin is
+// only used without credentials, otherwise the request origin is echoed since browsers reject the wildcard.
+// With credentials, the origin must be listed, the wildcard never allows an origin to send credentials.
+func setAllowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !util.IsAllowedOrigin(origin) {
+		return false
+	}
+
+	credentials := util.StringToBool(util.GetConfig().CORSAllowCredentials)
+	if credentials && !util.IsListedOrigin(origin) {
+		return false
+	}
+	if !credentials && util.StrContains(util.CORSAllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
@@ -2,9 +2,14 @@ package middleware
 
 //middleware includes auth, rate limit, and etc.
 import (
+	"encoding/json"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/kafkaesque-io/pulsar-beam/src/util"
 
 	log "github.com/sirupsen/logrus"
@@ -17,6 +22,12 @@ var (
 	Rate = NewSema(200)
 )
 
+// RevocationChecker returns true if a token or its subject is revoked
+type RevocationChecker func(tokenStr, subject string) bool
+
+// TokenRevoked rejects revoked tokens in AuthVerifyJWT, no revocation is checked if it is nil
+var TokenRevoked RevocationChecker
+
 // AuthFunc is a function type to allow pluggable authentication middleware
 type AuthFunc func(next http.Handler) http.Handler
 
@@ -28,23 +39,35 @@ func AuthVerifyJWT(next http.Handler) http.Handler {
 			r.Header.Set("injectedSubs", util.SuperRoles[0])
 			next.ServeHTTP(w, r)
 		})
+	case "jwks":
+		return verifyTokenSubject(next, util.JWKSAuth.GetTokenSubject)
 	default:
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
-			subjects, err := util.JWTAuth.GetTokenSubject(tokenStr)
-
-			if err == nil {
-				log.Infof("Authenticated with subjects %s", subjects)
-				r.Header.Set("injectedSubs", subjects)
-				next.ServeHTTP(w, r)
-			} else {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			}
-
-		})
+		return verifyTokenSubject(next, util.JWTAuth.GetTokenSubject)
 	}
 }
 
+// verifyTokenSubject authenticates the bearer token with getSubject and injects its subjects for authorization
+func verifyTokenSubject(next http.Handler, getSubject func(tokenStr string) (string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+		subjects, err := getSubject(tokenStr)
+
+		if err == nil && TokenRevoked != nil && TokenRevoked(tokenStr, subjects) {
+			log.Warnf("rejected revoked token with subjects %s", subjects)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err == nil {
+			log.Infof("Authenticated with subjects %s", subjects)
+			r.Header.Set("injectedSubs", subjects)
+			next.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+	})
+}
+
 // AuthHeaderRequired is a very weak auth to verify token existence only.
 func AuthHeaderRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -62,20 +85,89 @@ func AuthHeaderRequired(next http.Handler) http.Handler {
 // NoAuth bypasses the auth middleware
 func NoAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// subjects can only be injected by an authentication middleware, not by the client
+		r.Header.Del("injectedSubs")
 		next.ServeHTTP(w, r)
 	})
 }
 
+// TenantAllowed returns true if the authenticated subjects are allowed on the tenant. A request is only charged
+// to the token bucket of a tenant its subjects are allowed on, every authenticated request is charged if it is nil.
+var TenantAllowed func(tenant, subjects string) bool
+
 // LimitRate rate limites against http handler
-// use semaphore as a simple rate limiter
+// Every request uses semaphore as a simple global rate limiter.
+// A request is first limited by the token bucket of its client IP if ClientRateLimit is configured.
 func LimitRate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rate := util.GetConfig().ClientRateLimit; rate > 0 {
+			client := ClientIP(r, util.StringToBool(util.GetConfig().TrustProxy))
+			if ok, wait := clientBucket(client).Take(rate, time.Now()); !ok {
+				tooManyRequests(w, RateLimitResponse{
+					Error:      "too many requests",
+					Scope:      "client",
+					Limit:      rate,
+					RetryAfter: int(math.Ceil(wait.Seconds())),
+				})
+				return
+			}
+		}
+
 		err := Rate.Acquire()
 		if err != nil {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-		} else {
-			next.ServeHTTP(w, r)
+			tooManyRequests(w, RateLimitResponse{
+				Error:      "too many requests",
+				Scope:      "global",
+				Limit:      Rate.Size,
+				RetryAfter: 1,
+			})
+			return
 		}
+		next.ServeHTTP(w, r)
 		Rate.Release()
 	})
 }
+
+// LimitTenantRate limits a request on a route with a tenant by the tenant's token bucket if a per-tenant rate
+// limit is configured, so that a noisy tenant cannot starve the others. It wraps the handler inside the
+// authentication middleware, so that neither an anonymous caller nor the subject of another tenant can drain
+// the bucket of a tenant and get its traffic rejected.
+func LimitTenantRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := mux.Vars(r)["tenant"]
+		rate := util.TenantRateLimit(tenant)
+		if tenant == "" || rate <= 0 || (TenantAllowed != nil && !TenantAllowed(tenant, r.Header.Get("injectedSubs"))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := tenantBucket(tenant).Take(rate, time.Now()); !ok {
+			tooManyRequests(w, RateLimitResponse{
+				Error:      "too many requests",
+				Scope:      "tenant",
+				Tenant:     tenant,
+				Limit:      rate,
+				RetryAfter: int(math.Ceil(wait.Seconds())),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitResponse is the JSON body of a request rejected by the rate limiter.
+// Limit is requests per second for the tenant scope, or concurrent requests for the global scope.
+type RateLimitResponse struct {
+	Error      string `json:"error"`
+	Scope      string `json:"scope"`
+	Tenant     string `json:"tenant,omitempty"`
+	Limit      int    `json:"limit"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// tooManyRequests replies 429 with a Retry-After header in seconds and the limit in the JSON body
+func tooManyRequests(w http.ResponseWriter, limit RateLimitResponse) {
+	w.Header().Set("Retry-After", strconv.Itoa(limit.RetryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(limit)
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// TokenBucket is a token bucket rate limiter that allows a burst of up to one second of requests
+type TokenBucket struct {
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// Take takes a token from the bucket refilled at rate tokens per second.
+// It returns the time to wait for the next token if the bucket is empty.
+func (b *TokenBucket) Take(rate int, now time.Time) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = math.Min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / float64(rate) * float64(time.Second))
+}
+
+// tenantBuckets are the token buckets keyed by tenant, a bucket is dropped once its tenant is idle for the TTL
+var (
+	tenantBuckets = util.NewCache(util.CacheOption{
+		TTL:            10 * time.Minute,
+		CleanInterval:  1 * time.Minute,
+		ExpireCallback: func(key string, value interface{}) {},
+	})
+	tenantBucketsLock sync.Mutex
+)
+
+func tenantBucket(tenant string) *TokenBucket {
+	tenantBucketsLock.Lock()
+	defer tenantBucketsLock.Unlock()
+	if bucket, ok := tenantBuckets.Get(tenant); ok {
+		return bucket.(*TokenBucket)
+	}
+	bucket := &TokenBucket{}
+	tenantBuckets.Set(tenant, bucket)
+	return bucket
+}
+
+// clientBuckets are the token buckets keyed by client IP, a bucket is dropped once its client is idle for the TTL
+var (
+	clientBuckets = util.NewCache(util.CacheOption{
+		TTL:            10 * time.Minute,
+		CleanInterval:  1 * time.Minute,
+		ExpireCallback: func(key string, value interface{}) {},
+	})
+	clientBucketsLock sync.Mutex
+)
+
+func clientBucket(client string) *TokenBucket {
+	clientBucketsLock.Lock()
+	defer clientBucketsLock.Unlock()
+	if bucket, ok := clientBuckets.Get(client); ok {
+		return bucket.(*TokenBucket)
+	}
+	bucket := &TokenBucket{}
+	clientBuckets.Set(client, bucket)
+	return bucket
+}
+
+// ClientIP returns the IP of the client of a request. Behind a trusted proxy, it is the last hop of
+// X-Forwarded-For, which is appended by the proxy, or X-Real-IP set by the proxy. The earlier hops of
+// X-Forwarded-For come from the client and can be spoofed, so they are never used.
+// The remote address of the connection is used if the proxy is not trusted or sets neither header.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			hops := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// ConsumerConfig is the Pulsar consumer configuration requested by an HTTP client
+type ConsumerConfig struct {
+	SubscriptionName string
+	SubscriptionType pulsar.SubscriptionType
+	InitialPosition  pulsar.SubscriptionInitialPosition
+	// StartTime is the publish time the subscription is seeked to; zero value means no seek
+	StartTime time.Time
+	// StartMessageID is the message ID the subscription is seeked to in place of StartTime; nil means no seek
+	StartMessageID pulsar.MessageID
+	// Permanent excludes a durable subscription from the auto-unsubscribe on inactivity
+	Permanent bool
+	// Topics are the additional topics consumed together with the route's topic by a multi-topic consumer
+	Topics []string
+	// TopicsPattern is a regex topic subscription in place of the route's topic, see pulsar.ConsumerOptions.TopicsPattern
+	TopicsPattern string
+	// MaxRedeliveries moves a message to the dead letter topic after the number of redeliveries, 0 disables it
+	MaxRedeliveries uint32
+	// DeadLetterTopic defaults to the Pulsar client's <topic>-<subscription>-DLQ if it is empty
+	DeadLetterTopic string
+	// Filter selects the polled messages by their properties
+	Filter MessageFilter
+	// ReceiverQueueSize is the number of messages prefetched by the consumer, 0 uses the Pulsar client's default
+	ReceiverQueueSize int
+}
+
+// MessageFilter selects messages whose properties match all of the key value pairs.
+// The other messages are acknowledged so that the subscription advances, or negatively
+// acknowledged to be redelivered if Nack is true.
+type MessageFilter struct {
+	Properties map[string]string
+	Nack       bool
+}
+
+// Match returns true if the properties match the filter, an empty filter matches any message
+func (f MessageFilter) Match(properties map[string]string) bool {
+	for key, value := range f.Properties {
+		if v, ok := properties[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNonResumable returns true if the subscription is auto-generated and removed after the consumer closes
+func (c ConsumerConfig) IsNonResumable() bool {
+	return strings.HasPrefix(c.SubscriptionName, NonResumable)
+}
+
+// SubscriptionLag is the backlog of a subscription replied by the lag endpoint
+type SubscriptionLag struct {
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription"`
+	// Backlog is the number of messages not yet acknowledged, including the ones not delivered
+	Backlog int64 `json:"backlog"`
+	// Unacked is the number of messages delivered to the consumers but not acknowledged
+	Unacked int64 `json:"unacked"`
+}
+
+// TopicLastMessageID is the last message ID of a topic replied by the last message ID endpoint
+type TopicLastMessageID struct {
+	Topic string `json:"topic"`
+	// MessageID is ledgerId:entryId:partitionIndex, the same as the ID of a SSE event
+	MessageID string `json:"messageId,omitempty"`
+	// Partitions are the last message IDs of every partition of a partitioned topic
+	Partitions []TopicLastMessageID `json:"partitions,omitempty"`
+}
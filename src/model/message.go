@@ -1,7 +1,6 @@
 package model
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
@@ -9,12 +8,37 @@ import (
 
 // PulsarMessage is the Pulsar Message type
 type PulsarMessage struct {
-	Payload     []byte    `json:"payload"`
+	// Payload is omitted in a metadata only reply
+	Payload     []byte    `json:"payload,omitempty"`
 	Topic       string    `json:"topic"`
 	EventTime   time.Time `json:"eventTime"`
 	PublishTime time.Time `json:"publishTime"`
 	MessageID   string    `json:"messageId"`
 	Key         string    `json:"key"`
+	// OrderingKey is the key for the Key_Shared dispatch if it differs from Key
+	OrderingKey string `json:"orderingKey,omitempty"`
+	// Properties are the user defined message properties
+	Properties map[string]string `json:"properties,omitempty"`
+	// AckID is the serialized Pulsar message ID to acknowledge the message by the ack endpoint
+	AckID []byte `json:"ackId"`
+}
+
+// AsyncProduceError is the event published to the ackCallbackTopic when an async send has failed
+type AsyncProduceError struct {
+	RequestID string    `json:"requestId"`
+	Topic     string    `json:"topic"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// ProduceEvent is the event of a message sent by the send endpoint, streamed by the produce events endpoint
+type ProduceEvent struct {
+	Topic     string    `json:"topic"`
+	Size      int       `json:"size"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	// MessageID is empty for an async send, which is not acknowledged by the broker yet
+	MessageID string `json:"messageId,omitempty"`
 }
 
 // PulsarMessages encapsulates a list of messages to be returned to a client
@@ -22,6 +46,15 @@ type PulsarMessages struct {
 	Limit    int             `json:"limit"`
 	Size     int             `json:"size"`
 	Messages []PulsarMessage `json:"messages"`
+	// PayloadEncoding is base64 if the client requested encoded payloads
+	PayloadEncoding string `json:"payloadEncoding,omitempty"`
+}
+
+// ReplayMessages is the reply of a replay, Truncated is true if the replay was stopped by
+// the message or byte cap or the timeout before it reached the end position
+type ReplayMessages struct {
+	PulsarMessages
+	Truncated bool `json:"truncated"`
 }
 
 // NewPulsarMessages create a PulsarMessages object
@@ -43,15 +76,113 @@ func (msgs *PulsarMessages) AddPulsarMessage(msg pulsar.Message) bool {
 		Topic:       msg.Topic(),
 		EventTime:   msg.EventTime(),
 		PublishTime: msg.PublishTime(),
-		MessageID:   fmt.Sprintf("%+v", msg.ID()),
+		MessageID:   FormatMessageID(msg.ID()),
 		Key:         msg.Key(),
+		OrderingKey: msg.OrderingKey(),
+		Properties:  msg.Properties(),
+		AckID:       msg.ID().Serialize(),
 	})
 	msgs.Size++
 
 	return msgs.Size >= msgs.Limit
 }
 
+// OmitPayloads removes the payloads so that only the message metadata is returned to a client
+func (msgs *PulsarMessages) OmitPayloads() {
+	for i := range msgs.Messages {
+		msgs.Messages[i].Payload = nil
+	}
+}
+
 // IsEmpty checks if the message list is empty
 func (msgs *PulsarMessages) IsEmpty() bool {
 	return msgs.Size == 0
 }
+
+// AckRequest is the request body of the ack endpoint
+type AckRequest struct {
+	SubscriptionName string `json:"subscriptionName"`
+	// SubscriptionType is the type of the poll subscription, exclusive by default
+	SubscriptionType string `json:"subscriptionType,omitempty"`
+	// MessageIDs are the ackId of the messages returned by a noAck poll
+	MessageIDs [][]byte `json:"messageIds"`
+}
+
+// WebSocketMessage is a message frame sent to a WebSocket client
+type WebSocketMessage struct {
+	// MessageID is the serialized Pulsar message ID, the client sends it back to acknowledge the message
+	MessageID   []byte            `json:"messageId"`
+	Payload     []byte            `json:"payload"`
+	Properties  map[string]string `json:"properties"`
+	Key         string            `json:"key"`
+	EventTime   time.Time         `json:"eventTime"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+// WebSocketAck is an acknowledgement frame sent by a WebSocket client
+type WebSocketAck struct {
+	MessageID []byte `json:"messageId"`
+}
+
+// NewWebSocketMessage creates a WebSocket message frame from a Pulsar message
+func NewWebSocketMessage(msg pulsar.Message) WebSocketMessage {
+	return WebSocketMessage{
+		MessageID:   msg.ID().Serialize(),
+		Payload:     msg.Payload(),
+		Properties:  msg.Properties(),
+		Key:         msg.Key(),
+		EventTime:   msg.EventTime(),
+		PublishTime: msg.PublishTime(),
+	}
+}
+
+// BatchMessage is a message in a batch publish request
+type BatchMessage struct {
+	Payload    []byte            `json:"payload"`
+	Key        string            `json:"key"`
+	Properties map[string]string `json:"properties"`
+}
+
+// BatchPublishRequest is the body of a batch publish request
+type BatchPublishRequest struct {
+	Messages []BatchMessage `json:"messages"`
+}
+
+// BatchPublishResult is the publish result of a message in a batch, Index is the position of the message
+// in the request so that a client can retry only the failed messages
+type BatchPublishResult struct {
+	Index     int    `json:"index"`
+	Success   bool   `json:"success"`
+	MessageID string `json:"messageId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchPublishResponse has the aggregate and per message results of a batch publish request
+type BatchPublishResponse struct {
+	Total     int                  `json:"total"`
+	Succeeded int                  `json:"succeeded"`
+	Failed    int                  `json:"failed"`
+	Results   []BatchPublishResult `json:"results"`
+}
+
+// NewBatchPublishResponse creates a batch publish response from the message IDs and errors in the order of the batch
+func NewBatchPublishResponse(ids []pulsar.MessageID, errs []error) BatchPublishResponse {
+	resp := BatchPublishResponse{
+		Total:   len(errs),
+		Results: make([]BatchPublishResult, len(errs)),
+	}
+	for i, err := range errs {
+		resp.Results[i].Index = i
+		if err != nil {
+			resp.Failed++
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		resp.Succeeded++
+		resp.Results[i].Success = true
+		if i < len(ids) && ids[i] != nil {
+			resp.Results[i].MessageID = FormatMessageID(ids[i])
+		}
+	}
+	return resp
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// FormatMessageID formats a message ID as ledgerId:entryId:partition:batchIndex, where the partition
+// of a non-partitioned topic and the batch index of a message not in a batch can be -1
+func FormatMessageID(id pulsar.MessageID) string {
+	return fmt.Sprintf("%d:%d:%d:%d", id.LedgerID(), id.EntryID(), id.PartitionIdx(), id.BatchIdx())
+}
+
+// ParseMessageID parses a message ID formatted by FormatMessageID.
+// The batch index can be omitted as ledgerId:entryId:partition, it is -1 then.
+func ParseMessageID(str string) (pulsar.MessageID, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf("invalid message id %s, expected format is ledgerId:entryId:partition:batchIndex", str)
+	}
+	ids := []int64{0, 0, -1, -1}
+	for i, part := range parts {
+		// the ledger and entry ids are int64, the partition and batch index are int32
+		bitSize, min := 64, int64(0)
+		if i >= 2 {
+			bitSize, min = 32, -1
+		}
+		v, err := strconv.ParseInt(part, 10, bitSize)
+		if err != nil || v < min {
+			return nil, fmt.Errorf("invalid message id %s, expected format is ledgerId:entryId:partition:batchIndex", str)
+		}
+		ids[i] = v
+	}
+	return NewMessageID(ids[0], ids[1], int32(ids[2]), int32(ids[3]))
+}
+
+// NewMessageID returns the message ID of the ledger and entry ids, the partition and the batch index,
+// which are -1 for a non-partitioned topic and a message not in a batch
+func NewMessageID(ledgerID, entryID int64, partition, batchIndex int32) (pulsar.MessageID, error) {
+	if ledgerID < 0 || entryID < 0 || partition < -1 || batchIndex < -1 {
+		return nil, fmt.Errorf("invalid message id %d:%d:%d:%d", ledgerID, entryID, partition, batchIndex)
+	}
+	// MessageIdData protobuf of the Pulsar protocol, an absent partition or batch index field is -1
+	data := []byte{}
+	for i, v := range []int64{ledgerID, entryID, int64(partition), int64(batchIndex)} {
+		if v < 0 {
+			continue
+		}
+		data = append(data, byte((i+1)<<3))
+		buf := make([]byte, binary.MaxVarintLen64)
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(v))]...)
+	}
+	return pulsar.DeserializeMessageID(data)
+}
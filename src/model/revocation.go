@@ -0,0 +1,26 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// RevokedToken is a revoked token or subject document
+type RevokedToken struct {
+	// Key identifies the revoked token or subject, see TokenRevocationKey and SubjectRevocationKey
+	Key       string    `json:"key"`
+	Subject   string    `json:"subject,omitempty"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+// TokenRevocationKey returns the revocation key of a token. The token is hashed so that it is not stored.
+func TokenRevocationKey(tokenStr string) string {
+	hash := sha256.Sum256([]byte(tokenStr))
+	return "token:" + hex.EncodeToString(hash[:])
+}
+
+// SubjectRevocationKey returns the revocation key of a subject. All tokens of the subject are revoked.
+func SubjectRevocationKey(subject string) string {
+	return "subject:" + subject
+}
@@ -3,8 +3,10 @@ package model
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
@@ -12,6 +14,8 @@ import (
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/kafkaesque-io/pulsar-beam/src/icrypto"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 // Status can be used for webhook status
@@ -30,20 +34,38 @@ const (
 )
 
 // WebhookConfig - a configuration for webhook
+// Compression enables `gzip` content encoding of webhook body larger than CompressionMinSize bytes (default 1024).
+// A failed delivery is retried MaxRetries times (default 1) with an exponential backoff from InitialBackoff (default 2s)
+// up to MaxBackoff (default 28s). A message that failed all retries is sent to FailureTopic if it is specified,
+// otherwise it is left unacknowledged.
 type WebhookConfig struct {
-	URL              string    `json:"url"`
-	Headers          []string  `json:"headers"`
-	Subscription     string    `json:"subscription"`
-	SubscriptionType string    `json:"subscriptionType"`
-	InitialPosition  string    `json:"initialPosition"`
-	WebhookStatus    Status    `json:"webhookStatus"`
-	CreatedAt        time.Time `json:"createdAt"`
-	UpdatedAt        time.Time `json:"updatedAt"`
-	DeletedAt        time.Time `json:"deletedAt"`
+	URL                string    `json:"url"`
+	Headers            []string  `json:"headers"`
+	Subscription       string    `json:"subscription"`
+	SubscriptionType   string    `json:"subscriptionType"`
+	InitialPosition    string    `json:"initialPosition"`
+	Compression        string    `json:"compression"`
+	CompressionMinSize int       `json:"compressionMinSize"`
+	MaxRetries         int       `json:"maxRetries"`
+	InitialBackoff     string    `json:"initialBackoff"`
+	MaxBackoff         string    `json:"maxBackoff"`
+	FailureTopic       string    `json:"failureTopic"`
+	WebhookStatus      Status    `json:"webhookStatus"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+	DeletedAt          time.Time `json:"deletedAt"`
 }
 
 //TODO add state of Webhook replies
 
+// RoutingRule sends a message whose Header has the Value to Topic instead of the requested topic.
+// Topic is a fully qualified topic name in the same tenant as the topic config.
+type RoutingRule struct {
+	Header string `json:"header"`
+	Value  string `json:"value"`
+	Topic  string `json:"topic"`
+}
+
 // TopicConfig - a configuraion for topic and its webhook configuration.
 type TopicConfig struct {
 	TopicFullName string
@@ -54,8 +76,44 @@ type TopicConfig struct {
 	Notes         string
 	TopicStatus   Status
 	Webhooks      []WebhookConfig
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	// JSONSchema is an optional JSON Schema document the payloads sent to the topic are validated against
+	JSONSchema json.RawMessage `json:",omitempty"`
+	// RoutingRules route the messages sent to the topic by a header value, the first matching rule applies
+	RoutingRules []RoutingRule `json:",omitempty"`
+	// ExpiresAt is the optional time after which the config is treated as not found and deleted by the sweeper
+	ExpiresAt *time.Time `json:",omitempty"`
+	// AllowedSubjects are the token subjects allowed on the topic in addition to the subjects of its tenant
+	AllowedSubjects []string `json:",omitempty"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// IsExpired returns true if the topic config has an expiry time before now
+func (t *TopicConfig) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// TopicConfigList is a page of topic configs
+type TopicConfigList struct {
+	Total  int            `json:"total"`
+	Limit  int            `json:"limit"`
+	Offset int            `json:"offset"`
+	Topics []*TopicConfig `json:"topics"`
+}
+
+// TopicImportResult is the outcome of importing a single topic config
+type TopicImportResult struct {
+	TopicFullName string `json:"topicFullName"`
+	PulsarURL     string `json:"pulsarUrl"`
+	Key           string `json:"key,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// TopicImportResponse reports the outcome of every topic config in an import in the request order
+type TopicImportResponse struct {
+	Imported int                 `json:"imported"`
+	Failed   int                 `json:"failed"`
+	Results  []TopicImportResult `json:"results"`
 }
 
 // TopicKey represents a struct to identify a topic
@@ -64,9 +122,22 @@ type TopicKey struct {
 	PulsarURL     string `json:"PulsarURL"`
 }
 
-//
 const (
 	NonResumable = "NonResumable"
+
+	// GzipCompression is the gzip content encoding for webhook body
+	GzipCompression = "gzip"
+)
+
+// MaxAllowedSubjects is the maximum number of AllowedSubjects of a topic config
+const MaxAllowedSubjects = 100
+
+// the webhook delivery retry policy defaults and limit
+const (
+	DefaultWebhookMaxRetries     = 1
+	DefaultWebhookInitialBackoff = 2 * time.Second
+	DefaultWebhookMaxBackoff     = 28 * time.Second
+	MaxWebhookRetries            = 10
 )
 
 // NewTopicConfig creates a topic configuration struct.
@@ -134,6 +205,10 @@ func GetInitialPosition(pos string) (pulsar.SubscriptionInitialPosition, error)
 	}
 }
 
+// LookbackPosition is the initial position of a subscription seeked back by a lookback duration from now,
+// so that a new subscription replays a bounded backlog instead of the entire topic
+const LookbackPosition = "lookback"
+
 // GetSubscriptionType converts string based subscription type to Pulsar subscription type
 func GetSubscriptionType(subType string) (pulsar.SubscriptionType, error) {
 	switch strings.ToLower(subType) {
@@ -141,12 +216,65 @@ func GetSubscriptionType(subType string) (pulsar.SubscriptionType, error) {
 		return pulsar.Exclusive, nil
 	case "shared":
 		return pulsar.Shared, nil
-	case "keyshared":
+	case "keyshared", "key_shared":
 		return pulsar.KeyShared, nil
 	case "failover":
 		return pulsar.Failover, nil
 	default:
-		return -1, fmt.Errorf("unsupported subscription type %s", subType)
+		return -1, fmt.Errorf("unsupported subscription type %s, valid values are exclusive, shared, failover, and key_shared", subType)
+	}
+}
+
+// KeySharedPolicy returns the default auto split hash range policy of a Key_Shared subscription,
+// or nil for the other subscription types
+func KeySharedPolicy(subType pulsar.SubscriptionType) *pulsar.KeySharedPolicy {
+	if subType != pulsar.KeyShared {
+		return nil
+	}
+	return &pulsar.KeySharedPolicy{Mode: pulsar.KeySharedPolicyModeAutoSplit}
+}
+
+// InitialPositionName returns the name of a Pulsar subscription initial position
+func InitialPositionName(pos pulsar.SubscriptionInitialPosition) string {
+	switch pos {
+	case pulsar.SubscriptionPositionLatest:
+		return "latest"
+	case pulsar.SubscriptionPositionEarliest:
+		return "earliest"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscriptionTypeName returns the name of a Pulsar subscription type
+func SubscriptionTypeName(subType pulsar.SubscriptionType) string {
+	switch subType {
+	case pulsar.Exclusive:
+		return "exclusive"
+	case pulsar.Shared:
+		return "shared"
+	case pulsar.KeyShared:
+		return "keyshared"
+	case pulsar.Failover:
+		return "failover"
+	default:
+		return "unknown"
+	}
+}
+
+// GetCompressionType converts string based compression codec to Pulsar producer compression type
+func GetCompressionType(codec string) (pulsar.CompressionType, error) {
+	switch strings.ToLower(codec) {
+	case "none", "":
+		return pulsar.NoCompression, nil
+	case "lz4":
+		return pulsar.LZ4, nil
+	case "zlib":
+		return pulsar.ZLib, nil
+	case "zstd":
+		return pulsar.ZSTD, nil
+	default:
+		return -1, fmt.Errorf("unsupported compression codec %s", codec)
 	}
 }
 
@@ -177,6 +305,15 @@ func ValidateWebhookConfig(whs []WebhookConfig) error {
 		if _, err := GetInitialPosition(wh.InitialPosition); err != nil {
 			return err
 		}
+		if wh.Compression != "" && wh.Compression != GzipCompression {
+			return fmt.Errorf("unsupported webhook compression %s", wh.Compression)
+		}
+		if wh.CompressionMinSize < 0 {
+			return fmt.Errorf("webhook compression minimum size must not be negative")
+		}
+		if _, _, _, err := wh.RetryPolicy(); err != nil {
+			return err
+		}
 	}
 	return nil
 
@@ -187,10 +324,192 @@ func ValidateTopicConfig(top TopicConfig) (string, error) {
 	if err := ValidateWebhookConfig(top.Webhooks); err != nil {
 		return "", err
 	}
+	for _, wh := range top.Webhooks {
+		if wh.FailureTopic == "" {
+			continue
+		}
+		_, tenant, _, _, err := util.TokenizeTopicFullName(wh.FailureTopic)
+		if err != nil {
+			return "", fmt.Errorf("invalid webhook failureTopic %s", wh.FailureTopic)
+		}
+		if _, topicTenant, _, _, _ := util.TokenizeTopicFullName(top.TopicFullName); tenant != topicTenant {
+			return "", fmt.Errorf("webhook failureTopic %s must be in the tenant of the topic", wh.FailureTopic)
+		}
+	}
+	if len(top.JSONSchema) > 0 {
+		if _, err := CompileJSONSchema(top.JSONSchema); err != nil {
+			return "", fmt.Errorf("invalid JSONSchema %v", err)
+		}
+	}
+	if err := ValidateRoutingRules(top.RoutingRules, top.TopicFullName); err != nil {
+		return "", err
+	}
+	if top.ExpiresAt != nil && !top.ExpiresAt.After(time.Now()) {
+		return "", errors.New("ExpiresAt must be in the future")
+	}
+	if err := ValidateAllowedSubjects(top.AllowedSubjects); err != nil {
+		return "", err
+	}
 
 	return GetKeyFromNames(top.TopicFullName, top.PulsarURL)
 }
 
+// ValidateRoutingRules validates that every rule has a header, a value, and a target topic in the tenant of the topic
+func ValidateRoutingRules(rules []RoutingRule, topicFN string) error {
+	_, topicTenant, _, _, _ := util.TokenizeTopicFullName(topicFN)
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.Header) == "" || rule.Value == "" {
+			return errors.New("routing rule requires a header and a value")
+		}
+		_, tenant, namespace, topic, err := util.TokenizeTopicFullName(rule.Topic)
+		if err != nil || tenant == "" || namespace == "" || topic == "" {
+			return fmt.Errorf("invalid routing rule topic %s, it must be a fully qualified topic name", rule.Topic)
+		}
+		if tenant != topicTenant {
+			return fmt.Errorf("routing rule topic %s must be in the tenant of the topic", rule.Topic)
+		}
+	}
+	return nil
+}
+
+// ValidateAllowedSubjects validates that every allowed subject is a single token subject without a wildcard
+func ValidateAllowedSubjects(subjects []string) error {
+	if len(subjects) > MaxAllowedSubjects {
+		return fmt.Errorf("AllowedSubjects has %d subjects, the maximum is %d", len(subjects), MaxAllowedSubjects)
+	}
+	seen := make(map[string]bool, len(subjects))
+	for _, subject := range subjects {
+		switch {
+		case subject == "":
+			return errors.New("AllowedSubjects cannot have an empty subject")
+		case strings.ContainsAny(subject, ", \t\r\n"):
+			return fmt.Errorf("invalid allowed subject %q, it cannot contain a comma or whitespace", subject)
+		case strings.Contains(subject, "*"):
+			return fmt.Errorf("invalid allowed subject %q, wildcards are not supported", subject)
+		case seen[subject]:
+			return fmt.Errorf("allowed subject %s is duplicated", subject)
+		}
+		seen[subject] = true
+	}
+	return nil
+}
+
+// MatchRoutingRule returns the target topic of the first rule matching the headers, or empty if no rule matches
+func MatchRoutingRule(rules []RoutingRule, h http.Header) string {
+	for _, rule := range rules {
+		if strings.TrimSpace(h.Get(rule.Header)) == rule.Value {
+			return rule.Topic
+		}
+	}
+	return ""
+}
+
+// RetryPolicy returns the number of retries and the exponential backoff range of the webhook delivery
+func (wh WebhookConfig) RetryPolicy() (maxRetries int, initialBackoff, maxBackoff time.Duration, err error) {
+	if wh.MaxRetries < 0 || wh.MaxRetries > MaxWebhookRetries {
+		return 0, 0, 0, fmt.Errorf("webhook maxRetries must be between 0 and %d", MaxWebhookRetries)
+	}
+	maxRetries = wh.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultWebhookMaxRetries
+	}
+	initialBackoff, maxBackoff = DefaultWebhookInitialBackoff, DefaultWebhookMaxBackoff
+	if wh.InitialBackoff != "" {
+		if initialBackoff, err = time.ParseDuration(wh.InitialBackoff); err != nil || initialBackoff <= 0 {
+			return 0, 0, 0, fmt.Errorf("invalid webhook initialBackoff %s", wh.InitialBackoff)
+		}
+	}
+	if wh.MaxBackoff != "" {
+		if maxBackoff, err = time.ParseDuration(wh.MaxBackoff); err != nil || maxBackoff <= 0 {
+			return 0, 0, 0, fmt.Errorf("invalid webhook maxBackoff %s", wh.MaxBackoff)
+		}
+	}
+	if initialBackoff > maxBackoff {
+		return 0, 0, 0, fmt.Errorf("webhook initialBackoff %s must not be longer than maxBackoff %s", initialBackoff, maxBackoff)
+	}
+	return maxRetries, initialBackoff, maxBackoff, nil
+}
+
+// CompileJSONSchema compiles a JSON Schema document.
+// A $ref must be a local reference within the document, the compiler never loads a reference from the network
+// or the file system so that a topic config cannot make Beam fetch internal URLs or read local files.
+func CompileJSONSchema(schema json.RawMessage) (*gojsonschema.Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return nil, err
+	}
+	if err := checkLocalSchemaRefs(doc); err != nil {
+		return nil, err
+	}
+	return gojsonschema.NewSchema(localSchemaLoader{gojsonschema.NewBytesLoader(schema)})
+}
+
+// checkLocalSchemaRefs returns an error if a $ref of a JSON Schema document is not a local # pointer
+func checkLocalSchemaRefs(node interface{}) error {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" && !strings.HasPrefix(ref, "#") {
+				return fmt.Errorf("$ref %s must be a local reference starting with #", ref)
+			}
+			if err := checkLocalSchemaRefs(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if err := checkLocalSchemaRefs(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localSchemaLoader loads a JSON Schema document whose references cannot be loaded from outside the document
+type localSchemaLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (l localSchemaLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return localSchemaLoaderFactory{}
+}
+
+// localSchemaLoaderFactory refuses to load any referenced document
+type localSchemaLoaderFactory struct{}
+
+func (f localSchemaLoaderFactory) New(source string) gojsonschema.JSONLoader {
+	return refusedSchemaLoader{gojsonschema.NewReferenceLoader(source)}
+}
+
+// refusedSchemaLoader fails to load a referenced document without any I/O
+type refusedSchemaLoader struct {
+	gojsonschema.JSONLoader
+}
+
+func (l refusedSchemaLoader) LoadJSON() (interface{}, error) {
+	return nil, fmt.Errorf("reference %v is not a local reference", l.JsonSource())
+}
+
+func (l refusedSchemaLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return localSchemaLoaderFactory{}
+}
+
+// ValidateJSONPayload validates a payload against a compiled JSON Schema.
+// It returns the validation errors, which are empty if the payload is valid.
+func ValidateJSONPayload(schema *gojsonschema.Schema, payload []byte) []string {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		// the payload is not a valid JSON document
+		return []string{err.Error()}
+	}
+	errs := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	return errs
+}
+
 func isURL(str string) bool {
 	u, err := url.Parse(str)
 	return err == nil && u.Scheme != "" && u.Host != ""
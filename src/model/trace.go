@@ -0,0 +1,38 @@
+package model
+
+import "fmt"
+
+// PublishTrace records the resolution steps of a publish request for debugging
+type PublishTrace struct {
+	Steps []TraceStep `json:"steps"`
+	Error string      `json:"error,omitempty"`
+	// Code is the machine-readable code of a failed produce
+	Code string `json:"code,omitempty"`
+}
+
+// TraceStep is a single resolution step in a PublishTrace
+type TraceStep struct {
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+}
+
+// Add appends a step to the trace. It is a no-op on a nil trace so that callers do not
+// need to check whether tracing is enabled.
+func (t *PublishTrace) Add(step, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{
+		Step:   step,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// DryRunResult is the reply of a dry-run publish request, describing where the message would have been sent
+type DryRunResult struct {
+	Topic   string `json:"topic"`
+	Cluster string `json:"cluster"`
+	Size    int    `json:"size"`
+	// ProducerChecked is true if a producer was created and closed on the cluster
+	ProducerChecked bool `json:"producerChecked"`
+}
@@ -0,0 +1,396 @@
+package pulsardriver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// ErrSubscriptionNotFound is returned when the subscription to delete does not exist
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrSubscriptionInUse is returned when the subscription to delete still has connected consumers
+var ErrSubscriptionInUse = errors.New("subscription has connected consumers")
+
+// ErrAdminNotAuthorized is returned when the token is not authorized by the Pulsar admin REST API
+var ErrAdminNotAuthorized = errors.New("not authorized by Pulsar admin")
+
+// SubscriptionStats is the backlog of a subscription in the topic stats of the Pulsar admin REST API
+type SubscriptionStats struct {
+	MsgBacklog      int64 `json:"msgBacklog"`
+	UnackedMessages int64 `json:"unackedMessages"`
+}
+
+// LastMessageID is the ID of the last message of a topic or a partition replied by the Pulsar admin REST API
+type LastMessageID struct {
+	LedgerID       int64 `json:"ledgerId"`
+	EntryID        int64 `json:"entryId"`
+	PartitionIndex int32 `json:"partitionIndex"`
+	BatchIndex     int32 `json:"batchIndex"`
+}
+
+// String formats the message ID as ledgerId:entryId:partitionIndex:batchIndex, the same as the ID of a SSE event
+func (id LastMessageID) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", id.LedgerID, id.EntryID, id.PartitionIndex, id.BatchIndex)
+}
+
+// ErrTopicNotFound is returned by the Pulsar admin REST API for a topic that does not exist
+var ErrTopicNotFound = errors.New("topic not found")
+
+const adminRequestTimeout = 10 * time.Second
+
+// existingTopicTTL is how long a topic found by TopicExists is cached, a topic is rarely deleted
+const existingTopicTTL = 5 * time.Minute
+
+var existingTopics = util.NewCache(util.CacheOption{
+	TTL:            existingTopicTTL,
+	CleanInterval:  existingTopicTTL,
+	ExpireCallback: func(key string, value interface{}) {},
+})
+
+// AdminURL returns the admin REST API URL of a Pulsar cluster, either from PulsarAdminURLs
+// or derived from the Pulsar URL with the default web service ports.
+func AdminURL(pulsarURL string) (string, error) {
+	if adminURL, ok := util.ClusterAdminURLs[pulsarURL]; ok {
+		return strings.TrimSuffix(adminURL, "/"), nil
+	}
+	u, err := url.Parse(pulsarURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "pulsar":
+		return "http://" + u.Hostname() + ":8080", nil
+	case "pulsar+ssl":
+		return "https://" + u.Hostname() + ":8443", nil
+	}
+	return "", fmt.Errorf("unsupported pulsar URL %s", pulsarURL)
+}
+
+// DeleteSubscription deletes a subscription of a topic with the Pulsar admin REST API
+func DeleteSubscription(pulsarURL, tokenStr, topicFN, subscriptionName string) error {
+	res, err := topicAdminRequest(http.MethodDelete, pulsarURL, tokenStr, topicFN, "/subscription/"+url.PathEscape(subscriptionName), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrSubscriptionNotFound
+	case http.StatusPreconditionFailed:
+		return ErrSubscriptionInUse
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAdminNotAuthorized
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("failed to delete subscription %s status code %d %s", subscriptionName, res.StatusCode, string(body))
+}
+
+// ErrSubscriptionExists is returned when the subscription to create already exists
+var ErrSubscriptionExists = errors.New("subscription already exists")
+
+// CreateSubscription creates a durable subscription of a topic at the initial position with the Pulsar admin
+// REST API. The cursor is established on the broker without connecting a consumer.
+func CreateSubscription(pulsarURL, tokenStr, topicFN, subscriptionName string, position pulsar.SubscriptionInitialPosition) error {
+	// the message ID of the earliest or the latest position in the Pulsar admin API
+	messageID := map[string]int64{"ledgerId": math.MaxInt64, "entryId": math.MaxInt64}
+	if position == pulsar.SubscriptionPositionEarliest {
+		messageID = map[string]int64{"ledgerId": -1, "entryId": -1}
+	}
+	body, err := json.Marshal(messageID)
+	if err != nil {
+		return err
+	}
+	res, err := topicAdminRequest(http.MethodPut, pulsarURL, tokenStr, topicFN, "/subscription/"+url.PathEscape(subscriptionName), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return ErrSubscriptionExists
+	case http.StatusNotFound:
+		return ErrTopicNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAdminNotAuthorized
+	}
+	resBody, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("failed to create subscription %s status code %d %s", subscriptionName, res.StatusCode, string(resBody))
+}
+
+// TopicExists checks whether a partitioned or non-partitioned topic exists with the Pulsar admin REST API.
+// Unlike a topic lookup, the check does not create the topic if the cluster allows the auto-creation.
+func TopicExists(pulsarURL, tokenStr, topicFN string) (bool, error) {
+	key := pulsarURL + tokenStr + topicFN
+	if _, ok := existingTopics.Get(key); ok {
+		return true, nil
+	}
+
+	res, err := topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, "/partitions", nil)
+	if err != nil {
+		return false, err
+	}
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	err = adminResponse(res, &metadata)
+	if err == nil && metadata.Partitions == 0 {
+		// a non-partitioned topic has no partitions metadata
+		if res, err = topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, "/stats", nil); err != nil {
+			return false, err
+		}
+		err = adminResponse(res, nil)
+	}
+	if err == ErrTopicNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	existingTopics.Set(key, true)
+	return true, nil
+}
+
+// GetSubscriptionStats returns the backlog of a subscription with the Pulsar admin REST API.
+// The stats of a partitioned topic are aggregated over all partitions.
+func GetSubscriptionStats(pulsarURL, tokenStr, topicFN, subscriptionName string) (SubscriptionStats, error) {
+	var stats struct {
+		Subscriptions map[string]SubscriptionStats `json:"subscriptions"`
+	}
+	if err := getTopicStats(pulsarURL, tokenStr, topicFN, &stats); err != nil {
+		return SubscriptionStats{}, err
+	}
+	sub, ok := stats.Subscriptions[subscriptionName]
+	if !ok {
+		return SubscriptionStats{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// GetTopicStats returns the topic stats JSON of the Pulsar admin REST API as is.
+// The stats of a partitioned topic are aggregated over all partitions.
+func GetTopicStats(pulsarURL, tokenStr, topicFN string) (json.RawMessage, error) {
+	var stats json.RawMessage
+	if err := getTopicStats(pulsarURL, tokenStr, topicFN, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetLastMessageIDs returns the last message ID of a topic, or of every partition of a partitioned topic in the
+// partition order, with the Pulsar admin REST API
+func GetLastMessageIDs(pulsarURL, tokenStr, topicFN string) ([]LastMessageID, error) {
+	res, err := topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, "/partitions", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	if err = adminResponse(res, &metadata); err != nil {
+		return nil, err
+	}
+
+	if metadata.Partitions == 0 {
+		id, err := getLastMessageID(pulsarURL, tokenStr, topicFN)
+		if err != nil {
+			return nil, err
+		}
+		return []LastMessageID{id}, nil
+	}
+	ids := make([]LastMessageID, metadata.Partitions)
+	for i := range ids {
+		if ids[i], err = getLastMessageID(pulsarURL, tokenStr, fmt.Sprintf("%s-partition-%d", topicFN, i)); err != nil {
+			return nil, err
+		}
+		ids[i].PartitionIndex = int32(i)
+	}
+	return ids, nil
+}
+
+func getLastMessageID(pulsarURL, tokenStr, topicFN string) (LastMessageID, error) {
+	res, err := topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, "/lastMessageId", nil)
+	if err != nil {
+		return LastMessageID{}, err
+	}
+	id := LastMessageID{PartitionIndex: -1, BatchIndex: -1}
+	err = adminResponse(res, &id)
+	return id, err
+}
+
+// GetNamespaceTopics returns the full names of the persistent topics of a namespace, in the tenant/namespace format,
+// with the Pulsar admin REST API. A partitioned topic is listed by its partitions.
+func GetNamespaceTopics(pulsarURL, tokenStr, namespace string) ([]string, error) {
+	parts := strings.Split(namespace, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid namespace %s, it must be in the tenant/namespace format", namespace)
+	}
+	res, err := adminRequest(http.MethodGet, pulsarURL, tokenStr,
+		fmt.Sprintf("/admin/v2/namespaces/%s/%s/topics", url.PathEscape(parts[0]), url.PathEscape(parts[1])), nil)
+	if err != nil {
+		return nil, err
+	}
+	var topics []string
+	err = adminResponse(res, &topics)
+	return topics, err
+}
+
+// GetIdleSubscriptions returns the subscriptions of a topic with the name prefix that have no connected consumer
+// with the Pulsar admin REST API
+func GetIdleSubscriptions(pulsarURL, tokenStr, topicFN, prefix string) ([]string, error) {
+	var stats struct {
+		Subscriptions map[string]struct {
+			Consumers []json.RawMessage `json:"consumers"`
+		} `json:"subscriptions"`
+	}
+	if err := getTopicStats(pulsarURL, tokenStr, topicFN, &stats); err != nil {
+		return nil, err
+	}
+	idle := []string{}
+	for name, sub := range stats.Subscriptions {
+		if strings.HasPrefix(name, prefix) && len(sub.Consumers) == 0 {
+			idle = append(idle, name)
+		}
+	}
+	sort.Strings(idle)
+	return idle, nil
+}
+
+// getTopicStats decodes the stats of a topic, or the partitioned stats if the topic is partitioned, into v
+func getTopicStats(pulsarURL, tokenStr, topicFN string, v interface{}) error {
+	res, err := topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, "/partitions", nil)
+	if err != nil {
+		return err
+	}
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	if err = adminResponse(res, &metadata); err != nil {
+		return err
+	}
+
+	path := "/stats"
+	if metadata.Partitions > 0 {
+		path = "/partitioned-stats"
+	}
+	if res, err = topicAdminRequest(http.MethodGet, pulsarURL, tokenStr, topicFN, path, nil); err != nil {
+		return err
+	}
+	return adminResponse(res, v)
+}
+
+// adminResponse decodes a successful JSON response into v unless it is nil, and maps the error status codes
+func adminResponse(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		if v == nil {
+			return nil
+		}
+		return json.NewDecoder(res.Body).Decode(v)
+	case http.StatusNotFound:
+		return ErrTopicNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAdminNotAuthorized
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("pulsar admin request %s status code %d %s", res.Request.URL.Path, res.StatusCode, string(body))
+}
+
+// topicAdminRequest sends a request to the admin REST API path of a topic with the token
+func topicAdminRequest(method, pulsarURL, tokenStr, topicFN, path string, body []byte) (*http.Response, error) {
+	isPersistent, tenant, namespace, topic, err := util.TokenizeTopicFullName(topicFN)
+	if err != nil {
+		return nil, err
+	}
+	domain := "non-persistent"
+	if isPersistent {
+		domain = "persistent"
+	}
+	return adminRequest(method, pulsarURL, tokenStr, fmt.Sprintf("/admin/v2/%s/%s/%s/%s%s", domain,
+		url.PathEscape(tenant), url.PathEscape(namespace), url.PathEscape(topic), path), body)
+}
+
+// adminRequest sends a request to an admin REST API path of the cluster with the token
+func adminRequest(method, pulsarURL, tokenStr, path string, body []byte) (*http.Response, error) {
+	adminURL, err := AdminURL(pulsarURL)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := adminURL + path
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if tokenStr != "" {
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+	}
+
+	client, err := adminClient(adminURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// adminClient returns a HTTP client trusting the TrustStore for a TLS admin URL, and presenting the
+// Pulsar TLS client certificate if it is configured
+func adminClient(adminURL string) (*http.Client, error) {
+	client := &http.Client{Timeout: adminRequestTimeout}
+	if !strings.HasPrefix(adminURL, "https://") {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: util.StringToBool(os.Getenv("PulsarTLSAllowInsecureConnection")),
+	}
+	if trustStore := os.Getenv("TrustStore"); trustStore != "" {
+		certs, err := ioutil.ReadFile(trustStore)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(certs) {
+			return nil, fmt.Errorf("no certificate is loaded from trust store %s", trustStore)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile, keyFile := util.GetConfig().PulsarTLSCertFile, util.GetConfig().PulsarTLSKeyFile
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return client, nil
+}
@@ -1,6 +1,7 @@
 package pulsardriver
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -18,10 +19,68 @@ var ClientCache = make(map[string]*PulsarClient)
 // clientSync protects the ClientCache access
 var clientSync = &sync.RWMutex{}
 
-var (
-	clientOpsTimeout     = util.GetEnvInt("PulsarClientOperationTimeout", 30)
-	clientConnectTimeout = util.GetEnvInt("PulsarClientConnectionTimeout", 30)
-)
+// ErrPulsarTimeout is returned when a producer, consumer, or reader is not created within the operation timeout,
+// such as when the Pulsar broker is unreachable
+var ErrPulsarTimeout = errors.New("timed out creating a Pulsar producer or consumer")
+
+// OperationTimeout returns the configured timeout of the Pulsar client operations
+func OperationTimeout() time.Duration {
+	if timeout := util.GetConfig().PulsarClientOperationTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return util.DefaultPulsarClientTimeout * time.Second
+}
+
+// connectionTimeout returns the configured timeout of a broker connection
+func connectionTimeout() time.Duration {
+	if timeout := util.GetConfig().PulsarClientConnectionTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return util.DefaultPulsarClientTimeout * time.Second
+}
+
+// Closer is a Pulsar producer, consumer, or reader
+type Closer interface {
+	Close()
+}
+
+// CreateWithTimeout creates a producer, consumer, or reader with create, and fails with ErrPulsarTimeout if it is not
+// created within the operation timeout, so that a request does not hang on an unreachable broker. An object created
+// after the timeout is closed.
+func CreateWithTimeout(create func() (Closer, error)) (Closer, error) {
+	type result struct {
+		obj Closer
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		obj, err := create()
+		done <- result{obj, err}
+	}()
+
+	timer := time.NewTimer(OperationTimeout())
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.obj, res.err
+	case <-timer.C:
+		go func() {
+			if res := <-done; res.err == nil {
+				res.obj.Close()
+			}
+		}()
+		return nil, ErrPulsarTimeout
+	}
+}
+
+// IsTimeoutError returns whether an error is due to a Pulsar cluster that does not respond in time
+func IsTimeoutError(err error) bool {
+	if errors.Is(err, ErrPulsarTimeout) {
+		return true
+	}
+	var pulsarErr *pulsar.Error
+	return errors.As(err, &pulsarErr) && pulsarErr.Result() == pulsar.TimeoutError
+}
 
 // GetPulsarClient gets a Pulsar client object
 func GetPulsarClient(pulsarURL, pulsarToken string, reset bool) (pulsar.Client, error) {
@@ -96,20 +155,46 @@ func (c *PulsarClient) Reconnect() (pulsar.Client, error) {
 
 // NewPulsarClient always creates a new pulsar.Client connection
 func NewPulsarClient(url, tokenStr string) (pulsar.Client, error) {
+	clientOpt, err := NewClientOptions(url, tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := pulsar.NewClient(clientOpt)
+
+	if err != nil {
+		log.Errorf("failed instantiate pulsar client %v", err)
+		return nil, fmt.Errorf("Could not instantiate Pulsar client: %v", err)
+	}
+	if log.GetLevel() == log.DebugLevel {
+		log.Debugf("pulsar client url %s\n token %s", url, tokenStr)
+	}
+
+	return driver, nil
+}
+
+// NewClientOptions builds the Pulsar client options of a cluster.
+// The client authenticates with the token so that the caller's own identity is authorized by Pulsar.
+// When no token is specified, it authenticates with the TLS client certificate if PulsarTLSCertFile and
+// PulsarTLSKeyFile are configured. The cluster's configured token is resolved by the caller with util.ClusterToken.
+func NewClientOptions(url, tokenStr string) (pulsar.ClientOptions, error) {
 	clientOpt := pulsar.ClientOptions{
 		URL:               url,
-		OperationTimeout:  time.Duration(clientOpsTimeout) * time.Second,
-		ConnectionTimeout: time.Duration(clientConnectTimeout) * time.Second,
+		OperationTimeout:  OperationTimeout(),
+		ConnectionTimeout: connectionTimeout(),
 	}
 
-	if tokenStr != "" {
+	certFile, keyFile := util.GetConfig().PulsarTLSCertFile, util.GetConfig().PulsarTLSKeyFile
+	if tokenStr == "" && certFile != "" && keyFile != "" {
+		clientOpt.Authentication = pulsar.NewAuthenticationTLS(certFile, keyFile)
+	} else if tokenStr != "" {
 		clientOpt.Authentication = pulsar.NewAuthenticationToken(tokenStr)
 	}
 
 	if strings.HasPrefix(url, "pulsar+ssl://") {
 		trustStore := os.Getenv("TrustStore") //"/etc/ssl/certs/ca-bundle.crt" all Config is also written back to OS ENV
 		if trustStore == "" {
-			return nil, fmt.Errorf("this is fatal that we are missing trustStore while pulsar+ssl is required")
+			return clientOpt, fmt.Errorf("this is fatal that we are missing trustStore while pulsar+ssl is required")
 		}
 		clientOpt.TLSTrustCertsFilePath = trustStore
 	}
@@ -117,16 +202,25 @@ func NewPulsarClient(url, tokenStr string) (pulsar.Client, error) {
 	// default is false for these two configuration parameters
 	clientOpt.TLSAllowInsecureConnection = util.StringToBool(os.Getenv("PulsarTLSAllowInsecureConnection"))
 	clientOpt.TLSValidateHostname = util.StringToBool(os.Getenv("PulsarTLSValidateHostname"))
+	return clientOpt, nil
+}
 
-	driver, err := pulsar.NewClient(clientOpt)
-
+// CheckPulsarConnectivity verifies the cached client can reach the Pulsar cluster with a topic lookup
+func CheckPulsarConnectivity(pulsarURL, pulsarToken, topic string, timeout time.Duration) error {
+	client, err := GetPulsarClient(pulsarURL, pulsarToken, false)
 	if err != nil {
-		log.Errorf("failed instantiate pulsar client %v", err)
-		return nil, fmt.Errorf("Could not instantiate Pulsar client: %v", err)
-	}
-	if log.GetLevel() == log.DebugLevel {
-		log.Debugf("pulsar client url %s\n token %s", url, tokenStr)
+		return err
 	}
 
-	return driver, nil
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := client.TopicPartitions(topic)
+		errChan <- err
+	}()
+	select {
+	case err = <-errChan:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Pulsar topic lookup timed out after %v", timeout)
+	}
 }
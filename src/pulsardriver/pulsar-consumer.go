@@ -110,6 +110,7 @@ func (c *PulsarConsumer) GetConsumer() (pulsar.Consumer, error) {
 		SubscriptionName:            c.subscriptionName,
 		SubscriptionInitialPosition: c.initPosition,
 		Type:                        c.subscriptionType,
+		KeySharedPolicy:             model.KeySharedPolicy(c.subscriptionType),
 	})
 	if err != nil {
 		log.Errorf("consumer subscribe error:%s\n", err.Error())
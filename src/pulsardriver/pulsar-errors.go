@@ -0,0 +1,122 @@
+package pulsardriver
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// ProduceErrorCode is a stable machine-readable code of a failed produce
+type ProduceErrorCode string
+
+// the codes of a failed produce, see ClassifyProduceError
+const (
+	ErrCodeUnknown              ProduceErrorCode = "UNKNOWN"
+	ErrCodeTimeout              ProduceErrorCode = "TIMEOUT"
+	ErrCodeAuthenticationFailed ProduceErrorCode = "AUTHENTICATION_FAILED"
+	ErrCodeAuthorizationFailed  ProduceErrorCode = "AUTHORIZATION_FAILED"
+	ErrCodeTopicBacklogExceeded ProduceErrorCode = "TOPIC_BACKLOG_EXCEEDED"
+	ErrCodeTopicNotFound        ProduceErrorCode = "TOPIC_NOT_FOUND"
+	ErrCodeTopicTerminated      ProduceErrorCode = "TOPIC_TERMINATED"
+	ErrCodeInvalidTopicName     ProduceErrorCode = "INVALID_TOPIC_NAME"
+	ErrCodeMessageTooLarge      ProduceErrorCode = "MESSAGE_TOO_LARGE"
+	ErrCodeProducerQueueFull    ProduceErrorCode = "PRODUCER_QUEUE_FULL"
+	ErrCodeClusterUnavailable   ProduceErrorCode = "CLUSTER_UNAVAILABLE"
+)
+
+// producerError is the failure to create a producer, it is ErrProducerUnavailable with the Pulsar client's cause
+type producerError struct {
+	cause error
+}
+
+func (e *producerError) Error() string {
+	return ErrProducerUnavailable.Error() + ": " + e.cause.Error()
+}
+
+// Is matches ErrProducerUnavailable
+func (e *producerError) Is(target error) bool {
+	return target == ErrProducerUnavailable
+}
+
+// Unwrap returns the cause to be classified by ClassifyProduceError
+func (e *producerError) Unwrap() error {
+	return e.cause
+}
+
+// producerUnavailable returns ErrProducerUnavailable with the cause of the producer creation failure
+func producerUnavailable(cause error) error {
+	return &producerError{cause: cause}
+}
+
+// errorResultCodes maps the Pulsar client results to the codes and HTTP statuses
+var errorResultCodes = map[pulsar.Result]struct {
+	code   ProduceErrorCode
+	status int
+}{
+	pulsar.AuthenticationError:                   {ErrCodeAuthenticationFailed, http.StatusUnauthorized},
+	pulsar.AuthorizationError:                    {ErrCodeAuthorizationFailed, http.StatusForbidden},
+	pulsar.ProducerBlockedQuotaExceededError:     {ErrCodeTopicBacklogExceeded, http.StatusTooManyRequests},
+	pulsar.ProducerBlockedQuotaExceededException: {ErrCodeTopicBacklogExceeded, http.StatusTooManyRequests},
+	pulsar.TopicNotFound:                         {ErrCodeTopicNotFound, http.StatusNotFound},
+	pulsar.TopicTerminated:                       {ErrCodeTopicTerminated, http.StatusGone},
+	pulsar.InvalidTopicName:                      {ErrCodeInvalidTopicName, http.StatusUnprocessableEntity},
+	pulsar.MessageTooBig:                         {ErrCodeMessageTooLarge, http.StatusRequestEntityTooLarge},
+	pulsar.ProducerQueueIsFull:                   {ErrCodeProducerQueueFull, http.StatusServiceUnavailable},
+	pulsar.ConnectError:                          {ErrCodeClusterUnavailable, http.StatusServiceUnavailable},
+	pulsar.LookupError:                           {ErrCodeClusterUnavailable, http.StatusServiceUnavailable},
+	pulsar.NotConnectedError:                     {ErrCodeClusterUnavailable, http.StatusServiceUnavailable},
+	pulsar.ServiceUnitNotReady:                   {ErrCodeClusterUnavailable, http.StatusServiceUnavailable},
+}
+
+// serverErrorCodes maps the broker's error names of a producer creation or lookup failure, which the Pulsar
+// client does not return as a pulsar.Error but as the text "server error: <Name>: <message>"
+var serverErrorCodes = map[string]pulsar.Result{
+	"AuthenticationError":                   pulsar.AuthenticationError,
+	"AuthorizationError":                    pulsar.AuthorizationError,
+	"ProducerBlockedQuotaExceededError":     pulsar.ProducerBlockedQuotaExceededError,
+	"ProducerBlockedQuotaExceededException": pulsar.ProducerBlockedQuotaExceededException,
+	"TopicTerminatedError":                  pulsar.TopicTerminated,
+	"TopicNotFound":                         pulsar.TopicNotFound,
+	"InvalidTopicName":                      pulsar.InvalidTopicName,
+	"ServiceNotReady":                       pulsar.ServiceUnitNotReady,
+}
+
+// serverErrorPrefix precedes the broker's error name in the text of a server error
+const serverErrorPrefix = "server error: "
+
+// serverErrorName returns the broker's error name of a server error in the error text, or an empty string
+func serverErrorName(msg string) string {
+	i := strings.Index(msg, serverErrorPrefix)
+	if i < 0 {
+		return ""
+	}
+	name := msg[i+len(serverErrorPrefix):]
+	if j := strings.Index(name, ":"); j > 0 {
+		return name[:j]
+	}
+	return ""
+}
+
+// ClassifyProduceError returns the code and the HTTP status of an error of SendToPulsar.
+// An error that cannot be classified is ErrCodeUnknown with the status.
+func ClassifyProduceError(err error, status int) (ProduceErrorCode, int) {
+	if IsTimeoutError(err) {
+		return ErrCodeTimeout, http.StatusGatewayTimeout
+	}
+	var pulsarErr *pulsar.Error
+	if errors.As(err, &pulsarErr) {
+		if c, ok := errorResultCodes[pulsarErr.Result()]; ok {
+			return c.code, c.status
+		}
+	}
+	if result, ok := serverErrorCodes[serverErrorName(err.Error())]; ok {
+		c := errorResultCodes[result]
+		return c.code, c.status
+	}
+	if errors.Is(err, ErrProducerUnavailable) {
+		return ErrCodeClusterUnavailable, http.StatusServiceUnavailable
+	}
+	return ErrCodeUnknown, status
+}
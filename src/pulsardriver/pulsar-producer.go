@@ -3,6 +3,7 @@ package pulsardriver
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
@@ -13,24 +14,98 @@ import (
 )
 
 var producerCacheTTL = util.GetEnvInt("ProducerCacheTTL", 900)
-var producerSendRetryLimit = util.GetEnvInt("ProducerSendRetryLimit", 1)
 
-// ProducerCache is the cache for Producer objects
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 5 * time.Second
+)
+
+// ProducerCache is the cache for Producer objects. A producer idle for ProducerCacheTTL seconds
+// is evicted, and its pending messages are flushed before it is closed.
 var ProducerCache = util.NewCache(util.CacheOption{
 	TTL:           time.Duration(producerCacheTTL) * time.Second,
 	CleanInterval: time.Duration(producerCacheTTL+2) * time.Second,
 	ExpireCallback: func(key string, value interface{}) {
+		util.ProducerPoolSize.Dec()
 		if obj, ok := value.(*PulsarProducer); ok {
-			obj.Close()
+			// the callback runs under the cache lock, a flush can take up to the send timeout
+			closingProducers.Add(1)
+			go func() {
+				defer closingProducers.Done()
+				obj.FlushAndClose()
+			}()
 		} else {
 			log.Errorf("wrong PulsarProducer object type stored in Cache")
 		}
 	},
 })
 
+// closingProducers are the evicted producers being flushed and closed
+var closingProducers sync.WaitGroup
+
+// producerPoolLock serializes adding a new producer to the cache, so that concurrent requests
+// do not leak a producer by overwriting each other's
+var producerPoolLock sync.Mutex
+
+// FlushProducers evicts every cached producer, the pending messages are flushed before it is closed.
+// It returns the number of evicted producers.
+func FlushProducers() int {
+	producerPoolLock.Lock()
+	defer producerPoolLock.Unlock()
+	return ProducerCache.Flush()
+}
+
+// CloseProducers flushes and closes every cached producer, and waits until the pending messages of all
+// evicted producers are flushed. It is called before the process exits.
+func CloseProducers() int {
+	closed := FlushProducers()
+	closingProducers.Wait()
+	return closed
+}
+
+// ProducerConfig is the producer level configuration. Producers are cached per topic and configuration.
+// Zero batching values use the Pulsar client defaults.
+type ProducerConfig struct {
+	Compression             pulsar.CompressionType
+	BatchingMaxMessages     uint
+	BatchingMaxSize         uint
+	BatchingMaxPublishDelay time.Duration
+	// KeyBasedBatching only batches messages with the same key, as required by Key_Shared subscriptions
+	KeyBasedBatching bool
+	// Name is the stable producer name for the broker's message deduplication, a unique name is
+	// generated by the broker if it is empty
+	Name string
+}
+
+// cacheKey returns the part of the producer cache key identifying the configuration
+func (c ProducerConfig) cacheKey() string {
+	return fmt.Sprintf("%d-%d-%d-%d-%t-%s", c.Compression, c.BatchingMaxMessages, c.BatchingMaxSize, c.BatchingMaxPublishDelay, c.KeyBasedBatching, c.Name)
+}
+
+// SendOptions are the options to send a message to Pulsar
+type SendOptions struct {
+	// Key is used for partition routing; an empty key keeps the default round-robin routing.
+	Key string
+	// OrderingKey is used for the Key_Shared dispatch in place of Key if it is not empty.
+	OrderingKey string
+	// DeliverAfter and DeliverAt delay the message delivery to consumers, zero values deliver immediately.
+	DeliverAfter time.Duration
+	DeliverAt    time.Time
+	// EventTime is the application event time of the message, the send time is used if it is zero.
+	EventTime time.Time
+	// Properties are added to the message properties together with PulsarBeamId.
+	Properties map[string]string
+	// SequenceID is the message sequence id for the deduplication, the producer assigns one if it is nil.
+	SequenceID *int64
+	Producer   ProducerConfig
+	// OnAsyncError is called with the error of an async send that has failed after the retries,
+	// it runs on the producer's callback and must not block.
+	OnAsyncError func(err error)
+}
+
 // GetPulsarProducer gets a Pulsar producer object
-func GetPulsarProducer(pulsarURL, pulsarToken, topic string, reconnect bool) (pulsar.Producer, error) {
-	key := pulsarURL + pulsarToken + topic
+func GetPulsarProducer(pulsarURL, pulsarToken, topic string, cfg ProducerConfig, reconnect bool) (pulsar.Producer, error) {
+	key := pulsarURL + pulsarToken + topic + cfg.cacheKey()
 	obj, exists := ProducerCache.Get(key)
 	if exists {
 		if driver, ok := obj.(*PulsarProducer); ok {
@@ -45,6 +120,7 @@ func GetPulsarProducer(pulsarURL, pulsarToken, topic string, reconnect bool) (pu
 		pulsarURL: pulsarURL,
 		token:     pulsarToken,
 		topic:     topic,
+		cfg:       cfg,
 	}
 	p, err := prod.GetProducer()
 	if err != nil {
@@ -56,81 +132,324 @@ func GetPulsarProducer(pulsarURL, pulsarToken, topic string, reconnect bool) (pu
 			return nil, err
 		}
 	}
+
+	producerPoolLock.Lock()
+	defer producerPoolLock.Unlock()
+	if obj, exists := ProducerCache.Get(key); exists {
+		// another request has created the producer in the meantime
+		prod.Close()
+		return obj.(*PulsarProducer).GetProducer()
+	}
+	if maxSize := util.GetConfig().ProducerPoolMaxSize; maxSize > 0 {
+		// evict the least recently used producers to make room
+		for ProducerCache.Count() >= maxSize {
+			if !ProducerCache.DeleteOldest() {
+				break
+			}
+		}
+	}
 	ProducerCache.Set(key, prod)
+	util.ProducerPoolSize.Inc()
 	return p, nil
 }
 
+// CheckProducer creates and closes a producer on the topic without sending a message, so that the cluster's
+// connectivity and the token's authorization are verified. It fails with the same errors as a send.
+func CheckProducer(pulsarURL, pulsarToken, topic string) error {
+	driver, err := GetPulsarClient(pulsarURL, pulsarToken, false)
+	if err != nil {
+		log.Errorf("Failed to create Pulsar client err: %v", err)
+		return producerUnavailable(err)
+	}
+	p, err := CreateWithTimeout(func() (Closer, error) { return driver.CreateProducer(pulsar.ProducerOptions{Topic: topic}) })
+	if err == ErrPulsarTimeout {
+		log.Errorf("Failed to create Pulsar producer in time err: %v", err)
+		return err
+	} else if err != nil {
+		log.Errorf("Failed to create Pulsar produce err: %v", err)
+		return producerUnavailable(err)
+	}
+	p.Close()
+	return nil
+}
+
 // PulsarProducer encapsulates the Pulsar Producer object
 type PulsarProducer struct {
 	producer  pulsar.Producer
 	pulsarURL string
 	token     string
 	topic     string
+	cfg       ProducerConfig
 	createdAt time.Time
 	lastUsed  time.Time
 	sync.Mutex
 }
 
-// SendToPulsar sends data to a Pulsar producer.
-func SendToPulsar(url, token, topic string, data []byte, async bool, reconnect bool, retried int) error {
-	p, err := GetPulsarProducer(url, token, topic, reconnect)
-	if err != nil {
+// ErrProducerUnavailable is returned when the producer cannot be created on the Pulsar cluster,
+// wrapping the cause of the failure, see errors.Is
+var ErrProducerUnavailable = errors.New("Failed to create Pulsar producer")
+
+// SendToPulsar sends data to a Pulsar producer and returns the message ID, which is nil in async mode.
+// A retryable send error is retried up to ProducerSendRetryLimit times with exponential backoff,
+// while a non-retryable error, such as an authorization failure, fails fast.
+// With ProducerFailover enabled, a message that cannot be sent due to a connection error is sent to the
+// next allowed clusters in order, see FailoverURLs, and the message ID is the one of the cluster accepting it.
+// Only a message sent with the cluster's own token is failed over, see FailoverToken.
+func SendToPulsar(url, token, topic string, data []byte, opts SendOptions, async bool, reconnect bool, retried int) (id pulsar.MessageID, err error) {
+	defer observeProduceLatency(time.Now(), async, &err)
+
+	id, err = sendToCluster(url, token, topic, data, opts, async, reconnect, retried)
+	if err == nil || !util.StringToBool(util.GetConfig().ProducerFailover) {
+		return id, err
+	}
+	for _, fallbackURL := range FailoverURLs(url) {
+		if !IsConnectionError(err) {
+			break
+		}
+		fallbackToken, ok := FailoverToken(url, fallbackURL, token)
+		if !ok {
+			break
+		}
+		log.Warnf("failover sending to Pulsar %s topic %s due to %v", fallbackURL, topic, err)
+		if id, err = sendToCluster(fallbackURL, fallbackToken, topic, data, opts, async, false, 0); err == nil {
+			return id, nil
+		}
+	}
+	return nil, err
+}
+
+// observeProduceLatency records the latency of a send since the start time with the result of the error
+func observeProduceLatency(start time.Time, async bool, err *error) {
+	mode, result := "sync", "success"
+	if async {
+		mode = "async"
+	}
+	if *err != nil {
+		result = "failure"
+	}
+	util.ProduceLatency.WithLabelValues(mode, result).Observe(time.Since(start).Seconds())
+}
+
+// FailoverURLs returns the allowed Pulsar clusters to fail over to from a cluster, in the configured order
+// starting after the cluster. No cluster is returned for a cluster that is not allowed.
+func FailoverURLs(url string) []string {
+	allowed := util.AllowedPulsarURLs
+	for i := range allowed {
+		if allowed[i] != url {
+			continue
+		}
+		urls := []string{}
+		for j := 1; j < len(allowed); j++ {
+			if next := allowed[(i+j)%len(allowed)]; next != "" && next != url {
+				urls = append(urls, next)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// FailoverToken returns the token to send to a fallback cluster in place of the token of a cluster.
+// A token other than the cluster's own token is carried by the request for that cluster only, so that
+// the message is not failed over. Otherwise the fallback cluster's own token is used, or no token if
+// the message was sent without one.
+func FailoverToken(url, fallbackURL, token string) (string, bool) {
+	if token != util.ClusterTokens[url] {
+		return "", false
+	}
+	if token == "" {
+		return "", true
+	}
+	return util.ClusterTokens[fallbackURL], true
+}
+
+// IsConnectionError returns whether an error of sending to a cluster is due to the connection to the cluster.
+// The message is never persisted by the cluster on such an error, so that it can be sent to another cluster.
+// A producer creation failure rejected by the cluster, such as an authorization failure or a topic not
+// found, is not a connection error since another cluster with the same token and topic rejects it as well.
+// An async send is never failed over once the producer is created, since its send result is not awaited.
+func IsConnectionError(err error) bool {
+	if err == ErrPulsarTimeout {
+		return true
+	}
+	if errors.Is(err, ErrProducerUnavailable) {
+		code, _ := ClassifyProduceError(err, 0)
+		return code == ErrCodeClusterUnavailable || code == ErrCodeTimeout
+	}
+	var pulsarErr *pulsar.Error
+	if errors.As(err, &pulsarErr) {
+		switch pulsarErr.Result() {
+		case pulsar.ConnectError, pulsar.NotConnectedError, pulsar.LookupError:
+			return true
+		}
+	}
+	return false
+}
+
+// sendToCluster sends data to a Pulsar producer of the cluster with the retries of the retryable send errors
+func sendToCluster(url, token, topic string, data []byte, opts SendOptions, async bool, reconnect bool, retried int) (pulsar.MessageID, error) {
+	p, err := GetPulsarProducer(url, token, topic, opts.Producer, reconnect)
+	if err == ErrPulsarTimeout {
+		log.Errorf("Failed to create Pulsar producer in time err: %v", err)
+		return nil, err
+	} else if err != nil {
 		log.Errorf("Failed to create Pulsar produce err: %v", err)
-		return errors.New("Failed to create Pulsar producer")
+		return nil, producerUnavailable(err)
 	}
 
 	ctx := context.Background()
 
-	id, err := util.NewUUID()
-	if err != nil {
-		// this is very bad if happens
-		log.Warnf("NewUUID generation error %v", err)
-		id = strconv.FormatInt(time.Now().Unix(), 10)
+	prop := map[string]string{"PulsarBeamId": beamID()}
+	for name, value := range opts.Properties {
+		prop[name] = value
 	}
-	prop := map[string]string{"PulsarBeamId": id}
 	//TODO: add cluster origin and maybe other properties
 
+	eventTime := opts.EventTime
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+
+	if async && retried == 0 {
+		// the caller reuses the buffer once it returns, the asynchronous send and retries require a copy
+		data = append([]byte(nil), data...)
+	}
+
 	message := pulsar.ProducerMessage{
-		Payload:    data,
-		EventTime:  time.Now(),
-		Properties: prop,
+		Payload:      data,
+		Key:          opts.Key,
+		OrderingKey:  opts.OrderingKey,
+		EventTime:    eventTime,
+		Properties:   prop,
+		DeliverAfter: opts.DeliverAfter,
+		DeliverAt:    opts.DeliverAt,
+		SequenceID:   opts.SequenceID,
 	}
 
 	if async {
 		p.SendAsync(ctx, &message, func(messageId pulsar.MessageID, msg *pulsar.ProducerMessage, err error) {
 			if err != nil {
 				log.Warnf("send to Pulsar err %v", err)
-				var pulsarErr *pulsar.Error
-				if errors.As(err, &pulsarErr) {
-					// Do reconnect and re-send if producer was closed
-					if pulsarErr.Result() == pulsar.ProducerClosed {
-						if retried < producerSendRetryLimit {
-							log.Warnf("retry sending to Pulsar due to %v", err)
-							SendToPulsar(url, token, topic, data, async, true, retried+1)
+				if retry, reconnect := retryableSendError(err); retry && retried < util.GetConfig().ProducerSendRetryLimit {
+					// do not block the producer's callback
+					go func() {
+						time.Sleep(RetryBackoff(retried))
+						log.Warnf("retry sending to Pulsar due to %v", err)
+						if _, err := sendToCluster(url, token, topic, data, opts, async, reconnect, retried+1); err != nil && opts.OnAsyncError != nil {
+							opts.OnAsyncError(err)
 						}
-					}
+					}()
+					return
+				}
+				if opts.OnAsyncError != nil {
+					opts.OnAsyncError(err)
 				}
-				// TODO: push to a queue for retry
 			}
 		})
-		return nil
+		return nil, nil
 	}
-	_, err = p.Send(ctx, &message)
+	id, err := p.Send(ctx, &message)
 	if err != nil {
 		log.Warnf("send to Pulsar err %v", err)
-		var pulsarErr *pulsar.Error
-		if errors.As(err, &pulsarErr) {
-			if pulsarErr.Result() == pulsar.ProducerClosed {
-				// Do reconnect and re-send if producer was closed
-				if retried < producerSendRetryLimit {
-					log.Warnf("retry sending to Pulsar due to %v", err)
-					return SendToPulsar(url, token, topic, data, async, true, retried+1)
-				}
-			}
+		if retry, reconnect := retryableSendError(err); retry && retried < util.GetConfig().ProducerSendRetryLimit {
+			time.Sleep(RetryBackoff(retried))
+			log.Warnf("retry sending to Pulsar due to %v", err)
+			return sendToCluster(url, token, topic, data, opts, async, reconnect, retried+1)
+		}
+	}
+
+	return id, err
+}
+
+// retryableSendError returns whether a send error is retryable and requires the producer to reconnect
+func retryableSendError(err error) (retry, reconnect bool) {
+	var pulsarErr *pulsar.Error
+	if errors.As(err, &pulsarErr) {
+		return RetryableResult(pulsarErr.Result())
+	}
+	return false, false
+}
+
+// RetryableResult returns whether a Pulsar result is transient so that the send can be retried,
+// and whether the producer has to reconnect before the retry.
+func RetryableResult(result pulsar.Result) (retry, reconnect bool) {
+	switch result {
+	case pulsar.ProducerClosed, pulsar.AlreadyClosedError, pulsar.NotConnectedError:
+		return true, true
+	case pulsar.TimeoutError, pulsar.LookupError, pulsar.ConnectError, pulsar.ReadError,
+		pulsar.ServiceUnitNotReady, pulsar.TooManyLookupRequestException, pulsar.ProducerQueueIsFull,
+		pulsar.BrokerPersistenceError, pulsar.BrokerMetadataError:
+		return true, false
+	default:
+		return false, false
+	}
+}
+
+// RetryBackoff returns the exponential backoff before the next retry, it is capped at 5 seconds
+func RetryBackoff(retried int) time.Duration {
+	backoff, err := time.ParseDuration(util.GetConfig().ProducerRetryBackoff)
+	if err != nil || backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := 0; i < retried && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// SendBatchToPulsar sends messages asynchronously so that the producer batches them,
+// then flushes the producer and waits for the broker to acknowledge every message.
+// The message IDs and errors are returned in the order of the messages.
+func SendBatchToPulsar(url, token, topic string, messages []*pulsar.ProducerMessage, cfg ProducerConfig) ([]pulsar.MessageID, []error, error) {
+	p, err := GetPulsarProducer(url, token, topic, cfg, false)
+	if err == ErrPulsarTimeout {
+		log.Errorf("Failed to create Pulsar producer in time err: %v", err)
+		return nil, nil, err
+	} else if err != nil {
+		log.Errorf("Failed to create Pulsar produce err: %v", err)
+		return nil, nil, producerUnavailable(err)
+	}
+
+	ids := make([]pulsar.MessageID, len(messages))
+	errs := make([]error, len(messages))
+	var wg sync.WaitGroup
+	wg.Add(len(messages))
+	ctx := context.Background()
+	for i, message := range messages {
+		if message.Properties == nil {
+			message.Properties = map[string]string{}
 		}
+		message.Properties["PulsarBeamId"] = beamID()
+		if message.EventTime.IsZero() {
+			message.EventTime = time.Now()
+		}
+
+		index := i
+		p.SendAsync(ctx, message, func(id pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+			ids[index], errs[index] = id, err
+			wg.Done()
+		})
 	}
+	if err = p.Flush(); err != nil {
+		log.Warnf("flush Pulsar producer err %v", err)
+	}
+	wg.Wait()
+
+	return ids, errs, nil
+}
 
-	return err
+// beamID generates an unique ID for the PulsarBeamId message property
+func beamID() string {
+	id, err := util.NewUUID()
+	if err != nil {
+		// this is very bad if happens
+		log.Warnf("NewUUID generation error %v", err)
+		id = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	return id
 }
 
 // GetProducer acquires a new pulsar producer
@@ -146,15 +465,24 @@ func (c *PulsarProducer) GetProducer() (pulsar.Producer, error) {
 	if err != nil {
 		return nil, err
 	}
-	p, err := driver.CreateProducer(pulsar.ProducerOptions{
-		Topic: c.topic,
-	})
+	opts := pulsar.ProducerOptions{
+		Topic:                   c.topic,
+		CompressionType:         c.cfg.Compression,
+		BatchingMaxMessages:     c.cfg.BatchingMaxMessages,
+		BatchingMaxSize:         c.cfg.BatchingMaxSize,
+		BatchingMaxPublishDelay: c.cfg.BatchingMaxPublishDelay,
+		Name:                    c.cfg.Name,
+	}
+	if c.cfg.KeyBasedBatching {
+		opts.BatcherBuilderType = pulsar.KeyBasedBatchBuilder
+	}
+	p, err := CreateWithTimeout(func() (Closer, error) { return driver.CreateProducer(opts) })
 	if err != nil {
 		return nil, err
 	}
 
-	c.producer = p
-	return p, nil
+	c.producer = p.(pulsar.Producer)
+	return c.producer, nil
 }
 
 // UpdateTime updates all time stamps in the object
@@ -172,6 +500,19 @@ func (c *PulsarProducer) Close() {
 	}
 }
 
+// FlushAndClose flushes the pending messages of the producer before it is closed
+func (c *PulsarProducer) FlushAndClose() {
+	c.Lock()
+	defer c.Unlock()
+	if c.producer != nil {
+		if err := c.producer.Flush(); err != nil {
+			log.Errorf("failed to flush producer on topic %s error %v", c.topic, err)
+		}
+		c.producer.Close()
+		c.producer = nil
+	}
+}
+
 // Reconnect closes the current connection and reconnects again
 func (c *PulsarProducer) Reconnect() (pulsar.Producer, error) {
 	c.Close()
@@ -0,0 +1,53 @@
+package route
+
+import (
+	"strings"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// TopicSubjects returns the subjects allowed on a topic by the AllowedSubjects of its topic configs
+type TopicSubjects func(topicFN string) []string
+
+// AllowedTopicSubjects grants the subjects access to a topic in VerifySubjectBasedOnTopic beyond the tenant,
+// only the subjects of the tenant are allowed if it is nil
+var AllowedTopicSubjects TopicSubjects
+
+// NewTopicSubjects returns a TopicSubjects backed by the topic configs. The allowed subjects
+// of the topic configs on every allowed cluster are combined.
+func NewTopicSubjects(lookup TopicConfigLookup) TopicSubjects {
+	return func(topicFN string) []string {
+		var subjects []string
+		for _, cluster := range util.AllowedPulsarURLs {
+			if cluster == "" {
+				continue
+			}
+			key, err := model.GetKeyFromNames(topicFN, cluster)
+			if err != nil {
+				continue
+			}
+			if doc := lookup(key); doc != nil {
+				subjects = append(subjects, doc.AllowedSubjects...)
+			}
+		}
+		return subjects
+	}
+}
+
+// isAllowedTopicSubject returns true if any of the token subjects is allowed on the topic by its topic configs
+func isAllowedTopicSubject(topicFN, tokenSubjects string) bool {
+	if AllowedTopicSubjects == nil {
+		return false
+	}
+	allowed := AllowedTopicSubjects(topicFN)
+	if len(allowed) == 0 {
+		return false
+	}
+	for _, subject := range strings.Split(tokenSubjects, ",") {
+		if subject != "" && util.StrContains(allowed, subject) {
+			return true
+		}
+	}
+	return false
+}
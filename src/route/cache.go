@@ -0,0 +1,41 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/broker"
+	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// FlushCacheResponse is the number of cache entries evicted by the flush cache endpoint
+type FlushCacheResponse struct {
+	Producers int `json:"producers"`
+	Consumers int `json:"consumers"`
+}
+
+// FlushCacheHandler closes and evicts the cached producers and poll consumers, so that the stale
+// connections after a broker maintenance are recreated without restarting beam. Only super roles are allowed.
+func FlushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSuperUser(r) {
+		util.ResponseErrorJSON(errors.New("only super roles can flush the cache"), w, http.StatusForbidden)
+		return
+	}
+
+	resp := FlushCacheResponse{
+		Producers: pulsardriver.FlushProducers(),
+		Consumers: broker.FlushPollConsumers(),
+	}
+	log.Warnf("flushed %d cached producers and %d cached poll consumers", resp.Producers, resp.Consumers)
+
+	resJSON, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(resJSON)
+}
@@ -1,19 +1,30 @@
 package route
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"compress/flate"
 	"compress/gzip"
 
+	"github.com/andybalholm/brotli"
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/kafkaesque-io/pulsar-beam/src/broker"
 	"github.com/kafkaesque-io/pulsar-beam/src/db"
+	"github.com/kafkaesque-io/pulsar-beam/src/middleware"
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
 	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
 	"github.com/kafkaesque-io/pulsar-beam/src/util"
@@ -25,36 +36,269 @@ var singleDb db.Db
 
 const subDelimiter = "-"
 
-// 5MB + 1 byte buffer (default Pulsar message size limit is 5MB https://pulsar.apache.org/docs/concepts-messaging/)
-const workerBufferSize = 5242881
+var workerPool chan func(buffer *[]byte)
 
-var workerPool chan func(buffer []byte)
+// initialReceiveBufferSize is the size of a new receive buffer, it grows on demand up to MaxMessageSize
+const initialReceiveBufferSize = 32 * 1024
+
+// receiveBuffers are the message buffers shared by the workers, so that a worker of a small message
+// does not reserve a buffer of MaxMessageSize
+var receiveBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, initialReceiveBufferSize)
+		return &buffer
+	},
+}
+
+// workerPoolLock guards workerPool from being closed while a job is queued
+var workerPoolLock sync.RWMutex
+var workerPoolClosed bool
+var workerWg sync.WaitGroup
+
+// CheckProducer creates and closes a producer for a dry-run publish with dryRunProducer=true
+var CheckProducer = pulsardriver.CheckProducer
+
+// the maximum time in milliseconds a long poll waits for the first message
+const maxPollWaitMs = 30000
+
+// the maximum pollDeadlineMs of a poll
+const maxPollDeadlineMs = 60000
+
+// the heartbeat interval in milliseconds of a SSE stream without messages, shorter than the common proxy idle timeouts
+const (
+	defaultHeartbeatMs = 15000
+	minHeartbeatMs     = 1000
+	maxHeartbeatMs     = 300000
+)
+
+// the maximum number of messages a consumer prefetches, every consumer buffers up to the number of messages in memory
+const maxReceiverQueueSize = 10000
+
+// the default and maximum page size of the topic list
+const (
+	defaultTopicListLimit = 20
+	maxTopicListLimit     = 100
+)
+
+// maxTopicImportSize is the maximum number of topic configs in an import request
+const maxTopicImportSize = 1000
+
+// wsUpgrader upgrades a HTTP connection to WebSocket, a browser origin must be allowed by CORSAllowedOrigins
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || util.IsAllowedOrigin(origin)
+	},
+}
 
 // Init initializes database
 func Init() {
 	singleDb = db.NewDbWithPanic(util.GetConfig().PbDbType)
-	
-	log.Infof("Start worker pool with size = %d", util.GetConfig().WorkerPoolSize)
-	workerPool = make(chan func(buffer []byte), util.GetConfig().WorkerPoolSize)
-	
+	middleware.TokenRevoked = NewRevocationChecker(singleDb, revocationCheckTTL)
+	middleware.TenantAllowed = func(tenant, subjects string) bool { return VerifySubject(tenant, subjects, ExtractEvalTenant) }
+	topicConfigs := NewTopicConfigLookup(singleDb, topicConfigCheckTTL)
+	ValidatePayload = NewSchemaValidator(topicConfigs)
+	RouteTopic = NewTopicRouter(topicConfigs)
+	AllowedTopicSubjects = NewTopicSubjects(topicConfigs)
+	InitWorkerPool(util.GetConfig().WorkerPoolSize)
+	broker.StartNonResumableJanitor()
+	db.StartTopicExpirySweeper(singleDb)
+}
+
+// InitWorkerPool starts the receiver worker pool
+func InitWorkerPool(size int) {
+	log.Infof("Start worker pool with size = %d", size)
+	workerPoolLock.Lock()
+	defer workerPoolLock.Unlock()
+	if workerPool != nil && !workerPoolClosed {
+		// the workers of the previous pool exit after the queued jobs are done
+		close(workerPool)
+	}
+	workerPool = make(chan func(buffer *[]byte), size)
+	workerPoolClosed = false
+
 	// Start a number of goroutine as worker pool
-	for i := 0; i < util.GetConfig().WorkerPoolSize; i++ {
-		go func() {
-			var buffer [workerBufferSize]byte
-			for f := range workerPool {
-				f(buffer[:])
+	for i := 0; i < size; i++ {
+		workerWg.Add(1)
+		go func(jobs chan func(buffer *[]byte)) {
+			defer workerWg.Done()
+			for f := range jobs {
+				// a job may grow the buffer, the grown buffer is returned to the pool
+				buffer := receiveBuffers.Get().(*[]byte)
+				f(buffer)
+				receiveBuffers.Put(buffer)
 			}
-		}()
+		}(workerPool)
+	}
+}
+
+// GrowBuffer returns a buffer with the first n bytes of the buffer and a length of at least size,
+// the length is at least doubled to amortize the copies but never exceeds max.
+func GrowBuffer(buffer []byte, n, size, max int) []byte {
+	if size > max {
+		size = max
+	}
+	if size <= len(buffer) {
+		return buffer
+	}
+	if double := 2 * len(buffer); size < double {
+		size = double
+		if size > max {
+			size = max
+		}
+	}
+	grown := make([]byte, size)
+	copy(grown, buffer[:n])
+	return grown
+}
+
+// MaxMessageSize returns the configured message size limit of the receiver
+func MaxMessageSize() int {
+	if size := util.GetConfig().MaxMessageSize; size > 0 {
+		return size
+	}
+	return util.DefaultMaxMessageSize
+}
+
+// maxDecompressedSize returns the configured size limit of a decompressed request body
+func maxDecompressedSize() int {
+	if size := util.GetConfig().MaxDecompressedSize; size > 0 && size < MaxMessageSize() {
+		return size
+	}
+	return MaxMessageSize()
+}
+
+// maxCompressionRatio returns the configured compression ratio limit of a request body
+func maxCompressionRatio() int {
+	if ratio := util.GetConfig().MaxCompressionRatio; ratio > 0 {
+		return ratio
+	}
+	return util.DefaultMaxCompressionRatio
+}
+
+// maxMessageProperties returns the configured limit of the number of properties of a message
+func maxMessageProperties() int {
+	if count := util.GetConfig().MaxMessageProperties; count > 0 {
+		return count
+	}
+	return util.DefaultMaxMessageProperties
+}
+
+// maxPropertiesBytes returns the configured limit of the total size of the properties of a message
+func maxPropertiesBytes() int {
+	if size := util.GetConfig().MaxPropertiesBytes; size > 0 {
+		return size
+	}
+	return util.DefaultMaxPropertiesBytes
+}
+
+// CheckPropertyLimits returns an error if the number or the total byte size of the keys and values of
+// the properties exceeds the limits. The included headers are checked with the same limits.
+func CheckPropertyLimits(count, size int) error {
+	if limit := maxMessageProperties(); count > limit {
+		return fmt.Errorf("%d properties exceed the maximum of %d", count, limit)
+	}
+	if limit := maxPropertiesBytes(); size > limit {
+		return fmt.Errorf("properties of %d bytes exceed the maximum of %d bytes", size, limit)
+	}
+	return nil
+}
+
+// PropertiesSize returns the number and the total byte size of the keys and values of the properties
+func PropertiesSize(props map[string]string) (count, size int) {
+	for key, value := range props {
+		size += len(key) + len(value)
+	}
+	return len(props), size
+}
+
+// HeadersSize returns the number and the total byte size of the names and values of the headers
+// as they are written by AppendHeaders
+func HeadersSize(h http.Header, join bool) (count, size int) {
+	for name, values := range h {
+		size += len(name) + len(values[0])
+		if join {
+			size += len(strings.Join(values, ", ")) - len(values[0])
+		}
+	}
+	return len(h), size
+}
+
+// pollMaxBatchSize returns the configured maximum batchSize of a poll
+func pollMaxBatchSize() int {
+	if size := util.GetConfig().PollMaxBatchSize; size > 0 {
+		return size
+	}
+	return util.DefaultPollMaxBatchSize
+}
+
+// subscriptionNameMinLength returns the configured minimum length of a client specified subscription name
+func subscriptionNameMinLength() int {
+	if length := util.GetConfig().SubscriptionNameMinLength; length > 0 {
+		return length
+	}
+	return util.DefaultSubscriptionNameMinLength
+}
+
+// pollMaxPerMessageTimeoutMs returns the configured maximum perMessageTimeoutMs of a poll
+func pollMaxPerMessageTimeoutMs() int {
+	if timeoutMs := util.GetConfig().PollMaxPerMessageTimeoutMs; timeoutMs > 0 {
+		return timeoutMs
+	}
+	return util.DefaultPollMaxPerMessageTimeoutMs
+}
+
+// replayMaxMessages returns the configured maximum number of messages of a replay
+func replayMaxMessages() int {
+	if size := util.GetConfig().ReplayMaxMessages; size > 0 {
+		return size
 	}
+	return util.DefaultReplayMaxMessages
+}
+
+// replayMaxBytes returns the configured maximum total payload bytes of a replay
+func replayMaxBytes() int {
+	if size := util.GetConfig().ReplayMaxBytes; size > 0 {
+		return size
+	}
+	return util.DefaultReplayMaxBytes
+}
+
+// Shutdown stops the worker pool from accepting new messages and waits for
+// the queued and in-flight messages to be processed.
+func Shutdown() {
+	workerPoolLock.Lock()
+	if workerPool != nil && !workerPoolClosed {
+		workerPoolClosed = true
+		close(workerPool)
+	}
+	workerPoolLock.Unlock()
+	workerWg.Wait()
+}
+
+// submitWork queues a job to the worker pool, it returns false if the worker pool is shut down
+func submitWork(job func(buffer *[]byte)) bool {
+	workerPoolLock.RLock()
+	defer workerPoolLock.RUnlock()
+	if workerPoolClosed {
+		return false
+	}
+	workerPool <- job
+	return true
 }
 
 // TokenServerResponse is the json object for token server response
 type TokenServerResponse struct {
 	Subject string `json:"subject"`
 	Token   string `json:"token"`
+	// ExpiresAt is the token expiration in Unix epoch seconds, it is omitted if the token never expires
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 // TokenSubjectHandler issues new token
+// The exp query parameter is the token's validity duration, i.e. `24h`, default to TokenDefaultExpiry.
 func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	subject, ok := vars["sub"]
@@ -64,14 +308,23 @@ func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if util.StrContains(util.SuperRoles, util.AssignString(r.Header.Get("injectedSubs"), "BOGUSROLE")) {
-		tokenString, err := util.JWTAuth.GenerateToken(subject)
+		expiry, err := TokenExpiry(r.URL.Query())
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		tokenString, expiresAt, err := util.JWTAuth.GenerateTokenWithExpiry(subject, expiry)
 		if err != nil {
 			util.ResponseErrorJSON(errors.New("failed to generate token"), w, http.StatusInternalServerError)
 		} else {
-			respJSON, err := json.Marshal(&TokenServerResponse{
+			resp := TokenServerResponse{
 				Subject: subject,
 				Token:   tokenString,
-			})
+			}
+			if !expiresAt.IsZero() {
+				resp.ExpiresAt = expiresAt.Unix()
+			}
+			respJSON, err := json.Marshal(&resp)
 			if err != nil {
 				util.ResponseErrorJSON(errors.New("failed to marshal token response json object"), w, http.StatusInternalServerError)
 				return
@@ -84,22 +337,129 @@ func TokenSubjectHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// TokenExpiry returns the token validity duration from the exp query parameter or TokenDefaultExpiry.
+// A zero duration means the token never expires.
+func TokenExpiry(params url.Values) (time.Duration, error) {
+	exp := util.AssignString(params.Get("exp"), util.GetConfig().TokenDefaultExpiry)
+	if exp == "" {
+		return 0, nil
+	}
+	expiry, err := time.ParseDuration(exp)
+	if err != nil || expiry < 0 {
+		return 0, fmt.Errorf("invalid token expiry %s", exp)
+	}
+	return expiry, nil
+}
+
 // StatusPage replies with basic status code
 func StatusPage(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
+// HealthResponse is the json object for the health check response
+type HealthResponse struct {
+	Db     string `json:"db"`
+	Pulsar string `json:"pulsar"`
+}
+
+// healthCheckTimeout is the time out of each dependency check
+const healthCheckTimeout = 5 * time.Second
+
+// HealthHandler verifies the connectivity to the database and the first allowed Pulsar cluster
+// It replies 503 with the failed dependencies; StatusPage still replies 200 unconditionally.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	healthy := true
+	resp := HealthResponse{Db: "ok", Pulsar: "ok"}
+
+	if singleDb == nil || !singleDb.Health() {
+		healthy = false
+		resp.Db = "database is not reachable"
+	}
+
+	if len(util.AllowedPulsarURLs) == 0 || util.AllowedPulsarURLs[0] == "" {
+		resp.Pulsar = "skipped, no Pulsar cluster is configured"
+	} else {
+		topic := util.AssignString(util.GetConfig().HealthCheckTopic, "persistent://public/default/pulsar-beam-health")
+		err := pulsardriver.CheckPulsarConnectivity(util.AllowedPulsarURLs[0],
+			util.ClusterToken(util.AllowedPulsarURLs[0], util.GetConfig().HealthCheckToken), topic, healthCheckTimeout)
+		if err != nil {
+			healthy = false
+			resp.Pulsar = err.Error()
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
+
 // ReceiveHandler - the message receiver handler
 func ReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	// the pinned Pulsar client has no producer chunking, so a message larger than the limit cannot be sent
+	if util.StringToBool(r.URL.Query().Get("chunking")) {
+		util.ResponseErrorJSON(errors.New("chunking is not supported until the Pulsar client is upgraded"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	// reject an oversized uncompressed body before it is read, the limit applies to the decoded body so that
+	// a compressed or chunked request is checked while it is read
+	if maxSize := MaxMessageSize(); r.ContentLength > int64(maxSize) && isIdentityEncoding(r.Header.Get("Content-Encoding")) {
+		util.ResponseErrorJSON(fmt.Errorf("message exceeds the maximum size of %d bytes", maxSize), w, http.StatusRequestEntityTooLarge)
+		return
+	}
 	done := make(chan bool)
-	workerPool <- func(buffer []byte) {
+	accepted := submitWork(func(pooled *[]byte) {
+		buffer := *pooled
 		var b []byte = buffer[:0]
 		var err error
 		var bufferSize int = 0
+		// one more byte than the message size limit to detect an overflow
+		bufferLimit := MaxMessageSize() + 1
 		
 		defer r.Body.Close()
 		defer func() { done <- true }()
+
+		// operator configured defaults for the query parameters absent in the request
+		if len(util.ReceiverQueryDefaults) > 0 {
+			r.URL.RawQuery = util.ApplyQueryDefaults(r.URL.Query(), util.ReceiverQueryDefaults).Encode()
+		}
+
+		// debug=true replies with a trace of the publish resolution steps, it is only allowed for super users
+		var trace *model.PublishTrace
+		if util.StringToBool(r.URL.Query().Get("debug")) {
+			if !isSuperUser(r) {
+				util.ResponseErrorJSON(errors.New("debug trace requires a super user subject"), w, http.StatusForbidden)
+				return
+			}
+			trace = &model.PublishTrace{}
+		}
+		replyError := func(err error, statusCode int) {
+			if trace != nil {
+				trace.Error = err.Error()
+				writePublishTrace(trace, w, statusCode)
+				return
+			}
+			util.ResponseErrorJSON(err, w, statusCode)
+		}
+		// a failed produce is replied with the machine-readable code of the Pulsar error
+		replyProduceError := func(code pulsardriver.ProduceErrorCode, err error, statusCode int) {
+			if trace != nil {
+				trace.Code = string(code)
+				trace.Error = err.Error()
+				writePublishTrace(trace, w, statusCode)
+				return
+			}
+			util.ResponseErrorCodeJSON(string(code), err, w, statusCode)
+		}
         
         // Include request line (GET /uri HTTP/1.1) into the message payload if url has includeRequestLine=true
 		includeRequestLine, isIncludeRequestLine := r.URL.Query()["includeRequestLine"]
@@ -112,182 +472,1978 @@ func ReceiveHandler(w http.ResponseWriter, r *http.Request) {
 		includeHeaders, isIncludeHeaders := r.URL.Query()["includeHeaders"]
 		
 		if isIncludeHeaders && includeHeaders[0] != "false"  {
-			for name, values := range r.Header {
-				b = append(append(append(append(b, name...), ": "...), values[0]...), "\r\n"...)
+			// joinHeaderValues=true keeps all values of a multi-valued header, otherwise only the first value
+			join := util.StringToBool(r.URL.Query().Get("joinHeaderValues"))
+			if err := CheckPropertyLimits(HeadersSize(r.Header, join)); err != nil {
+				replyError(fmt.Errorf("included headers: %v", err), http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			b = AppendHeaders(b, r.Header, join)
+		}
+        
+        // Append header delimiter (\r\n\r\n) and adjust the buffer size
+        if isIncludeRequestLine || isIncludeHeaders {
+            b = append(b, "\r\n\r\n"...)
+            bufferSize = len(b)
+        }
+		
+		trace.Add("header", "includeRequestLine=%t includeHeaders=%t", isIncludeRequestLine, isIncludeHeaders)
+		trace.Add("decode", "Content-Encoding=%q", r.Header.Get("Content-Encoding"))
+		body, err := LimitedContentDecoder(r.Header.Get("Content-Encoding"), r.Body, maxDecompressedSize(), maxCompressionRatio())
+		if errors.Is(err, ErrUnsupportedEncoding) {
+			replyError(err, http.StatusUnsupportedMediaType)
+			return
+		} else if errors.Is(err, ErrInvalidBody) {
+			replyError(err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			replyError(err, http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		// the prepended request line and headers may have outgrown the buffer
+		if bufferSize >= bufferLimit {
+			replyError(fmt.Errorf("message exceeds the maximum size of %d bytes", bufferLimit-1), http.StatusRequestEntityTooLarge)
+			return
+		}
+		buffer = b[:cap(b)]
+		if len(buffer) > bufferLimit {
+			// a pooled buffer may be larger than the limit if the limit has changed
+			buffer = buffer[:bufferLimit]
+		}
+		if r.ContentLength > 0 {
+			// reserve the known body size upfront, a compressed body grows further on demand
+			buffer = GrowBuffer(buffer, bufferSize, bufferSize+int(r.ContentLength)+1, bufferLimit)
+		}
+		defer func() { *pooled = buffer }()
+
+		// the buffer overflow guard applies to the decoded body regardless of the content encoding
+		bodyStart := bufferSize
+		var n int
+		for {
+			if bufferSize == len(buffer) {
+				buffer = GrowBuffer(buffer, bufferSize, bufferSize+1, bufferLimit)
+			}
+			n, err = body.Read(buffer[bufferSize:])
+			bufferSize += n
+			if err == io.EOF {
+				break
+			} else if errors.Is(err, ErrDecompressionLimit) {
+				trace.Add("decode", "aborted after %d decompressed bytes", bufferSize-bodyStart)
+				replyError(err, http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				// corrupted compressed data is a client error
+				if err = InvalidBodyError(r.Header.Get("Content-Encoding"), err); errors.Is(err, ErrInvalidBody) {
+					replyError(err, http.StatusBadRequest)
+				} else {
+					replyError(err, http.StatusInternalServerError)
+				}
+				return
+			} else if bufferSize >= bufferLimit {
+				// the fallback of the Content-Length check for a compressed or chunked request
+				replyError(fmt.Errorf("message exceeds the maximum size of %d bytes", bufferLimit-1), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		
+		b = buffer[:bufferSize]
+
+		// decode=base64 decodes the decompressed body, but not the included request line and headers
+		if decode := r.URL.Query().Get("decode"); decode != "" {
+			payload, err := DecodePayload(decode, b[bodyStart:])
+			if err != nil {
+				replyError(err, http.StatusUnprocessableEntity)
+				return
+			}
+			b = append(b[:bodyStart], payload...)
+			bufferSize = len(b)
+			trace.Add("decode", "%s payload decoded to %d bytes", decode, bufferSize-bodyStart)
+		}
+		RequestLog(r).Debugf("Message buffer (size = %d): %s", bufferSize, b);
+		trace.Add("body", "message size %d bytes", bufferSize)
+		
+		token, topic, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+		if err != nil {
+			trace.Add("cluster", "pulsar URL rejected by allowed clusters %v", util.AllowedPulsarURLs)
+			replyError(err, http.StatusUnauthorized)
+			return
+		}
+		trace.Add("cluster", "pulsar URL %s is allowed", pulsarURL)
+		
+		topicFN, err2 := GetTopicFnFromRoute(mux.Vars(r))
+		_, hasRouteTopic := mux.Vars(r)["topic"]
+		if defaultTopic := util.GetConfig().DefaultTopic; topic == "" && !hasRouteTopic && defaultTopic != "" {
+			// the configured default topic is only sent to by the subjects allowed on its tenant
+			if !VerifySubjectBasedOnTopic(defaultTopic, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+				trace.Add("topic", "default topic %s is not allowed for the subject", defaultTopic)
+				replyError(errors.New("the subject is not allowed on the default topic's tenant"), http.StatusForbidden)
+				return
+			}
+			if defaultURL := util.GetConfig().DefaultTopicPulsarURL; defaultURL != "" && r.Header.Get("PulsarUrl") == "" {
+				pulsarURL = defaultURL
+			}
+			topicFN, err2 = defaultTopic, nil
+			trace.Add("topic", "%s is the default topic", defaultTopic)
+		}
+		if topic == "" && err2 != nil {
+			// only read topic from routes
+			replyError(err2, http.StatusUnprocessableEntity)
+			return
+		}
+		if topic != "" {
+			// a TopicFn header is validated before any Pulsar call
+			if topic, err = util.NormalizeTopicFn(topic); err != nil {
+				trace.Add("topic", "invalid TopicFn header")
+				replyError(err, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		topicFN = util.AssignString(topic, topicFN) // header topicFn overwrites topic specified in the routes
+		if topic != "" {
+			trace.Add("topic", "%s from TopicFn header", topicFN)
+		} else if hasRouteTopic {
+			trace.Add("topic", "%s from route", topicFN)
+		}
+		if routed := routedTopic(topicFN, pulsarURL, r.Header); routed != topicFN {
+			trace.Add("topic", "%s by the routing rules of %s", routed, topicFN)
+			topicFN = routed
+		}
+		// the cluster token only stands in for a missing request token of a subject verified on the topic,
+		// never for an unauthenticated request of /v1/firehose
+		if token == "" && VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+			token = util.ClusterToken(pulsarURL, token)
+		}
+		RequestLog(r).Infof("topicFN %s pulsarURL %s", topicFN, pulsarURL)
+		tenant := util.TopicTenant(topicFN)
+		// dryRun=true validates the request without sending the message, it is not counted as a received message
+		dryRun := util.StringToBool(r.URL.Query().Get("dryRun"))
+		if !dryRun {
+			util.ReceivedMessages.WithLabelValues(tenant).Inc()
+			util.ReceivedBytes.WithLabelValues(tenant).Add(float64(bufferSize))
+		}
+
+		// message key for partition routing, the header takes precedence over the query parameter
+		key := util.AssignString(r.Header.Get("X-Pulsar-Key"), r.URL.Query().Get("key"))
+		// ordering key for the Key_Shared dispatch, independent of the partition routing key
+		orderingKey := util.AssignString(r.Header.Get("X-Pulsar-Ordering-Key"), r.URL.Query().Get("orderingKey"))
+
+		// producer compression codec, the header takes precedence over the query parameter
+		codec := util.AssignString(r.Header.Get("X-Pulsar-Compression"), r.URL.Query().Get("compression"))
+		compression, err := model.GetCompressionType(codec)
+		if err != nil {
+			replyError(err, http.StatusUnprocessableEntity)
+			return
+		}
+		trace.Add("compression", "codec %q", codec)
+
+		deliverAfter, deliverAt, err := DeliveryParams(r.Header)
+		if err != nil {
+			replyError(err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		// the sequence id and a stable producer name enable the broker's message deduplication of a retried request
+		sequenceID, err := SequenceIDParam(r.Header)
+		if err != nil {
+			replyError(err, http.StatusUnprocessableEntity)
+			return
+		}
+		producerName := strings.TrimSpace(r.Header.Get("X-Pulsar-Producer-Name"))
+
+		// the request ID traces the message from the HTTP edge to the consumers
+		var props map[string]string
+		if requestID := RequestID(r.Context()); requestID != "" {
+			props = map[string]string{RequestIDProperty: requestID}
+		}
+		if status, err := checkMessage(r, topicFN, pulsarURL, b[bodyStart:], bufferSize, props); err != nil {
+			trace.Add("message", "rejected %v", err)
+			replyError(err, status)
+			return
+		}
+
+		// an invalid event time does not fail the message, the send time is used instead
+		eventTime, err := EventTimeParam(r.Header)
+		if err != nil {
+			RequestLog(r).Warnf("%v on topic %s, the send time is used as the event time", err, topicFN)
+		}
+
+		// requireExistingTopic=true rejects a topic that the cluster would otherwise create automatically
+		if util.StringToBool(r.URL.Query().Get("requireExistingTopic")) {
+			exists, err := pulsardriver.TopicExists(pulsarURL, token, topicFN)
+			switch {
+			case err == pulsardriver.ErrAdminNotAuthorized:
+				replyError(err, http.StatusForbidden)
+				return
+			case err != nil:
+				RequestLog(r).Errorf("failed to check the existence of topic %s error %v", topicFN, err)
+				replyError(err, http.StatusServiceUnavailable)
+				return
+			case !exists:
+				trace.Add("topic", "%s does not exist", topicFN)
+				replyError(fmt.Errorf("topic %s does not exist", topicFN), http.StatusNotFound)
+				return
+			}
+			trace.Add("topic", "%s exists", topicFN)
+		}
+
+		pulsarAsync := r.URL.Query().Get("mode") == "async"
+		trace.Add("message", "key=%q orderingKey=%q async=%t deliverAfter=%s deliverAt=%s eventTime=%s producerName=%q", key, orderingKey, pulsarAsync, deliverAfter, deliverAt, eventTime, producerName)
+		opts := pulsardriver.SendOptions{
+			Key:          key,
+			OrderingKey:  orderingKey,
+			DeliverAfter: deliverAfter,
+			DeliverAt:    deliverAt,
+			EventTime:    eventTime,
+			Properties:   props,
+			SequenceID:   sequenceID,
+			Producer: pulsardriver.ProducerConfig{
+				Name:        producerName,
+				Compression: compression,
+				// messages with different ordering keys must not share a batch for the Key_Shared dispatch
+				KeyBasedBatching: orderingKey != "",
+			},
+		}
+		// ackCallbackTopic receives an error event for an async send that fails after the reply
+		if callbackTopic := strings.TrimSpace(r.URL.Query().Get("ackCallbackTopic")); callbackTopic != "" {
+			if err := ValidateAckCallbackTopic(callbackTopic, topicFN, pulsarAsync); err != nil {
+				replyError(err, http.StatusUnprocessableEntity)
+				return
+			}
+			trace.Add("callback", "async errors are published to %s", callbackTopic)
+			opts.OnAsyncError = AsyncErrorPublisher(pulsarURL, token, callbackTopic, topicFN, RequestID(r.Context()))
+		}
+		if dryRun {
+			result := model.DryRunResult{Topic: topicFN, Cluster: pulsarURL, Size: bufferSize}
+			// dryRunProducer=true also verifies the connectivity and authorization with a producer on the cluster
+			if util.StringToBool(r.URL.Query().Get("dryRunProducer")) {
+				if err := CheckProducer(pulsarURL, token, topicFN); err != nil {
+					code, status := pulsardriver.ClassifyProduceError(err, http.StatusServiceUnavailable)
+					replyProduceError(code, err, status)
+					return
+				}
+				result.ProducerChecked = true
+			}
+			trace.Add("dryrun", "not sent to %s on %s, producer checked %t", topicFN, pulsarURL, result.ProducerChecked)
+			if trace != nil {
+				writePublishTrace(trace, w, http.StatusOK)
+				return
+			}
+			writeDryRunResult(&result, w)
+			return
+		}
+		msgID, err := pulsardriver.SendToPulsar(pulsarURL, token, topicFN, b, opts, pulsarAsync, false, 0)
+		if err != nil {
+			util.ProduceErrors.WithLabelValues(tenant).Inc()
+			code, status := pulsardriver.ClassifyProduceError(err, http.StatusServiceUnavailable)
+			ProduceLog(r, topicFN, bufferSize, pulsarAsync, status).WithError(err).WithField("code", code).Warn("produce")
+			replyProduceError(code, err, status)
+			return
+		}
+		ProduceLog(r, topicFN, bufferSize, pulsarAsync, http.StatusOK).Info("produce")
+		if msgID != nil {
+			// the message ID of the cluster accepting the message, in the same format as the SSE event ID
+			w.Header().Set("X-Pulsar-Message-Id", model.FormatMessageID(msgID))
+		}
+		// a best effort event for the produce event streams of the tenant
+		event := model.ProduceEvent{Topic: topicFN, Size: bufferSize, Time: time.Now(), RequestID: RequestID(r.Context())}
+		if msgID != nil {
+			event.MessageID = model.FormatMessageID(msgID)
+		}
+		PublishProduceEvent(event)
+		if trace != nil {
+			trace.Add("publish", "sent to %s message id %v", topicFN, msgID)
+			writePublishTrace(trace, w, http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	})
+	if !accepted {
+		util.ResponseErrorJSON(errors.New("server is shutting down"), w, http.StatusServiceUnavailable)
+		return
+	}
+	<-done
+	return
+}
+
+// routedTopic returns the topic a message is sent to by the routing rules of the topic config on a header value,
+// or the topic itself if no rule matches. A target topic is in the tenant of the topic, which is checked again
+// in case of a stale config.
+func routedTopic(topicFN, pulsarURL string, h http.Header) string {
+	if RouteTopic == nil {
+		return topicFN
+	}
+	topicKey, err := model.GetKeyFromNames(topicFN, pulsarURL)
+	if err != nil {
+		return topicFN
+	}
+	if routed := RouteTopic(topicKey, h); routed != "" && util.TopicTenant(routed) == util.TopicTenant(topicFN) {
+		return routed
+	}
+	return topicFN
+}
+
+// checkMessage applies the per-message checks of the send and batch publish endpoints to a message of the
+// routed topic, the size limit, the property limits, and the topic's JSON schema unless a super user skips it
+// with skipSchemaValidation=true. size is the message size sent to Pulsar, which includes the request line and
+// headers prepended to the payload. It returns the status to reject the message with.
+func checkMessage(r *http.Request, topicFN, pulsarURL string, payload []byte, size int, props map[string]string) (int, error) {
+	if maxSize := MaxMessageSize(); size > maxSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("message exceeds the maximum size of %d bytes", maxSize)
+	}
+	if err := CheckPropertyLimits(PropertiesSize(props)); err != nil {
+		return http.StatusRequestHeaderFieldsTooLarge, err
+	}
+	skipValidation := util.StringToBool(r.URL.Query().Get("skipSchemaValidation")) && isSuperUser(r)
+	if ValidatePayload != nil && !skipValidation {
+		if topicKey, err := model.GetKeyFromNames(topicFN, pulsarURL); err == nil {
+			if errs := ValidatePayload(topicKey, payload); len(errs) > 0 {
+				return http.StatusUnprocessableEntity, fmt.Errorf("payload does not match the topic schema: %s", strings.Join(errs, "; "))
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// LastEventIDStart returns the message ID to seek a resumable subscription to for the Last-Event-ID header sent by
+// a reconnecting EventSource, which is just after the last event it received, in place of startTimestampMs.
+// It returns nil for the subscription to resume from its committed position. The header is ignored for a Shared
+// or KeyShared subscription, because a seek rewinds the cursor of every consumer on the subscription.
+func LastEventIDStart(r *http.Request, cfg model.ConsumerConfig) pulsar.MessageID {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" || cfg.IsNonResumable() || cfg.TopicsPattern != "" || len(cfg.Topics) > 0 {
+		return nil
+	}
+	if cfg.SubscriptionType != pulsar.Exclusive && cfg.SubscriptionType != pulsar.Failover {
+		RequestLog(r).Warnf("Last-Event-ID is ignored on the shared subscription %s", cfg.SubscriptionName)
+		return nil
+	}
+	id, err := broker.MessageIDAfter(lastEventID)
+	if err != nil {
+		RequestLog(r).Warnf("%v in Last-Event-ID, the subscription resumes from its normal position", err)
+		return nil
+	}
+	return id
+}
+
+// AppendHeaders appends the headers in the `name: value\r\n` format to b.
+// Multiple values of a header are joined comma separated per the HTTP spec if join is true,
+// otherwise only the first value is appended.
+func AppendHeaders(b []byte, h http.Header, join bool) []byte {
+	for name, values := range h {
+		value := values[0]
+		if join {
+			value = strings.Join(values, ", ")
+		}
+		b = append(append(append(append(b, name...), ": "...), value...), "\r\n"...)
+	}
+	return b
+}
+
+// DeliveryParams returns the delayed delivery specified by either the X-Pulsar-Deliver-After header
+// as a duration, i.e. 30s or 5m, or the X-Pulsar-Deliver-At header as a RFC3339 timestamp.
+func DeliveryParams(h http.Header) (deliverAfter time.Duration, deliverAt time.Time, err error) {
+	after, at := h.Get("X-Pulsar-Deliver-After"), h.Get("X-Pulsar-Deliver-At")
+	if after != "" && at != "" {
+		return 0, time.Time{}, errors.New("only one of X-Pulsar-Deliver-After and X-Pulsar-Deliver-At can be specified")
+	}
+	if after != "" {
+		deliverAfter, err = time.ParseDuration(after)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid X-Pulsar-Deliver-After %s", after)
+		}
+		if deliverAfter < 0 {
+			return 0, time.Time{}, fmt.Errorf("negative X-Pulsar-Deliver-After %s", after)
+		}
+	}
+	if at != "" {
+		deliverAt, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid RFC3339 X-Pulsar-Deliver-At %s", at)
+		}
+	}
+	return deliverAfter, deliverAt, nil
+}
+
+// SequenceIDParam returns the message sequence id in the X-Pulsar-Sequence-Id header as a non-negative integer.
+// It returns nil if the header is absent, so that the producer assigns the sequence id.
+func SequenceIDParam(h http.Header) (*int64, error) {
+	value := h.Get("X-Pulsar-Sequence-Id")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("invalid X-Pulsar-Sequence-Id %s, it must be a non-negative integer", value)
+	}
+	return &id, nil
+}
+
+// EventTimeParam returns the event time in the X-Pulsar-Event-Time header as either a RFC3339 timestamp
+// or a Unix epoch time in milliseconds. It returns the zero time if the header is absent.
+func EventTimeParam(h http.Header) (time.Time, error) {
+	value := h.Get("X-Pulsar-Event-Time")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	eventTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid X-Pulsar-Event-Time %s", value)
+	}
+	return eventTime, nil
+}
+
+// ErrUnsupportedEncoding is returned for a request body in an unsupported content encoding
+var ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// ErrInvalidBody is returned for a request body that cannot be decoded in its content encoding
+var ErrInvalidBody = errors.New("invalid")
+
+// ContentDecoder returns a reader decoding the body according to the Content-Encoding header.
+// gzip, deflate, and br are supported. The body is read as-is without a content encoding.
+func ContentDecoder(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip":
+		g, err := gzip.NewReader(body)
+		if err != nil {
+			// an empty body or a body without the gzip header
+			return nil, fmt.Errorf("%w gzip body: %v", ErrInvalidBody, err)
+		}
+		return g, nil
+	case "deflate":
+		return flate.NewReader(body), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedEncoding, encoding)
+	}
+}
+
+// ErrDecompressionLimit is returned when a compressed body exceeds the decompressed size or compression ratio limit
+var ErrDecompressionLimit = errors.New("decompressed body exceeds the limit")
+
+// compressionRatioMinSize is the decompressed size after which the compression ratio limit applies,
+// so that a small but highly compressible body is accepted
+const compressionRatioMinSize = 1024 * 1024
+
+// LimitedContentDecoder returns a ContentDecoder that fails a compressed body with ErrDecompressionLimit as
+// soon as its decompressed size exceeds maxSize, or its compression ratio exceeds maxRatio. The limits are
+// checked on every read so that a decompression bomb is aborted without decompressing it fully.
+func LimitedContentDecoder(encoding string, body io.Reader, maxSize, maxRatio int) (io.ReadCloser, error) {
+	if isIdentityEncoding(encoding) {
+		return ContentDecoder(encoding, body)
+	}
+	compressed := &countingReader{reader: body}
+	decoder, err := ContentDecoder(encoding, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressionLimiter{ReadCloser: decoder, compressed: compressed, maxSize: int64(maxSize), maxRatio: int64(maxRatio)}, nil
+}
+
+// isIdentityEncoding returns whether a Content-Encoding leaves the body as is
+func isIdentityEncoding(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return true
+	}
+	return false
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressionLimiter enforces the decompressed size and compression ratio limits of a decoded body
+type decompressionLimiter struct {
+	io.ReadCloser
+	compressed   *countingReader
+	decompressed int64
+	maxSize      int64
+	maxRatio     int64
+}
+
+func (d *decompressionLimiter) Read(p []byte) (int, error) {
+	// read at most one byte over the size limit to detect the overflow
+	if remaining := d.maxSize - d.decompressed + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := d.ReadCloser.Read(p)
+	d.decompressed += int64(n)
+	if d.decompressed > d.maxSize {
+		return n, fmt.Errorf("%w of %d bytes", ErrDecompressionLimit, d.maxSize)
+	}
+	if d.decompressed > compressionRatioMinSize && d.decompressed > d.maxRatio*d.compressed.n {
+		return n, fmt.Errorf("%w of compression ratio %d", ErrDecompressionLimit, d.maxRatio)
+	}
+	return n, err
+}
+
+// InvalidBodyError wraps an error reading a decoded body as ErrInvalidBody if the compressed data
+// is corrupted or truncated. Other errors are returned as is.
+func InvalidBodyError(encoding string, err error) error {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "identity" {
+		return err
+	}
+	var corrupted flate.CorruptInputError
+	if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.As(err, &corrupted) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w %s body: %v", ErrInvalidBody, encoding, err)
+	}
+	return err
+}
+
+// AcceptsGzip returns true if the Accept-Encoding header of a request accepts gzip, unless its quality is 0
+func AcceptsGzip(h http.Header) bool {
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					if quality, err := strconv.ParseFloat(q[2:], 64); err == nil && quality == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response body, Flush sends the data compressed so far to the client
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	g.gz.Flush()
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// GzipResponse returns a writer compressing the response body with gzip if the request accepts it, otherwise
+// the writer as is. The returned function completes the compressed body and must be called after the body is written.
+func GzipResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !AcceptsGzip(r.Header) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gz := gzip.NewWriter(w)
+	return &gzipResponseWriter{ResponseWriter: w, gz: gz}, func() { gz.Close() }
+}
+
+// base64Encoding is the payload encoding of the decode and encode query parameters
+const base64Encoding = "base64"
+
+// PayloadEncoding returns the payload encoding of the encode query parameter, either base64 or
+// empty for the raw payload.
+func PayloadEncoding(params url.Values) (string, error) {
+	switch encoding := strings.ToLower(params.Get("encode")); encoding {
+	case "", base64Encoding:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unsupported encode %s, only base64 is supported", encoding)
+	}
+}
+
+// DecodePayload decodes a payload sent in a text encoding by the decode query parameter,
+// only base64 is supported. The payload is returned as is without an encoding.
+func DecodePayload(encoding string, payload []byte) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "":
+		return payload, nil
+	case base64Encoding:
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(payload))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 payload: %v", err)
+		}
+		return decoded[:n], nil
+	}
+	return nil, fmt.Errorf("unsupported decode %s, only base64 is supported", encoding)
+}
+
+// BatchPublishHandler publishes a batch of messages to a topic. Messages are sent with the producer
+// batching enabled and the handler replies once the batch is flushed and acknowledged by the broker.
+func BatchPublishHandler(w http.ResponseWriter, r *http.Request) {
+	token, topic, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnauthorized)
+		return
+	}
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if topic == "" && err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if topic != "" {
+		if topic, err = util.NormalizeTopicFn(topic); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	topicFN = util.AssignString(topic, topicFN) // header topicFn overwrites topic specified in the routes
+	// the routing rules match the request headers, so all messages of a batch go to the same topic
+	topicFN = routedTopic(topicFN, pulsarURL, r.Header)
+
+	compression, err := model.GetCompressionType(util.AssignString(r.Header.Get("X-Pulsar-Compression"), r.URL.Query().Get("compression")))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	var batch model.BatchPublishRequest
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(MaxMessageSize()))).Decode(&batch); err != nil {
+		util.ResponseErrorJSON(fmt.Errorf("invalid batch publish request %v", err), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if len(batch.Messages) == 0 {
+		util.ResponseErrorJSON(errors.New("no messages in the batch"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	tenant := util.TopicTenant(topicFN)
+	messages := make([]*pulsar.ProducerMessage, len(batch.Messages))
+	for i, m := range batch.Messages {
+		// a batch is rejected as a whole if one of its messages fails the checks of the send endpoint
+		if status, err := checkMessage(r, topicFN, pulsarURL, m.Payload, len(m.Payload), m.Properties); err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("message %d: %v", i, err), w, status)
+			return
+		}
+	}
+	for i, m := range batch.Messages {
+		messages[i] = &pulsar.ProducerMessage{
+			Payload:    m.Payload,
+			Key:        m.Key,
+			Properties: m.Properties,
+		}
+		util.ReceivedBytes.WithLabelValues(tenant).Add(float64(len(m.Payload)))
+	}
+	util.ReceivedMessages.WithLabelValues(tenant).Add(float64(len(messages)))
+
+	ids, errs, err := pulsardriver.SendBatchToPulsar(pulsarURL, token, topicFN, messages, batchProducerConfig(compression))
+	if err != nil {
+		util.ProduceErrors.WithLabelValues(tenant).Add(float64(len(messages)))
+		code, status := pulsardriver.ClassifyProduceError(err, http.StatusServiceUnavailable)
+		for _, m := range messages {
+			ProduceLog(r, topicFN, len(m.Payload), false, status).WithError(err).WithField("code", code).Warn("produce")
+		}
+		util.ResponseErrorCodeJSON(string(code), err, w, status)
+		return
+	}
+	for i, m := range messages {
+		if errs[i] != nil {
+			code, status := pulsardriver.ClassifyProduceError(errs[i], http.StatusServiceUnavailable)
+			ProduceLog(r, topicFN, len(m.Payload), false, status).WithError(errs[i]).WithField("code", code).Warn("produce")
+		} else {
+			ProduceLog(r, topicFN, len(m.Payload), false, http.StatusOK).Info("produce")
+		}
+	}
+
+	resp := model.NewBatchPublishResponse(ids, errs)
+	util.ProduceErrors.WithLabelValues(tenant).Add(float64(resp.Failed))
+	data, err := json.Marshal(resp)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Failed > 0 {
+		w.WriteHeader(http.StatusMultiStatus)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(data)
+}
+
+// batchProducerConfig returns the producer configuration of the batch publish endpoint
+func batchProducerConfig(compression pulsar.CompressionType) pulsardriver.ProducerConfig {
+	cfg := util.GetConfig()
+	delay, err := time.ParseDuration(util.AssignString(cfg.BatchPublishMaxPublishDelay, "0s"))
+	if err != nil {
+		log.Errorf("invalid BatchPublishMaxPublishDelay %s, use the default", cfg.BatchPublishMaxPublishDelay)
+		delay = 0
+	}
+	return pulsardriver.ProducerConfig{
+		Compression:             compression,
+		BatchingMaxMessages:     uint(cfg.BatchPublishMaxMessages),
+		BatchingMaxSize:         uint(cfg.BatchPublishMaxBytes),
+		BatchingMaxPublishDelay: delay,
+	}
+}
+
+// writePublishTrace replies with the publish trace as a JSON object
+func writePublishTrace(trace *model.PublishTrace, w http.ResponseWriter, statusCode int) {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+// writeDryRunResult replies with the result of a dry-run publish as a JSON object
+func writeDryRunResult(result *model.DryRunResult, w http.ResponseWriter) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// isSuperUser returns true if one of the authenticated subjects is a super role
+func isSuperUser(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("injectedSubs"), ",") {
+		if util.StrContains(util.SuperRoles, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverHandler a function recovers from panic
+func recoverHandler(r *http.Request) {
+	if r := recover(); r != nil {
+		fmt.Printf("Recovered in http handler crash %v", r)
+	} else {
+		fmt.Printf("exit http handler")
+	}
+}
+
+// PollHandler polls messages from a Pulsar topic.
+func PollHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	token, topicFN, pulsarURL, cfg, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &r.Header, mux.Vars(r), params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	// the bounds keep a poll from tying up a consumer and the connection for too long
+	size, err := util.QueryParamIntRange(params, "batchSize", 10, 1, pollMaxBatchSize())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	perMessageTimeoutMs, err := util.QueryParamIntRange(params, "perMessageTimeoutMs", 300, 1, pollMaxPerMessageTimeoutMs())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	waitMs := util.QueryParamInt(params, "waitMs", 0)
+	if waitMs > maxPollWaitMs {
+		waitMs = maxPollWaitMs
+	}
+	// pollDeadlineMs bounds the whole poll, the batch collected so far is replied once it elapses
+	deadlineMs, err := util.QueryParamIntRange(params, "pollDeadlineMs", 0, 0, maxPollDeadlineMs)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// subscription initial position defaults to earliest since this is short poll
+	cfg.InitialPosition = PollInitialPosition(params, cfg.InitialPosition)
+	// noAck leaves the messages unacknowledged until they are acknowledged by the ack endpoint
+	noAck := util.StringToBool(util.QueryParamString(params, "noAck", "false"))
+	if noAck && cfg.IsNonResumable() {
+		util.ResponseErrorJSON(errors.New("noAck requires a SubscriptionName"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	// the pinned Pulsar client has no cumulative acknowledgement, the messages are acknowledged individually
+	if ackMode := util.QueryParamString(params, "ackMode", "individual"); !strings.EqualFold(ackMode, "individual") {
+		util.ResponseErrorJSON(fmt.Errorf("ackMode %s is not supported until the Pulsar client is upgraded, only individual is supported", ackMode), w, http.StatusUnprocessableEntity)
+		return
+	}
+	// peek reads with a short-lived subscription that is removed afterwards, so no cursor is moved
+	peek := util.StringToBool(util.QueryParamString(params, "peek", "false"))
+	if peek && (noAck || !cfg.IsNonResumable()) {
+		util.ResponseErrorJSON(errors.New("peek does not support noAck or a SubscriptionName"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// filterProp only returns the messages with the matching properties
+	cfg.Filter, err = PropertyFilter(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// additional topics are polled together with the route's topic by a multi-topic consumer
+	cfg.Topics, err = PollTopics(params, topicFN)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if len(cfg.Topics) > 0 && (noAck || !cfg.StartTime.IsZero()) {
+		util.ResponseErrorJSON(errors.New("noAck and startTimestampMs are not supported with multiple topics"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	// the subjects must be allowed on the route's topic and every additional topic
+	subjects := r.Header.Get("injectedSubs")
+	for _, t := range append([]string{topicFN}, cfg.Topics...) {
+		if !VerifySubjectBasedOnTopic(t, subjects, ExtractEvalTenant) {
+			util.ResponseErrorJSON(fmt.Errorf("not allowed to poll topic %s", t), w, http.StatusForbidden)
+			return
+		}
+	}
+	token = util.ClusterToken(pulsarURL, token)
+	// the JSON payloads are always base64 encoded, encode=base64 flags it in the reply for the clients
+	encoding, err := PayloadEncoding(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	countConsumerSubscription("poll", cfg)
+	// a client disconnect aborts the poll
+	ctx := r.Context()
+	if deadlineMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(deadlineMs)*time.Millisecond)
+		defer cancel()
+	}
+	var msgs model.PulsarMessages
+	switch {
+	case peek:
+		msgs, err = broker.PeekBatchMessages(ctx, pulsarURL, token, topicFN, cfg, size, perMessageTimeoutMs, waitMs)
+	case noAck:
+		msgs, err = broker.PollBatchMessagesNoAck(ctx, pulsarURL, token, topicFN, cfg, size, perMessageTimeoutMs, waitMs)
+	default:
+		msgs, err = broker.PollBatchMessages(ctx, pulsarURL, token, topicFN, cfg, size, perMessageTimeoutMs, waitMs)
+	}
+	if err == broker.ErrPollConsumerMismatch {
+		util.ResponseErrorJSON(err, w, http.StatusConflict)
+		return
+	} else if err != nil {
+		_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+		util.ResponseErrorJSON(err, w, status)
+		return
+	}
+
+	if msgs.IsEmpty() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// metadataOnly omits the payloads, the messages are still acknowledged unless noAck is set
+	if util.StringToBool(util.QueryParamString(params, "metadataOnly", "false")) {
+		msgs.OmitPayloads()
+	}
+	msgs.PayloadEncoding = encoding
+
+	// the Accept header selects JSON, CSV, or msgpack, an unsupported media type falls back to JSON
+	mediaType := PollMediaType(r.Header.Get("Accept"))
+	data, err := EncodePollMessages(msgs, mediaType)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	// the response is compressed if the client accepts gzip
+	w, closeBody := GzipResponse(w, r)
+	defer closeBody()
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	util.DeliveredMessages.WithLabelValues("poll", util.TopicTenant(topicFN)).Add(float64(msgs.Size))
+	w.Write(data)
+}
+
+// PropertyFilter returns the message filter of the repeated filterProp query parameter in the key=value format.
+// The filtered out messages are negatively acknowledged if filterNack is true, otherwise they are acknowledged.
+func PropertyFilter(params url.Values) (model.MessageFilter, error) {
+	filter := model.MessageFilter{
+		Nack: util.StringToBool(params.Get("filterNack")),
+	}
+	for _, prop := range params["filterProp"] {
+		parts := strings.SplitN(prop, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return filter, fmt.Errorf("invalid filterProp %s, expected format is key=value", prop)
+		}
+		if filter.Properties == nil {
+			filter.Properties = make(map[string]string)
+		}
+		if _, ok := filter.Properties[parts[0]]; ok {
+			return filter, fmt.Errorf("filterProp %s is specified more than once", parts[0])
+		}
+		filter.Properties[parts[0]] = parts[1]
+	}
+	return filter, nil
+}
+
+// PollTopics returns the additional topics from the repeated or comma separated topic query parameter.
+// A short topic name is in the same namespace as the route's topic, otherwise a topic full name is required.
+func PollTopics(params url.Values, topicFN string) ([]string, error) {
+	topics := []string{}
+	seen := map[string]bool{topicFN: true}
+	for _, value := range params["topic"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			name, err := topicInNamespace(name, topicFN)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[name] {
+				seen[name] = true
+				topics = append(topics, name)
+			}
+		}
+	}
+	return topics, nil
+}
+
+// topicInNamespace returns the full name of a topic. A short topic name is in the same namespace as topicFN.
+func topicInNamespace(name, topicFN string) (string, error) {
+	if !strings.Contains(name, "://") {
+		name = topicFN[:strings.LastIndex(topicFN, "/")+1] + name
+	}
+	if _, _, _, topic, err := util.TokenizeTopicFullName(name); err != nil || topic == "" {
+		return "", fmt.Errorf("invalid topic %s", name)
+	}
+	return name, nil
+}
+
+// TopicsPattern returns the regex topic subscription pattern from the topicsPattern query parameter.
+// The regex only matches topic names so that the pattern is constrained to the route's tenant and namespace.
+func TopicsPattern(params url.Values, topicFN string) (string, error) {
+	pattern := util.QueryParamString(params, "topicsPattern", "")
+	if pattern == "" {
+		return "", nil
+	}
+	if strings.Contains(pattern, "/") {
+		return "", errors.New("topicsPattern must only match topic names in the namespace")
+	}
+	// the Pulsar client only discovers the persistent topics of a namespace
+	if util.IsNonPersistentTopic(topicFN) {
+		return "", errors.New("topicsPattern is not supported on non-persistent topics")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", fmt.Errorf("invalid topicsPattern %v", err)
+	}
+	return topicFN[:strings.LastIndex(topicFN, "/")+1] + pattern, nil
+}
+
+// AckHandler acknowledges messages by the ackId returned from a noAck poll on the same subscription
+func AckHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	var req model.AckRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(fmt.Errorf("invalid ack request %v", err), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if req.SubscriptionName == "" || len(req.MessageIDs) == 0 {
+		util.ResponseErrorJSON(errors.New("subscriptionName and messageIds are required"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	subType, err := model.GetSubscriptionType(req.SubscriptionType)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// all message IDs are validated before any is acknowledged
+	msgIDs := make([]pulsar.MessageID, len(req.MessageIDs))
+	for i, id := range req.MessageIDs {
+		if msgIDs[i], err = pulsar.DeserializeMessageID(id); err != nil {
+			util.ResponseErrorJSON(fmt.Errorf("invalid message id at index %d", i), w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if err = broker.AckMessages(pulsarURL, token, topicFN, model.ConsumerConfig{SubscriptionName: req.SubscriptionName, SubscriptionType: subType}, msgIDs); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSubscriptionHandler deletes a subscription of the route's topic with the Pulsar admin REST API
+func DeleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	subName := mux.Vars(r)["subName"]
+	if subName == "" {
+		util.ResponseErrorJSON(errors.New("missing subscription name"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to delete a subscription of the tenant"), w, http.StatusForbidden)
+		return
+	}
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	switch err = pulsardriver.DeleteSubscription(pulsarURL, token, topicFN, subName); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case pulsardriver.ErrSubscriptionNotFound:
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+	case pulsardriver.ErrSubscriptionInUse:
+		util.ResponseErrorJSON(err, w, http.StatusConflict)
+	case pulsardriver.ErrAdminNotAuthorized:
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+	default:
+		RequestLog(r).Errorf("failed to delete subscription %s of topic %s error %v", subName, topicFN, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+	}
+}
+
+// CreateSubscriptionHandler creates a durable subscription of the route's topic at the requested initial position
+// with the Pulsar admin REST API, so that a consumer connecting later does not miss the messages in between.
+// No message is consumed. It replies 201 if the subscription is created, or 200 if it already exists.
+func CreateSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	subName := mux.Vars(r)["subName"]
+	if err = ValidateSubscriptionName(subName); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	position, err := model.GetInitialPosition(r.URL.Query().Get("SubscriptionInitialPosition"))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to create a subscription of the tenant"), w, http.StatusForbidden)
+		return
+	}
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	switch err = pulsardriver.CreateSubscription(pulsarURL, token, topicFN, subName, position); err {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+	case pulsardriver.ErrSubscriptionExists:
+		w.WriteHeader(http.StatusOK)
+	case pulsardriver.ErrTopicNotFound:
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+	case pulsardriver.ErrAdminNotAuthorized:
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+	default:
+		RequestLog(r).Errorf("failed to create subscription %s of topic %s error %v", subName, topicFN, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+	}
+}
+
+// LagHandler replies the backlog of a subscription of the route's topic with the Pulsar admin REST API
+func LagHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	subName := mux.Vars(r)["subName"]
+	if subName == "" {
+		util.ResponseErrorJSON(errors.New("missing subscription name"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to query a subscription of the tenant"), w, http.StatusForbidden)
+		return
+	}
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	stats, err := pulsardriver.GetSubscriptionStats(pulsarURL, token, topicFN, subName)
+	switch err {
+	case nil:
+	case pulsardriver.ErrSubscriptionNotFound, pulsardriver.ErrTopicNotFound:
+		// drop the series of a removed subscription so that the gauge only covers the existing ones
+		util.SubscriptionBacklog.DeleteLabelValues(topicFN, subName)
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	case pulsardriver.ErrAdminNotAuthorized:
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	default:
+		RequestLog(r).Errorf("failed to get the stats of subscription %s of topic %s error %v", subName, topicFN, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	util.SubscriptionBacklog.WithLabelValues(topicFN, subName).Set(float64(stats.MsgBacklog))
+
+	data, err := json.Marshal(model.SubscriptionLag{
+		Topic:        topicFN,
+		Subscription: subName,
+		Backlog:      stats.MsgBacklog,
+		Unacked:      stats.UnackedMessages,
+	})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// StatsHandler returns the topic stats of the Pulsar admin REST API
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to query a topic of the tenant"), w, http.StatusForbidden)
+		return
+	}
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	stats, err := pulsardriver.GetTopicStats(pulsarURL, token, topicFN)
+	switch err {
+	case nil:
+	case pulsardriver.ErrTopicNotFound:
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	case pulsardriver.ErrAdminNotAuthorized:
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	default:
+		RequestLog(r).Errorf("failed to get the stats of topic %s error %v", topicFN, err)
+		util.ResponseErrorJSON(errors.New("failed to get the topic stats"), w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(stats)
+}
+
+// LastMessageIDHandler returns the last message ID of a topic, so that a reader knows when it has caught up
+func LastMessageIDHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to query a topic of the tenant"), w, http.StatusForbidden)
+		return
+	}
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	ids, err := pulsardriver.GetLastMessageIDs(pulsarURL, token, topicFN)
+	switch err {
+	case nil:
+	case pulsardriver.ErrTopicNotFound:
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	case pulsardriver.ErrAdminNotAuthorized:
+		util.ResponseErrorJSON(err, w, http.StatusForbidden)
+		return
+	default:
+		RequestLog(r).Errorf("failed to get the last message id of topic %s error %v", topicFN, err)
+		util.ResponseErrorJSON(errors.New("failed to get the last message id"), w, http.StatusInternalServerError)
+		return
+	}
+
+	lastMessageID := model.TopicLastMessageID{Topic: topicFN}
+	if len(ids) == 1 && ids[0].PartitionIndex < 0 {
+		lastMessageID.MessageID = ids[0].String()
+	} else {
+		for i, id := range ids {
+			lastMessageID.Partitions = append(lastMessageID.Partitions, model.TopicLastMessageID{
+				Topic:     fmt.Sprintf("%s-partition-%d", topicFN, i),
+				MessageID: id.String(),
+			})
+		}
+	}
+
+	data, err := json.Marshal(lastMessageID)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// SSEHandler is the HTTP SSE handler
+func SSEHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	// broadcast=true fans out a reader shared by the SSE clients of the topic, without a subscription per client
+	broadcast, err := SSEBroadcast(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	params.Set("SubscriptionType", SSESubscriptionType(params))
+	token, topicFN, pulsarURL, cfg, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &r.Header, mux.Vars(r), params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// topicsPattern subscribes to the topics matching the regex in the route's namespace
+	cfg.TopicsPattern, err = TopicsPattern(params, topicFN)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if cfg.TopicsPattern != "" {
+		if !cfg.StartTime.IsZero() {
+			util.ResponseErrorJSON(errors.New("startTimestampMs is not supported with topicsPattern"), w, http.StatusUnprocessableEntity)
+			return
+		}
+		if !VerifySubjectBasedOnTenant(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+			util.ResponseErrorJSON(errors.New("not allowed to subscribe to the tenant"), w, http.StatusForbidden)
+			return
+		}
+	}
+	if startMessageID := LastEventIDStart(r, cfg); startMessageID != nil {
+		cfg.StartMessageID = startMessageID
+	}
+	if !broadcast {
+		countConsumerSubscription("sse", cfg)
+	}
+
+	// encode=base64 writes the payloads base64 encoded for the clients that cannot handle binary data
+	encoding, err := PayloadEncoding(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// the stream is closed after maxMessages are delivered, or no message arrives within idleTimeoutMs
+	// both default to 0 as unlimited
+	maxMessages := util.QueryParamInt(params, "maxMessages", 0)
+	idleTimeoutMs := util.QueryParamInt(params, "idleTimeoutMs", 0)
+	if maxMessages < 0 || idleTimeoutMs < 0 {
+		util.ResponseErrorJSON(errors.New("maxMessages and idleTimeoutMs must not be negative"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	heartbeatInterval, err := HeartbeatInterval(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Make sure that the writer supports flushing.
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// the caps protect the Pulsar consumer quota from a client opening too many connections
+	release, ok := AcquireSSEConnection(topicFN)
+	if !ok {
+		util.ResponseErrorJSON(errors.New("too many SSE connections"), w, http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	// the event stream is compressed if the client accepts gzip, every event is flushed as a gzip sync block
+	w, closeBody := GzipResponse(w, r)
+	defer closeBody()
+	flusher = w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	var eventChan <-chan pulsar.ConsumerMessage
+	var writeEvent func(msg pulsar.Message) error
+	if broadcast {
+		// a broadcast message is neither acknowledged nor redelivered, a slow client misses messages
+		messages, leave, err := broker.JoinBroadcast(pulsarURL, token, topicFN, util.GetConfig().SSEEventBufferSize)
+		if err != nil {
+			_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+			util.ResponseErrorJSON(err, w, status)
+			return
+		}
+		defer leave()
+		eventChan = messages
+		writeEvent = func(msg pulsar.Message) error { return writeSSEEvent(r.Context(), w, flusher, msg, encoding) }
+	} else {
+		client, consumer, err := broker.GetPulsarClientConsumer(pulsarURL, token, topicFN, cfg)
+		if err != nil {
+			_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+			util.ResponseErrorJSON(err, w, status)
+			return
+		}
+		defer client.Close()
+		defer consumer.Close()
+		if cfg.IsNonResumable() {
+			defer consumer.Unsubscribe()
+		}
+
+		// messages are only acknowledged after they are written to the client,
+		// a slow client fills up the buffer and stops the consumer from receiving more messages
+		eventChan = broker.BufferConsumerMessages(r.Context(), consumer, util.GetConfig().SSEEventBufferSize)
+		writeEvent = func(msg pulsar.Message) error { return WriteSSEMessage(r.Context(), w, flusher, consumer, msg, encoding) }
+	}
+	util.ActiveSSEConnections.Inc()
+	defer util.ActiveSSEConnections.Dec()
+	deliveredCounter := util.DeliveredMessages.WithLabelValues("sse", util.TopicTenant(topicFN))
+
+	// a nil channel never fires when the idle timeout is disabled
+	var idleChan <-chan time.Time
+	idleTimeout := time.Duration(idleTimeoutMs) * time.Millisecond
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleChan = idleTimer.C
+	}
+
+	// a heartbeat comment keeps the proxies from closing a stream of a quiet topic
+	var heartbeatChan <-chan time.Time
+	var heartbeatTicker *time.Ticker
+	if heartbeatInterval > 0 {
+		heartbeatTicker = time.NewTicker(heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeatChan = heartbeatTicker.C
+	}
+
+	delivered := 0
+	for {
+		select {
+		case msg, ok := <-eventChan:
+			// log.Infof("received message %s on topic %s", string(msg.Payload()), topicFN)
+			if !ok {
+				// the broadcast reader has failed, the client reconnects to a new reader
+				return
+			}
+
+			if err := writeEvent(msg.Message); err != nil {
+				RequestLog(r).Infof("sse write error %v", err)
+				return
+			}
+			deliveredCounter.Inc()
+
+			delivered++
+			if maxMessages > 0 && delivered >= maxMessages {
+				writeSSEComplete(w, flusher, delivered)
+				return
+			}
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(idleTimeout)
+			}
+			if heartbeatTicker != nil {
+				heartbeatTicker.Reset(heartbeatInterval)
+			}
+		case <-heartbeatChan:
+			if err := WriteSSEHeartbeat(r.Context(), w, flusher); err != nil {
+				return
+			}
+		case <-idleChan:
+			writeSSEComplete(w, flusher, delivered)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// SSEBroadcast returns true if broadcast=true requests the SSE broadcast of the topic.
+// It cannot be combined with the parameters of a subscription.
+func SSEBroadcast(params url.Values) (bool, error) {
+	if !util.StringToBool(params.Get("broadcast")) {
+		return false, nil
+	}
+	for _, name := range []string{"SubscriptionName", "SubscriptionType", "SubscriptionInitialPosition", "startTimestampMs",
+		"topicsPattern", "maxRedeliveries", "deadLetterTopic", "receiverQueueSize"} {
+		if params.Get(name) != "" {
+			return true, fmt.Errorf("%s is not supported with broadcast", name)
+		}
+	}
+	return true, nil
+}
+
+// WriteSSEMessage writes a message event to the SSE client. The message is only acknowledged after
+// it is written and flushed without error. Otherwise it is negatively acknowledged to be redelivered.
+func WriteSSEMessage(ctx context.Context, w io.Writer, flusher http.Flusher, consumer pulsar.Consumer, msg pulsar.Message, encoding string) error {
+	if err := writeSSEEvent(ctx, w, flusher, msg, encoding); err != nil {
+		consumer.Nack(msg)
+		return err
+	}
+	consumer.Ack(msg)
+	return nil
+}
+
+// writeSSEEvent writes and flushes a message event to the SSE client.
+// The payload is written base64 encoded with an encoding field if the encoding is base64.
+func writeSSEEvent(ctx context.Context, w io.Writer, flusher http.Flusher, msg pulsar.Message, encoding string) error {
+	_, err := fmt.Fprintf(w, "id: %s\n", model.FormatMessageID(msg.ID()))
+	if err == nil {
+		// custom fields are ignored by an EventSource client, other SSE clients can read the timestamps
+		_, err = fmt.Fprintf(w, "eventTime: %d\npublishTime: %d\n", epochMs(msg.EventTime()), epochMs(msg.PublishTime()))
+	}
+	if err == nil {
+		err = writeSSEField(w, "key", msg.Key())
+	}
+	if err == nil {
+		err = writeSSEField(w, "orderingKey", msg.OrderingKey())
+	}
+	if err == nil && encoding == base64Encoding {
+		_, err = fmt.Fprintf(w, "encoding: %s\ndata: %s\n\n", encoding, base64.StdEncoding.EncodeToString(msg.Payload()))
+	} else if err == nil {
+		_, err = fmt.Fprintf(w, "data: %s\n\n", msg.Payload())
+	}
+	if err == nil {
+		flusher.Flush()
+		// a flush does not report an error, the request context is cancelled once the client is gone
+		err = ctx.Err()
+	}
+	return err
+}
+
+// writeSSEField writes an optional field of an event, it is skipped when it is empty
+// or has a line break that would end the field early
+func writeSSEField(w io.Writer, name, value string) error {
+	if value == "" || strings.ContainsAny(value, "\r\n") {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%s: %s\n", name, value)
+	return err
+}
+
+// epochMs returns the time in Unix epoch milliseconds, or 0 for the zero time
+func epochMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// WriteSSEHeartbeat writes and flushes a comment line that SSE clients ignore, so that the intermediaries
+// see activity on a stream without messages
+func WriteSSEHeartbeat(ctx context.Context, w io.Writer, flusher http.Flusher) error {
+	if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return ctx.Err()
+}
+
+// HeartbeatInterval parses the heartbeatMs query parameter of a SSE stream, 0 disables the heartbeat
+func HeartbeatInterval(params url.Values) (time.Duration, error) {
+	heartbeatMs := util.QueryParamInt(params, "heartbeatMs", defaultHeartbeatMs)
+	if heartbeatMs != 0 && (heartbeatMs < minHeartbeatMs || heartbeatMs > maxHeartbeatMs) {
+		return 0, fmt.Errorf("heartbeatMs must be 0 to disable or between %d and %d", minHeartbeatMs, maxHeartbeatMs)
+	}
+	return time.Duration(heartbeatMs) * time.Millisecond, nil
+}
+
+// writeSSEComplete sends the final complete event with the number of delivered messages before the stream closes
+func writeSSEComplete(w http.ResponseWriter, flusher http.Flusher, delivered int) {
+	fmt.Fprintf(w, "event: complete\ndata: %d\n\n", delivered)
+	flusher.Flush()
+}
+
+// ProduceEventsHandler streams an SSE event for every message sent by the send endpoint to a topic in the tenant.
+// The events are best effort, they are dropped for a client that does not keep up with the produce rate.
+func ProduceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	tenant := mux.Vars(r)["tenant"]
+	if !VerifySubject(tenant, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(fmt.Errorf("not allowed to stream the produce events of tenant %s", tenant), w, http.StatusForbidden)
+		return
+	}
+	u, _ := url.Parse(r.URL.String())
+	heartbeatInterval, err := HeartbeatInterval(u.Query())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// the stream of a tenant counts as a topic against the SSE connection caps
+	release, ok := AcquireSSEConnection(tenant)
+	if !ok {
+		util.ResponseErrorJSON(errors.New("too many SSE connections"), w, http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	events, unsubscribe := SubscribeProduceEvents(tenant)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var heartbeatChan <-chan time.Time
+	if heartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeatChan = heartbeatTicker.C
+	}
+
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: produce\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeatChan:
+			if err := WriteSSEHeartbeat(r.Context(), w, flusher); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ReaderHandler streams messages to an SSE client with a Pulsar reader. Unlike SSEHandler, no subscription
+// is created and no message is acknowledged, so tailing a topic does not affect any subscription's backlog.
+func ReaderHandler(w http.ResponseWriter, r *http.Request) {
+	defer recoverHandler(r)
+
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to read a topic of the tenant"), w, http.StatusForbidden)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
+
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	startMessageID, startTime, err := ReaderStartPosition(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !startTime.IsZero() && util.IsNonPersistentTopic(topicFN) {
+		util.ResponseErrorJSON(errors.New("a start time is not supported on non-persistent topics"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// encode=base64 writes the payloads base64 encoded for the clients that cannot handle binary data
+	encoding, err := PayloadEncoding(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	maxMessages := util.QueryParamInt(params, "maxMessages", 0)
+	idleTimeoutMs := util.QueryParamInt(params, "idleTimeoutMs", 0)
+	if maxMessages < 0 || idleTimeoutMs < 0 {
+		util.ResponseErrorJSON(errors.New("maxMessages and idleTimeoutMs must not be negative"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	heartbeatInterval, err := HeartbeatInterval(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	client, reader, err := broker.DialReader(pulsarURL, token, topicFN, startMessageID, startTime)
+	if err != nil {
+		_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+		util.ResponseErrorJSON(err, w, status)
+		return
+	}
+	defer client.Close()
+	defer reader.Close()
+
+	util.ActiveSSEConnections.Inc()
+	defer util.ActiveSSEConnections.Dec()
+	deliveredCounter := util.DeliveredMessages.WithLabelValues("reader", util.TopicTenant(topicFN))
+
+	msgChan := broker.BufferReaderMessages(r.Context(), reader, util.GetConfig().SSEEventBufferSize)
+
+	var idleChan <-chan time.Time
+	idleTimeout := time.Duration(idleTimeoutMs) * time.Millisecond
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleChan = idleTimer.C
+	}
+
+	// a heartbeat comment keeps the proxies from closing a stream of a quiet topic
+	var heartbeatChan <-chan time.Time
+	var heartbeatTicker *time.Ticker
+	if heartbeatInterval > 0 {
+		heartbeatTicker = time.NewTicker(heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeatChan = heartbeatTicker.C
+	}
+
+	delivered := 0
+	for {
+		select {
+		case msg := <-msgChan:
+			if err := writeSSEEvent(r.Context(), w, flusher, msg, encoding); err != nil {
+				RequestLog(r).Infof("reader sse write error %v", err)
+				return
 			}
-		}
-        
-        // Append header delimiter (\r\n\r\n) and adjust the buffer size
-        if isIncludeRequestLine || isIncludeHeaders {
-            b = append(b, "\r\n\r\n"...)
-            bufferSize = len(b)
-        }
-		
-		if r.Header.Get("Content-Encoding") == "gzip" {
-			g, gerr := gzip.NewReader(r.Body)
-			
-			if gerr != nil {
-				util.ResponseErrorJSON(gerr, w, http.StatusInternalServerError)
+			deliveredCounter.Inc()
+
+			delivered++
+			if maxMessages > 0 && delivered >= maxMessages {
+				writeSSEComplete(w, flusher, delivered)
 				return
 			}
-			
-			defer g.Close()
-			
-            var n int
-			for {
-                n, err = g.Read(buffer[bufferSize:])
-                bufferSize += n
-                if err == io.EOF {
-                    break
-                } else if err != nil {
-                    util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
-                    return
-                } else if bufferSize >= workerBufferSize {
-                    util.ResponseErrorJSON(errors.New("Buffer overflow"), w, http.StatusInternalServerError)
-                    return
-                }
-            }
-		} else {
-            var n int
-            for {
-                n, err = r.Body.Read(buffer[bufferSize:])
-                bufferSize += n
-                if err == io.EOF {
-                    break
-                } else if err != nil {
-                    util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
-                    return
-                } else if bufferSize >= workerBufferSize {
-                    util.ResponseErrorJSON(errors.New("Buffer overflow"), w, http.StatusInternalServerError)
-                    return
-                }
-            }
-		}
-		
-		b = buffer[:bufferSize]
-		log.Debugf("Message buffer (size = %d): %s", bufferSize, b);
-		
-		token, topic, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
-		if err != nil {
-			util.ResponseErrorJSON(err, w, http.StatusUnauthorized)
-			return
-		}
-		
-		topicFN, err2 := GetTopicFnFromRoute(mux.Vars(r))
-		if topic == "" && err2 != nil {
-			// only read topic from routes
-			util.ResponseErrorJSON(err2, w, http.StatusUnprocessableEntity)
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(idleTimeout)
+			}
+			if heartbeatTicker != nil {
+				heartbeatTicker.Reset(heartbeatInterval)
+			}
+		case <-heartbeatChan:
+			if err := WriteSSEHeartbeat(r.Context(), w, flusher); err != nil {
+				return
+			}
+		case <-idleChan:
+			writeSSEComplete(w, flusher, delivered)
 			return
-		}
-		topicFN = util.AssignString(topic, topicFN) // header topicFn overwrites topic specified in the routes
-		log.Infof("topicFN %s pulsarURL %s", topicFN, pulsarURL)
-
-		pulsarAsync := r.URL.Query().Get("mode") == "async"
-		err = pulsardriver.SendToPulsar(pulsarURL, token, topicFN, b, pulsarAsync, false, 0)
-		if err != nil {
-			util.ResponseErrorJSON(err, w, http.StatusServiceUnavailable)
+		case <-r.Context().Done():
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		return
 	}
-	<-done
-	return
 }
 
-// recoverHandler a function recovers from panic
-func recoverHandler(r *http.Request) {
-	if r := recover(); r != nil {
-		fmt.Printf("Recovered in http handler crash %v", r)
-	} else {
-		fmt.Printf("exit http handler")
+// ReaderStartPosition parses the startMessageId query parameter of a reader.
+// It is either `earliest`, `latest` as default, or a Unix epoch time in milliseconds
+// that the reader is seeked to from the earliest message.
+func ReaderStartPosition(params url.Values) (pulsar.MessageID, time.Time, error) {
+	value := util.QueryParamString(params, "startMessageId", "latest")
+	switch strings.ToLower(value) {
+	case "latest":
+		return pulsar.LatestMessageID(), time.Time{}, nil
+	case "earliest":
+		return pulsar.EarliestMessageID(), time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return nil, time.Time{}, fmt.Errorf("invalid startMessageId %s, it must be earliest, latest, or an epoch time in milliseconds", value)
 	}
+	startTime := time.Unix(0, ms*int64(time.Millisecond))
+	if startTime.After(time.Now()) {
+		return nil, time.Time{}, fmt.Errorf("startMessageId %s is in the future", value)
+	}
+	return pulsar.EarliestMessageID(), startTime, nil
 }
 
-// PollHandler polls messages from a Pulsar topic.
-func PollHandler(w http.ResponseWriter, r *http.Request) {
+// replayTimeout bounds the time a replay reads before it returns the messages read so far as truncated
+const replayTimeout = 30 * time.Second
+
+// ReplayHandler returns the messages of a topic between a start and an end position as JSON.
+// The messages are read with a reader so that no subscription is created on the topic.
+func ReplayHandler(w http.ResponseWriter, r *http.Request) {
 	defer recoverHandler(r)
 
-	u, _ := url.Parse(r.URL.String())
-	params := u.Query()
-	token, topicFN, pulsarURL, subName, _, subType, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &r.Header, mux.Vars(r), params)
+	topicFN, err := GetTopicFnFromRoute(mux.Vars(r))
 	if err != nil {
 		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if !VerifySubjectBasedOnTopic(topicFN, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+		util.ResponseErrorJSON(errors.New("not allowed to replay a topic of the tenant"), w, http.StatusForbidden)
+		return
+	}
+	if util.IsNonPersistentTopic(topicFN) {
+		util.ResponseErrorJSON(errors.New("replay is not supported on non-persistent topics"), w, http.StatusUnprocessableEntity)
+		return
+	}
 
-	size := util.QueryParamInt(params, "batchSize", 10)
-	perMessageTimeoutMs := util.QueryParamInt(params, "perMessageTimeoutMs", 300)
+	token, _, pulsarURL, err := util.ReceiverHeader(util.AllowedPulsarURLs, &r.Header)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	token = util.ClusterToken(pulsarURL, token)
 
-	// subscription initial position is always set to earliest since this is short poll
-	msgs, err := broker.PollBatchMessages(pulsarURL, token, topicFN, subName, subType, size, perMessageTimeoutMs)
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	startMessageID, startTime, err := ReplayPosition(params, "start")
 	if err != nil {
-		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	// the replay starts from the earliest message by default, a start time seeks the reader from it
+	if startMessageID == nil {
+		startMessageID = pulsar.EarliestMessageID()
+	}
+	rng := broker.ReplayRange{MaxBytes: replayMaxBytes()}
+	if rng.EndMessageID, rng.EndTime, err = ReplayPosition(params, "end"); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !startTime.IsZero() && !rng.EndTime.IsZero() && rng.EndTime.Before(startTime) {
+		util.ResponseErrorJSON(errors.New("endTimestampMs is before startTimestampMs"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	if rng.MaxMessages, err = util.QueryParamIntRange(params, "maxMessages", replayMaxMessages(), 1, replayMaxMessages()); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	// the JSON payloads are always base64 encoded, encode=base64 flags it in the reply for the clients
+	encoding, err := PayloadEncoding(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
 		return
 	}
 
-	if msgs.IsEmpty() {
-		w.WriteHeader(http.StatusNoContent)
+	ctx, cancel := context.WithTimeout(r.Context(), replayTimeout)
+	defer cancel()
+	replay, err := broker.ReplayMessages(ctx, pulsarURL, token, topicFN, startMessageID, startTime, rng)
+	if err != nil {
+		_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+		util.ResponseErrorJSON(err, w, status)
 		return
 	}
+	replay.PayloadEncoding = encoding
 
-	data, err := json.Marshal(msgs)
+	data, err := json.Marshal(replay)
 	if err != nil {
 		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	// the response is compressed if the client accepts gzip
+	w, closeBody := GzipResponse(w, r)
+	defer closeBody()
 	w.WriteHeader(http.StatusOK)
+	util.DeliveredMessages.WithLabelValues("replay", util.TopicTenant(topicFN)).Add(float64(replay.Size))
 	w.Write(data)
 }
 
-// SSEHandler is the HTTP SSE handler
-func SSEHandler(w http.ResponseWriter, r *http.Request) {
+// ReplayPosition returns a replay position of the prefix's MessageId or TimestampMs query parameter.
+// The message ID is the base64 encoded ackId of a message, and startMessageId also accepts earliest.
+// It returns a nil message ID and a zero time if neither parameter is specified.
+func ReplayPosition(params url.Values, prefix string) (pulsar.MessageID, time.Time, error) {
+	idParam, timeParam := prefix+"MessageId", prefix+"TimestampMs"
+	id, ms := params.Get(idParam), params.Get(timeParam)
+	switch {
+	case id != "" && ms != "":
+		return nil, time.Time{}, fmt.Errorf("%s and %s cannot be specified together", idParam, timeParam)
+	case id != "":
+		if prefix == "start" && strings.ToLower(id) == "earliest" {
+			return pulsar.EarliestMessageID(), time.Time{}, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(id)
+		if err != nil {
+			data, err = base64.URLEncoding.DecodeString(id)
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid %s, it must be the base64 encoded ackId of a message", idParam)
+		}
+		msgID, err := pulsar.DeserializeMessageID(data)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid %s, it must be the base64 encoded ackId of a message", idParam)
+		}
+		return msgID, time.Time{}, nil
+	case ms != "":
+		timestamp, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil || timestamp < 0 {
+			return nil, time.Time{}, fmt.Errorf("invalid %s %s, it must be an epoch time in milliseconds", timeParam, ms)
+		}
+		return nil, time.Unix(0, timestamp*int64(time.Millisecond)), nil
+	}
+	return nil, time.Time{}, nil
+}
+
+// WebSocketHandler streams messages to a WebSocket client as JSON frames.
+// Unlike SSE, messages are not acknowledged automatically. The client acknowledges
+// a message by sending a frame with its message ID.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	defer recoverHandler(r)
 
 	u, _ := url.Parse(r.URL.String())
 	params := u.Query()
-	token, topicFN, pulsarURL, subName, subInitPos, subType, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &r.Header, mux.Vars(r), params)
+	token, topicFN, pulsarURL, cfg, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &r.Header, mux.Vars(r), params)
 	if err != nil {
 		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
 		return
 	}
+	countConsumerSubscription("websocket", cfg)
 
-	// Make sure that the writer supports flushing.
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // allow connection from different domain
-
-	client, consumer, err := broker.GetPulsarClientConsumer(pulsarURL, token, topicFN, subName, subType, subInitPos)
+	client, consumer, err := broker.GetPulsarClientConsumer(pulsarURL, token, topicFN, cfg)
 	if err != nil {
-		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		_, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+		util.ResponseErrorJSON(err, w, status)
 		return
 	}
 	defer client.Close()
 	defer consumer.Close()
-	if strings.HasPrefix(subName, model.NonResumable) {
+	if cfg.IsNonResumable() {
 		defer consumer.Unsubscribe()
 	}
 
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client with an error
+		RequestLog(r).Errorf("websocket upgrade error %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// receive acknowledgements from the client, a read error means the socket is dropped
+	go func() {
+		defer cancel()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var ack model.WebSocketAck
+			if err = json.Unmarshal(data, &ack); err != nil {
+				RequestLog(r).Warnf("websocket invalid ack frame %v", err)
+				continue
+			}
+			msgID, err := pulsar.DeserializeMessageID(ack.MessageID)
+			if err != nil {
+				RequestLog(r).Warnf("websocket invalid message id %v", err)
+				continue
+			}
+			consumer.AckID(msgID)
+		}
+	}()
+
+	deliveredCounter := util.DeliveredMessages.WithLabelValues("websocket", util.TopicTenant(topicFN))
 	consumChan := consumer.Chan()
 	for {
 		select {
 		case msg := <-consumChan:
-			// log.Infof("received message %s on topic %s", string(msg.Payload()), topicFN)
-			consumer.Ack(msg)
-
-			// ledgerId, entryId, batchId, partitionIndex, reserved, consumerId
-			fmt.Fprintf(w, strings.Replace(fmt.Sprintf("id: %v\n", msg.Message.ID()), "&", "", 1))
-			fmt.Fprintf(w, "data: %s\n\n", msg.Payload())
-			flusher.Flush()
-		case <-r.Context().Done():
+			if err = conn.WriteJSON(model.NewWebSocketMessage(msg)); err != nil {
+				RequestLog(r).Infof("websocket write error %v", err)
+				return
+			}
+			deliveredCounter.Inc()
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -304,11 +2460,11 @@ func GetTopicHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: we may fix the problem that allows negatively look up by another tenant
 	doc, err := singleDb.GetByKey(topicKey)
 	if err != nil {
-		log.Errorf("get topic error %v", err)
+		RequestLog(r).Errorf("get topic error %v", err)
 		util.ResponseErrorJSON(err, w, http.StatusNotFound)
 		return
 	}
-	if !VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+	if !VerifySubjectBasedOnTenant(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -323,6 +2479,132 @@ func GetTopicHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// GetTopicsHandler lists the topic configs that the caller's subjects are allowed to access
+// The limit and offset query parameters paginate the list, limit defaults to 20 and is at most 100.
+func GetTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit := util.QueryParamInt(params, "limit", defaultTopicListLimit)
+	offset := util.QueryParamInt(params, "offset", 0)
+	if limit < 1 || limit > maxTopicListLimit || offset < 0 {
+		util.ResponseErrorJSON(fmt.Errorf("limit must be between 1 and %d and offset must not be negative", maxTopicListLimit), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	subjects := r.Header.Get("injectedSubs")
+	topics, total, err := singleDb.List(func(doc *model.TopicConfig) bool {
+		return VerifySubjectBasedOnTenant(doc.TopicFullName, subjects, ExtractEvalTenant)
+	}, limit, offset)
+	if err != nil {
+		RequestLog(r).Errorf("list topics error %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	resJSON, err := json.Marshal(model.TopicConfigList{
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+		Topics: topics,
+	})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(resJSON)
+}
+
+// ExportTopicsHandler streams all topic configs the caller's subjects are allowed to access as a JSON array
+func ExportTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	subjects := r.Header.Get("injectedSubs")
+	filter := func(doc *model.TopicConfig) bool {
+		return VerifySubjectBasedOnTenant(doc.TopicFullName, subjects, ExtractEvalTenant)
+	}
+
+	topics, total, err := singleDb.List(filter, maxTopicListLimit, 0)
+	if err != nil {
+		RequestLog(r).Errorf("export topics error %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte("["))
+	encoder := json.NewEncoder(w)
+	for offset := 0; ; {
+		for i, topic := range topics {
+			if offset+i > 0 {
+				w.Write([]byte(","))
+			}
+			if err = encoder.Encode(topic); err != nil {
+				RequestLog(r).Errorf("export topics write error %v", err)
+				return
+			}
+		}
+		offset += len(topics)
+		if len(topics) == 0 || offset >= total {
+			break
+		}
+		// the status has been sent, a failed page can only end the response early
+		if topics, _, err = singleDb.List(filter, maxTopicListLimit, offset); err != nil {
+			RequestLog(r).Errorf("export topics error %v", err)
+			return
+		}
+	}
+	w.Write([]byte("]"))
+}
+
+// ImportTopicsHandler upserts an array of topic configs, such as the export of another server.
+// Every topic config is validated and imported independently, so a failed entry does not abort the others.
+func ImportTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var docs []model.TopicConfig
+	if err := json.NewDecoder(r.Body).Decode(&docs); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if len(docs) > maxTopicImportSize {
+		util.ResponseErrorJSON(fmt.Errorf("an import is limited to %d topic configs", maxTopicImportSize), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	subjects := r.Header.Get("injectedSubs")
+	res := model.TopicImportResponse{Results: make([]model.TopicImportResult, len(docs))}
+	for i := range docs {
+		doc := &docs[i]
+		res.Results[i] = model.TopicImportResult{TopicFullName: doc.TopicFullName, PulsarURL: doc.PulsarURL}
+		key, err := importTopic(doc, subjects)
+		if err != nil {
+			res.Results[i].Error = err.Error()
+			res.Failed++
+			continue
+		}
+		res.Results[i].Key = key
+		res.Imported++
+	}
+	RequestLog(r).Infof("imported %d topic configs, %d failed", res.Imported, res.Failed)
+
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(resJSON)
+}
+
+// importTopic validates and upserts a topic config in the tenants of the subjects
+func importTopic(doc *model.TopicConfig, subjects string) (string, error) {
+	if _, err := model.ValidateTopicConfig(*doc); err != nil {
+		return "", err
+	}
+	if !VerifySubjectBasedOnTenant(doc.TopicFullName, subjects, ExtractEvalTenant) {
+		return "", errors.New("not allowed to import the topic")
+	}
+	return singleDb.Update(doc)
+}
+
 // UpdateTopicHandler creates or updates a topic
 func UpdateTopicHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
@@ -341,7 +2623,7 @@ func UpdateTopicHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+	if !VerifySubjectBasedOnTenant(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -380,11 +2662,11 @@ func DeleteTopicHandler(w http.ResponseWriter, r *http.Request) {
 
 	doc, err := singleDb.GetByKey(topicKey)
 	if err != nil {
-		log.Errorf("failed to get topic based on key %s err: %v", topicKey, err)
+		RequestLog(r).Errorf("failed to get topic based on key %s err: %v", topicKey, err)
 		util.ResponseErrorJSON(err, w, http.StatusNotFound)
 		return
 	}
-	if !VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
+	if !VerifySubjectBasedOnTenant(doc.TopicFullName, r.Header.Get("injectedSubs"), ExtractEvalTenant) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -428,8 +2710,57 @@ func GetTopicKey(r *http.Request) (string, error) {
 	return topicKey, err
 }
 
+// ValidateAckCallbackTopic validates the ackCallbackTopic of a send, which must be a fully qualified topic name
+// in the same tenant as the topic of the send. It is only supported in async mode.
+func ValidateAckCallbackTopic(callbackTopic, topicFN string, async bool) error {
+	if !async {
+		return errors.New("ackCallbackTopic is only supported with mode=async")
+	}
+	_, tenant, ns, topic, err := util.TokenizeTopicFullName(callbackTopic)
+	if err != nil || tenant == "" || ns == "" || topic == "" {
+		return fmt.Errorf("invalid ackCallbackTopic %s, it must be a fully qualified topic name", callbackTopic)
+	}
+	if tenant != util.TopicTenant(topicFN) {
+		return fmt.Errorf("ackCallbackTopic %s must be in the tenant of topic %s", callbackTopic, topicFN)
+	}
+	return nil
+}
+
+// AsyncErrorPublisher returns a callback that publishes the error of an async send of a request to the callback topic
+func AsyncErrorPublisher(pulsarURL, token, callbackTopic, topicFN, requestID string) func(err error) {
+	return func(sendErr error) {
+		data, err := json.Marshal(model.AsyncProduceError{
+			RequestID: requestID,
+			Topic:     topicFN,
+			Error:     sendErr.Error(),
+			Time:      time.Now(),
+		})
+		if err != nil {
+			log.Errorf("failed to marshal the async send error of request %s error %v", requestID, err)
+			return
+		}
+		opts := pulsardriver.SendOptions{Properties: map[string]string{RequestIDProperty: requestID}}
+		// the callback must not block the producer of the failed send
+		go func() {
+			if _, err := pulsardriver.SendToPulsar(pulsarURL, token, callbackTopic, data, opts, false, false, 0); err != nil {
+				log.Errorf("failed to publish the async send error of request %s to %s error %v", requestID, callbackTopic, err)
+			}
+		}()
+	}
+}
+
 // VerifySubjectBasedOnTopic verifies the subject can meet the requirement.
+// A subject that is not allowed on the tenant can be allowed on the topic by the AllowedSubjects of its topic config.
 func VerifySubjectBasedOnTopic(topicFN, tokenSub string, evalTenant func(tenant, subjects string) bool) bool {
+	if VerifySubjectBasedOnTenant(topicFN, tokenSub, evalTenant) {
+		return true
+	}
+	return isAllowedTopicSubject(topicFN, tokenSub)
+}
+
+// VerifySubjectBasedOnTenant verifies the subject is allowed on the tenant of the topic.
+// It guards the operations on a tenant, such as the topic configs, that a subject allowed on a topic cannot perform.
+func VerifySubjectBasedOnTenant(topicFN, tokenSub string, evalTenant func(tenant, subjects string) bool) bool {
 	parts := strings.Split(topicFN, "/")
 	if len(parts) < 4 {
 		return false
@@ -493,46 +2824,226 @@ func GetTopicFnFromRoute(vars map[string]string) (string, error) {
 	return topicFn, nil
 }
 
+// TopicFnFromRouteOrQuery returns the topic full name from the route, or from the first value of the topic
+// query parameter if the route has no topic parts. The query parameter must be a fully qualified topic name.
+func TopicFnFromRouteOrQuery(vars map[string]string, params url.Values) (string, error) {
+	if _, ok := vars["topic"]; ok {
+		return GetTopicFnFromRoute(vars)
+	}
+	if topics, ok := params["topic"]; ok {
+		topicFN := strings.TrimSpace(strings.Split(topics[0], ",")[0])
+		if _, tenant, ns, topic, err := util.TokenizeTopicFullName(topicFN); err != nil || tenant == "" || ns == "" || topic == "" {
+			return "", fmt.Errorf("invalid topic %s, it must be a fully qualified topic name", topicFN)
+		}
+		return topicFN, nil
+	}
+	return "", errors.New("missing topic, either the route or the topic query parameter must specify a fully qualified topic name")
+}
+
+// PollInitialPosition returns the initial position for a poll subscription. It is earliest unless
+// the client explicitly requests a position, so that a new subscription does not skip messages between polls.
+func PollInitialPosition(params url.Values, requested pulsar.SubscriptionInitialPosition) pulsar.SubscriptionInitialPosition {
+	if _, ok := params["SubscriptionInitialPosition"]; ok {
+		return requested
+	}
+	return pulsar.SubscriptionPositionEarliest
+}
+
+// SSESubscriptionType returns the subscription type of an SSE consumer. A named subscription defaults to
+// shared so that the SSE clients of the same subscription on different beam instances consume it together
+// instead of failing on an exclusive subscription. An explicit SubscriptionType is honored.
+func SSESubscriptionType(params url.Values) string {
+	if subType, ok := params["SubscriptionType"]; ok && len(subType) > 0 {
+		return subType[0]
+	}
+	if params.Get("SubscriptionName") != "" {
+		return "shared"
+	}
+	return "exclusive"
+}
+
+// countConsumerSubscription counts the consumer requested by an HTTP client in metrics
+func countConsumerSubscription(endpoint string, cfg model.ConsumerConfig) {
+	util.ConsumerSubscriptions.WithLabelValues(
+		endpoint,
+		model.SubscriptionTypeName(cfg.SubscriptionType),
+		model.InitialPositionName(cfg.InitialPosition),
+	).Inc()
+}
+
 // ConsumerParams returns a configuration parameters for Pulsar consumer
-func ConsumerParams(params url.Values) (subName string, subInitPos pulsar.SubscriptionInitialPosition, subType pulsar.SubscriptionType, err error) {
-	subType, err = model.GetSubscriptionType(util.QueryParamString(params, "SubscriptionType", "exclusive"))
+// The subscription initial position is only applied to a brand new subscription. An existing durable
+// subscription, identified by SubscriptionName, resumes from its committed position regardless of the
+// requested initial position. An auto-generated NonResumable subscription is always new.
+// startTimestampMs, in epoch milliseconds, seeks the subscription to the message publish time.
+// permanent=true excludes a durable subscription from the auto-unsubscribe on inactivity.
+func ConsumerParams(params url.Values) (model.ConsumerConfig, error) {
+	cfg := model.ConsumerConfig{}
+	var err error
+	cfg.SubscriptionType, err = model.GetSubscriptionType(util.QueryParamString(params, "SubscriptionType", "exclusive"))
+	if err != nil {
+		return model.ConsumerConfig{}, err
+	}
+	// the lookback position seeks a new subscription by the lookback duration instead of replaying the topic,
+	// the consumer is created at the latest position and seeked to cfg.StartTime, see broker.SeekByStartTime
+	position := util.QueryParamString(params, "SubscriptionInitialPosition", "latest")
+	lookback := strings.EqualFold(position, model.LookbackPosition)
+	if lookback {
+		cfg.InitialPosition = pulsar.SubscriptionPositionLatest
+		cfg.StartTime, err = lookbackParam(params)
+	} else if util.QueryParamString(params, "lookback", "") != "" {
+		err = fmt.Errorf("lookback requires SubscriptionInitialPosition=%s", model.LookbackPosition)
+	} else if cfg.InitialPosition, err = model.GetInitialPosition(position); err == nil {
+		cfg.StartTime, err = startTimeParam(params)
+	}
+	if err != nil {
+		return model.ConsumerConfig{}, err
+	}
+
+	cfg.MaxRedeliveries, cfg.DeadLetterTopic, err = deadLetterParams(params, cfg.SubscriptionType)
 	if err != nil {
-		return "", -1, -1, err
+		return model.ConsumerConfig{}, err
 	}
-	subInitPos, err = model.GetInitialPosition(util.QueryParamString(params, "SubscriptionInitialPosition", "latest"))
+	cfg.ReceiverQueueSize, err = receiverQueueSizeParam(params)
 	if err != nil {
-		return "", -1, -1, err
+		return model.ConsumerConfig{}, err
+	}
+	// the pinned Pulsar client has no consumer ack timeout, see PollConsumerIdleTimeout for the redelivery
+	if _, ok := params["ackTimeoutMs"]; ok {
+		return model.ConsumerConfig{}, errors.New("ackTimeoutMs is not supported until the Pulsar client is upgraded")
 	}
 
-	subName = util.QueryParamString(params, "SubscriptionName", "")
+	subName := util.QueryParamString(params, "SubscriptionName", "")
 	if len(subName) == 0 {
 		name, err := util.NewUUID()
 		if err != nil {
-			return "", -1, -1, fmt.Errorf("failed to generate uuid error %v", err)
+			return model.ConsumerConfig{}, fmt.Errorf("failed to generate uuid error %v", err)
+		}
+		cfg.SubscriptionName = model.NonResumable + name
+		return cfg, nil
+	} else if err := ValidateSubscriptionName(subName); err != nil {
+		return model.ConsumerConfig{}, err
+	} else if lookback {
+		// a durable subscription would be seeked back again on every reconnect
+		return model.ConsumerConfig{}, errors.New("lookback is only supported with an auto-generated subscription")
+	}
+	cfg.SubscriptionName = subName
+	cfg.Permanent = util.StringToBool(util.QueryParamString(params, "permanent", "false"))
+	return cfg, nil
+}
+
+// ValidateSubscriptionName validates a client specified subscription name
+func ValidateSubscriptionName(subName string) error {
+	if minLength := subscriptionNameMinLength(); len(subName) < minLength {
+		return fmt.Errorf("subscription name is too short, it must be at least %d characters", minLength)
+	}
+	if strings.HasPrefix(subName, model.NonResumable) {
+		// such a name would be unsubscribed as an auto-generated subscription when the consumer closes
+		return fmt.Errorf("subscription name must not start with the reserved prefix %s", model.NonResumable)
+	}
+	return nil
+}
+
+// receiverQueueSizeParam parses the optional receiverQueueSize query parameter, it is 0 as the Pulsar client's
+// default if it is absent
+func receiverQueueSizeParam(params url.Values) (int, error) {
+	return util.QueryParamIntRange(params, "receiverQueueSize", 0, 1, maxReceiverQueueSize)
+}
+
+// deadLetterParams parses the optional maxRedeliveries and deadLetterTopic query parameters
+// The dead letter policy is only supported by the shared and key shared subscriptions.
+func deadLetterParams(params url.Values, subType pulsar.SubscriptionType) (uint32, string, error) {
+	maxRedeliveries := util.QueryParamInt(params, "maxRedeliveries", 0)
+	deadLetterTopic := util.QueryParamString(params, "deadLetterTopic", "")
+	if maxRedeliveries < 0 {
+		return 0, "", fmt.Errorf("maxRedeliveries must not be negative")
+	}
+	if maxRedeliveries == 0 {
+		if deadLetterTopic != "" {
+			return 0, "", fmt.Errorf("deadLetterTopic requires maxRedeliveries")
 		}
-		return model.NonResumable + name, subInitPos, subType, nil
-	} else if len(subName) < 5 {
-		return "", -1, -1, fmt.Errorf("subscription name must be more than 4 characters")
+		return 0, "", nil
+	}
+	if subType != pulsar.Shared && subType != pulsar.KeyShared {
+		return 0, "", fmt.Errorf("maxRedeliveries requires a shared or keyshared subscription")
+	}
+	return uint32(maxRedeliveries), deadLetterTopic, nil
+}
+
+// DeadLetterTopic returns the dead letter topic full name. A short topic name is in the same namespace as
+// the source topic. The dead letter topic must be in the same tenant as the source topic.
+func DeadLetterTopic(name, topicFN string) (string, error) {
+	dlt, err := topicInNamespace(name, topicFN)
+	if err != nil {
+		return "", err
 	}
-	return subName, subInitPos, subType, nil
+	_, tenant, _, _, _ := util.TokenizeTopicFullName(topicFN)
+	_, dltTenant, _, _, _ := util.TokenizeTopicFullName(dlt)
+	if tenant != dltTenant {
+		return "", fmt.Errorf("dead letter topic %s must be in the tenant %s", dlt, tenant)
+	}
+	return dlt, nil
+}
+
+// startTimeParam parses the optional startTimestampMs query parameter
+func startTimeParam(params url.Values) (time.Time, error) {
+	value := util.QueryParamString(params, "startTimestampMs", "")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return time.Time{}, fmt.Errorf("invalid startTimestampMs %s", value)
+	}
+	startTime := time.Unix(0, ms*int64(time.Millisecond))
+	if startTime.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("startTimestampMs %s is in the future", value)
+	}
+	return startTime, nil
+}
+
+// maxLookback is the longest lookback duration, the retention of a topic is rarely longer
+const maxLookback = 7 * 24 * time.Hour
+
+// lookbackParam returns the start time of the lookback query parameter, a duration such as 5m back from now
+func lookbackParam(params url.Values) (time.Time, error) {
+	value := util.QueryParamString(params, "lookback", "")
+	if util.QueryParamString(params, "startTimestampMs", "") != "" {
+		return time.Time{}, errors.New("lookback and startTimestampMs cannot be specified together")
+	}
+	lookback, err := time.ParseDuration(value)
+	if err != nil || lookback <= 0 || lookback > maxLookback {
+		return time.Time{}, fmt.Errorf("invalid lookback %s, it must be a duration such as 5m up to %v", value, maxLookback)
+	}
+	return time.Now().Add(-lookback), nil
 }
 
 // ConsumerConfigFromHTTPParts returns configuration parameters required to generate Pulsar Client and Consumer
-func ConsumerConfigFromHTTPParts(allowedClusters []string, h *http.Header, vars map[string]string, params url.Values) (token, topicFN, pulsarURL, subName string, subInitPos pulsar.SubscriptionInitialPosition, subType pulsar.SubscriptionType, err error) {
+func ConsumerConfigFromHTTPParts(allowedClusters []string, h *http.Header, vars map[string]string, params url.Values) (token, topicFN, pulsarURL string, cfg model.ConsumerConfig, err error) {
 	token, _, pulsarURL, err = util.ReceiverHeader(allowedClusters, h)
 	if err != nil {
-		return "", "", "", "", -1, -1, err
+		return "", "", "", model.ConsumerConfig{}, err
 	}
 
-	topicFN, err = GetTopicFnFromRoute(vars)
+	topicFN, err = TopicFnFromRouteOrQuery(vars, params)
 	if err != nil {
-		return "", "", "", "", -1, -1, err
+		return "", "", "", model.ConsumerConfig{}, err
 	}
 
-	subName, subInitPos, subType, err = ConsumerParams(params)
+	cfg, err = ConsumerParams(params)
 	if err != nil {
-		return "", "", "", "", -1, -1, err
+		return "", "", "", model.ConsumerConfig{}, err
+	}
+	if !cfg.StartTime.IsZero() && util.IsNonPersistentTopic(topicFN) {
+		return "", "", "", model.ConsumerConfig{}, errors.New("startTimestampMs and lookback are not supported on non-persistent topics")
+	}
+
+	if cfg.DeadLetterTopic != "" {
+		cfg.DeadLetterTopic, err = DeadLetterTopic(cfg.DeadLetterTopic, topicFN)
+		if err != nil {
+			return "", "", "", model.ConsumerConfig{}, err
+		}
 	}
 
-	return token, topicFN, pulsarURL, subName, subInitPos, subType, nil
+	return token, topicFN, pulsarURL, cfg, nil
 }
@@ -1,24 +1,146 @@
 package route
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	"github.com/sirupsen/logrus"
 )
 
-// Logger logs http traffic.
+// RequestIDHeader is the HTTP header carrying the request ID for distributed tracing
+const RequestIDHeader = "X-Request-Id"
+
+// RequestIDProperty is the message property carrying the request ID of the produce request
+const RequestIDProperty = "RequestId"
+
+// maxRequestIDLength limits the length of a request ID from a client
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// Logger logs http traffic with an access log entry per request. Every request is assigned a request ID,
+// from the X-Request-Id header or generated if it is absent, which is stored in the request context and
+// echoed in the response.
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		inner.ServeHTTP(w, r)
+		requestID := NewRequestID(r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, requestID)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID))
+
+		rw := &responseRecorder{ResponseWriter: w}
+		inner.ServeHTTP(rw, r)
+
+		logrus.WithFields(logrus.Fields{
+			"method":    r.Method,
+			"path":      r.URL.Path,
+			"route":     name,
+			"status":    rw.Status(),
+			"bytes":     rw.size,
+			"duration":  time.Since(start).String(),
+			"tenant":    mux.Vars(r)["tenant"],
+			"requestId": requestID,
+		}).Info("http request")
+	})
+}
+
+// responseRecorder captures the status code and the response size for the access log.
+// It implements http.Flusher and http.Hijacker for the SSE and WebSocket handlers.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += n
+	return n, err
+}
+
+// Status returns the response status code, 200 is implied if nothing is written
+func (rw *responseRecorder) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+func (rw *responseRecorder) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	rw.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// NewRequestID returns the request ID from a client if it is valid, otherwise a newly generated ID.
+// An ID is only accepted with printable ASCII characters so that it cannot forge log lines.
+func NewRequestID(id string) string {
+	valid := id != "" && len(id) <= maxRequestIDLength
+	for i := 0; valid && i < len(id); i++ {
+		valid = id[i] > ' ' && id[i] < 0x7f
+	}
+	if valid {
+		return id
+	}
+	id, err := util.NewUUID()
+	if err != nil {
+		id = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return id
+}
+
+// RequestID returns the request ID in the context, or empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLog returns a logger with the request ID field of the request
+func RequestLog(r *http.Request) *logrus.Entry {
+	return logrus.WithField("requestId", RequestID(r.Context()))
+}
 
-		log.Printf(
-			"%s\t%s\t%s\t%s",
-			r.Method,
-			r.RequestURI,
-			name,
-			time.Since(start),
-		)
+// ProduceLog returns a logger with the fields of a produce. The field names are stable for the log pipelines
+// that bill and audit the produced bytes. bufferSize is the message size sent to Pulsar, after the body is
+// decompressed and decoded and the request line and headers are included.
+func ProduceLog(r *http.Request, topicFN string, bufferSize int, async bool, status int) *logrus.Entry {
+	mode := "sync"
+	if async {
+		mode = "async"
+	}
+	return RequestLog(r).WithFields(logrus.Fields{
+		"topic":           topicFN,
+		"tenant":          util.TopicTenant(topicFN),
+		"bufferSize":      bufferSize,
+		"mode":            mode,
+		"contentEncoding": r.Header.Get("Content-Encoding"),
+		"status":          status,
 	})
 }
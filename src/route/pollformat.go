@@ -0,0 +1,152 @@
+package route
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// the media types of the poll response
+const (
+	jsonMediaType    = "application/json"
+	csvMediaType     = "text/csv"
+	msgpackMediaType = "application/msgpack"
+)
+
+// pollMediaTypes maps the accepted media types to the poll response media types
+var pollMediaTypes = map[string]string{
+	jsonMediaType:           jsonMediaType,
+	"application/*":         jsonMediaType,
+	"*/*":                   jsonMediaType,
+	csvMediaType:            csvMediaType,
+	"text/*":                csvMediaType,
+	msgpackMediaType:        msgpackMediaType,
+	"application/x-msgpack": msgpackMediaType,
+}
+
+// PollMediaType returns the poll response media type with the highest quality in the Accept header.
+// It defaults to JSON for an empty or unsupported Accept header.
+func PollMediaType(accept string) string {
+	mediaType, quality := jsonMediaType, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		supported, ok := pollMediaTypes[accepted]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		// the first media type wins a tie
+		if q > quality {
+			mediaType, quality = supported, q
+		}
+	}
+	return mediaType
+}
+
+// EncodePollMessages encodes the polled messages in the media type. JSON is the messages object,
+// CSV is a row of the id, payload, and JSON properties of every message, and msgpack is the array of messages.
+func EncodePollMessages(msgs model.PulsarMessages, mediaType string) ([]byte, error) {
+	switch mediaType {
+	case csvMediaType:
+		return encodeCSVMessages(msgs)
+	case msgpackMediaType:
+		return encodeMsgpackMessages(msgs), nil
+	default:
+		return json.Marshal(msgs)
+	}
+}
+
+// encodeCSVMessages writes the payloads as text unless the client requested base64 encoded payloads,
+// the ackId column is base64 encoded as in the JSON messages
+func encodeCSVMessages(msgs model.PulsarMessages) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"id", "payload", "properties", "ackId"})
+	for _, msg := range msgs.Messages {
+		payload := string(msg.Payload)
+		if msgs.PayloadEncoding == base64Encoding {
+			payload = base64.StdEncoding.EncodeToString(msg.Payload)
+		}
+		properties := ""
+		if len(msg.Properties) > 0 {
+			data, err := json.Marshal(msg.Properties)
+			if err != nil {
+				return nil, err
+			}
+			properties = string(data)
+		}
+		writer.Write([]string{msg.MessageID, payload, properties, base64.StdEncoding.EncodeToString(msg.AckID)})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// encodeMsgpackMessages writes every message as a map with the same keys as the JSON message,
+// the payload and ackId are binary and the times are timestamps
+func encodeMsgpackMessages(msgs model.PulsarMessages) []byte {
+	var e util.MsgpackEncoder
+	e.WriteArrayHeader(len(msgs.Messages))
+	for _, msg := range msgs.Messages {
+		fields := 6
+		if msg.Payload != nil {
+			fields++
+		}
+		if msg.OrderingKey != "" {
+			fields++
+		}
+		if len(msg.Properties) > 0 {
+			fields++
+		}
+		e.WriteMapHeader(fields)
+		if msg.Payload != nil {
+			e.WriteString("payload")
+			e.WriteBinary(msg.Payload)
+		}
+		e.WriteString("topic")
+		e.WriteString(msg.Topic)
+		e.WriteString("eventTime")
+		e.WriteTime(msg.EventTime)
+		e.WriteString("publishTime")
+		e.WriteTime(msg.PublishTime)
+		e.WriteString("messageId")
+		e.WriteString(msg.MessageID)
+		e.WriteString("key")
+		e.WriteString(msg.Key)
+		if msg.OrderingKey != "" {
+			e.WriteString("orderingKey")
+			e.WriteString(msg.OrderingKey)
+		}
+		if len(msg.Properties) > 0 {
+			e.WriteString("properties")
+			keys := make([]string, 0, len(msg.Properties))
+			for key := range msg.Properties {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			e.WriteMapHeader(len(keys))
+			for _, key := range keys {
+				e.WriteString(key)
+				e.WriteString(msg.Properties[key])
+			}
+		}
+		e.WriteString("ackId")
+		e.WriteBinary(msg.AckID)
+	}
+	return e.Bytes()
+}
@@ -0,0 +1,53 @@
+package route
+
+import (
+	"sync"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// produceEventBufferSize is the number of produce events buffered for a subscriber,
+// the events are dropped once the buffer of a slow subscriber is full
+const produceEventBufferSize = 100
+
+// produceEventSubscribers are the channels of the produce event streams by tenant
+var (
+	produceEventSubscribers     = make(map[string]map[chan model.ProduceEvent]bool)
+	produceEventSubscribersLock sync.RWMutex
+)
+
+// SubscribeProduceEvents subscribes to the produce events of the topics in the tenant.
+// The returned function must be called to unsubscribe once the stream is closed.
+func SubscribeProduceEvents(tenant string) (<-chan model.ProduceEvent, func()) {
+	ch := make(chan model.ProduceEvent, produceEventBufferSize)
+	produceEventSubscribersLock.Lock()
+	if produceEventSubscribers[tenant] == nil {
+		produceEventSubscribers[tenant] = make(map[chan model.ProduceEvent]bool)
+	}
+	produceEventSubscribers[tenant][ch] = true
+	produceEventSubscribersLock.Unlock()
+
+	return ch, func() {
+		produceEventSubscribersLock.Lock()
+		defer produceEventSubscribersLock.Unlock()
+		delete(produceEventSubscribers[tenant], ch)
+		if len(produceEventSubscribers[tenant]) == 0 {
+			delete(produceEventSubscribers, tenant)
+		}
+	}
+}
+
+// PublishProduceEvent delivers a produce event to the subscribers of the topic's tenant.
+// It never blocks the produce path, an event is dropped for a subscriber whose buffer is full.
+func PublishProduceEvent(event model.ProduceEvent) {
+	tenant := util.TopicTenant(event.Topic)
+	produceEventSubscribersLock.RLock()
+	defer produceEventSubscribersLock.RUnlock()
+	for ch := range produceEventSubscribers[tenant] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
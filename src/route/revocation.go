@@ -0,0 +1,97 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/db"
+	"github.com/kafkaesque-io/pulsar-beam/src/middleware"
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// revocationCheckTTL is how long a revocation lookup is cached before the database is checked again
+const revocationCheckTTL = 30 * time.Second
+
+// RevokeTokenRequest is the request body of the token revocation endpoint, either token or subject is required
+type RevokeTokenRequest struct {
+	Token   string `json:"token"`
+	Subject string `json:"subject"`
+}
+
+// revocationStatus is a cached revocation lookup
+type revocationStatus struct {
+	revoked   bool
+	checkedAt time.Time
+}
+
+// NewRevocationChecker returns a middleware.RevocationChecker backed by the revocation store.
+// The lookups are cached for a short TTL so that the database is not queried on every request.
+func NewRevocationChecker(store db.Revocation, ttl time.Duration) middleware.RevocationChecker {
+	cache := util.NewCache(util.CacheOption{
+		TTL:            10 * ttl,
+		CleanInterval:  ttl,
+		ExpireCallback: func(key string, value interface{}) {},
+	})
+
+	isRevoked := func(key string) bool {
+		if v, ok := cache.Get(key); ok && time.Since(v.(revocationStatus).checkedAt) < ttl {
+			return v.(revocationStatus).revoked
+		}
+		_, err := store.GetRevocation(key)
+		if err != nil && err.Error() != db.DocNotFound {
+			// do not lock out every client when the database is not reachable
+			log.Errorf("failed to look up token revocation error %v", err)
+			return false
+		}
+		cache.Set(key, revocationStatus{revoked: err == nil, checkedAt: time.Now()})
+		return err == nil
+	}
+
+	return func(tokenStr, subject string) bool {
+		return isRevoked(model.TokenRevocationKey(tokenStr)) || isRevoked(model.SubjectRevocationKey(subject))
+	}
+}
+
+// RevokeTokenHandler revokes a token or all tokens of a subject, only super roles are allowed
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSuperUser(r) {
+		util.ResponseErrorJSON(errors.New("only super roles can revoke tokens"), w, http.StatusForbidden)
+		return
+	}
+
+	var req RevokeTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	doc := model.RevokedToken{RevokedAt: time.Now()}
+	switch {
+	case req.Token != "":
+		doc.Key = model.TokenRevocationKey(req.Token)
+	case req.Subject != "":
+		doc.Key = model.SubjectRevocationKey(req.Subject)
+		doc.Subject = req.Subject
+	default:
+		util.ResponseErrorJSON(errors.New("token or subject is required"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := singleDb.Revoke(&doc); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	log.Warnf("revoked %s", util.AssignString(doc.Subject, "a token"))
+
+	resJSON, err := json.Marshal(doc)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(resJSON)
+}
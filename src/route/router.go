@@ -15,17 +15,41 @@ import (
 func NewRouter(mode *string) *mux.Router {
 
 	router := mux.NewRouter().StrictSlash(true)
+	methods := make(map[string][]string)
+	patterns := []string{}
 	for _, route := range GetEffectiveRoutes(mode) {
 		var handler http.Handler
 
-		handler = route.HandlerFunc
+		// the logger is the outermost so that a request rejected by the auth also has a request ID
+		switch {
+		case route.AuthExempt:
+			handler = middleware.NoAuth(route.HandlerFunc)
+		case route.AuthFunc != nil:
+			// a tenant's rate limit is only charged once the request is authenticated
+			handler = route.AuthFunc(middleware.LimitTenantRate(route.HandlerFunc))
+		default:
+			log.Panicf("route %s %s must have an AuthFunc unless it is auth-exempt", route.Method, route.Pattern)
+		}
 		handler = Logger(handler, route.Name)
 
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(route.AuthFunc(handler))
+			Handler(handler)
+
+		if _, ok := methods[route.Pattern]; !ok {
+			patterns = append(patterns, route.Pattern)
+		}
+		methods[route.Pattern] = append(methods[route.Pattern], route.Method)
+	}
+
+	// CORS preflight requests carry no credentials so that they are not authenticated
+	for _, pattern := range patterns {
+		router.
+			Methods(http.MethodOptions).
+			Path(pattern).
+			Handler(Logger(middleware.CORSPreflight(methods[pattern]), "cors-preflight"))
 	}
 	
 	router.Handle("/debug/pprof", http.HandlerFunc(pprof.Index))
@@ -37,6 +61,8 @@ func NewRouter(mode *string) *mux.Router {
 	router.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
 	router.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
 	
+	// CORS is the outer middleware so that a request rejected by the rate limit also has the CORS headers
+	router.Use(middleware.CORS)
 	// TODO rate limit can be added per route basis
 	router.Use(middleware.LimitRate)
 
@@ -46,7 +72,7 @@ func NewRouter(mode *string) *mux.Router {
 
 // GetEffectiveRoutes gets effective routes
 func GetEffectiveRoutes(mode *string) Routes {
-	return append(PrometheusRoute, getRoutes(mode)...)
+	return append(append(PrometheusRoute, HealthRoute...), getRoutes(mode)...)
 }
 
 func getRoutes(mode *string) Routes {
@@ -9,12 +9,15 @@ import (
 )
 
 // Route - HTTP Route
+// An AuthExempt route, such as the metrics and the health checks, is served without the AuthFunc so that
+// an internal client needs no credentials. Every other route must have an AuthFunc.
 type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
 	AuthFunc    mux.MiddlewareFunc
+	AuthExempt  bool
 }
 
 // Routes list of HTTP Routes
@@ -28,6 +31,7 @@ var TokenServerRoutes = Routes{
 		"/subject/{sub}",
 		TokenSubjectHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 }
 
@@ -38,7 +42,20 @@ var PrometheusRoute = Routes{
 		http.MethodGet,
 		"/metrics",
 		promhttp.Handler().ServeHTTP,
-		middleware.NoAuth,
+		nil,
+		true,
+	},
+}
+
+// HealthRoute definition
+var HealthRoute = Routes{
+	Route{
+		"health",
+		http.MethodGet,
+		"/health",
+		HealthHandler,
+		nil,
+		true,
 	},
 }
 
@@ -49,7 +66,8 @@ var ReceiverRoutes = Routes{
 		"GET",
 		"/status",
 		StatusPage,
-		middleware.AuthHeaderRequired,
+		nil,
+		true,
 	},
 	Route{
 		"Receive",
@@ -57,6 +75,7 @@ var ReceiverRoutes = Routes{
 		"/v1/firehose",
 		ReceiveHandler,
 		middleware.NoAuth,
+		false,
 	},
 	Route{
 		"Receive",
@@ -64,6 +83,31 @@ var ReceiverRoutes = Routes{
 		"/v2/firehose/{persistent}/{tenant}/{namespace}/{topic}",
 		ReceiveHandler,
 		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"Receive",
+		"POST",
+		"/v2/firehose",
+		ReceiveHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"produce-events",
+		http.MethodGet,
+		"/v2/firehose/{tenant}",
+		ProduceEventsHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"batch-publish",
+		http.MethodPost,
+		"/v2/publish/batch/{persistent}/{tenant}/{namespace}/{topic}",
+		BatchPublishHandler,
+		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"http-sse",
@@ -71,6 +115,31 @@ var ReceiverRoutes = Routes{
 		"/v2/sse/{persistent}/{tenant}/{namespace}/{topic}",
 		SSEHandler,
 		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"http-reader",
+		http.MethodGet,
+		"/v2/reader/{persistent}/{tenant}/{namespace}/{topic}",
+		ReaderHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"replay",
+		http.MethodGet,
+		"/v2/replay/{persistent}/{tenant}/{namespace}/{topic}",
+		ReplayHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"websocket",
+		http.MethodGet,
+		"/v2/ws/{persistent}/{tenant}/{namespace}/{topic}",
+		WebSocketHandler,
+		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"poll-messages",
@@ -78,17 +147,115 @@ var ReceiverRoutes = Routes{
 		"/v2/poll/{persistent}/{tenant}/{namespace}/{topic}",
 		PollHandler,
 		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"poll-messages",
+		http.MethodGet,
+		"/v2/poll",
+		PollHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"ack-messages",
+		http.MethodPost,
+		"/v2/ack/{persistent}/{tenant}/{namespace}/{topic}",
+		AckHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"create-subscription",
+		http.MethodPut,
+		"/v2/subscription/{persistent}/{tenant}/{namespace}/{topic}/{subName}",
+		CreateSubscriptionHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"delete-subscription",
+		http.MethodDelete,
+		"/v2/subscription/{persistent}/{tenant}/{namespace}/{topic}/{subName}",
+		DeleteSubscriptionHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"subscription-lag",
+		http.MethodGet,
+		"/v2/lag/{persistent}/{tenant}/{namespace}/{topic}/{subName}",
+		LagHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"topic-stats",
+		http.MethodGet,
+		"/v2/stats/{persistent}/{tenant}/{namespace}/{topic}",
+		StatsHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"last-message-id",
+		http.MethodGet,
+		"/v2/last-message-id/{persistent}/{tenant}/{namespace}/{topic}",
+		LastMessageIDHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"flush-cache",
+		http.MethodPost,
+		"/v2/admin/flush-cache",
+		FlushCacheHandler,
+		middleware.AuthVerifyJWT,
+		false,
 	},
 }
 
 // RestRoutes definition
 var RestRoutes = Routes{
+	Route{
+		"Revoke a token",
+		http.MethodPost,
+		"/v2/revoke",
+		RevokeTokenHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"List topics",
+		http.MethodGet,
+		"/v2/topics",
+		GetTopicsHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"Export topics",
+		http.MethodGet,
+		"/v2/topics/export",
+		ExportTopicsHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
+	Route{
+		"Import topics",
+		http.MethodPost,
+		"/v2/topics/import",
+		ImportTopicsHandler,
+		middleware.AuthVerifyJWT,
+		false,
+	},
 	Route{
 		"Get a topic with key",
 		"GET",
 		"/v2/topic/{topicKey}",
 		GetTopicHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"Get a topic",
@@ -96,6 +263,7 @@ var RestRoutes = Routes{
 		"/v2/topic",
 		GetTopicHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"Update a topic",
@@ -103,6 +271,7 @@ var RestRoutes = Routes{
 		"/v2/topic",
 		UpdateTopicHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"Delete a topic with key",
@@ -110,6 +279,7 @@ var RestRoutes = Routes{
 		"/v2/topic/{topicKey}",
 		DeleteTopicHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 	Route{
 		"Delete a topic",
@@ -117,5 +287,6 @@ var RestRoutes = Routes{
 		"/v2/topic",
 		DeleteTopicHandler,
 		middleware.AuthVerifyJWT,
+		false,
 	},
 }
@@ -0,0 +1,25 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+)
+
+// TopicRouter returns the destination topic of a message by the routing rules of the topic key.
+// It returns empty if the topic has no rule matching the headers.
+type TopicRouter func(topicKey string, h http.Header) string
+
+// RouteTopic picks the destination topic in ReceiveHandler, messages are sent to the requested topic if it is nil
+var RouteTopic TopicRouter
+
+// NewTopicRouter returns a TopicRouter backed by the routing rules of the topic configs
+func NewTopicRouter(lookup TopicConfigLookup) TopicRouter {
+	return func(topicKey string, h http.Header) string {
+		doc := lookup(topicKey)
+		if doc == nil {
+			return ""
+		}
+		return model.MatchRoutingRule(doc.RoutingRules, h)
+	}
+}
@@ -0,0 +1,59 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// PayloadValidator validates a payload against the JSON schema of the topic key.
+// It returns the validation errors, which are empty if the payload is valid or the topic has no schema.
+type PayloadValidator func(topicKey string, payload []byte) []string
+
+// ValidatePayload validates the payloads in ReceiveHandler, no schema is validated if it is nil
+var ValidatePayload PayloadValidator
+
+// topicSchema is a compiled schema and its source, a nil schema means the source failed to compile
+type topicSchema struct {
+	schema *gojsonschema.Schema
+	source json.RawMessage
+}
+
+// NewSchemaValidator returns a PayloadValidator backed by the schemas of the topic configs.
+// The compiled schemas are cached per topic and only recompiled when the schema document changes.
+func NewSchemaValidator(lookup TopicConfigLookup) PayloadValidator {
+	compiled := util.NewCache(util.CacheOption{
+		TTL:            10 * topicConfigCheckTTL,
+		CleanInterval:  topicConfigCheckTTL,
+		ExpireCallback: func(key string, value interface{}) {},
+	})
+
+	getSchema := func(topicKey string) *gojsonschema.Schema {
+		doc := lookup(topicKey)
+		if doc == nil || len(doc.JSONSchema) == 0 {
+			return nil
+		}
+		if cached, exists := compiled.Get(topicKey); exists && bytes.Equal(cached.(topicSchema).source, doc.JSONSchema) {
+			return cached.(topicSchema).schema
+		}
+		entry := topicSchema{source: doc.JSONSchema}
+		var err error
+		if entry.schema, err = model.CompileJSONSchema(doc.JSONSchema); err != nil {
+			log.Errorf("failed to compile the schema of topic %s error %v", doc.TopicFullName, err)
+		}
+		compiled.Set(topicKey, entry)
+		return entry.schema
+	}
+
+	return func(topicKey string, payload []byte) []string {
+		schema := getSchema(topicKey)
+		if schema == nil {
+			return nil
+		}
+		return model.ValidateJSONPayload(schema, payload)
+	}
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+)
+
+// sseConnections is the number of open SSE connections across all topics
+var sseConnections int64
+
+// topicSSEConnections is the number of open SSE connections per topic
+var (
+	topicSSEConnections     = make(map[string]int)
+	topicSSEConnectionsLock sync.Mutex
+)
+
+// AcquireSSEConnection counts an SSE connection to the topic against SSEMaxConnections and
+// SSEMaxConnectionsPerTopic. It returns false if either cap is reached, otherwise the returned
+// release function must be called once the connection is closed.
+func AcquireSSEConnection(topicFN string) (release func(), ok bool) {
+	cfg := util.GetConfig()
+	if total := atomic.AddInt64(&sseConnections, 1); cfg.SSEMaxConnections > 0 && total > int64(cfg.SSEMaxConnections) {
+		atomic.AddInt64(&sseConnections, -1)
+		return nil, false
+	}
+
+	topicSSEConnectionsLock.Lock()
+	if cfg.SSEMaxConnectionsPerTopic > 0 && topicSSEConnections[topicFN] >= cfg.SSEMaxConnectionsPerTopic {
+		topicSSEConnectionsLock.Unlock()
+		atomic.AddInt64(&sseConnections, -1)
+		return nil, false
+	}
+	topicSSEConnections[topicFN]++
+	util.TopicSSEConnections.WithLabelValues(topicFN).Inc()
+	topicSSEConnectionsLock.Unlock()
+
+	return func() { releaseSSEConnection(topicFN) }, true
+}
+
+func releaseSSEConnection(topicFN string) {
+	atomic.AddInt64(&sseConnections, -1)
+
+	topicSSEConnectionsLock.Lock()
+	defer topicSSEConnectionsLock.Unlock()
+	if topicSSEConnections[topicFN]--; topicSSEConnections[topicFN] <= 0 {
+		// a topic without connection is removed to keep the gauge's label cardinality bounded
+		delete(topicSSEConnections, topicFN)
+		util.TopicSSEConnections.DeleteLabelValues(topicFN)
+		return
+	}
+	util.TopicSSEConnections.WithLabelValues(topicFN).Dec()
+}
@@ -0,0 +1,48 @@
+package route
+
+import (
+	"time"
+
+	"github.com/kafkaesque-io/pulsar-beam/src/db"
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// topicConfigCheckTTL is how long a topic config is cached before the database is checked for an update
+const topicConfigCheckTTL = 30 * time.Second
+
+// TopicConfigLookup returns the topic config of a topic key, or nil if the topic has none
+type TopicConfigLookup func(topicKey string) *model.TopicConfig
+
+// cachedTopicConfig is a cached topic config, a nil doc means the topic has none
+type cachedTopicConfig struct {
+	doc       *model.TopicConfig
+	checkedAt time.Time
+}
+
+// NewTopicConfigLookup returns a TopicConfigLookup backed by the topic configs in the store.
+// The topic configs, and the topics without one, are cached per topic key for the ttl.
+func NewTopicConfigLookup(store db.Crud, ttl time.Duration) TopicConfigLookup {
+	cache := util.NewCache(util.CacheOption{
+		TTL:            10 * ttl,
+		CleanInterval:  ttl,
+		ExpireCallback: func(key string, value interface{}) {},
+	})
+
+	return func(topicKey string) *model.TopicConfig {
+		if cached, exists := cache.Get(topicKey); exists && time.Since(cached.(cachedTopicConfig).checkedAt) < ttl {
+			return cached.(cachedTopicConfig).doc
+		}
+		doc, err := store.GetByKey(topicKey)
+		if err != nil {
+			if err.Error() != db.DocNotFound {
+				// a topic is treated as having no config when the database is not reachable
+				log.Errorf("failed to look up the topic config of topic key %s error %v", topicKey, err)
+			}
+			doc = nil
+		}
+		cache.Set(topicKey, cachedTopicConfig{doc: doc, checkedAt: time.Now()})
+		return doc
+	}
+}
@@ -1,10 +1,18 @@
 package tests
 
 import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	. "github.com/kafkaesque-io/pulsar-beam/src/icrypto"
 )
 
@@ -169,3 +177,109 @@ func TestJWTRSASignAndVerifyWithPKCS12Keys(t *testing.T) {
 	equals(t, expireOffset, 3600)
 
 }
+
+func TestJWTTokenExpiry(t *testing.T) {
+	privateKeyPath := "./example_private_key"
+	publicKeyPath := "./example_public_key.pub"
+	authen := NewRSAKeyPair(privateKeyPath, publicKeyPath)
+
+	tokenString, expiresAt, err := authen.GenerateTokenWithExpiry("myadmin", time.Hour)
+	errNil(t, err)
+	assert(t, expiresAt.After(time.Now().Add(59*time.Minute)), "token expires in an hour")
+	subjects, err := authen.GetTokenSubject(tokenString)
+	errNil(t, err)
+	equals(t, "myadmin", subjects)
+
+	_, expiresAt, err = authen.GenerateTokenWithExpiry("myadmin", 0)
+	errNil(t, err)
+	assert(t, expiresAt.IsZero(), "token never expires")
+
+	expired := jwt.New(jwt.SigningMethodRS256)
+	expired.Claims = jwt.MapClaims{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+		"sub": "myadmin",
+	}
+	tokenString, err = expired.SignedString(authen.PrivateKey)
+	errNil(t, err)
+	_, err = authen.GetTokenSubject(tokenString)
+	assert(t, err != nil, "expired token is rejected")
+}
+
+// jwksServer serves the public key of the example key pair as a JWKS with the key ID
+func jwksServer(t *testing.T, kid string, publicKey *rsa.PublicKey, fetches *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		errNil(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			}},
+		}))
+	}))
+}
+
+// signJWKSToken signs the claims with the example private key and the key ID
+func signJWKSToken(t *testing.T, privateKey *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(privateKey)
+	errNil(t, err)
+	return tokenString
+}
+
+func TestJWKS(t *testing.T) {
+	keys := NewRSAKeyPair("./example_private_key", "./example_public_key.pub")
+	var fetches int32
+	server := jwksServer(t, "key1", keys.PublicKey, &fetches)
+	defer server.Close()
+
+	jwks := NewJWKS(server.URL, "https://idp.example.com/", "pulsar-beam", time.Hour)
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://idp.example.com/",
+			"aud": []string{"pulsar-beam", "other"},
+			"exp": time.Now().Add(time.Minute).Unix(),
+			"sub": "myadmin",
+		}
+	}
+
+	subjects, err := jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key1", claims()))
+	errNil(t, err)
+	equals(t, "myadmin", subjects)
+	subjects, err = jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key1", claims()))
+	errNil(t, err)
+	equals(t, "myadmin", subjects)
+	equals(t, int32(1), atomic.LoadInt32(&fetches))
+
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://other.example.com/"
+	_, err = jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key1", wrongIssuer))
+	equals(t, "invalid issuer", err.Error())
+
+	wrongAudience := claims()
+	wrongAudience["aud"] = "other"
+	_, err = jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key1", wrongAudience))
+	equals(t, "invalid audience", err.Error())
+
+	expired := claims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key1", expired))
+	assert(t, err != nil, "expired token is rejected")
+
+	// an unknown key ID is looked up at most once within the minimum refresh interval
+	_, err = jwks.GetTokenSubject(signJWKSToken(t, keys.PrivateKey, "key2", claims()))
+	assert(t, err != nil, "token signed by an unknown key is rejected")
+	equals(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// the token of beam's static key pair has no key ID, accepted if the JWKS has a single key
+	tokenString, err := keys.GenerateToken("myadmin")
+	errNil(t, err)
+	_, err = NewJWKS(server.URL, "", "", time.Hour).GetTokenSubject(tokenString)
+	errNil(t, err)
+	_, err = jwks.GetTokenSubject(tokenString)
+	equals(t, "invalid issuer", err.Error())
+}
@@ -1,10 +1,13 @@
 package tests
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kafkaesque-io/pulsar-beam/src/broker"
 	. "github.com/kafkaesque-io/pulsar-beam/src/db"
@@ -75,9 +78,21 @@ func TestMongoDbDriver(t *testing.T) {
 	equals(t, err != nil, true)
 
 	var key string
+	topic.AllowedSubjects = []string{"partner"}
 	key, err = mongodb.Update(&topic)
 	errNil(t, err)
 	equals(t, key != "", true)
+	updated, err := mongodb.GetByKey(key)
+	errNil(t, err)
+	equals(t, []string{"partner"}, updated.AllowedSubjects)
+
+	// revoke the allowed subjects
+	topic.AllowedSubjects = nil
+	_, err = mongodb.Update(&topic)
+	errNil(t, err)
+	updated, err = mongodb.GetByKey(key)
+	errNil(t, err)
+	equals(t, 0, len(updated.AllowedSubjects))
 
 	res, err := mongodb.Load()
 	if err != nil {
@@ -181,9 +196,21 @@ func TestInMemoryDatabase(t *testing.T) {
 	equals(t, err != nil, true)
 
 	var key string
+	topic.AllowedSubjects = []string{"partner"}
 	key, err = inmemorydb.Update(&topic)
 	errNil(t, err)
 	equals(t, key != "", true)
+	updated, err := inmemorydb.GetByKey(key)
+	errNil(t, err)
+	equals(t, []string{"partner"}, updated.AllowedSubjects)
+
+	// revoke the allowed subjects
+	topic.AllowedSubjects = nil
+	_, err = inmemorydb.Update(&topic)
+	errNil(t, err)
+	updated, err = inmemorydb.GetByKey(key)
+	errNil(t, err)
+	equals(t, 0, len(updated.AllowedSubjects))
 
 	res, err := inmemorydb.Load()
 	if err != nil {
@@ -326,3 +353,105 @@ func TestPulsarDbDriver(t *testing.T) {
 	// Comment out because there are other test cases require database.
 	errNil(t, pulsardb.Close())
 }
+
+func TestInMemoryRevocation(t *testing.T) {
+	inmemorydb, err := NewInMemoryHandler()
+	errNil(t, err)
+
+	_, err = inmemorydb.GetRevocation(model.SubjectRevocationKey("leaked"))
+	equals(t, DocNotFound, err.Error())
+
+	errNil(t, inmemorydb.Revoke(&model.RevokedToken{Key: model.SubjectRevocationKey("leaked"), Subject: "leaked"}))
+	doc, err := inmemorydb.GetRevocation(model.SubjectRevocationKey("leaked"))
+	errNil(t, err)
+	equals(t, "leaked", doc.Subject)
+
+	// the revocations are checked by every request while a token is revoked
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			subject := fmt.Sprintf("subject%d", i)
+			errNil(t, inmemorydb.Revoke(&model.RevokedToken{Key: model.SubjectRevocationKey(subject), Subject: subject}))
+			_, err := inmemorydb.GetRevocation(model.SubjectRevocationKey("leaked"))
+			errNil(t, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestInMemoryList(t *testing.T) {
+	inmemorydb, err := NewInMemoryHandler()
+	errNil(t, err)
+
+	pulsarURL := "pulsar+ssl://useast1.gcp.kafkaesque.io:6651"
+	for _, topicFullName := range []string{
+		"persistent://tenant1/ns/topic1",
+		"persistent://tenant1/ns/topic2",
+		"persistent://tenant1/ns/topic3",
+		"persistent://tenant2/ns/topic1",
+	} {
+		topic, err := model.NewTopicConfig(topicFullName, pulsarURL, "token")
+		errNil(t, err)
+		_, err = inmemorydb.Create(&topic)
+		errNil(t, err)
+	}
+
+	tenant1 := func(doc *model.TopicConfig) bool { return strings.HasPrefix(doc.TopicFullName, "persistent://tenant1/") }
+	page1, total, err := inmemorydb.List(tenant1, 2, 0)
+	errNil(t, err)
+	equals(t, 3, total)
+	equals(t, 2, len(page1))
+	assert(t, page1[0].Key < page1[1].Key, "ordered by key")
+
+	page2, total, err := inmemorydb.List(tenant1, 2, 2)
+	errNil(t, err)
+	equals(t, 3, total)
+	equals(t, 1, len(page2))
+	assert(t, page2[0].Key != page1[0].Key && page2[0].Key != page1[1].Key, "pages do not overlap")
+
+	page3, total, err := inmemorydb.List(tenant1, 2, 4)
+	errNil(t, err)
+	equals(t, 3, total)
+	equals(t, 0, len(page3))
+
+	_, total, err = inmemorydb.List(nil, 10, 0)
+	errNil(t, err)
+	equals(t, 4, total)
+}
+
+func TestTopicConfigExpiry(t *testing.T) {
+	inmemorydb, err := NewInMemoryHandler()
+	errNil(t, err)
+
+	pulsarURL := "pulsar+ssl://useast1.gcp.kafkaesque.io:6651"
+	topic, err := model.NewTopicConfig("persistent://tenant1/ns/ephemeral", pulsarURL, "token")
+	errNil(t, err)
+	expiresAt := time.Now().Add(-time.Minute)
+	topic.ExpiresAt = &expiresAt
+	_, err = model.ValidateTopicConfig(topic)
+	equals(t, "ExpiresAt must be in the future", err.Error())
+
+	key, err := inmemorydb.Create(&topic)
+	errNil(t, err)
+	permanent, err := model.NewTopicConfig("persistent://tenant1/ns/permanent", pulsarURL, "token")
+	errNil(t, err)
+	_, err = inmemorydb.Create(&permanent)
+	errNil(t, err)
+
+	// an expired config is not found before the sweeper deletes it
+	_, err = inmemorydb.GetByKey(key)
+	equals(t, DocNotFound, err.Error())
+
+	reaped, err := ReapExpiredTopics(inmemorydb, time.Now())
+	errNil(t, err)
+	equals(t, 1, reaped)
+	_, total, err := inmemorydb.List(nil, 10, 0)
+	errNil(t, err)
+	equals(t, 1, total)
+
+	reaped, err = ReapExpiredTopics(inmemorydb, time.Now())
+	errNil(t, err)
+	equals(t, 0, reaped)
+}
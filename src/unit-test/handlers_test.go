@@ -1,17 +1,35 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/gorilla/mux"
+	"github.com/kafkaesque-io/pulsar-beam/src/broker"
+	"github.com/kafkaesque-io/pulsar-beam/src/db"
+	"github.com/kafkaesque-io/pulsar-beam/src/middleware"
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
+	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
 	. "github.com/kafkaesque-io/pulsar-beam/src/route"
 	"github.com/kafkaesque-io/pulsar-beam/src/util"
 )
@@ -53,7 +71,27 @@ func TestTokenServerHandler(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	equals(t, http.StatusOK, rr.Code)
 
+	var resp TokenServerResponse
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	equals(t, int64(0), resp.ExpiresAt)
+
+	req = httptest.NewRequest(http.MethodGet, "/subject?exp=1h", nil)
+	req = mux.SetURLVars(req, map[string]string{"sub": "auser"})
+	req.Header.Set("injectedSubs", "myadmin")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code)
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert(t, resp.ExpiresAt > time.Now().Unix(), "token has an expiration")
+
+	req = httptest.NewRequest(http.MethodGet, "/subject?exp=tomorrow", nil)
+	req = mux.SetURLVars(req, map[string]string{"sub": "auser"})
+	req.Header.Set("injectedSubs", "myadmin")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
 }
+
 func TestTopicHandler(t *testing.T) {
 	// bootstrap set up
 	os.Setenv("PULSAR_BEAM_CONFIG", "../../config/pulsar_beam.json")
@@ -284,6 +322,70 @@ func TestTopicConfig(t *testing.T) {
 	topic.Webhooks[1].InitialPosition = "earliest"
 	_, err = model.ValidateTopicConfig(topic)
 	errNil(t, err)
+
+	topic.Webhooks[1].Compression = "deflate"
+	_, err = model.ValidateTopicConfig(topic)
+	assertErr(t, "unsupported webhook compression deflate", err)
+
+	topic.Webhooks[1].Compression = model.GzipCompression
+	topic.Webhooks[1].CompressionMinSize = -1
+	_, err = model.ValidateTopicConfig(topic)
+	assert(t, err != nil, "negative compression minimum size")
+
+	topic.Webhooks[1].CompressionMinSize = 2048
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+
+	topic.JSONSchema = json.RawMessage(`{"type": "object", "required": ["id"]}`)
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+
+	topic.JSONSchema = json.RawMessage(`{"type": "unknown"}`)
+	_, err = model.ValidateTopicConfig(topic)
+	assert(t, err != nil, "invalid JSON schema")
+
+	// only local references are resolved, a reference never reaches the network or the file system
+	topic.JSONSchema = json.RawMessage(`{"definitions": {"id": {"type": "integer"}}, "properties": {"id": {"$ref": "#/definitions/id"}}}`)
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+	for _, ref := range []string{"http://169.254.169.254/latest/meta-data", "file:///etc/passwd", "other.json#/id"} {
+		topic.JSONSchema = json.RawMessage(`{"properties": {"id": {"$ref": "` + ref + `"}}}`)
+		_, err = model.ValidateTopicConfig(topic)
+		assert(t, err != nil && strings.Contains(err.Error(), "must be a local reference"), "remote reference "+ref)
+	}
+	// an $id base makes a local pointer resolve within the document
+	topic.JSONSchema = json.RawMessage(`{"$id": "http://internal.net/schema.json", "definitions": {"id": {"type": "integer"}}, "properties": {"id": {"$ref": "#/definitions/id"}}}`)
+	schema, err := model.CompileJSONSchema(topic.JSONSchema)
+	errNil(t, err)
+	equals(t, 1, len(model.ValidateJSONPayload(schema, []byte(`{"id": "a"}`))))
+}
+
+func TestGetSubscriptionType(t *testing.T) {
+	for name, expected := range map[string]pulsar.SubscriptionType{
+		"":           pulsar.Exclusive,
+		"exclusive":  pulsar.Exclusive,
+		"Exclusive":  pulsar.Exclusive,
+		"shared":     pulsar.Shared,
+		"SHARED":     pulsar.Shared,
+		"failover":   pulsar.Failover,
+		"Failover":   pulsar.Failover,
+		"key_shared": pulsar.KeyShared,
+		"Key_Shared": pulsar.KeyShared,
+		"keyshared":  pulsar.KeyShared,
+	} {
+		subType, err := model.GetSubscriptionType(name)
+		errNil(t, err)
+		equals(t, expected, subType)
+	}
+
+	for _, name := range []string{"key-shared", "exclusive ", "round-robin"} {
+		_, err := model.GetSubscriptionType(name)
+		assert(t, err != nil, "unsupported subscription type "+name)
+		assert(t, strings.Contains(err.Error(), "valid values are exclusive, shared, failover, and key_shared"), "valid values are listed")
+	}
+
+	equals(t, pulsar.KeySharedPolicyModeAutoSplit, model.KeySharedPolicy(pulsar.KeyShared).Mode)
+	assert(t, model.KeySharedPolicy(pulsar.Shared) == nil, "no key shared policy for a shared subscription")
 }
 
 // test other topic model functions
@@ -304,6 +406,22 @@ func TestTopicModelFunctions(t *testing.T) {
 	assert(t, err != nil, "unmatched subscription type returns error")
 	assert(t, subType == -1, "unmatched subscription type")
 
+	compression, err := model.GetCompressionType("")
+	errNil(t, err)
+	equals(t, pulsar.NoCompression, compression)
+
+	compression, err = model.GetCompressionType("ZSTD")
+	errNil(t, err)
+	equals(t, pulsar.ZSTD, compression)
+
+	_, err = model.GetCompressionType("snappy")
+	equals(t, "unsupported compression codec snappy", err.Error())
+
+	equals(t, "keyshared", model.SubscriptionTypeName(pulsar.KeyShared))
+	equals(t, "unknown", model.SubscriptionTypeName(-1))
+	equals(t, "earliest", model.InitialPositionName(pulsar.SubscriptionPositionEarliest))
+	equals(t, "unknown", model.InitialPositionName(-1))
+
 	// test unmatched URL in webhook
 	wh := model.WebhookConfig{
 		URL: "localhost:8080/test",
@@ -337,6 +455,44 @@ func TestTopicModelFunctions(t *testing.T) {
 	errNil(t, err)
 }
 
+func TestWebhookRetryPolicy(t *testing.T) {
+	maxRetries, initialBackoff, maxBackoff, err := model.WebhookConfig{}.RetryPolicy()
+	errNil(t, err)
+	equals(t, model.DefaultWebhookMaxRetries, maxRetries)
+	equals(t, model.DefaultWebhookInitialBackoff, initialBackoff)
+	equals(t, model.DefaultWebhookMaxBackoff, maxBackoff)
+
+	maxRetries, initialBackoff, maxBackoff, err = model.WebhookConfig{MaxRetries: 5, InitialBackoff: "500ms", MaxBackoff: "1m"}.RetryPolicy()
+	errNil(t, err)
+	equals(t, 5, maxRetries)
+	equals(t, 500*time.Millisecond, initialBackoff)
+	equals(t, time.Minute, maxBackoff)
+
+	for _, wh := range []model.WebhookConfig{
+		{MaxRetries: -1},
+		{MaxRetries: model.MaxWebhookRetries + 1},
+		{InitialBackoff: "soon"},
+		{MaxBackoff: "-1s"},
+		{InitialBackoff: "1m", MaxBackoff: "10s"},
+	} {
+		wh.URL = "http://host.com:8080"
+		wh.Subscription = "mysubscription"
+		assert(t, model.ValidateWebhookConfig([]model.WebhookConfig{wh}) != nil, "invalid retry policy")
+	}
+
+	topic, err := model.NewTopicConfig("persistent://tenant1/ns/topic1", "pulsar://localhost:6650", "token")
+	errNil(t, err)
+	wh := model.NewWebhookConfig("http://host.com:8080")
+	wh.FailureTopic = "persistent://tenant1/ns/topic1-failed"
+	topic.Webhooks = []model.WebhookConfig{wh}
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+
+	topic.Webhooks[0].FailureTopic = "persistent://tenant2/ns/topic1-failed"
+	_, err = model.ValidateTopicConfig(topic)
+	assert(t, err != nil, "the failure topic must be in the same tenant")
+}
+
 func TestGetTopicFullNameFromRoute(t *testing.T) {
 	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "np"}
 	topicFn, err := GetTopicFnFromRoute(vars)
@@ -357,36 +513,161 @@ func TestGetTopicFullNameFromRoute(t *testing.T) {
 	assert(t, err.Error() == "supported persistent types are persistent, p, non-persistent, np", "")
 }
 
+func TestNonPersistentTopic(t *testing.T) {
+	persistentFN, err := util.BuildTopicFn("p", "public", "default", "testtopic")
+	errNil(t, err)
+	equals(t, "persistent://public/default/testtopic", persistentFN)
+	nonPersistentFN, err := util.BuildTopicFn("non-persistent", "public", "default", "testtopic")
+	errNil(t, err)
+	equals(t, "non-persistent://public/default/testtopic", nonPersistentFN)
+	topicFN, err := util.BuildTopicFn("nonpersistent", "public", "default", "testtopic")
+	errNil(t, err)
+	equals(t, nonPersistentFN, topicFN)
+	assert(t, !util.IsNonPersistentTopic(persistentFN), "persistent topic")
+	assert(t, util.IsNonPersistentTopic(nonPersistentFN), "non-persistent topic")
+
+	persistentKey, err := model.GetKeyFromNames(persistentFN, "pulsar://mydomain.net:6650")
+	errNil(t, err)
+	nonPersistentKey, err := model.GetKeyFromNames(nonPersistentFN, "pulsar://mydomain.net:6650")
+	errNil(t, err)
+	assert(t, persistentKey != nonPersistentKey, "the persistent and non-persistent topics have different keys")
+
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	header := http.Header{}
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "np"}
+	_, topicFN, _, cfg, err := ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &header, vars, url.Values{"SubscriptionName": {"my-subscription"}})
+	errNil(t, err)
+	equals(t, nonPersistentFN, topicFN)
+	equals(t, "my-subscription", cfg.SubscriptionName)
+
+	startTime := strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano()/int64(time.Millisecond), 10)
+	_, _, _, _, err = ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &header, vars, url.Values{"startTimestampMs": {startTime}})
+	equals(t, "startTimestampMs and lookback are not supported on non-persistent topics", err.Error())
+	vars["persistent"] = "p"
+	_, _, _, _, err = ConsumerConfigFromHTTPParts(util.AllowedPulsarURLs, &header, vars, url.Values{"startTimestampMs": {startTime}})
+	errNil(t, err)
+
+	pattern, err := TopicsPattern(url.Values{"topicsPattern": {"test.*"}}, persistentFN)
+	errNil(t, err)
+	equals(t, "persistent://public/default/test.*", pattern)
+	_, err = TopicsPattern(url.Values{"topicsPattern": {"test.*"}}, nonPersistentFN)
+	equals(t, "topicsPattern is not supported on non-persistent topics", err.Error())
+
+	// the consumer is created on the non-persistent topic of the route
+	var consumedTopic string
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		consumedTopic = topic
+		return newQueuedConsumer()
+	})()
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll/np/public/default/testtopic?perMessageTimeoutMs=10", nil)
+	req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "np"})
+	req.Header.Set("injectedSubs", "public")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusNoContent, rr.Code)
+	equals(t, nonPersistentFN, consumedTopic)
+}
+
+func TestLookbackPosition(t *testing.T) {
+	cfg, err := ConsumerParams(url.Values{"SubscriptionInitialPosition": {"lookback"}, "lookback": {"5m"}})
+	errNil(t, err)
+	assert(t, cfg.IsNonResumable(), "lookback on an auto-generated subscription")
+	equals(t, pulsar.SubscriptionPositionLatest, cfg.InitialPosition)
+	lookback := time.Since(cfg.StartTime)
+	assert(t, lookback >= 5*time.Minute && lookback < 5*time.Minute+time.Second, "seek to 5 minutes ago")
+
+	for _, lookback := range []string{"", "5", "-5m", "0s", "200h"} {
+		_, err = ConsumerParams(url.Values{"SubscriptionInitialPosition": {"lookback"}, "lookback": {lookback}})
+		assert(t, strings.HasPrefix(err.Error(), "invalid lookback"), "invalid lookback "+lookback)
+	}
+
+	_, err = ConsumerParams(url.Values{"lookback": {"5m"}})
+	equals(t, "lookback requires SubscriptionInitialPosition=lookback", err.Error())
+	_, err = ConsumerParams(url.Values{"SubscriptionInitialPosition": {"lookback"}, "lookback": {"5m"}, "startTimestampMs": {"1000"}})
+	equals(t, "lookback and startTimestampMs cannot be specified together", err.Error())
+	_, err = ConsumerParams(url.Values{"SubscriptionInitialPosition": {"lookback"}, "lookback": {"5m"}, "SubscriptionName": {"my-subscription"}})
+	equals(t, "lookback is only supported with an auto-generated subscription", err.Error())
+
+	// the consumer of a poll is seeked back by the lookback from the latest position
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	var dialed model.ConsumerConfig
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		dialed = cfg
+		return newQueuedConsumer()
+	})()
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic?perMessageTimeoutMs=10&SubscriptionInitialPosition=lookback&lookback=5m", nil)
+	req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"})
+	req.Header.Set("injectedSubs", "public")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusNoContent, rr.Code)
+	equals(t, pulsar.SubscriptionPositionLatest, dialed.InitialPosition)
+	lookback = time.Since(dialed.StartTime)
+	assert(t, lookback >= 5*time.Minute && lookback < 5*time.Minute+time.Second, "the consumer seeks to 5 minutes ago")
+}
+
 func TestConsumerParams(t *testing.T) {
 	params := map[string][]string{"SubscriptionType": []string{"test"}}
-	_, _, _, err := ConsumerParams(params)
-	equals(t, err.Error(), "unsupported subscription type test")
+	_, err := ConsumerParams(params)
+	equals(t, "unsupported subscription type test, valid values are exclusive, shared, failover, and key_shared", err.Error())
 
 	params = map[string][]string{"SubscriptionType": []string{"shared"}}
-	subName, subPos, subType, err := ConsumerParams(params)
-	equals(t, subPos, pulsar.SubscriptionPositionLatest)
-	equals(t, subType, pulsar.Shared)
-	assert(t, strings.HasPrefix(subName, model.NonResumable), "")
+	cfg, err := ConsumerParams(params)
+	equals(t, cfg.InitialPosition, pulsar.SubscriptionPositionLatest)
+	equals(t, cfg.SubscriptionType, pulsar.Shared)
+	assert(t, strings.HasPrefix(cfg.SubscriptionName, model.NonResumable), "")
 
 	params = map[string][]string{"SubscriptionInitialPosition": []string{"last"}}
-	_, _, _, err = ConsumerParams(params)
+	_, err = ConsumerParams(params)
 	equals(t, err.Error(), "invalid subscription initial position last")
 
 	params = map[string][]string{"SubscriptionInitialPosition": []string{"earliest"}}
-	subName, subPos, subType, err = ConsumerParams(params)
-	equals(t, subPos, pulsar.SubscriptionPositionEarliest)
-	equals(t, subType, pulsar.Exclusive)
-	assert(t, strings.HasPrefix(subName, model.NonResumable), "")
+	cfg, err = ConsumerParams(params)
+	equals(t, cfg.InitialPosition, pulsar.SubscriptionPositionEarliest)
+	equals(t, cfg.SubscriptionType, pulsar.Exclusive)
+	assert(t, strings.HasPrefix(cfg.SubscriptionName, model.NonResumable), "")
 
 	params = map[string][]string{"SubscriptionName": []string{"last"}}
-	_, _, _, err = ConsumerParams(params)
-	equals(t, err.Error(), "subscription name must be more than 4 characters")
+	_, err = ConsumerParams(params)
+	equals(t, err.Error(), "subscription name is too short, it must be at least 5 characters")
+
+	minLength := util.GetConfig().SubscriptionNameMinLength
+	util.GetConfig().SubscriptionNameMinLength = 3
+	cfg, err = ConsumerParams(params)
+	errNil(t, err)
+	equals(t, "last", cfg.SubscriptionName)
+	util.GetConfig().SubscriptionNameMinLength = minLength
+
+	params = map[string][]string{"SubscriptionName": []string{model.NonResumable + "mysub"}}
+	_, err = ConsumerParams(params)
+	equals(t, err.Error(), "subscription name must not start with the reserved prefix NonResumable")
 
 	params = map[string][]string{"SubscriptionInitialPosition": []string{"earliest"}, "SubscriptionName": []string{"subname1234"}}
-	subName, subPos, subType, err = ConsumerParams(params)
-	equals(t, subPos, pulsar.SubscriptionPositionEarliest)
-	equals(t, subType, pulsar.Exclusive)
-	equals(t, subName, "subname1234")
+	cfg, err = ConsumerParams(params)
+	equals(t, cfg.InitialPosition, pulsar.SubscriptionPositionEarliest)
+	equals(t, cfg.SubscriptionType, pulsar.Exclusive)
+	equals(t, cfg.SubscriptionName, "subname1234")
+	assert(t, cfg.StartTime.IsZero(), "no start time is requested")
+	assert(t, !cfg.Permanent, "a subscription is not permanent by default")
+
+	params = map[string][]string{"SubscriptionName": []string{"subname1234"}, "permanent": []string{"true"}}
+	cfg, err = ConsumerParams(params)
+	errNil(t, err)
+	assert(t, cfg.Permanent, "the subscription is marked as permanent")
+
+	params = map[string][]string{"SubscriptionName": []string{"subname1234"}, "startTimestampMs": []string{"1600000000000"}}
+	cfg, err = ConsumerParams(params)
+	errNil(t, err)
+	equals(t, int64(1600000000000), cfg.StartTime.UnixNano()/int64(time.Millisecond))
+
+	params = map[string][]string{"startTimestampMs": []string{"yesterday"}}
+	_, err = ConsumerParams(params)
+	equals(t, err.Error(), "invalid startTimestampMs yesterday")
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond), 10)
+	params = map[string][]string{"startTimestampMs": []string{future}}
+	_, err = ConsumerParams(params)
+	equals(t, err.Error(), "startTimestampMs "+future+" is in the future")
 }
 
 func TestConsumerConfigFromHTTPParts(t *testing.T) {
@@ -395,17 +676,2229 @@ func TestConsumerConfigFromHTTPParts(t *testing.T) {
 	header := http.Header{}
 	// header.Set("Authorization", "Bearer erfagagagag")
 	header.Set("PulsarUrl", "pulsar://mydomain.net:6650")
-	_, _, _, _, _, _, err := ConsumerConfigFromHTTPParts(strings.Split("pulsar://mydomain.net:6651", ","), &header, vars, params)
+	_, _, _, _, err := ConsumerConfigFromHTTPParts(strings.Split("pulsar://mydomain.net:6651", ","), &header, vars, params)
 	equals(t, err.Error(), "pulsar cluster pulsar://mydomain.net:6650 is not allowed")
-	_, _, _, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
+	_, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
 	equals(t, err.Error(), "supported persistent types are persistent, p, non-persistent, np")
 
 	vars = map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
 	params = map[string][]string{"SubscriptionInitialPosition": []string{"earlies"}, "SubscriptionName": []string{"subname1234"}}
-	_, _, _, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
+	_, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
 	equals(t, err.Error(), "invalid subscription initial position earlies")
 
 	params = map[string][]string{"SubscriptionInitialPosition": []string{"earliest"}, "SubscriptionName": []string{"subname1234"}}
-	_, _, _, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
+	_, _, _, _, err = ConsumerConfigFromHTTPParts(strings.Split("", ","), &header, vars, params)
+	errNil(t, err)
+}
+
+func TestPollInitialPosition(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	var dialed model.ConsumerConfig
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		dialed = cfg
+		return newQueuedConsumer()
+	})()
+	defer broker.FlushPollConsumers()
+
+	poll := func(query string) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic?perMessageTimeoutMs=10&"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"})
+		req.Header.Set("injectedSubs", "public")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusNoContent, rr.Code)
+	}
+
+	// poll creates a new subscription from the earliest message by default, unlike the SSE endpoint
+	poll("SubscriptionName=initial-default")
+	equals(t, pulsar.SubscriptionPositionEarliest, dialed.InitialPosition)
+	// a named durable subscription keeps its name so the broker resumes from the committed cursor
+	equals(t, "initial-default", dialed.SubscriptionName)
+	assert(t, !dialed.IsNonResumable(), "durable subscription must not be treated as non-resumable")
+
+	// an explicit initial position is honored for a new subscription
+	poll("SubscriptionName=initial-latest&SubscriptionInitialPosition=latest")
+	equals(t, pulsar.SubscriptionPositionLatest, dialed.InitialPosition)
+	poll("SubscriptionInitialPosition=latest")
+	equals(t, pulsar.SubscriptionPositionLatest, dialed.InitialPosition)
+}
+
+func TestSSESubscriptionType(t *testing.T) {
+	// a named subscription defaults to shared so that the beam instances co-consume it
+	params := url.Values{"SubscriptionName": []string{"subname1234"}}
+	equals(t, "shared", SSESubscriptionType(params))
+	params.Set("SubscriptionType", SSESubscriptionType(params))
+	cfg, err := ConsumerParams(params)
+	errNil(t, err)
+	equals(t, pulsar.Shared, cfg.SubscriptionType)
+
+	// the dead letter policy is allowed on the default shared subscription
+	params.Set("maxRedeliveries", "3")
+	_, err = ConsumerParams(params)
+	errNil(t, err)
+
+	// an explicit type is honored
+	params = url.Values{"SubscriptionName": []string{"subname1234"}, "SubscriptionType": []string{"Exclusive"}}
+	equals(t, "Exclusive", SSESubscriptionType(params))
+
+	// an auto-generated subscription has a single consumer and stays exclusive
+	equals(t, "exclusive", SSESubscriptionType(url.Values{}))
+	params = url.Values{"SubscriptionType": []string{"failover"}}
+	equals(t, "failover", SSESubscriptionType(params))
+}
+
+func TestContentDecoder(t *testing.T) {
+	payload := []byte("pulsar beam payload")
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(payload)
+	gw.Close()
+
+	var fl bytes.Buffer
+	fw, err := flate.NewWriter(&fl, flate.DefaultCompression)
+	errNil(t, err)
+	fw.Write(payload)
+	fw.Close()
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write(payload)
+	bw.Close()
+
+	for encoding, body := range map[string][]byte{"": payload, "gzip": gz.Bytes(), "deflate": fl.Bytes(), "BR": br.Bytes()} {
+		reader, err := ContentDecoder(encoding, bytes.NewReader(body))
+		errNil(t, err)
+		decoded, err := ioutil.ReadAll(reader)
+		errNil(t, err)
+		equals(t, payload, decoded)
+		reader.Close()
+	}
+
+	_, err = ContentDecoder("compress", bytes.NewReader(payload))
+	assert(t, errors.Is(err, ErrUnsupportedEncoding), "unsupported content encoding")
+	equals(t, "unsupported Content-Encoding compress", err.Error())
+}
+
+func TestDeliveryParams(t *testing.T) {
+	header := http.Header{}
+	after, at, err := DeliveryParams(header)
+	errNil(t, err)
+	equals(t, time.Duration(0), after)
+	assert(t, at.IsZero(), "no delayed delivery")
+
+	header.Set("X-Pulsar-Deliver-After", "5m")
+	after, _, err = DeliveryParams(header)
+	errNil(t, err)
+	equals(t, 5*time.Minute, after)
+
+	header.Set("X-Pulsar-Deliver-At", "2030-01-02T15:04:05Z")
+	_, _, err = DeliveryParams(header)
+	equals(t, "only one of X-Pulsar-Deliver-After and X-Pulsar-Deliver-At can be specified", err.Error())
+
+	header.Del("X-Pulsar-Deliver-After")
+	_, at, err = DeliveryParams(header)
+	errNil(t, err)
+	equals(t, time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC), at.UTC())
+
+	header.Set("X-Pulsar-Deliver-At", "tomorrow")
+	_, _, err = DeliveryParams(header)
+	equals(t, "invalid RFC3339 X-Pulsar-Deliver-At tomorrow", err.Error())
+
+	header = http.Header{}
+	header.Set("X-Pulsar-Deliver-After", "-30s")
+	_, _, err = DeliveryParams(header)
+	equals(t, "negative X-Pulsar-Deliver-After -30s", err.Error())
+}
+
+func TestSSEHandlerBoundedStreamParams(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+
+	for _, query := range []string{"maxMessages=-1", "maxMessages=10&idleTimeoutMs=-5"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/sse/p/public/default/testtopic?"+query, nil)
+		req.Header.Set("PulsarUrl", "pulsar://mydomain.net:6650")
+		req = mux.SetURLVars(req, vars)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(SSEHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestWorkerPoolShutdown(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	InitWorkerPool(1)
+
+	// the first message occupies the only worker until its body is closed
+	pr, pw := io.Pipe()
+	first, queued := httptest.NewRecorder(), httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ReceiveHandler(first, httptest.NewRequest(http.MethodPost, "/v1/firehose", pr))
+	}()
+	_, err := pw.Write([]byte("first"))
+	errNil(t, err)
+
+	go func() {
+		defer wg.Done()
+		ReceiveHandler(queued, httptest.NewRequest(http.MethodPost, "/v1/firehose", strings.NewReader("queued")))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan bool)
+	go func() {
+		Shutdown()
+		shutdown <- true
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown must wait for the in-flight message")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pw.Close()
+	<-shutdown
+	wg.Wait()
+
+	// both messages are processed rather than rejected, they fail to resolve a topic without route vars
+	equals(t, http.StatusUnprocessableEntity, first.Code)
+	equals(t, http.StatusUnprocessableEntity, queued.Code)
+
+	rejected := httptest.NewRecorder()
+	ReceiveHandler(rejected, httptest.NewRequest(http.MethodPost, "/v1/firehose", strings.NewReader("late")))
+	equals(t, http.StatusServiceUnavailable, rejected.Code)
+	assert(t, strings.Contains(rejected.Body.String(), "server is shutting down"), "reject new messages during shutdown")
+}
+
+func TestAppendHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("Accept", "text/html")
+	header.Add("Accept", "application/json")
+
+	// the first value only by default
+	equals(t, "Accept: text/html\r\n", string(AppendHeaders(nil, header, false)))
+	equals(t, "Accept: text/html, application/json\r\n", string(AppendHeaders(nil, header, true)))
+
+	header.Set("Cookie", "a=1")
+	b := AppendHeaders([]byte("POST / HTTP/1.1\r\n"), header, true)
+	assert(t, strings.HasPrefix(string(b), "POST / HTTP/1.1\r\n"), "append after the request line")
+	assert(t, strings.Contains(string(b), "Cookie: a=1\r\n"), "single valued header")
+	assert(t, strings.Contains(string(b), "Accept: text/html, application/json\r\n"), "multi valued header")
+}
+
+func TestBatchPublishHandlerValidation(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+
+	for body, errMsg := range map[string]string{
+		`{"messages": []}`:  "no messages in the batch",
+		`{"messages": [{"p`: "invalid batch publish request",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v2/publish/batch/p/public/default/testtopic", strings.NewReader(body))
+		req = mux.SetURLVars(req, vars)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(BatchPublishHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+		assert(t, strings.Contains(rr.Body.String(), errMsg), "batch publish validation error "+errMsg)
+	}
+}
+
+func TestBatchPublishHandlerMessageChecks(t *testing.T) {
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+	publish := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/publish/batch/p/public/default/testtopic", strings.NewReader(body))
+		req = mux.SetURLVars(req, vars)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(BatchPublishHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the messages of a batch are checked with the limits of the send endpoint
+	util.Config.MaxPropertiesBytes = 10
+	rr := publish(`{"messages": [{"payload": "YQ=="}, {"payload": "Yg==", "properties": {"key": "a value over the limit"}}]}`)
+	equals(t, http.StatusRequestHeaderFieldsTooLarge, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "message 1: properties of 25 bytes exceed the maximum of 10 bytes"), rr.Body.String())
+
+	util.Config.MaxPropertiesBytes = 0
+	ValidatePayload = func(topicKey string, payload []byte) []string { return []string{"rejected " + string(payload)} }
+	defer func() { ValidatePayload = nil }()
+	rr = publish(`{"messages": [{"payload": "YQ=="}]}`)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "payload does not match the topic schema: rejected a"), rr.Body.String())
+}
+
+func TestAckHandlerValidation(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+	msgID, err := json.Marshal(pulsar.EarliestMessageID().Serialize())
+	errNil(t, err)
+
+	for body, expected := range map[string]int{
+		`{"subscriptionName": "subname1234"}`:                                        http.StatusUnprocessableEntity,
+		`{"subscriptionName": "subname1234", "messageIds": ["bm90IGFuIGlk"]}`:        http.StatusUnprocessableEntity,
+		`{"subscriptionName": "subname1234", "messageIds": [` + string(msgID) + `]}`: http.StatusNotFound,
+		`{"subscriptionName": "subname1234", "messageIds": [`:                        http.StatusUnprocessableEntity,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v2/ack/p/public/default/testtopic", strings.NewReader(body))
+		req = mux.SetURLVars(req, vars)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(AckHandler).ServeHTTP(rr, req)
+		equals(t, expected, rr.Code)
+	}
+
+	// noAck requires a durable subscription to acknowledge the messages later
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic?noAck=true", nil)
+	req = mux.SetURLVars(req, vars)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "noAck requires a SubscriptionName"), "noAck without subscription name")
+}
+
+func TestPollHandlerBounds(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.Config.PollMaxBatchSize = 100
+	util.Config.PollMaxPerMessageTimeoutMs = 5000
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+
+	for query, errMsg := range map[string]string{
+		"batchSize=101":                       "batchSize must be an integer between 1 and 100",
+		"batchSize=0":                         "batchSize must be an integer between 1 and 100",
+		"batchSize=ten":                       "batchSize must be an integer between 1 and 100",
+		"perMessageTimeoutMs=5001":            "perMessageTimeoutMs must be an integer between 1 and 5000",
+		"perMessageTimeoutMs=-1":              "perMessageTimeoutMs must be an integer between 1 and 5000",
+		"batchSize=100&noAck=true":            "noAck requires a SubscriptionName",
+		"perMessageTimeoutMs=5000&noAck=true": "noAck requires a SubscriptionName",
+		"ackMode=cumulative":                  "ackMode cumulative is not supported",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic?"+query, nil)
+		req = mux.SetURLVars(req, vars)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+		assert(t, strings.Contains(rr.Body.String(), errMsg), "poll bounds "+query)
+	}
+}
+
+func TestTopicFnFromRouteOrQuery(t *testing.T) {
+	vars := map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"}
+	topicFN, err := TopicFnFromRouteOrQuery(vars, url.Values{"topic": {"persistent://t/ns/other"}})
+	errNil(t, err)
+	equals(t, "persistent://public/default/testtopic", topicFN)
+
+	topicFN, err = TopicFnFromRouteOrQuery(map[string]string{}, url.Values{"topic": {"persistent://t/ns/a,persistent://t/ns/b"}})
+	errNil(t, err)
+	equals(t, "persistent://t/ns/a", topicFN)
+
+	for _, topic := range []string{"t/ns/a", "persistent://t/ns", "persistent://t//a", "kafka://t/ns/a"} {
+		_, err = TopicFnFromRouteOrQuery(map[string]string{}, url.Values{"topic": {topic}})
+		assert(t, err != nil, "invalid topic query parameter "+topic)
+	}
+
+	_, err = TopicFnFromRouteOrQuery(map[string]string{}, url.Values{})
+	assert(t, err != nil, "missing topic")
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll?topic=mytopic", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "fully qualified topic name"), "poll with an invalid topic query parameter")
+}
+
+func TestValidateAckCallbackTopic(t *testing.T) {
+	topicFN := "persistent://mytenant/ns/topic"
+	errNil(t, ValidateAckCallbackTopic("persistent://mytenant/other/errors", topicFN, true))
+
+	err := ValidateAckCallbackTopic("persistent://mytenant/ns/errors", topicFN, false)
+	equals(t, "ackCallbackTopic is only supported with mode=async", err.Error())
+
+	for _, callbackTopic := range []string{"errors", "persistent://mytenant/errors", "persistent://mytenant//errors"} {
+		err = ValidateAckCallbackTopic(callbackTopic, topicFN, true)
+		assert(t, strings.Contains(err.Error(), "fully qualified topic name"), "invalid callback topic "+callbackTopic)
+	}
+
+	err = ValidateAckCallbackTopic("persistent://othertenant/ns/errors", topicFN, true)
+	equals(t, "ackCallbackTopic persistent://othertenant/ns/errors must be in the tenant of topic persistent://mytenant/ns/topic", err.Error())
+}
+
+func TestGzipResponse(t *testing.T) {
+	h := http.Header{}
+	assert(t, !AcceptsGzip(h), "no Accept-Encoding")
+	h.Set("Accept-Encoding", "deflate, br")
+	assert(t, !AcceptsGzip(h), "gzip is not accepted")
+	h.Set("Accept-Encoding", "deflate, GZIP;q=0.8")
+	assert(t, AcceptsGzip(h), "gzip with a quality")
+	h.Set("Accept-Encoding", "gzip;q=0")
+	assert(t, !AcceptsGzip(h), "gzip is refused with quality 0")
+
+	// every flushed SSE event can be decompressed before the stream ends
+	req := httptest.NewRequest(http.MethodGet, "/v2/sse/p/public/default/testtopic", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	w, closeBody := GzipResponse(rr, req)
+	equals(t, "gzip", rr.Header().Get("Content-Encoding"))
+	io.WriteString(w, "data: event1\n\n")
+	w.(http.Flusher).Flush()
+	assert(t, rr.Flushed, "the response is flushed")
+	gz, err := gzip.NewReader(bytes.NewReader(rr.Body.Bytes()))
+	errNil(t, err)
+	event := make([]byte, len("data: event1\n\n"))
+	_, err = io.ReadFull(gz, event)
+	errNil(t, err)
+	equals(t, "data: event1\n\n", string(event))
+	closeBody()
+
+	req.Header.Del("Accept-Encoding")
+	rr = httptest.NewRecorder()
+	w, closeBody = GzipResponse(rr, req)
+	io.WriteString(w, "data: event1\n\n")
+	closeBody()
+	equals(t, "", rr.Header().Get("Content-Encoding"))
+	equals(t, "data: event1\n\n", rr.Body.String())
+}
+
+func TestPollHandlerGzip(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	queued := 2
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		return newQueuedConsumer(testMessages(queued)...)
+	})()
+
+	poll := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic?batchSize=10&perMessageTimeoutMs=20", nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"})
+		req.Header.Set("injectedSubs", "public")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := poll("gzip, deflate")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "gzip", rr.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(rr.Body)
+	errNil(t, err)
+	var msgs model.PulsarMessages
+	errNil(t, json.NewDecoder(gz).Decode(&msgs))
+	equals(t, 2, msgs.Size)
+
+	rr = poll("")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "", rr.Header().Get("Content-Encoding"))
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &msgs))
+	equals(t, 2, msgs.Size)
+
+	// nothing to compress without messages
+	queued = 0
+	rr = poll("gzip")
+	equals(t, http.StatusNoContent, rr.Code)
+	equals(t, "", rr.Header().Get("Content-Encoding"))
+}
+
+func TestProduceEvents(t *testing.T) {
+	// a slow subscriber drops the events over its buffer instead of blocking the producer
+	events, unsubscribe := SubscribeProduceEvents("tenant1")
+	for i := 0; i < 150; i++ {
+		PublishProduceEvent(model.ProduceEvent{Topic: "persistent://tenant1/ns/topic1", Size: i})
+	}
+	equals(t, 100, len(events))
+	unsubscribe()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"tenant": "tenant1"})
+		r.Header.Set("injectedSubs", r.Header.Get("subjects"))
+		ProduceEventsHandler(w, r)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v2/firehose/tenant1", nil)
+	req.Header.Set("subjects", "tenant2-12345")
+	res, err := http.DefaultClient.Do(req)
+	errNil(t, err)
+	res.Body.Close()
+	equals(t, http.StatusForbidden, res.StatusCode)
+
+	req.Header.Set("subjects", "tenant1-12345")
+	res, err = http.DefaultClient.Do(req)
+	errNil(t, err)
+	defer res.Body.Close()
+	equals(t, http.StatusOK, res.StatusCode)
+	equals(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the stream is subscribed once the headers are replied, only the events of the tenant are streamed
+	PublishProduceEvent(model.ProduceEvent{Topic: "persistent://tenant2/ns/topic1", Size: 1})
+	PublishProduceEvent(model.ProduceEvent{Topic: "persistent://tenant1/ns/topic1", Size: 2, RequestID: "req-1"})
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	errNil(t, err)
+	equals(t, "event: produce\n", line)
+	line, err = reader.ReadString('\n')
+	errNil(t, err)
+	var event model.ProduceEvent
+	errNil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+	equals(t, "persistent://tenant1/ns/topic1", event.Topic)
+	equals(t, 2, event.Size)
+	equals(t, "req-1", event.RequestID)
+
+	// the stream counts against the SSE connection caps
+	maxTotal := util.Config.SSEMaxConnections
+	defer func() { util.Config.SSEMaxConnections = maxTotal }()
+	util.Config.SSEMaxConnections = 1
+	res, err = http.DefaultClient.Do(req)
+	errNil(t, err)
+	res.Body.Close()
+	equals(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+func TestPollHandlerTimeout(t *testing.T) {
+	// the consumer creation blocks past the operation timeout as on a cluster that never responds
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.Config.PulsarClientOperationTimeout = 1
+	blocked := make(chan struct{})
+	defer close(blocked)
+	broker.DialConsumer = func(url, token, topic string, cfg model.ConsumerConfig) (pulsar.Client, pulsar.Consumer, error) {
+		_, err := pulsardriver.CreateWithTimeout(func() (pulsardriver.Closer, error) {
+			<-blocked
+			return nil, errors.New("the cluster never responds")
+		})
+		return nil, nil, err
+	}
+	defer func() { broker.DialConsumer = broker.GetPulsarClientConsumer }()
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/public/default/testtopic", nil)
+	req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"})
+	req.Header.Set("injectedSubs", "public")
+	req.Header.Set("PulsarUrl", "pulsar://mydomain.net:6650")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusGatewayTimeout, rr.Code)
+	assert(t, time.Since(start) < 3*time.Second, "the poll returns promptly after the operation timeout")
+}
+
+func TestHealthHandler(t *testing.T) {
+	allowed := util.AllowedPulsarURLs
+	defer func() { util.AllowedPulsarURLs = allowed }()
+	util.AllowedPulsarURLs = []string{""}
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HealthHandler).ServeHTTP(rr, req)
+
+	var resp HealthResponse
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	equals(t, "skipped, no Pulsar cluster is configured", resp.Pulsar)
+	if resp.Db == "ok" {
+		equals(t, http.StatusOK, rr.Code)
+	} else {
+		equals(t, http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestInvalidGzipBody(t *testing.T) {
+	// not gzip data
+	_, err := ContentDecoder("gzip", strings.NewReader("plain text"))
+	assert(t, errors.Is(err, ErrInvalidBody), "invalid gzip header")
+	equals(t, "invalid gzip body: gzip: invalid header", err.Error())
+
+	// an empty body
+	_, err = ContentDecoder("gzip", strings.NewReader(""))
+	assert(t, errors.Is(err, ErrInvalidBody), "empty gzip body")
+
+	// a truncated gzip body fails in the read loop
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("pulsar beam payload"))
+	gw.Close()
+	reader, err := ContentDecoder("gzip", bytes.NewReader(gz.Bytes()[:gz.Len()-4]))
+	errNil(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert(t, errors.Is(InvalidBodyError("gzip", err), ErrInvalidBody), "truncated gzip body")
+
+	// other errors remain internal errors
+	assert(t, !errors.Is(InvalidBodyError("gzip", errors.New("connection reset")), ErrInvalidBody), "not a decoding error")
+	assert(t, !errors.Is(InvalidBodyError("", io.ErrUnexpectedEOF), ErrInvalidBody), "no content encoding")
+}
+
+func TestLimitedContentDecoder(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		gw.Write(data)
+		gw.Close()
+		return gz.Bytes()
+	}
+	// a crafted bomb of 4MB zeros compressed to less than 16KB
+	bomb := gzipped(make([]byte, 4*1024*1024))
+	assert(t, len(bomb) < 16*1024, "high compression ratio payload")
+
+	readAll := func(body []byte, maxSize, maxRatio int) (int, error) {
+		reader, err := LimitedContentDecoder("gzip", bytes.NewReader(body), maxSize, maxRatio)
+		errNil(t, err)
+		buffer := make([]byte, 8*1024*1024)
+		size := 0
+		for {
+			n, err := reader.Read(buffer[size:])
+			size += n
+			if err == io.EOF {
+				return size, nil
+			} else if err != nil {
+				return size, err
+			}
+		}
+	}
+
+	// the ratio limit aborts the bomb shortly after the minimum size is decompressed
+	size, err := readAll(bomb, 8*1024*1024, 100)
+	assert(t, errors.Is(err, ErrDecompressionLimit), "compression ratio limit")
+	equals(t, "decompressed body exceeds the limit of compression ratio 100", err.Error())
+	assert(t, size < 2*1024*1024, "the bomb is not fully decompressed")
+
+	// the size limit aborts without reading more than one byte over the limit
+	size, err = readAll(bomb, 100*1024, 10000)
+	assert(t, errors.Is(err, ErrDecompressionLimit), "decompressed size limit")
+	equals(t, "decompressed body exceeds the limit of 102400 bytes", err.Error())
+	equals(t, 100*1024+1, size)
+
+	// a body within the limits is decompressed as is
+	payload := []byte(strings.Repeat("pulsar beam payload ", 100))
+	size, err = readAll(gzipped(payload), 100*1024, 100)
+	errNil(t, err)
+	equals(t, len(payload), size)
+
+	// the limits only apply to a compressed body
+	reader, err := LimitedContentDecoder("", bytes.NewReader(make([]byte, 2048)), 1024, 1)
+	errNil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	errNil(t, err)
+	equals(t, 2048, len(data))
+}
+
+// ackRecorder records the acknowledgements of a consumer
+type ackRecorder struct {
+	pulsar.Consumer
+	acked  int
+	nacked int
+}
+
+func (c *ackRecorder) Ack(msg pulsar.Message)  { c.acked++ }
+func (c *ackRecorder) Nack(msg pulsar.Message) { c.nacked++ }
+
+type testMessage struct {
+	pulsar.Message
+}
+
+func (m testMessage) ID() pulsar.MessageID          { return pulsar.EarliestMessageID() }
+func (m testMessage) Payload() []byte               { return []byte("payload") }
+func (m testMessage) EventTime() time.Time          { return time.Unix(1, 0) }
+func (m testMessage) PublishTime() time.Time        { return time.Unix(2, 0) }
+func (m testMessage) Topic() string                 { return "persistent://tenant1/ns/topic1" }
+func (m testMessage) Key() string                   { return "partition-key" }
+func (m testMessage) OrderingKey() string           { return "ordering-key" }
+func (m testMessage) Properties() map[string]string { return nil }
+
+// failedWriter simulates a client connection that dies mid-stream
+type failedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failedWriter) Write(b []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestWriteSSEMessage(t *testing.T) {
+	consumer := &ackRecorder{}
+	rr := httptest.NewRecorder()
+	errNil(t, WriteSSEMessage(context.Background(), rr, rr, consumer, testMessage{}, ""))
+	equals(t, 1, consumer.acked)
+	equals(t, 0, consumer.nacked)
+	assert(t, strings.Contains(rr.Body.String(), "data: payload\n\n"), "message event is written")
+	assert(t, strings.Contains(rr.Body.String(), "eventTime: 1000\npublishTime: 2000\n"), "message timestamps are written")
+	assert(t, strings.Contains(rr.Body.String(), "key: partition-key\norderingKey: ordering-key\n"), "message keys are written")
+
+	consumer = &ackRecorder{}
+	rr = httptest.NewRecorder()
+	errNil(t, WriteSSEMessage(context.Background(), rr, rr, consumer, testMessage{}, "base64"))
+	equals(t, 1, consumer.acked)
+	assert(t, strings.Contains(rr.Body.String(), "encoding: base64\ndata: cGF5bG9hZA==\n\n"), "base64 payload is written")
+
+	consumer = &ackRecorder{}
+	w := failedWriter{httptest.NewRecorder()}
+	err := WriteSSEMessage(context.Background(), w, w, consumer, testMessage{}, "")
+	assert(t, err != nil, "write failure is returned")
+	equals(t, 0, consumer.acked)
+	equals(t, 1, consumer.nacked)
+
+	// the client is gone after the flush
+	consumer = &ackRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rr = httptest.NewRecorder()
+	err = WriteSSEMessage(ctx, rr, rr, consumer, testMessage{}, "")
+	assert(t, err != nil, "cancelled request is returned")
+	equals(t, 0, consumer.acked)
+	equals(t, 1, consumer.nacked)
+}
+
+func TestWriteSSEHeartbeat(t *testing.T) {
+	rr := httptest.NewRecorder()
+	errNil(t, WriteSSEHeartbeat(context.Background(), rr, rr))
+	equals(t, ": heartbeat\n\n", rr.Body.String())
+	assert(t, rr.Flushed, "heartbeat is flushed")
+
+	w := failedWriter{httptest.NewRecorder()}
+	assert(t, WriteSSEHeartbeat(context.Background(), w, w) != nil, "write failure is returned")
+
+	// the heartbeat stops once the client is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rr = httptest.NewRecorder()
+	assert(t, WriteSSEHeartbeat(ctx, rr, rr) != nil, "cancelled request is returned")
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	interval, err := HeartbeatInterval(url.Values{})
+	errNil(t, err)
+	equals(t, 15*time.Second, interval)
+
+	interval, err = HeartbeatInterval(url.Values{"heartbeatMs": []string{"5000"}})
+	errNil(t, err)
+	equals(t, 5*time.Second, interval)
+
+	interval, err = HeartbeatInterval(url.Values{"heartbeatMs": []string{"0"}})
+	errNil(t, err)
+	equals(t, time.Duration(0), interval)
+
+	for _, value := range []string{"-1", "999", "300001"} {
+		_, err = HeartbeatInterval(url.Values{"heartbeatMs": []string{value}})
+		equals(t, "heartbeatMs must be 0 to disable or between 1000 and 300000", err.Error())
+	}
+}
+
+func TestRevocationChecker(t *testing.T) {
+	store, err := db.NewInMemoryHandler()
 	errNil(t, err)
+	isRevoked := NewRevocationChecker(store, 50*time.Millisecond)
+	assert(t, !isRevoked("token1", "subject1"), "no token is revoked")
+
+	errNil(t, store.Revoke(&model.RevokedToken{Key: model.TokenRevocationKey("token1")}))
+	// the lookup is cached
+	assert(t, !isRevoked("token1", "subject1"), "cached revocation lookup")
+	time.Sleep(60 * time.Millisecond)
+	assert(t, isRevoked("token1", "subject1"), "token is revoked")
+
+	errNil(t, store.Revoke(&model.RevokedToken{Key: model.SubjectRevocationKey("subject2"), Subject: "subject2"}))
+	assert(t, isRevoked("token2", "subject2"), "all tokens of the subject are revoked")
+	assert(t, !isRevoked("token3", "subject3"), "another subject is not revoked")
+}
+
+func TestRevokeTokenHandlerValidation(t *testing.T) {
+	util.SuperRoles = []string{"myadmin"}
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/revoke", strings.NewReader(`{"subject": "leaked"}`))
+	req.Header.Set("injectedSubs", "tenant1")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(RevokeTokenHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/v2/revoke", strings.NewReader(`{}`))
+	req.Header.Set("injectedSubs", "myadmin")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(RevokeTokenHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestGetTopicsHandlerValidation(t *testing.T) {
+	for _, query := range []string{"limit=0", "limit=101", "offset=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/topics?"+query, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(GetTopicsHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestPollTopics(t *testing.T) {
+	params := url.Values{"topic": []string{"topic2,topic3", "persistent://public/other/topic4", "topic2", "topic1"}}
+	topics, err := PollTopics(params, "persistent://public/default/topic1")
+	errNil(t, err)
+	equals(t, []string{
+		"persistent://public/default/topic2",
+		"persistent://public/default/topic3",
+		"persistent://public/other/topic4",
+	}, topics)
+
+	topics, err = PollTopics(url.Values{}, "persistent://public/default/topic1")
+	errNil(t, err)
+	equals(t, 0, len(topics))
+
+	_, err = PollTopics(url.Values{"topic": []string{"ns/topic2"}}, "persistent://public/default/topic1")
+	equals(t, "invalid topic persistent://public/default/ns/topic2", err.Error())
+}
+
+func TestPollMultipleTopicsAuthorization(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.SuperRoles = []string{"myadmin"}
+	vars := map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p"}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/tenant1/default/topic1?topic=persistent://tenant2/default/topic2", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant1-client")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "persistent://tenant2/default/topic2"), "the disallowed topic is reported")
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/poll/p/tenant1/default/topic1?topic=topic2&SubscriptionName=subname1234&noAck=true", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant1-client")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// the route's topic alone is verified as well
+	req = httptest.NewRequest(http.MethodGet, "/v2/poll/p/tenant1/default/topic1", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant2-client")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+}
+
+func TestTopicsPattern(t *testing.T) {
+	pattern, err := TopicsPattern(url.Values{"topicsPattern": []string{"device-.*"}}, "persistent://tenant1/devices/anytopic")
+	errNil(t, err)
+	equals(t, "persistent://tenant1/devices/device-.*", pattern)
+
+	pattern, err = TopicsPattern(url.Values{}, "persistent://tenant1/devices/anytopic")
+	errNil(t, err)
+	equals(t, "", pattern)
+
+	_, err = TopicsPattern(url.Values{"topicsPattern": []string{"../../tenant2/ns/.*"}}, "persistent://tenant1/devices/anytopic")
+	assert(t, err != nil, "a pattern cannot cross namespaces")
+
+	_, err = TopicsPattern(url.Values{"topicsPattern": []string{"device-(.*"}}, "persistent://tenant1/devices/anytopic")
+	assert(t, err != nil, "invalid regex")
+}
+
+func TestReceiverQueueSizeParam(t *testing.T) {
+	cfg, err := ConsumerParams(url.Values{})
+	errNil(t, err)
+	equals(t, 0, cfg.ReceiverQueueSize)
+
+	cfg, err = ConsumerParams(url.Values{"receiverQueueSize": []string{"5000"}, "SubscriptionName": []string{"mysubscription"}})
+	errNil(t, err)
+	equals(t, 5000, cfg.ReceiverQueueSize)
+
+	for _, size := range []string{"-1", "0", "10001", "abc"} {
+		_, err = ConsumerParams(url.Values{"receiverQueueSize": []string{size}})
+		equals(t, "receiverQueueSize must be an integer between 1 and 10000", err.Error())
+	}
+}
+
+func TestAckTimeoutParam(t *testing.T) {
+	_, err := ConsumerParams(url.Values{"ackTimeoutMs": []string{"30000"}, "SubscriptionName": []string{"mysubscription"}})
+	equals(t, "ackTimeoutMs is not supported until the Pulsar client is upgraded", err.Error())
+}
+
+func TestDeadLetterParams(t *testing.T) {
+	params := url.Values{"SubscriptionType": []string{"shared"}, "maxRedeliveries": []string{"3"}, "deadLetterTopic": []string{"mydlq"}}
+	cfg, err := ConsumerParams(params)
+	errNil(t, err)
+	equals(t, uint32(3), cfg.MaxRedeliveries)
+	equals(t, "mydlq", cfg.DeadLetterTopic)
+
+	_, err = ConsumerParams(url.Values{"maxRedeliveries": []string{"3"}})
+	equals(t, "maxRedeliveries requires a shared or keyshared subscription", err.Error())
+
+	_, err = ConsumerParams(url.Values{"SubscriptionType": []string{"shared"}, "deadLetterTopic": []string{"mydlq"}})
+	equals(t, "deadLetterTopic requires maxRedeliveries", err.Error())
+
+	dlt, err := DeadLetterTopic("mydlq", "persistent://tenant1/ns/topic1")
+	errNil(t, err)
+	equals(t, "persistent://tenant1/ns/mydlq", dlt)
+
+	dlt, err = DeadLetterTopic("persistent://tenant1/dlq/topic1-dlq", "persistent://tenant1/ns/topic1")
+	errNil(t, err)
+	equals(t, "persistent://tenant1/dlq/topic1-dlq", dlt)
+
+	_, err = DeadLetterTopic("persistent://tenant2/ns/mydlq", "persistent://tenant1/ns/topic1")
+	equals(t, "dead letter topic persistent://tenant2/ns/mydlq must be in the tenant tenant1", err.Error())
+}
+
+func TestReaderStartPosition(t *testing.T) {
+	msgID, startTime, err := ReaderStartPosition(url.Values{})
+	errNil(t, err)
+	equals(t, pulsar.LatestMessageID(), msgID)
+	assert(t, startTime.IsZero(), "latest does not seek")
+
+	msgID, _, err = ReaderStartPosition(url.Values{"startMessageId": []string{"earliest"}})
+	errNil(t, err)
+	equals(t, pulsar.EarliestMessageID(), msgID)
+
+	msgID, startTime, err = ReaderStartPosition(url.Values{"startMessageId": []string{"1577836800000"}})
+	errNil(t, err)
+	equals(t, pulsar.EarliestMessageID(), msgID)
+	equals(t, int64(1577836800000), startTime.UnixNano()/int64(time.Millisecond))
+
+	_, _, err = ReaderStartPosition(url.Values{"startMessageId": []string{"first"}})
+	assert(t, err != nil, "invalid start position")
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond), 10)
+	_, _, err = ReaderStartPosition(url.Values{"startMessageId": []string{future}})
+	assert(t, err != nil, "start time in the future")
+}
+
+func TestPollPeekValidation(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p"}
+
+	for _, query := range []string{"peek=true&SubscriptionName=subname1234", "peek=true&noAck=true&SubscriptionName=subname1234"} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/poll/p/tenant1/default/topic1?"+query, nil)
+		req = mux.SetURLVars(req, vars)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(PollHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestDeleteSubscriptionHandlerValidation(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	vars := map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p", "subName": "sub1"}
+
+	req := httptest.NewRequest(http.MethodDelete, "/v2/subscription/p/tenant1/default/topic1/sub1", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant2")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(DeleteSubscriptionHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+
+	vars["subName"] = ""
+	req = httptest.NewRequest(http.MethodDelete, "/v2/subscription/p/tenant1/default/topic1/", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant1")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(DeleteSubscriptionHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestCreateSubscriptionHandler(t *testing.T) {
+	var method, path, body string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterAdminURLs = map[string]string{"pulsar://mydomain.net:6650": server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	create := func(subName, query, subjects string) *httptest.ResponseRecorder {
+		vars := map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p", "subName": subName}
+		req := httptest.NewRequest(http.MethodPut, "/v2/subscription/p/tenant1/default/topic1/"+subName+query, nil)
+		req = mux.SetURLVars(req, vars)
+		req.Header.Set("injectedSubs", subjects)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(CreateSubscriptionHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the latest position by default
+	equals(t, http.StatusCreated, create("mysubscription", "", "tenant1").Code)
+	equals(t, http.MethodPut, method)
+	equals(t, "/admin/v2/persistent/tenant1/default/topic1/subscription/mysubscription", path)
+	equals(t, `{"entryId":9223372036854775807,"ledgerId":9223372036854775807}`, body)
+
+	equals(t, http.StatusCreated, create("mysubscription", "?SubscriptionInitialPosition=earliest", "tenant1").Code)
+	equals(t, `{"entryId":-1,"ledgerId":-1}`, body)
+
+	status = http.StatusConflict
+	equals(t, http.StatusOK, create("mysubscription", "", "tenant1").Code)
+
+	status = http.StatusNotFound
+	equals(t, http.StatusNotFound, create("mysubscription", "", "tenant1").Code)
+
+	// rejected before reaching the admin API
+	path = ""
+	equals(t, http.StatusForbidden, create("mysubscription", "", "tenant2").Code)
+	equals(t, http.StatusUnprocessableEntity, create("sub", "", "tenant1").Code)
+	equals(t, http.StatusUnprocessableEntity, create(model.NonResumable+"sub", "", "tenant1").Code)
+	equals(t, http.StatusUnprocessableEntity, create("mysubscription", "?SubscriptionInitialPosition=last", "tenant1").Code)
+	equals(t, "", path)
+}
+
+func TestTopicConfigLookup(t *testing.T) {
+	store, err := db.NewInMemoryHandler()
+	errNil(t, err)
+	lookup := NewTopicConfigLookup(store, 50*time.Millisecond)
+
+	topic, err := model.NewTopicConfig("persistent://tenant1/ns/config-topic", "pulsar://localhost:6650", "token")
+	errNil(t, err)
+	key, err := store.Create(&topic)
+	errNil(t, err)
+	equals(t, topic.TopicFullName, lookup(key).TopicFullName)
+	assert(t, lookup("unknown-key") == nil, "a topic without a config")
+
+	// the config is served from the cache until the ttl passes
+	_, err = store.DeleteByKey(key)
+	errNil(t, err)
+	assert(t, lookup(key) != nil, "cached topic config")
+	time.Sleep(60 * time.Millisecond)
+	assert(t, lookup(key) == nil, "the deleted topic config is looked up again")
+}
+
+func TestSchemaValidator(t *testing.T) {
+	store, err := db.NewInMemoryHandler()
+	errNil(t, err)
+	validate := NewSchemaValidator(NewTopicConfigLookup(store, 50*time.Millisecond))
+
+	topic, err := model.NewTopicConfig("persistent://tenant1/ns/schema-topic", "pulsar://localhost:6650", "token")
+	errNil(t, err)
+	topic.JSONSchema = json.RawMessage(`{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`)
+	key, err := store.Create(&topic)
+	errNil(t, err)
+
+	equals(t, 0, len(validate(key, []byte(`{"id": 1}`))))
+	assert(t, len(validate(key, []byte(`{"id": "1"}`))) > 0, "id is not an integer")
+	assert(t, len(validate(key, []byte(`{}`))) > 0, "id is required")
+	assert(t, len(validate(key, []byte(`not json`))) > 0, "payload is not JSON")
+
+	// a topic without a config or schema accepts any payload
+	equals(t, 0, len(validate("unknown-key", []byte(`not json`))))
+}
+
+func TestReceiveHandlerSchemaValidation(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	ValidatePayload = func(topicKey string, payload []byte) []string {
+		if string(payload) == `{"id": 1}` {
+			return nil
+		}
+		return []string{"id is required"}
+	}
+	defer func() { ValidatePayload = nil }()
+	InitWorkerPool(1)
+	defer Shutdown()
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1", strings.NewReader(`{}`))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "id is required"), "validation errors are replied")
+
+	// only a super user can skip the validation
+	req = httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?skipSchemaValidation=true", strings.NewReader(`{}`))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+	req.Header.Set("injectedSubs", "tenant1")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestRoutingRules(t *testing.T) {
+	topicFN := "persistent://tenant1/ns/events"
+	rules := []model.RoutingRule{
+		{Header: "X-Event-Type", Value: "order", Topic: "persistent://tenant1/ns/orders"},
+		{Header: "X-Event-Type", Value: "payment", Topic: "persistent://tenant1/other/payments"},
+	}
+	errNil(t, model.ValidateRoutingRules(rules, topicFN))
+
+	err := model.ValidateRoutingRules([]model.RoutingRule{{Header: "X-Event-Type", Value: "order", Topic: "persistent://tenant2/ns/orders"}}, topicFN)
+	equals(t, "routing rule topic persistent://tenant2/ns/orders must be in the tenant of the topic", err.Error())
+	err = model.ValidateRoutingRules([]model.RoutingRule{{Header: "X-Event-Type", Value: "order", Topic: "orders"}}, topicFN)
+	assert(t, strings.Contains(err.Error(), "fully qualified topic name"), "a short topic name is rejected")
+	err = model.ValidateRoutingRules([]model.RoutingRule{{Value: "order", Topic: "persistent://tenant1/ns/orders"}}, topicFN)
+	equals(t, "routing rule requires a header and a value", err.Error())
+
+	topic, err := model.NewTopicConfig(topicFN, "pulsar://mydomain.net:6650", "token")
+	errNil(t, err)
+	topic.RoutingRules = rules
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+
+	h := http.Header{}
+	h.Set("X-Event-Type", "payment")
+	equals(t, "persistent://tenant1/other/payments", model.MatchRoutingRule(rules, h))
+	h.Set("X-Event-Type", "refund")
+	equals(t, "", model.MatchRoutingRule(rules, h))
+	equals(t, "", model.MatchRoutingRule(rules, http.Header{}))
+
+	store, err := db.NewInMemoryHandler()
+	errNil(t, err)
+	key, err := store.Create(&topic)
+	errNil(t, err)
+	route := NewTopicRouter(NewTopicConfigLookup(store, 50*time.Millisecond))
+	h.Set("X-Event-Type", "order")
+	equals(t, "persistent://tenant1/ns/orders", route(key, h))
+	equals(t, "", route("unknown-key", h))
+
+	// the schema validation observes the destination topic before the message is sent
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	RouteTopic = route
+	var validatedKey string
+	ValidatePayload = func(topicKey string, payload []byte) []string {
+		validatedKey = topicKey
+		return []string{"rejected"}
+	}
+	defer func() { RouteTopic, ValidatePayload = nil, nil }()
+	InitWorkerPool(1)
+	defer Shutdown()
+
+	send := func(eventType string) {
+		req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/events", strings.NewReader(`{}`))
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "events", "persistent": "p"})
+		req.Header.Set("X-Event-Type", eventType)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+	}
+	ordersKey, _ := model.GetKeyFromNames("persistent://tenant1/ns/orders", "pulsar://mydomain.net:6650")
+	send("order")
+	equals(t, ordersKey, validatedKey)
+	// no matching rule falls back to the topic of the route
+	send("refund")
+	equals(t, key, validatedKey)
+}
+
+func TestEventTimeParam(t *testing.T) {
+	h := http.Header{}
+	eventTime, err := EventTimeParam(h)
+	errNil(t, err)
+	assert(t, eventTime.IsZero(), "no event time without the header")
+
+	h.Set("X-Pulsar-Event-Time", "2020-01-02T15:04:05Z")
+	eventTime, err = EventTimeParam(h)
+	errNil(t, err)
+	equals(t, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC).Unix(), eventTime.Unix())
+
+	h.Set("X-Pulsar-Event-Time", "1577836800123")
+	eventTime, err = EventTimeParam(h)
+	errNil(t, err)
+	equals(t, int64(1577836800123), eventTime.UnixNano()/int64(time.Millisecond))
+
+	h.Set("X-Pulsar-Event-Time", "yesterday")
+	_, err = EventTimeParam(h)
+	assert(t, err != nil, "invalid event time")
+}
+
+func TestOrderingKey(t *testing.T) {
+	cfg, err := ConsumerParams(url.Values{"SubscriptionType": []string{"keyshared"}, "SubscriptionName": []string{"keyshared-sub"}})
+	errNil(t, err)
+	equals(t, pulsar.KeyShared, cfg.SubscriptionType)
+
+	// the ordering key is returned independent of the partition key
+	msgs := model.NewPulsarMessages(1)
+	msgs.AddPulsarMessage(testMessage{})
+	equals(t, "partition-key", msgs.Messages[0].Key)
+	equals(t, "ordering-key", msgs.Messages[0].OrderingKey)
+}
+
+func TestImportTopicsHandlerValidation(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v2/topics/import", strings.NewReader(`{"TopicFullName": "not an array"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ImportTopicsHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// the invalid and the forbidden configs fail independently before reaching the database
+	body := `[
+		{"TopicFullName": "persistent://tenant1/ns/topic1", "PulsarURL": "pulsar://localhost:6650", "Webhooks": [{"URL": "http://localhost:8080", "SubscriptionType": "selective"}]},
+		{"TopicFullName": "persistent://tenant2/ns/topic2", "PulsarURL": "pulsar://localhost:6650"}
+	]`
+	req = httptest.NewRequest(http.MethodPost, "/v2/topics/import", strings.NewReader(body))
+	req.Header.Set("injectedSubs", "tenant1")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(ImportTopicsHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code)
+
+	var res model.TopicImportResponse
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	equals(t, 0, res.Imported)
+	equals(t, 2, res.Failed)
+	equals(t, "persistent://tenant1/ns/topic1", res.Results[0].TopicFullName)
+	assert(t, res.Results[0].Error != "", "invalid webhook subscription type")
+	equals(t, "not allowed to import the topic", res.Results[1].Error)
+}
+
+func TestDecodePayload(t *testing.T) {
+	payload, err := DecodePayload("", []byte("raw"))
+	errNil(t, err)
+	equals(t, "raw", string(payload))
+
+	payload, err = DecodePayload("base64", []byte(base64.StdEncoding.EncodeToString([]byte{0, 1, 254, 255})+"\n"))
+	errNil(t, err)
+	equals(t, []byte{0, 1, 254, 255}, payload)
+
+	_, err = DecodePayload("base64", []byte("not base64!"))
+	assert(t, err != nil, "invalid base64")
+	_, err = DecodePayload("hex", []byte("00"))
+	assert(t, err != nil, "unsupported decode")
+}
+
+func TestReceiveHandlerBase64Decode(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	var received []byte
+	ValidatePayload = func(topicKey string, payload []byte) []string {
+		received = append([]byte{}, payload...)
+		return []string{"stop before producing"}
+	}
+	defer func() { ValidatePayload = nil }()
+	InitWorkerPool(1)
+	defer Shutdown()
+	vars := map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"}
+
+	// the gzip body is decompressed before the base64 decoding
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write([]byte(base64.StdEncoding.EncodeToString([]byte{0, 1, 254, 255})))
+	errNil(t, err)
+	errNil(t, gw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?decode=base64&includeHeaders=true", &gz)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, []byte{0, 1, 254, 255}, received)
+
+	received = nil
+	req = httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?decode=base64", strings.NewReader("not base64!"))
+	req = mux.SetURLVars(req, vars)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "invalid base64 payload"), "invalid base64 is rejected")
+	assert(t, received == nil, "invalid base64 is not produced")
+}
+
+func TestPayloadEncoding(t *testing.T) {
+	encoding, err := PayloadEncoding(url.Values{})
+	errNil(t, err)
+	equals(t, "", encoding)
+
+	encoding, err = PayloadEncoding(url.Values{"encode": []string{"Base64"}})
+	errNil(t, err)
+	equals(t, "base64", encoding)
+
+	_, err = PayloadEncoding(url.Values{"encode": []string{"hex"}})
+	assert(t, err != nil, "unsupported encode")
+}
+
+func TestReceiveHandlerMaxMessageSize(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	maxSize := util.Config.MaxMessageSize
+	util.Config.MaxMessageSize = 10
+	defer func() { util.Config.MaxMessageSize = maxSize }()
+	InitWorkerPool(1)
+	defer Shutdown()
+	equals(t, 10, MaxMessageSize())
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1", strings.NewReader("more than ten bytes"))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// a chunked request without Content-Length is rejected by the overflow guard
+	req = httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1", strings.NewReader("more than ten bytes"))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	// the limit applies to the decoded body rather than the Content-Length of a compressed body
+	ValidatePayload = func(topicKey string, payload []byte) []string { return []string{"rejected"} }
+	defer func() { ValidatePayload = nil }()
+	for body, status := range map[string]int{"short": http.StatusUnprocessableEntity, "more than ten bytes": http.StatusRequestEntityTooLarge} {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write([]byte(body))
+		zw.Close()
+		assert(t, gz.Len() > 10, "the compressed body exceeds the limit")
+		req = httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1", bytes.NewReader(gz.Bytes()))
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+		req.Header.Set("Content-Encoding", "gzip")
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+		equals(t, status, rr.Code)
+	}
+
+	// an oversized message cannot be chunked by the Pulsar client
+	req = httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?chunking=true", strings.NewReader("short"))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "chunking is not supported"), rr.Body.String())
+
+	util.Config.MaxMessageSize = 0
+	equals(t, util.DefaultMaxMessageSize, MaxMessageSize())
+}
+
+func TestGrowBuffer(t *testing.T) {
+	buffer := []byte("abcd")
+	equals(t, buffer, GrowBuffer(buffer, 4, 3, 100))
+
+	// the length is at least doubled
+	grown := GrowBuffer(buffer, 4, 5, 100)
+	equals(t, 8, len(grown))
+	equals(t, "abcd", string(grown[:4]))
+
+	grown = GrowBuffer(buffer, 2, 50, 100)
+	equals(t, 50, len(grown))
+	equals(t, "ab", string(grown[:2]))
+
+	// never beyond the maximum
+	equals(t, 6, len(GrowBuffer(buffer, 4, 5, 6)))
+	equals(t, 6, len(GrowBuffer(buffer, 4, 50, 6)))
+}
+
+func TestWorkerPoolSharedBuffers(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	ValidatePayload = func(topicKey string, payload []byte) []string { return []string{"rejected"} }
+	defer func() { ValidatePayload = nil }()
+
+	// the workers share the growing receive buffers, the sizing of a buffer is covered by TestGrowBuffer
+	const workers = 20
+	InitWorkerPool(workers)
+	defer Shutdown()
+	var wg sync.WaitGroup
+	for i := 0; i < workers*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1", strings.NewReader(`{"id": 1}`))
+			req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+			equals(t, http.StatusUnprocessableEntity, rr.Code)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReceiveHandlerRequireExistingTopic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterAdminURLs = map[string]string{"pulsar://mydomain.net:6650": server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+	InitWorkerPool(1)
+	defer Shutdown()
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/typo-topic?requireExistingTopic=true", strings.NewReader("message"))
+	req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "typo-topic", "persistent": "p"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPropertyFilter(t *testing.T) {
+	filter, err := PropertyFilter(url.Values{})
+	errNil(t, err)
+	assert(t, filter.Match(nil), "an empty filter matches any message")
+
+	filter, err = PropertyFilter(url.Values{"filterProp": []string{"color=red", "size=a=b"}, "filterNack": []string{"true"}})
+	errNil(t, err)
+	assert(t, filter.Nack, "filterNack")
+	assert(t, filter.Match(map[string]string{"color": "red", "size": "a=b", "other": "x"}), "all properties match")
+	assert(t, !filter.Match(map[string]string{"color": "red"}), "a property is missing")
+	assert(t, !filter.Match(map[string]string{"color": "blue", "size": "a=b"}), "a property does not match")
+
+	_, err = PropertyFilter(url.Values{"filterProp": []string{"color"}})
+	assert(t, err != nil, "invalid filterProp")
+	_, err = PropertyFilter(url.Values{"filterProp": []string{"color=red", "color=blue"}})
+	assert(t, err != nil, "duplicate filterProp")
+}
+
+func TestLagHandler(t *testing.T) {
+	removed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/partitions") {
+			w.Write([]byte(`{"partitions": 0}`))
+			return
+		}
+		if removed {
+			w.Write([]byte(`{"subscriptions": {}}`))
+			return
+		}
+		w.Write([]byte(`{"subscriptions": {"sub1": {"msgBacklog": 7, "unackedMessages": 2}}}`))
+	}))
+	defer server.Close()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterAdminURLs = map[string]string{"pulsar://mydomain.net:6650": server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+	vars := map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p", "subName": "sub1"}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/lag/p/tenant1/default/topic1/sub1", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant2")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LagHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/lag/p/tenant1/default/topic1/sub1", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant1")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(LagHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code)
+	var lag model.SubscriptionLag
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &lag))
+	equals(t, model.SubscriptionLag{Topic: "persistent://tenant1/default/topic1", Subscription: "sub1", Backlog: 7, Unacked: 2}, lag)
+
+	// the backlog series of a removed subscription is deleted
+	req = httptest.NewRequest(http.MethodGet, "/v2/lag/p/tenant1/default/topic1/sub1", nil)
+	req = mux.SetURLVars(req, vars)
+	req.Header.Set("injectedSubs", "tenant1")
+	removed = true
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(LagHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusNotFound, rr.Code)
+	assert(t, !util.SubscriptionBacklog.DeleteLabelValues("persistent://tenant1/default/topic1", "sub1"), "the backlog series is deleted")
+}
+
+func TestStatsHandler(t *testing.T) {
+	stats := `{"msgRateIn":1.5,"storageSize":1024,"subscriptions":{"sub1":{"msgBacklog":7}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/missing-topic/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"reason":"Topic not found"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/partitions") {
+			w.Write([]byte(`{"partitions": 0}`))
+			return
+		}
+		w.Write([]byte(stats))
+	}))
+	defer server.Close()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterAdminURLs = map[string]string{"pulsar://mydomain.net:6650": server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	request := func(topic, subs string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/stats/p/tenant1/default/"+topic, nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "default", "topic": topic, "persistent": "p"})
+		req.Header.Set("injectedSubs", subs)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(StatsHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	equals(t, http.StatusForbidden, request("topic1", "tenant2").Code)
+
+	rr := request("topic1", "tenant1")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "application/json", rr.Header().Get("Content-Type"))
+	equals(t, stats, rr.Body.String())
+
+	rr = request("missing-topic", "tenant1")
+	equals(t, http.StatusNotFound, rr.Code)
+	equals(t, `{"error":"topic not found"}`, rr.Body.String())
+}
+
+func TestLastMessageIDHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/missing-topic"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/partitioned-topic/partitions"):
+			w.Write([]byte(`{"partitions": 2}`))
+		case strings.HasSuffix(r.URL.Path, "/partitions"):
+			w.Write([]byte(`{"partitions": 0}`))
+		case strings.HasSuffix(r.URL.Path, "/partitioned-topic-partition-1/lastMessageId"):
+			w.Write([]byte(`{"ledgerId": 12, "entryId": 3, "partitionIndex": 1}`))
+		default:
+			w.Write([]byte(`{"ledgerId": 10, "entryId": 5, "partitionIndex": -1}`))
+		}
+	}))
+	defer server.Close()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterAdminURLs = map[string]string{"pulsar://mydomain.net:6650": server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	request := func(topic, subs string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/last-message-id/p/tenant1/default/"+topic, nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "default", "topic": topic, "persistent": "p"})
+		req.Header.Set("injectedSubs", subs)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(LastMessageIDHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	equals(t, http.StatusForbidden, request("topic1", "tenant2").Code)
+	equals(t, http.StatusNotFound, request("missing-topic", "tenant1").Code)
+
+	rr := request("topic1", "tenant1")
+	equals(t, http.StatusOK, rr.Code)
+	var id model.TopicLastMessageID
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &id))
+	equals(t, model.TopicLastMessageID{Topic: "persistent://tenant1/default/topic1", MessageID: "10:5:-1:-1"}, id)
+
+	rr = request("partitioned-topic", "tenant1")
+	equals(t, http.StatusOK, rr.Code)
+	id = model.TopicLastMessageID{}
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &id))
+	equals(t, model.TopicLastMessageID{
+		Topic: "persistent://tenant1/default/partitioned-topic",
+		Partitions: []model.TopicLastMessageID{
+			{Topic: "persistent://tenant1/default/partitioned-topic-partition-0", MessageID: "10:5:0:-1"},
+			{Topic: "persistent://tenant1/default/partitioned-topic-partition-1", MessageID: "12:3:1:-1"},
+		},
+	}, id)
+}
+
+func TestSequenceIDParam(t *testing.T) {
+	h := http.Header{}
+	id, err := SequenceIDParam(h)
+	errNil(t, err)
+	assert(t, id == nil, "the producer assigns the sequence id without the header")
+
+	h.Set("X-Pulsar-Sequence-Id", "42")
+	id, err = SequenceIDParam(h)
+	errNil(t, err)
+	equals(t, int64(42), *id)
+
+	for _, value := range []string{"-1", "1.5", "abc", "9223372036854775808"} {
+		h.Set("X-Pulsar-Sequence-Id", value)
+		_, err = SequenceIDParam(h)
+		assert(t, err != nil, "invalid sequence id "+value)
+	}
+}
+
+func TestAcquireSSEConnection(t *testing.T) {
+	maxTotal, maxPerTopic := util.Config.SSEMaxConnections, util.Config.SSEMaxConnectionsPerTopic
+	defer func() { util.Config.SSEMaxConnections, util.Config.SSEMaxConnectionsPerTopic = maxTotal, maxPerTopic }()
+	util.Config.SSEMaxConnections = 3
+	util.Config.SSEMaxConnectionsPerTopic = 2
+
+	release1, ok := AcquireSSEConnection("persistent://tenant1/ns/hot-topic")
+	assert(t, ok, "the first connection to a topic")
+	release2, ok := AcquireSSEConnection("persistent://tenant1/ns/hot-topic")
+	assert(t, ok, "the second connection to a topic")
+	_, ok = AcquireSSEConnection("persistent://tenant1/ns/hot-topic")
+	assert(t, !ok, "the per topic cap is reached")
+
+	release3, ok := AcquireSSEConnection("persistent://tenant1/ns/other-topic")
+	assert(t, ok, "another topic has its own cap")
+	_, ok = AcquireSSEConnection("persistent://tenant1/ns/third-topic")
+	assert(t, !ok, "the global cap is reached")
+
+	release1()
+	release4, ok := AcquireSSEConnection("persistent://tenant1/ns/hot-topic")
+	assert(t, ok, "a released connection frees the caps")
+	for _, release := range []func(){release2, release3, release4} {
+		release()
+	}
+}
+
+// replayMessageID is a message ID with the serialized form of the Pulsar protocol for the small ledger and entry IDs
+type replayMessageID struct {
+	pulsar.MessageID
+	ledger, entry int64
+}
+
+func (id replayMessageID) LedgerID() int64     { return id.ledger }
+func (id replayMessageID) EntryID() int64      { return id.entry }
+func (id replayMessageID) BatchIdx() int32     { return -1 }
+func (id replayMessageID) PartitionIdx() int32 { return 0 }
+func (id replayMessageID) Serialize() []byte {
+	return []byte{0x08, byte(id.ledger), 0x10, byte(id.entry)}
+}
+
+type replayMessage struct {
+	testMessage
+	entry int64
+}
+
+func (m replayMessage) ID() pulsar.MessageID   { return replayMessageID{ledger: 1, entry: m.entry} }
+func (m replayMessage) PublishTime() time.Time { return time.Unix(m.entry*10, 0) }
+
+// replayReader reads the queued messages in order
+type replayReader struct {
+	pulsar.Reader
+	msgs []pulsar.Message
+}
+
+func (r *replayReader) HasNext() bool { return len(r.msgs) > 0 }
+func (r *replayReader) Close()        {}
+func (r *replayReader) Next(ctx context.Context) (pulsar.Message, error) {
+	msg := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	return msg, nil
+}
+
+func TestReaderHandlerSubject(t *testing.T) {
+	clusterTokens := util.ClusterTokens
+	defer func() { util.ClusterTokens = clusterTokens }()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterTokens = map[string]string{"pulsar://mydomain.net:6650": "clustertoken"}
+	var tokens []string
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		tokens = append(tokens, token)
+		return nil, nil, errors.New("dial stopped by the test")
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+
+	read := func(subjects string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v2/reader/p/tenant1/default/topic1", nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "default", "topic": "topic1", "persistent": "p"})
+		req.Header.Set("injectedSubs", subjects)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReaderHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	// another tenant is rejected before a reader is created with the cluster token
+	equals(t, http.StatusForbidden, read("tenant2"))
+	equals(t, 0, len(tokens))
+	assert(t, read("tenant1") != http.StatusForbidden, "the tenant reads its topic")
+	equals(t, []string{"clustertoken"}, tokens)
+}
+
+func TestReplayHandler(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	maxMessages, maxBytes := util.Config.ReplayMaxMessages, util.Config.ReplayMaxBytes
+	defer func() { util.Config.ReplayMaxMessages, util.Config.ReplayMaxBytes = maxMessages, maxBytes }()
+	var startTime time.Time
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		startTime = start
+		reader := &replayReader{}
+		for entry := int64(1); entry <= 5; entry++ {
+			reader.msgs = append(reader.msgs, replayMessage{entry: entry})
+		}
+		return idleClient{}, reader, nil
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+
+	replay := func(topic, query string) (*httptest.ResponseRecorder, model.ReplayMessages) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/replay/p/tenant1/default/"+topic+"?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "default", "topic": topic, "persistent": "p"})
+		req.Header.Set("injectedSubs", "tenant1")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReplayHandler).ServeHTTP(rr, req)
+		var msgs model.ReplayMessages
+		if rr.Code == http.StatusOK {
+			errNil(t, json.Unmarshal(rr.Body.Bytes(), &msgs))
+		}
+		return rr, msgs
+	}
+
+	rr, msgs := replay("topic1", "")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, 5, msgs.Size)
+	assert(t, !msgs.Truncated, "the replay reached the end of the topic")
+
+	endID := base64.StdEncoding.EncodeToString(replayMessageID{ledger: 1, entry: 3}.Serialize())
+	rr, msgs = replay("topic1", "endMessageId="+url.QueryEscape(endID))
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, 3, msgs.Size)
+	assert(t, msgs.Messages[2].PublishTime.Equal(time.Unix(30, 0)), "the last message is the end message")
+	assert(t, !msgs.Truncated, "the replay ends at the end message id")
+
+	rr, msgs = replay("topic1", "startTimestampMs=15000&endTimestampMs=40000")
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, time.Unix(15, 0), startTime)
+	equals(t, 4, msgs.Size)
+
+	rr, msgs = replay("topic1", "maxMessages=2")
+	equals(t, 2, msgs.Size)
+	assert(t, msgs.Truncated, "the replay is truncated by maxMessages")
+
+	util.Config.ReplayMaxBytes = 3 * len(testMessage{}.Payload())
+	rr, msgs = replay("topic1", "")
+	equals(t, 3, msgs.Size)
+	assert(t, msgs.Truncated, "the replay is truncated by ReplayMaxBytes")
+
+	// a message larger than ReplayMaxBytes is returned alone so that the replay makes progress
+	util.Config.ReplayMaxBytes = 1
+	rr, msgs = replay("topic1", "")
+	equals(t, 1, msgs.Size)
+	assert(t, msgs.Truncated, "the replay is truncated after the large message")
+
+	rr, _ = replay("topic1", "endMessageId=1&endTimestampMs=40000")
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	rr, _ = replay("topic1", "endMessageId=not-an-id")
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	rr, _ = replay("topic1", "startTimestampMs=40000&endTimestampMs=15000")
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	util.Config.ReplayMaxMessages, util.Config.ReplayMaxBytes = 4, 0
+	rr, _ = replay("topic1", "maxMessages=5")
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+	rr, msgs = replay("topic1", "")
+	equals(t, 4, msgs.Size)
+	assert(t, msgs.Truncated, "the replay is truncated by ReplayMaxMessages")
+}
+
+func TestFlushCacheHandler(t *testing.T) {
+	util.SuperRoles = []string{"myadmin"}
+
+	req := httptest.NewRequest(http.MethodPost, "/v2/admin/flush-cache", nil)
+	req.Header.Set("injectedSubs", "tenant1")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(FlushCacheHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+
+	flush := func() FlushCacheResponse {
+		req := httptest.NewRequest(http.MethodPost, "/v2/admin/flush-cache", nil)
+		req.Header.Set("injectedSubs", "tenant1,myadmin")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(FlushCacheHandler).ServeHTTP(rr, req)
+		equals(t, http.StatusOK, rr.Code)
+		var resp FlushCacheResponse
+		errNil(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		return resp
+	}
+	flush()
+
+	// a poll on a durable subscription caches its consumer until the flush
+	dialed := 0
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		dialed++
+		return newQueuedConsumer()
+	})()
+	cfg := model.ConsumerConfig{SubscriptionName: "flush-subscription"}
+	_, err := broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 1, 1, 0)
+	errNil(t, err)
+	_, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 1, 1, 0)
+	errNil(t, err)
+	equals(t, 1, dialed)
+
+	equals(t, FlushCacheResponse{Producers: 0, Consumers: 1}, flush())
+	equals(t, FlushCacheResponse{}, flush())
+
+	// the next poll creates a new consumer
+	_, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 1, 1, 0)
+	errNil(t, err)
+	equals(t, 2, dialed)
+	flush()
+}
+
+func TestPollMediaType(t *testing.T) {
+	equals(t, "application/json", PollMediaType(""))
+	equals(t, "application/json", PollMediaType("application/json"))
+	equals(t, "text/csv", PollMediaType("text/csv; charset=utf-8"))
+	equals(t, "application/msgpack", PollMediaType("application/msgpack"))
+	equals(t, "application/msgpack", PollMediaType("application/x-msgpack"))
+	equals(t, "text/csv", PollMediaType("application/json;q=0.5, text/csv"))
+	// the first media type wins a tie
+	equals(t, "text/csv", PollMediaType("text/csv, application/msgpack"))
+	// an unsupported or malformed Accept header falls back to JSON
+	equals(t, "application/json", PollMediaType("application/xml"))
+	equals(t, "application/json", PollMediaType("text/csv;q=0"))
+	equals(t, "application/json", PollMediaType(";;;"))
+}
+
+func TestEncodePollMessages(t *testing.T) {
+	published := time.Unix(1600000000, 5)
+	msgs := model.PulsarMessages{Limit: 2, Size: 2, Messages: []model.PulsarMessage{
+		{Payload: []byte("hello, world"), Topic: "t", PublishTime: published, EventTime: published, MessageID: "1:2:0",
+			Properties: map[string]string{"b": "2", "a": "1"}, AckID: []byte{8, 1}},
+		{Payload: []byte("two"), Topic: "t", PublishTime: published, EventTime: published, MessageID: "1:3:0", AckID: []byte{8, 1}},
+	}}
+
+	data, err := EncodePollMessages(msgs, "text/csv")
+	errNil(t, err)
+	equals(t, "id,payload,properties,ackId\n1:2:0,\"hello, world\",\"{\"\"a\"\":\"\"1\"\",\"\"b\"\":\"\"2\"\"}\",CAE=\n1:3:0,two,,CAE=\n", string(data))
+
+	msgs.PayloadEncoding = "base64"
+	data, err = EncodePollMessages(msgs, "text/csv")
+	errNil(t, err)
+	assert(t, strings.Contains(string(data), "1:3:0,dHdv,,CAE=\n"), "base64 encoded payload")
+
+	data, err = EncodePollMessages(msgs, "application/json")
+	errNil(t, err)
+	var decoded model.PulsarMessages
+	errNil(t, json.Unmarshal(data, &decoded))
+	equals(t, 2, decoded.Size)
+
+	// an array of two maps, the first one with the payload and properties
+	data, err = EncodePollMessages(msgs, "application/msgpack")
+	errNil(t, err)
+	equals(t, []byte{0x92, 0x88, 0xa7}, data[:3])
+	equals(t, "payload", string(data[3:10]))
+	equals(t, []byte{0xc4, 12}, data[10:12])
+	assert(t, bytes.Contains(data, []byte("\xaaproperties\x82\xa1a\xa11\xa1b\xa12")), "sorted properties map")
+	assert(t, bytes.Contains(data, []byte("\x87\xa7payload\xc4\x03two")), "second message without properties")
+	assert(t, bytes.HasSuffix(data, []byte("\xa5ackId\xc4\x02\x08\x01")), "binary ackId")
+}
+
+func TestPropertyLimits(t *testing.T) {
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.Config.MaxMessageProperties = 2
+	util.Config.MaxPropertiesBytes = 10
+
+	// the limits are inclusive
+	errNil(t, CheckPropertyLimits(PropertiesSize(map[string]string{"a": "1234", "b": "1234"})))
+	equals(t, "3 properties exceed the maximum of 2", CheckPropertyLimits(PropertiesSize(map[string]string{"a": "", "b": "", "c": ""})).Error())
+	equals(t, "properties of 11 bytes exceed the maximum of 10 bytes", CheckPropertyLimits(PropertiesSize(map[string]string{"a": "1234", "b": "12345"})).Error())
+	errNil(t, CheckPropertyLimits(PropertiesSize(nil)))
+
+	// the joined values of a multi-valued header count towards the size
+	h := http.Header{"Ab": []string{"12", "34"}}
+	count, size := HeadersSize(h, false)
+	equals(t, 1, count)
+	equals(t, 4, size)
+	count, size = HeadersSize(h, true)
+	equals(t, 1, count)
+	equals(t, 8, size)
+
+	util.Config.MaxMessageProperties = 0
+	util.Config.MaxPropertiesBytes = 0
+	errNil(t, CheckPropertyLimits(util.DefaultMaxMessageProperties, util.DefaultMaxPropertiesBytes))
+	assert(t, CheckPropertyLimits(util.DefaultMaxMessageProperties+1, 0) != nil, "default count limit")
+	assert(t, CheckPropertyLimits(0, util.DefaultMaxPropertiesBytes+1) != nil, "default size limit")
+}
+
+func TestReceiveHandlerIncludedHeaderLimits(t *testing.T) {
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	produced := false
+	ValidatePayload = func(topicKey string, payload []byte) []string {
+		produced = true
+		return []string{"stop before producing"}
+	}
+	defer func() { ValidatePayload = nil }()
+	InitWorkerPool(1)
+	defer Shutdown()
+
+	send := func(headers int) int {
+		req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?includeHeaders=true", strings.NewReader("payload"))
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+		for i := 0; i < headers; i++ {
+			req.Header.Set("X-Header-"+strconv.Itoa(i), "value")
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// the headers at the limit are included
+	util.Config.MaxMessageProperties = 3
+	produced = false
+	equals(t, http.StatusUnprocessableEntity, send(3))
+	assert(t, produced, "the headers at the limit are included")
+
+	produced = false
+	equals(t, http.StatusRequestHeaderFieldsTooLarge, send(4))
+	assert(t, !produced, "too many headers are rejected")
+
+	// X-Header-0: value is 15 bytes
+	util.Config.MaxMessageProperties = 0
+	util.Config.MaxPropertiesBytes = 29
+	equals(t, http.StatusRequestHeaderFieldsTooLarge, send(2))
+	util.Config.MaxPropertiesBytes = 30
+	equals(t, http.StatusUnprocessableEntity, send(2))
+}
+
+func TestReceiveHandlerClusterToken(t *testing.T) {
+	cfg := *util.GetConfig()
+	clusterTokens := util.ClusterTokens
+	defer func() {
+		util.Config = cfg
+		util.ClusterTokens = clusterTokens
+	}()
+	util.Config.PulsarTokenHeaderName = "Authorization"
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterTokens = map[string]string{"pulsar://mydomain.net:6650": "clustertoken"}
+	InitWorkerPool(1)
+	defer Shutdown()
+	var tokens []string
+	CheckProducer = func(pulsarURL, pulsarToken, topic string) error {
+		tokens = append(tokens, pulsarToken)
+		return nil
+	}
+	defer func() { CheckProducer = pulsardriver.CheckProducer }()
+
+	send := func(handler http.Handler, path, subjects string) {
+		req := httptest.NewRequest(http.MethodPost, path+"?dryRun=true&dryRunProducer=true", strings.NewReader("payload"))
+		req.Header.Set("TopicFn", "persistent://tenant1/ns/topic1")
+		req.Header.Set("injectedSubs", subjects)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		equals(t, http.StatusOK, rr.Code)
+	}
+
+	// an unauthenticated /v1/firehose request never produces with the cluster token
+	send(middleware.NoAuth(http.HandlerFunc(ReceiveHandler)), "/v1/firehose", "tenant1")
+	// nor does a subject that is not verified on the topic
+	send(http.HandlerFunc(ReceiveHandler), "/v2/firehose", "tenant2")
+	send(http.HandlerFunc(ReceiveHandler), "/v2/firehose", "tenant1")
+	equals(t, []string{"", "", "clustertoken"}, tokens)
+}
+
+func TestReceiveHandlerDryRun(t *testing.T) {
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.Config.PulsarTokenHeaderName = "Authorization"
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	InitWorkerPool(1)
+	defer Shutdown()
+	var checked []string
+	var checkErr error
+	CheckProducer = func(pulsarURL, pulsarToken, topic string) error {
+		checked = append(checked, pulsarURL+" "+pulsarToken+" "+topic)
+		return checkErr
+	}
+	defer func() { CheckProducer = pulsardriver.CheckProducer }()
+
+	send := func(query string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/firehose/p/tenant1/ns/topic1?"+query, strings.NewReader("payload"))
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"})
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the resolved topic and cluster are replied without a producer
+	rr := send("dryRun=true", nil)
+	equals(t, http.StatusOK, rr.Code)
+	equals(t, "application/json", rr.Header().Get("Content-Type"))
+	var result model.DryRunResult
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, model.DryRunResult{Topic: "persistent://tenant1/ns/topic1", Cluster: "pulsar://mydomain.net:6650", Size: 7}, result)
+	equals(t, 0, len(checked))
+
+	rr = send("dryRun=true&dryRunProducer=true", http.Header{"Authorization": {"Bearer mytoken"}})
+	equals(t, http.StatusOK, rr.Code)
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert(t, result.ProducerChecked, "the producer is checked")
+	equals(t, []string{"pulsar://mydomain.net:6650 mytoken persistent://tenant1/ns/topic1"}, checked)
+
+	// the failures have the status of a real produce
+	checkErr = pulsardriver.ErrProducerUnavailable
+	rr = send("dryRun=true&dryRunProducer=true", nil)
+	equals(t, http.StatusServiceUnavailable, rr.Code)
+	equals(t, `{"code":"CLUSTER_UNAVAILABLE","message":"Failed to create Pulsar producer"}`, rr.Body.String())
+	checkErr = errors.New("server error: AuthorizationError: not authorized")
+	rr = send("dryRun=true&dryRunProducer=true", nil)
+	equals(t, http.StatusForbidden, rr.Code)
+	assert(t, strings.HasPrefix(rr.Body.String(), `{"code":"AUTHORIZATION_FAILED"`), "machine-readable code")
+	checkErr = pulsardriver.ErrPulsarTimeout
+	equals(t, http.StatusGatewayTimeout, send("dryRun=true&dryRunProducer=true", nil).Code)
+	equals(t, http.StatusUnauthorized, send("dryRun=true", http.Header{"Pulsarurl": {"pulsar://other.net:6650"}}).Code)
+	equals(t, http.StatusUnprocessableEntity, send("dryRun=true&compression=snappy", nil).Code)
+	equals(t, 4, len(checked))
+
+	// the TopicFn header is validated and normalized before any Pulsar call
+	rr = send("dryRun=true", http.Header{"Topicfn": {"Persistent://tenant1/ns/other"}})
+	equals(t, http.StatusOK, rr.Code)
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, "persistent://tenant1/ns/other", result.Topic)
+	for _, topicFn := range []string{"persistent://tenant1/ns/my topic", "persistent://tenant1/ns/a/b", "persistent://tenant1//other"} {
+		rr = send("dryRun=true&dryRunProducer=true", http.Header{"Topicfn": {topicFn}})
+		equals(t, http.StatusUnprocessableEntity, rr.Code)
+	}
+	equals(t, 4, len(checked))
+}
+
+func TestReceiveHandlerDefaultTopic(t *testing.T) {
+	cfg := *util.GetConfig()
+	defer func() { util.Config = cfg }()
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650", "pulsar://other.net:6650"}
+	InitWorkerPool(1)
+	defer Shutdown()
+
+	send := func(vars map[string]string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/firehose?dryRun=true", strings.NewReader("payload"))
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		req.Header.Set("injectedSubs", "tenant1")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReceiveHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// a request without a topic is rejected without a default topic
+	equals(t, http.StatusUnprocessableEntity, send(nil, nil).Code)
+
+	util.Config.DefaultTopic, util.Config.DefaultTopicPulsarURL = "persistent://tenant1/ns/default", "pulsar://other.net:6650"
+	rr := send(nil, nil)
+	equals(t, http.StatusOK, rr.Code)
+	var result model.DryRunResult
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, "persistent://tenant1/ns/default", result.Topic)
+	equals(t, "pulsar://other.net:6650", result.Cluster)
+
+	rr = send(nil, http.Header{"Pulsarurl": {"pulsar://mydomain.net:6650"}})
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, "pulsar://mydomain.net:6650", result.Cluster)
+
+	// the header and the route topics take precedence over the default topic
+	rr = send(nil, http.Header{"Topicfn": {"persistent://tenant2/ns/header"}})
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, "persistent://tenant2/ns/header", result.Topic)
+	equals(t, "pulsar://mydomain.net:6650", result.Cluster)
+	rr = send(map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "p"}, nil)
+	errNil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	equals(t, "persistent://tenant1/ns/topic1", result.Topic)
+	equals(t, http.StatusUnprocessableEntity, send(map[string]string{"tenant": "tenant1", "namespace": "ns", "topic": "topic1", "persistent": "x"}, nil).Code)
+
+	// the subject must be allowed on the default topic's tenant
+	util.Config.DefaultTopic = "persistent://tenant2/ns/default"
+	equals(t, http.StatusForbidden, send(nil, nil).Code)
+}
+
+// broadcastReader reads the messages sent on its channel until the channel is closed
+type broadcastReader struct {
+	pulsar.Reader
+	msgs   chan pulsar.Message
+	closed chan bool
+}
+
+func (r *broadcastReader) Close() { close(r.closed) }
+func (r *broadcastReader) Next(ctx context.Context) (pulsar.Message, error) {
+	select {
+	case msg, ok := <-r.msgs:
+		if !ok {
+			return nil, errors.New("reader failed")
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestJoinBroadcast(t *testing.T) {
+	var readers []*broadcastReader
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		reader := &broadcastReader{msgs: make(chan pulsar.Message), closed: make(chan bool)}
+		readers = append(readers, reader)
+		return idleClient{}, reader, nil
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+
+	topic := "persistent://tenant1/default/broadcast"
+	fast, leaveFast, err := broker.JoinBroadcast("pulsar://mydomain.net:6650", "token", topic, 3)
+	errNil(t, err)
+	slow, leaveSlow, err := broker.JoinBroadcast("pulsar://mydomain.net:6650", "token", topic, 1)
+	errNil(t, err)
+	equals(t, 1, len(readers))
+
+	for entry := int64(1); entry <= 3; entry++ {
+		readers[0].msgs <- replayMessage{entry: entry}
+	}
+	for entry := int64(1); entry <= 3; entry++ {
+		msg := <-fast
+		equals(t, replayMessageID{ledger: 1, entry: entry}, msg.ID())
+	}
+	// the slow client only buffers the first message, the others are dropped
+	equals(t, 1, len(slow))
+	equals(t, replayMessageID{ledger: 1, entry: 1}, (<-slow).ID())
+
+	leaveFast()
+	leaveFast()
+	select {
+	case <-readers[0].closed:
+		t.Fatal("the reader is shared until the last client leaves")
+	case <-time.After(50 * time.Millisecond):
+	}
+	leaveSlow()
+	<-readers[0].closed
+
+	// a new client creates a new reader, which closes the client channel once it fails
+	ch, leave, err := broker.JoinBroadcast("pulsar://mydomain.net:6650", "token", topic, 1)
+	errNil(t, err)
+	defer leave()
+	equals(t, 2, len(readers))
+	close(readers[1].msgs)
+	_, ok := <-ch
+	assert(t, !ok, "the client channel is closed on a reader failure")
+	<-readers[1].closed
+}
+
+func TestJoinBroadcastDial(t *testing.T) {
+	var dials int32
+	dialing, blocked := make(chan struct{}, 3), make(chan struct{})
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		atomic.AddInt32(&dials, 1)
+		if strings.HasSuffix(topic, "slow") {
+			dialing <- struct{}{}
+			<-blocked
+		}
+		return idleClient{}, &broadcastReader{msgs: make(chan pulsar.Message), closed: make(chan bool)}, nil
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+
+	// the clients joining a topic while its reader is created share the reader
+	joined := make(chan func(), 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, leave, err := broker.JoinBroadcast("pulsar://mydomain.net:6650", "token", "persistent://tenant1/default/slow", 1)
+			errNil(t, err)
+			joined <- leave
+		}()
+	}
+
+	// a slow reader creation does not block the other topics
+	<-dialing
+	_, leave, err := broker.JoinBroadcast("pulsar://mydomain.net:6650", "token", "persistent://tenant1/default/fast", 1)
+	errNil(t, err)
+	leave()
+
+	close(blocked)
+	leaves := []func(){}
+	for i := 0; i < 3; i++ {
+		leaves = append(leaves, <-joined)
+	}
+	equals(t, int32(2), atomic.LoadInt32(&dials))
+	for _, leave := range leaves {
+		leave()
+	}
+}
+
+func TestSSEBroadcast(t *testing.T) {
+	broadcast, err := SSEBroadcast(url.Values{})
+	errNil(t, err)
+	assert(t, !broadcast, "broadcast is opt in")
+
+	broadcast, err = SSEBroadcast(url.Values{"broadcast": {"true"}, "maxMessages": {"10"}})
+	errNil(t, err)
+	assert(t, broadcast, "broadcast is selected by the query param")
+
+	for _, name := range []string{"SubscriptionName", "SubscriptionType", "startTimestampMs", "topicsPattern", "deadLetterTopic"} {
+		_, err = SSEBroadcast(url.Values{"broadcast": {"true"}, name: {"1"}})
+		assert(t, err != nil, name+" requires a subscription")
+	}
+
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	req := httptest.NewRequest(http.MethodGet, "/v2/sse/p/public/default/testtopic?broadcast=true&SubscriptionName=sub1", nil)
+	req.Header.Set("PulsarUrl", "pulsar://mydomain.net:6650")
+	req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "testtopic", "persistent": "p"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(SSEHandler).ServeHTTP(rr, req)
+	equals(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestLastEventIDStart(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/sse/p/tenant1/ns/topic1", nil)
+	req.Header.Set("Last-Event-ID", "12345:67:0")
+	cfg := model.ConsumerConfig{SubscriptionName: "sub1", SubscriptionType: pulsar.Exclusive}
+	equals(t, "12345:68:0:-1", model.FormatMessageID(LastEventIDStart(req, cfg)))
+	cfg.SubscriptionType = pulsar.Failover
+	equals(t, "12345:68:0:-1", model.FormatMessageID(LastEventIDStart(req, cfg)))
+
+	// a seek of a shared subscription would rewind the other consumers, so the header is ignored
+	for _, subType := range []pulsar.SubscriptionType{pulsar.Shared, pulsar.KeyShared} {
+		cfg.SubscriptionType = subType
+		assert(t, LastEventIDStart(req, cfg) == nil, "no seek of a shared subscription")
+	}
+	cfg = model.ConsumerConfig{SubscriptionName: model.NonResumable + "sub", SubscriptionType: pulsar.Exclusive}
+	assert(t, LastEventIDStart(req, cfg) == nil, "no seek of an auto-generated subscription")
+	cfg = model.ConsumerConfig{SubscriptionName: "sub1", SubscriptionType: pulsar.Exclusive}
+	req.Header.Set("Last-Event-ID", "malformed")
+	assert(t, LastEventIDStart(req, cfg) == nil, "a malformed id is ignored")
+}
+
+func TestSSEHandlerBroadcast(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	reader := &broadcastReader{msgs: make(chan pulsar.Message), closed: make(chan bool)}
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		return idleClient{}, reader, nil
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/sse/p/public/default/broadcast?broadcast=true&maxMessages=1", nil)
+	req.Header.Set("PulsarUrl", "pulsar://mydomain.net:6650")
+	req = mux.SetURLVars(req, map[string]string{"tenant": "public", "namespace": "default", "topic": "broadcast", "persistent": "p"})
+	rr := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		http.HandlerFunc(SSEHandler).ServeHTTP(rr, req)
+		close(done)
+	}()
+
+	// a message published before the client joins is not delivered, keep publishing until one is
+	for delivered := false; !delivered; {
+		select {
+		case reader.msgs <- replayMessage{entry: 1}:
+		case <-done:
+			delivered = true
+		}
+	}
+	<-reader.closed
+	equals(t, http.StatusOK, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "data: "+string(testMessage{}.Payload())+"\n\n"), "the broadcast message is written as an event")
+}
+
+func TestAllowedTopicSubjects(t *testing.T) {
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650", "pulsar://other.net:6650"}
+	store, err := db.NewInMemoryHandler()
+	errNil(t, err)
+	topic, err := model.NewTopicConfig("persistent://tenant1/default/shared", "pulsar://other.net:6650", "token")
+	errNil(t, err)
+	topic.AllowedSubjects = []string{"reporting-svc", "audit"}
+	_, err = store.Create(&topic)
+	errNil(t, err)
+	AllowedTopicSubjects = NewTopicSubjects(NewTopicConfigLookup(store, time.Minute))
+	defer func() { AllowedTopicSubjects = nil }()
+
+	// a cross-tenant subject is granted the topic of the topic config only
+	assert(t, VerifySubjectBasedOnTopic("persistent://tenant1/default/shared", "reporting-svc", ExtractEvalTenant), "allowed subject")
+	assert(t, VerifySubjectBasedOnTopic("persistent://tenant1/default/shared", "tenant2,audit", ExtractEvalTenant), "any allowed subject")
+	assert(t, VerifySubjectBasedOnTopic("persistent://tenant1/default/shared", "tenant1", ExtractEvalTenant), "the tenant is still allowed")
+	assert(t, !VerifySubjectBasedOnTopic("persistent://tenant1/default/shared", "tenant2", ExtractEvalTenant), "subject not in the list")
+	assert(t, !VerifySubjectBasedOnTopic("persistent://tenant1/default/shared", "reporting", ExtractEvalTenant), "subjects are matched exactly")
+	assert(t, !VerifySubjectBasedOnTopic("persistent://tenant1/default/other", "reporting-svc", ExtractEvalTenant), "another topic of the tenant")
+	assert(t, !VerifySubjectBasedOnTopic("persistent://tenant1/default/shared-partition-0", "reporting-svc", ExtractEvalTenant), "another topic name")
+	// the operations on the tenant, such as the topic configs, are not granted
+	assert(t, !VerifySubjectBasedOnTenant("persistent://tenant1/default/shared", "reporting-svc", ExtractEvalTenant), "tenant only")
+
+	broker.DialReader = func(url, token, topic string, startMessageID pulsar.MessageID, start time.Time) (pulsar.Client, pulsar.Reader, error) {
+		return idleClient{}, &replayReader{msgs: []pulsar.Message{replayMessage{entry: 1}}}, nil
+	}
+	defer func() { broker.DialReader = broker.GetPulsarClientReader }()
+	replay := func(topic string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v2/replay/p/tenant1/default/"+topic, nil)
+		req = mux.SetURLVars(req, map[string]string{"tenant": "tenant1", "namespace": "default", "topic": topic, "persistent": "p"})
+		req.Header.Set("injectedSubs", "reporting-svc")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReplayHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	equals(t, http.StatusOK, replay("shared"))
+	equals(t, http.StatusForbidden, replay("other"))
+}
+
+func TestValidateAllowedSubjects(t *testing.T) {
+	topic, err := model.NewTopicConfig("persistent://tenant1/default/shared", "pulsar://mydomain.net:6650", "token")
+	errNil(t, err)
+	topic.AllowedSubjects = []string{"reporting-svc", "audit-1234"}
+	_, err = model.ValidateTopicConfig(topic)
+	errNil(t, err)
+
+	for _, subjects := range [][]string{{""}, {"a,b"}, {"reporting svc"}, {"*"}, {"reporting-*"}, {"audit", "audit"}} {
+		topic.AllowedSubjects = subjects
+		_, err = model.ValidateTopicConfig(topic)
+		assert(t, err != nil, "invalid allowed subjects "+strings.Join(subjects, "|"))
+	}
+	topic.AllowedSubjects = make([]string, model.MaxAllowedSubjects+1)
+	for i := range topic.AllowedSubjects {
+		topic.AllowedSubjects[i] = "subject-" + strconv.Itoa(i)
+	}
+	_, err = model.ValidateTopicConfig(topic)
+	assert(t, err != nil, "too many allowed subjects")
 }
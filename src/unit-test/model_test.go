@@ -1,8 +1,12 @@
 package tests
 
 import (
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 
+	"github.com/apache/pulsar-client-go/pulsar"
 	. "github.com/kafkaesque-io/pulsar-beam/src/model"
 )
 
@@ -11,4 +15,44 @@ func TestPulsarMessages(t *testing.T) {
 	messages := NewPulsarMessages(10)
 	equals(t, messages.Limit, 10)
 	equals(t, messages.IsEmpty(), true)
+
+	messages.Messages = append(messages.Messages, PulsarMessage{
+		Payload:    []byte("large payload"),
+		Key:        "k1",
+		Properties: map[string]string{"p1": "v1"},
+	})
+	messages.Size++
+	messages.OmitPayloads()
+	data, err := json.Marshal(messages)
+	errNil(t, err)
+	assert(t, !strings.Contains(string(data), "payload"), "payload is omitted")
+	assert(t, strings.Contains(string(data), `"properties":{"p1":"v1"}`), "properties are kept")
+	assert(t, strings.Contains(string(data), `"key":"k1"`), "key is kept")
+}
+
+func TestPublishTrace(t *testing.T) {
+	var disabled *PublishTrace
+	disabled.Add("topic", "%s from route", "persistent://public/default/test")
+	assert(t, disabled == nil, "a nil trace must stay nil")
+
+	trace := &PublishTrace{}
+	trace.Add("topic", "%s from route", "persistent://public/default/test")
+	trace.Add("message", "key=%q async=%t", "k1", true)
+	equals(t, 2, len(trace.Steps))
+	equals(t, "topic", trace.Steps[0].Step)
+	equals(t, "persistent://public/default/test from route", trace.Steps[0].Detail)
+	equals(t, `key="k1" async=true`, trace.Steps[1].Detail)
+}
+
+func TestBatchPublishResponse(t *testing.T) {
+	resp := NewBatchPublishResponse(make([]pulsar.MessageID, 3), []error{nil, errors.New("producer closed"), nil})
+	equals(t, 3, resp.Total)
+	equals(t, 2, resp.Succeeded)
+	equals(t, 1, resp.Failed)
+	equals(t, "producer closed", resp.Results[1].Error)
+	equals(t, "", resp.Results[0].Error)
+	for i, result := range resp.Results {
+		equals(t, i, result.Index)
+		equals(t, i != 1, result.Success)
+	}
 }
@@ -1,12 +1,24 @@
 package tests
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/kafkaesque-io/pulsar-beam/src/broker"
+	"github.com/kafkaesque-io/pulsar-beam/src/model"
 	"github.com/kafkaesque-io/pulsar-beam/src/pulsardriver"
 	"github.com/kafkaesque-io/pulsar-beam/src/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func TestClientCreation(t *testing.T) {
@@ -36,7 +48,7 @@ func TestProducerObject(t *testing.T) {
 	os.Setenv("PulsarClientOperationTimeout", "1")
 	os.Setenv("PulsarClientConnectionTimeout", "1")
 
-	_, err := pulsardriver.GetPulsarProducer("pulsar://test url", "tokenstring", "topicName")
+	_, err := pulsardriver.GetPulsarProducer("pulsar://test url", "tokenstring", "topicName", pulsardriver.ProducerConfig{}, false)
 	assert(t, err != nil, "create pulsar consumer with bogus url")
 
 	// pulsardriver.SendToPulsar("pulsar://", "tokenstring", "topicName", []byte("payload"), false)
@@ -53,3 +65,662 @@ func TestProducerObject(t *testing.T) {
 	clt.UpdateTime()
 	clt.Close()
 }
+
+func TestSendRetryPolicy(t *testing.T) {
+	retry, reconnect := pulsardriver.RetryableResult(pulsar.ProducerClosed)
+	assert(t, retry && reconnect, "a closed producer is retried after reconnect")
+	retry, reconnect = pulsardriver.RetryableResult(pulsar.TimeoutError)
+	assert(t, retry && !reconnect, "timeout is retried")
+	retry, _ = pulsardriver.RetryableResult(pulsar.AuthorizationError)
+	assert(t, !retry, "authorization error fails fast")
+	retry, _ = pulsardriver.RetryableResult(pulsar.MessageTooBig)
+	assert(t, !retry, "message too big fails fast")
+
+	util.Config.ProducerRetryBackoff = "100ms"
+	equals(t, 100*time.Millisecond, pulsardriver.RetryBackoff(0))
+	equals(t, 400*time.Millisecond, pulsardriver.RetryBackoff(2))
+	equals(t, 5*time.Second, pulsardriver.RetryBackoff(10))
+
+	util.Config.ProducerRetryBackoff = "invalid"
+	equals(t, 200*time.Millisecond, pulsardriver.RetryBackoff(1))
+}
+
+// idleClient and idleConsumer stand in for a Pulsar client and consumer without any message
+type idleClient struct {
+	pulsar.Client
+}
+
+func (c idleClient) Close() {}
+
+type idleConsumer struct {
+	pulsar.Consumer
+	ch chan pulsar.ConsumerMessage
+}
+
+func (c idleConsumer) Chan() <-chan pulsar.ConsumerMessage { return c.ch }
+func (c idleConsumer) Subscription() string                { return "" }
+func (c idleConsumer) Unsubscribe() error                  { return nil }
+func (c idleConsumer) Close()                              {}
+
+func TestPollConsumerCache(t *testing.T) {
+	dials := 0
+	broker.DialConsumer = func(url, token, topic string, cfg model.ConsumerConfig) (pulsar.Client, pulsar.Consumer, error) {
+		dials++
+		return idleClient{}, idleConsumer{ch: make(chan pulsar.ConsumerMessage)}, nil
+	}
+	defer func() { broker.DialConsumer = broker.GetPulsarClientConsumer }()
+
+	cfg := model.ConsumerConfig{SubscriptionName: "cached-subscription", SubscriptionType: pulsar.Shared}
+	topic := "persistent://tenant1/ns/cached-topic"
+	for i := 0; i < 2; i++ {
+		_, err := broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", topic, cfg, 1, 1, 0)
+		errNil(t, err)
+	}
+	equals(t, 1, dials)
+
+	// a different subscription type is a different consumer
+	cfg.SubscriptionType = pulsar.Failover
+	_, err := broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", topic, cfg, 1, 1, 0)
+	errNil(t, err)
+	equals(t, 2, dials)
+
+	// other consumer settings than the cached consumer are rejected
+	mismatch := cfg
+	mismatch.ReceiverQueueSize = 10
+	_, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", topic, mismatch, 1, 1, 0)
+	equals(t, broker.ErrPollConsumerMismatch, err)
+	mismatch = cfg
+	mismatch.Filter = model.MessageFilter{Properties: map[string]string{"region": "us"}}
+	_, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", topic, mismatch, 1, 1, 0)
+	equals(t, broker.ErrPollConsumerMismatch, err)
+	equals(t, 2, dials)
+
+	// a NonResumable subscription is dialed on every poll
+	cfg.SubscriptionName = model.NonResumable + "subscription"
+	for i := 0; i < 2; i++ {
+		_, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", topic, cfg, 1, 1, 0)
+		errNil(t, err)
+	}
+	equals(t, 4, dials)
+}
+
+func TestDeleteSubscription(t *testing.T) {
+	adminURL, err := pulsardriver.AdminURL("pulsar+ssl://cluster1.example.com:6651")
+	errNil(t, err)
+	equals(t, "https://cluster1.example.com:8443", adminURL)
+	adminURL, err = pulsardriver.AdminURL("pulsar://cluster1.example.com:6650")
+	errNil(t, err)
+	equals(t, "http://cluster1.example.com:8080", adminURL)
+
+	var path, auth string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.EscapedPath(), r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	pulsarURL := "pulsar://admin-test:6650"
+	util.ClusterAdminURLs = map[string]string{pulsarURL: server.URL + "/"}
+	defer func() { util.ClusterAdminURLs = nil }()
+	adminURL, err = pulsardriver.AdminURL(pulsarURL)
+	errNil(t, err)
+	equals(t, server.URL, adminURL)
+
+	errNil(t, pulsardriver.DeleteSubscription(pulsarURL, "token1", "persistent://tenant1/ns1/topic1", "sub/1"))
+	equals(t, "/admin/v2/persistent/tenant1/ns1/topic1/subscription/sub%2F1", path)
+	equals(t, "Bearer token1", auth)
+
+	status = http.StatusNotFound
+	equals(t, pulsardriver.ErrSubscriptionNotFound, pulsardriver.DeleteSubscription(pulsarURL, "token1", "non-persistent://tenant1/ns1/topic1", "sub1"))
+	equals(t, "/admin/v2/non-persistent/tenant1/ns1/topic1/subscription/sub1", path)
+
+	status = http.StatusPreconditionFailed
+	equals(t, pulsardriver.ErrSubscriptionInUse, pulsardriver.DeleteSubscription(pulsarURL, "token1", "persistent://tenant1/ns1/topic1", "sub1"))
+}
+
+func TestTopicExists(t *testing.T) {
+	topics := map[string]string{
+		"/admin/v2/persistent/tenant1/ns1/partitioned/partitions": `{"partitions": 3}`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/partitions":      `{"partitions": 0}`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/stats":           `{}`,
+		"/admin/v2/persistent/tenant1/ns1/missing/partitions":     `{"partitions": 0}`,
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if body, ok := topics[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	pulsarURL := "pulsar://exists-test:6650"
+	util.ClusterAdminURLs = map[string]string{pulsarURL: server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	exists, err := pulsardriver.TopicExists(pulsarURL, "token", "persistent://tenant1/ns1/partitioned")
+	errNil(t, err)
+	assert(t, exists, "partitioned topic exists")
+	exists, err = pulsardriver.TopicExists(pulsarURL, "token", "persistent://tenant1/ns1/topic1")
+	errNil(t, err)
+	assert(t, exists, "non-partitioned topic exists")
+	exists, err = pulsardriver.TopicExists(pulsarURL, "token", "persistent://tenant1/ns1/missing")
+	errNil(t, err)
+	assert(t, !exists, "topic does not exist")
+
+	// an existing topic is cached
+	requests = 0
+	exists, err = pulsardriver.TopicExists(pulsarURL, "token", "persistent://tenant1/ns1/topic1")
+	errNil(t, err)
+	assert(t, exists, "cached topic exists")
+	equals(t, 0, requests)
+}
+
+// propMessage is a testMessage with properties
+type propMessage struct {
+	testMessage
+	props map[string]string
+}
+
+func (m propMessage) Properties() map[string]string { return m.props }
+
+// queuedConsumer delivers the queued messages and records the acknowledgements
+type queuedConsumer struct {
+	*ackRecorder
+	ch chan pulsar.ConsumerMessage
+}
+
+func (c queuedConsumer) Chan() <-chan pulsar.ConsumerMessage { return c.ch }
+func (c queuedConsumer) Subscription() string                { return "" }
+func (c queuedConsumer) Unsubscribe() error                  { return nil }
+func (c queuedConsumer) Close()                              {}
+
+// newQueuedConsumer returns a queuedConsumer with the messages queued
+func newQueuedConsumer(msgs ...pulsar.Message) queuedConsumer {
+	consumer := queuedConsumer{ackRecorder: &ackRecorder{}, ch: make(chan pulsar.ConsumerMessage, len(msgs))}
+	for _, msg := range msgs {
+		consumer.ch <- pulsar.ConsumerMessage{Message: msg}
+	}
+	return consumer
+}
+
+// testMessages returns n test messages to queue
+func testMessages(n int) []pulsar.Message {
+	msgs := make([]pulsar.Message, n)
+	for i := range msgs {
+		msgs[i] = testMessage{}
+	}
+	return msgs
+}
+
+// stubDialConsumer replaces broker.DialConsumer with the consumer returned by newConsumer on every dial.
+// The returned function restores the dialer.
+func stubDialConsumer(newConsumer func(topic string, cfg model.ConsumerConfig) queuedConsumer) func() {
+	broker.DialConsumer = func(url, token, topic string, cfg model.ConsumerConfig) (pulsar.Client, pulsar.Consumer, error) {
+		return idleClient{}, newConsumer(topic, cfg), nil
+	}
+	return func() { broker.DialConsumer = broker.GetPulsarClientConsumer }
+}
+
+func TestPollPropertyFilter(t *testing.T) {
+	var consumer queuedConsumer
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		msgs := []pulsar.Message{}
+		for _, color := range []string{"red", "blue", "red"} {
+			msgs = append(msgs, propMessage{props: map[string]string{"color": color}})
+		}
+		consumer = newQueuedConsumer(msgs...)
+		return consumer
+	})()
+
+	cfg := model.ConsumerConfig{
+		SubscriptionName: model.NonResumable + "filter",
+		Filter:           model.MessageFilter{Properties: map[string]string{"color": "red"}},
+	}
+	msgs, err := broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 3, 1, 0)
+	errNil(t, err)
+	equals(t, 2, msgs.Size)
+	equals(t, 3, consumer.acked)
+	equals(t, 0, consumer.nacked)
+
+	cfg.Filter.Nack = true
+	msgs, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 3, 1, 0)
+	errNil(t, err)
+	equals(t, 2, msgs.Size)
+	equals(t, 2, consumer.acked)
+	equals(t, 1, consumer.nacked)
+
+	// the messages removed by the filter do not count toward the batch size
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		msgs := []pulsar.Message{}
+		for _, color := range []string{"blue", "red", "blue", "blue", "red", "red"} {
+			msgs = append(msgs, propMessage{props: map[string]string{"color": color}})
+		}
+		consumer = newQueuedConsumer(msgs...)
+		return consumer
+	})()
+	cfg.Filter.Nack = false
+	msgs, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 2, 100, 0)
+	errNil(t, err)
+	equals(t, 2, msgs.Size)
+	equals(t, 5, consumer.acked)
+
+	// the filter empties the batch
+	cfg.Filter.Properties["color"] = "green"
+	msgs, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 3, 1, 0)
+	errNil(t, err)
+	assert(t, msgs.IsEmpty(), "no message matches the filter")
+}
+
+func TestPollPartialBatch(t *testing.T) {
+	queued := 2
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		return newQueuedConsumer(testMessages(queued)...)
+	})()
+
+	cfg := model.ConsumerConfig{SubscriptionName: model.NonResumable + "partial"}
+	// the messages collected before perMessageTimeoutMs elapses are returned as a partial batch
+	start := time.Now()
+	msgs, err := broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 10, 50, 0)
+	errNil(t, err)
+	equals(t, 2, msgs.Size)
+	equals(t, 2, len(msgs.Messages))
+	equals(t, 10, msgs.Limit)
+	assert(t, time.Since(start) < 10*50*time.Millisecond, "a partial batch only waits one perMessageTimeoutMs")
+
+	queued = 0
+	msgs, err = broker.PollBatchMessages(context.Background(), "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 10, 50, 0)
+	errNil(t, err)
+	assert(t, msgs.IsEmpty(), "no message arrives within perMessageTimeoutMs")
+}
+
+func TestPollDeadline(t *testing.T) {
+	// a message trickles in just within every perMessageTimeoutMs
+	ch := make(chan pulsar.ConsumerMessage)
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case ch <- pulsar.ConsumerMessage{Message: testMessage{}}:
+				time.Sleep(20 * time.Millisecond)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		return queuedConsumer{ackRecorder: &ackRecorder{}, ch: ch}
+	})()
+
+	cfg := model.ConsumerConfig{SubscriptionName: model.NonResumable + "deadline"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	msgs, err := broker.PollBatchMessages(ctx, "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 1000, 200, 0)
+	errNil(t, err)
+	assert(t, time.Since(start) < 500*time.Millisecond, "the deadline bounds the whole poll")
+	assert(t, msgs.Size > 0 && msgs.Size < 1000, "the messages collected before the deadline are returned")
+
+	// a cancelled request context aborts a long poll
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	_, err = broker.PollBatchMessages(ctx, "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 10, 200, 5000)
+	errNil(t, err)
+	assert(t, time.Since(start) < 500*time.Millisecond, "a cancelled context aborts the poll")
+}
+
+func TestPollCancelledNack(t *testing.T) {
+	var consumer queuedConsumer
+	defer stubDialConsumer(func(topic string, cfg model.ConsumerConfig) queuedConsumer {
+		consumer = newQueuedConsumer(testMessages(2)...)
+		return consumer
+	})()
+	cfg := model.ConsumerConfig{SubscriptionName: model.NonResumable + "cancel"}
+
+	// the messages of a poll whose client is gone are negatively acknowledged for redelivery
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := broker.PollBatchMessages(ctx, "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 10, 5000, 0)
+	errNil(t, err)
+	equals(t, 0, consumer.acked)
+	equals(t, 2, consumer.nacked)
+
+	// the partial batch of an elapsed poll deadline is replied and acknowledged
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msgs, err := broker.PollBatchMessages(ctx, "pulsar://localhost:6650", "token", "persistent://tenant1/ns/topic1", cfg, 10, 5000, 0)
+	errNil(t, err)
+	equals(t, 2, msgs.Size)
+	equals(t, 2, consumer.acked)
+	equals(t, 0, consumer.nacked)
+}
+
+func TestGetSubscriptionStats(t *testing.T) {
+	responses := map[string]string{
+		"/admin/v2/persistent/tenant1/ns1/partitioned/partitions":        `{"partitions": 2}`,
+		"/admin/v2/persistent/tenant1/ns1/partitioned/partitioned-stats": `{"subscriptions": {"sub1": {"msgBacklog": 20, "unackedMessages": 3}}}`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/partitions":             `{"partitions": 0}`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/stats":                  `{"subscriptions": {"sub1": {"msgBacklog": 5, "unackedMessages": 1}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := responses[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	pulsarURL := "pulsar://stats-test:6650"
+	util.ClusterAdminURLs = map[string]string{pulsarURL: server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	stats, err := pulsardriver.GetSubscriptionStats(pulsarURL, "token", "persistent://tenant1/ns1/partitioned", "sub1")
+	errNil(t, err)
+	equals(t, pulsardriver.SubscriptionStats{MsgBacklog: 20, UnackedMessages: 3}, stats)
+
+	stats, err = pulsardriver.GetSubscriptionStats(pulsarURL, "token", "persistent://tenant1/ns1/topic1", "sub1")
+	errNil(t, err)
+	equals(t, int64(5), stats.MsgBacklog)
+
+	_, err = pulsardriver.GetSubscriptionStats(pulsarURL, "token", "persistent://tenant1/ns1/topic1", "sub2")
+	equals(t, pulsardriver.ErrSubscriptionNotFound, err)
+}
+
+func TestNonResumableJanitor(t *testing.T) {
+	stats := `{"subscriptions": {
+		"NonResumable-orphan": {"consumers": []},
+		"NonResumable-active": {"consumers": [{"consumerName": "c1"}]},
+		"durable-sub": {"consumers": []}}}`
+	responses := map[string]string{
+		"/admin/v2/namespaces/tenant1/ns1/topics":            `["persistent://tenant1/ns1/topic1"]`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/partitions": `{"partitions": 0}`,
+		"/admin/v2/persistent/tenant1/ns1/topic1/stats":      stats,
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if body, ok := responses[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	pulsarURL := "pulsar://janitor-test:6650"
+	util.ClusterAdminURLs = map[string]string{pulsarURL: server.URL}
+	defer func() { util.ClusterAdminURLs = nil }()
+
+	topics, err := pulsardriver.GetNamespaceTopics(pulsarURL, "", "tenant1/ns1")
+	errNil(t, err)
+	equals(t, []string{"persistent://tenant1/ns1/topic1"}, topics)
+	_, err = pulsardriver.GetNamespaceTopics(pulsarURL, "", "tenant1")
+	assert(t, err != nil, "a namespace requires a tenant")
+
+	idle, err := pulsardriver.GetIdleSubscriptions(pulsarURL, "", "persistent://tenant1/ns1/topic1", model.NonResumable)
+	errNil(t, err)
+	equals(t, []string{"NonResumable-orphan"}, idle)
+
+	janitor := broker.NewNonResumableJanitor([]string{pulsarURL}, []string{"tenant1/ns1", "tenant1/missing"})
+	// the first scan only records the subscription without a consumer
+	equals(t, 0, janitor.Run())
+	equals(t, 0, len(deleted))
+	equals(t, 1, janitor.Run())
+	equals(t, []string{"/admin/v2/persistent/tenant1/ns1/topic1/subscription/NonResumable-orphan"}, deleted)
+
+	// a subscription that has regained a consumer is not unsubscribed
+	deleted = nil
+	janitor = broker.NewNonResumableJanitor([]string{pulsarURL}, []string{"tenant1/ns1"})
+	equals(t, 0, janitor.Run())
+	responses["/admin/v2/persistent/tenant1/ns1/topic1/stats"] = `{"subscriptions": {"NonResumable-orphan": {"consumers": [{}]}}}`
+	equals(t, 0, janitor.Run())
+	responses["/admin/v2/persistent/tenant1/ns1/topic1/stats"] = stats
+	equals(t, 0, janitor.Run())
+	equals(t, 0, len(deleted))
+}
+
+func TestNewClientOptions(t *testing.T) {
+	cfg := *util.GetConfig()
+	trustStore := os.Getenv("TrustStore")
+	defer func() {
+		util.Config = cfg
+		os.Setenv("TrustStore", trustStore)
+	}()
+
+	opts, err := pulsardriver.NewClientOptions("pulsar://mydomain.net:6650", "mytoken")
+	errNil(t, err)
+	equals(t, "pulsar://mydomain.net:6650", opts.URL)
+	equals(t, "", opts.TLSTrustCertsFilePath)
+	assert(t, opts.Authentication != nil, "token authentication")
+	equals(t, "*auth.tokenAuthProvider", fmt.Sprintf("%T", opts.Authentication))
+
+	os.Setenv("TrustStore", "/etc/ssl/certs/ca-bundle.crt")
+	util.Config.PulsarTLSCertFile = "/etc/pulsar/client.cert.pem"
+	util.Config.PulsarTLSKeyFile = "/etc/pulsar/client.key-pk8.pem"
+	opts, err = pulsardriver.NewClientOptions("pulsar+ssl://mydomain.net:6651", "")
+	errNil(t, err)
+	equals(t, "/etc/ssl/certs/ca-bundle.crt", opts.TLSTrustCertsFilePath)
+	equals(t, pulsar.NewAuthenticationTLS("/etc/pulsar/client.cert.pem", "/etc/pulsar/client.key-pk8.pem"), opts.Authentication)
+
+	// the caller's token is never replaced by beam's certificate
+	opts, err = pulsardriver.NewClientOptions("pulsar+ssl://mydomain.net:6651", "mytoken")
+	errNil(t, err)
+	equals(t, "*auth.tokenAuthProvider", fmt.Sprintf("%T", opts.Authentication))
+
+	os.Setenv("TrustStore", "")
+	_, err = pulsardriver.NewClientOptions("pulsar+ssl://mydomain.net:6651", "")
+	assert(t, err != nil, "pulsar+ssl requires the trust store")
+
+	// the cluster token is resolved by the callers that verified the subject, never by the client options
+	clusterTokens := util.ClusterTokens
+	defer func() { util.ClusterTokens = clusterTokens }()
+	util.ClusterTokens = map[string]string{"pulsar://mydomain.net:6650": "clustertoken"}
+	util.Config.PulsarTLSCertFile = ""
+	opts, err = pulsardriver.NewClientOptions("pulsar://mydomain.net:6650", "")
+	errNil(t, err)
+	assert(t, opts.Authentication == nil, "no cluster token without a request token")
+	equals(t, "clustertoken", util.ClusterToken("pulsar://mydomain.net:6650", ""))
+	equals(t, "mytoken", util.ClusterToken("pulsar://mydomain.net:6650", "mytoken"))
+}
+
+func TestToPulsarWithoutToken(t *testing.T) {
+	cfg := *util.GetConfig()
+	allowed, clusterTokens := util.AllowedPulsarURLs, util.ClusterTokens
+	defer func() {
+		util.Config = cfg
+		util.AllowedPulsarURLs, util.ClusterTokens = allowed, clusterTokens
+		broker.SendToPulsar = pulsardriver.SendToPulsar
+	}()
+	util.Config.PulsarTokenHeaderName = "Authorization"
+	util.AllowedPulsarURLs = []string{"pulsar://mydomain.net:6650"}
+	util.ClusterTokens = map[string]string{"pulsar://mydomain.net:6650": "clustertoken"}
+	var tokens []string
+	broker.SendToPulsar = func(url, token, topic string, data []byte, opts pulsardriver.SendOptions, async, reconnect bool, retried int) (pulsar.MessageID, error) {
+		tokens = append(tokens, token)
+		return nil, nil
+	}
+
+	// a webhook response never publishes with the cluster token
+	res := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader("reply"))}
+	res.Header.Set("TopicFn", "persistent://tenant2/ns/topic")
+	broker.ToPulsar(res)
+	res = &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader("reply"))}
+	res.Header.Set("TopicFn", "persistent://tenant2/ns/topic")
+	res.Header.Set("Authorization", "Bearer webhooktoken")
+	broker.ToPulsar(res)
+	equals(t, []string{"", "webhooktoken"}, tokens)
+}
+
+func TestFailoverURLs(t *testing.T) {
+	allowed := util.AllowedPulsarURLs
+	defer func() { util.AllowedPulsarURLs = allowed }()
+	util.AllowedPulsarURLs = []string{"pulsar://cluster1:6650", "pulsar://cluster2:6650", "", "pulsar://cluster3:6650"}
+
+	equals(t, []string{"pulsar://cluster2:6650", "pulsar://cluster3:6650"}, pulsardriver.FailoverURLs("pulsar://cluster1:6650"))
+	equals(t, []string{"pulsar://cluster3:6650", "pulsar://cluster1:6650"}, pulsardriver.FailoverURLs("pulsar://cluster2:6650"))
+	equals(t, []string{"pulsar://cluster1:6650", "pulsar://cluster2:6650"}, pulsardriver.FailoverURLs("pulsar://cluster3:6650"))
+	assert(t, pulsardriver.FailoverURLs("pulsar://unknown:6650") == nil, "no failover from a cluster not allowed")
+}
+
+func TestFailoverToken(t *testing.T) {
+	clusterTokens := util.ClusterTokens
+	defer func() { util.ClusterTokens = clusterTokens }()
+	util.ClusterTokens = map[string]string{"pulsar://cluster1:6650": "token1", "pulsar://cluster2:6650": "token2"}
+
+	token, ok := pulsardriver.FailoverToken("pulsar://cluster1:6650", "pulsar://cluster2:6650", "token1")
+	assert(t, ok, "the cluster token is failed over")
+	equals(t, "token2", token)
+	_, ok = pulsardriver.FailoverToken("pulsar://cluster1:6650", "pulsar://cluster2:6650", "request-token")
+	assert(t, !ok, "a request token is not sent to another cluster")
+	token, ok = pulsardriver.FailoverToken("pulsar://cluster3:6650", "pulsar://cluster2:6650", "")
+	assert(t, ok, "a message without a token is failed over")
+	equals(t, "", token)
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert(t, pulsardriver.IsConnectionError(pulsardriver.ErrProducerUnavailable), "producer creation failure")
+	assert(t, !pulsardriver.IsConnectionError(errors.New("some error")), "unknown error")
+
+	// a producer creation rejected by the cluster is not failed over
+	for _, cause := range []string{"AuthorizationError", "AuthenticationError", "TopicNotFound", "InvalidTopicName"} {
+		err := fmt.Errorf("%w: server error: %s: rejected", pulsardriver.ErrProducerUnavailable, cause)
+		assert(t, !pulsardriver.IsConnectionError(err), cause+" is not a connection error")
+	}
+	err := fmt.Errorf("%w: server error: ServiceNotReady: not ready", pulsardriver.ErrProducerUnavailable)
+	assert(t, pulsardriver.IsConnectionError(err), "a cluster not ready fails over")
+}
+
+// produceLatencyMetrics returns the exposed metrics and the count of the failed sync sends
+func produceLatencyMetrics() (string, int) {
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	count := 0
+	prefix := `pulsar_beam_produce_latency_seconds_count{mode="sync",result="failure"} `
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count, _ = strconv.Atoi(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return rr.Body.String(), count
+}
+
+func TestProduceLatency(t *testing.T) {
+	_, before := produceLatencyMetrics()
+
+	// the producer of an invalid Pulsar URL fails immediately
+	_, err := pulsardriver.SendToPulsar("invalid://mydomain.net:6650", "", "persistent://tenant1/ns/latency", []byte("payload"), pulsardriver.SendOptions{}, false, false, 0)
+	assert(t, errors.Is(err, pulsardriver.ErrProducerUnavailable), "producer creation failure")
+
+	metrics, after := produceLatencyMetrics()
+	assert(t, strings.Contains(metrics, `pulsar_beam_produce_latency_seconds_bucket{mode="sync",result="failure",le="0.001"}`), "latency buckets start at 1ms")
+	equals(t, before+1, after)
+}
+
+func TestFormatParseMessageID(t *testing.T) {
+	for _, str := range []string{"12345:67:0:-1", "12345:67:3:5", "0:0:-1:-1", "9223372036854775807:9223372036854775807:2147483647:2147483647"} {
+		id, err := model.ParseMessageID(str)
+		errNil(t, err)
+		equals(t, str, model.FormatMessageID(id))
+
+		// the serialized form of a parsed id deserializes to the same id
+		deserialized, err := pulsar.DeserializeMessageID(id.Serialize())
+		errNil(t, err)
+		equals(t, str, model.FormatMessageID(deserialized))
+	}
+
+	id, err := model.ParseMessageID("12345:67:3")
+	errNil(t, err)
+	equals(t, int64(12345), id.LedgerID())
+	equals(t, int64(67), id.EntryID())
+	equals(t, int32(3), id.PartitionIdx())
+	equals(t, int32(-1), id.BatchIdx())
+
+	id, err = model.NewMessageID(1, 2, -1, 3)
+	errNil(t, err)
+	equals(t, "1:2:-1:3", model.FormatMessageID(id))
+
+	for _, str := range []string{"", "12345", "12345:67", "12345:67:0:1:2", "a:67:0:0", "12345:67:0:b", "-1:67:0:0", "12345:-1:0:0",
+		"12345:67:-2:0", "12345:67:0:-2", "12345:67:2147483648:0", "9223372036854775808:0:0:0", "12345:67: 0:0"} {
+		_, err = model.ParseMessageID(str)
+		assert(t, err != nil, "expect an error for message id "+str)
+	}
+}
+
+func TestMessageIDAfter(t *testing.T) {
+	// the seek position is the entry following the event id
+	id, err := broker.MessageIDAfter("12345:67:0")
+	errNil(t, err)
+	equals(t, "12345:68:0", fmt.Sprintf("%v", id))
+	equals(t, int64(12345), id.LedgerID())
+	equals(t, int32(-1), id.BatchIdx())
+
+	id, err = broker.MessageIDAfter("9223372036854775807:0:3")
+	errNil(t, err)
+	equals(t, "9223372036854775807:1:3", fmt.Sprintf("%v", id))
+
+	// the remaining messages of a batch entry are skipped
+	id, err = broker.MessageIDAfter("12345:67:2:5")
+	errNil(t, err)
+	equals(t, "12345:68:2:-1", model.FormatMessageID(id))
+
+	// a malformed id is rejected for the subscription to resume from its normal position
+	for _, eventID := range []string{"", "12345:67", "12345:67:0:1:2", "a:67:0", "12345:-1:0", "12345:67:-1", "12345:67:-1:0",
+		"12345:9223372036854775807:0", "12345:67:4294967296", "12345:67:0:-2"} {
+		_, err = broker.MessageIDAfter(eventID)
+		assert(t, err != nil, "expect an error for event id "+eventID)
+	}
+}
+
+func TestClassifyProduceError(t *testing.T) {
+	// a producer creation failure keeps the broker's error of the cause
+	cases := []struct {
+		err    error
+		code   pulsardriver.ProduceErrorCode
+		status int
+	}{
+		{pulsardriver.ErrPulsarTimeout, pulsardriver.ErrCodeTimeout, http.StatusGatewayTimeout},
+		{errors.New("server error: AuthorizationError: not authorized"), pulsardriver.ErrCodeAuthorizationFailed, http.StatusForbidden},
+		{errors.New("server error: AuthenticationError: invalid token"), pulsardriver.ErrCodeAuthenticationFailed, http.StatusUnauthorized},
+		{errors.New("server error: ProducerBlockedQuotaExceededException: backlog"), pulsardriver.ErrCodeTopicBacklogExceeded, http.StatusTooManyRequests},
+		{errors.New("server error: TopicTerminatedError: terminated"), pulsardriver.ErrCodeTopicTerminated, http.StatusGone},
+		{errors.New("lookup failed: server error: TopicNotFound: no topic"), pulsardriver.ErrCodeTopicNotFound, http.StatusNotFound},
+		{errors.New("server error: ProducerBlockedQuotaExceededError: backlog"), pulsardriver.ErrCodeTopicBacklogExceeded, http.StatusTooManyRequests},
+		// only the broker's error name is matched, not a name in the message text
+		{errors.New("TopicNotFound"), pulsardriver.ErrCodeUnknown, http.StatusInternalServerError},
+		{errors.New("server error: UnknownError: AuthorizationError in a plugin"), pulsardriver.ErrCodeUnknown, http.StatusInternalServerError},
+		{pulsardriver.ErrProducerUnavailable, pulsardriver.ErrCodeClusterUnavailable, http.StatusServiceUnavailable},
+		{errors.New("some error"), pulsardriver.ErrCodeUnknown, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		code, status := pulsardriver.ClassifyProduceError(c.err, http.StatusInternalServerError)
+		equals(t, c.code, code)
+		equals(t, c.status, status)
+	}
+
+	// the result of a Pulsar client error
+	client, err := pulsar.NewClient(pulsar.ClientOptions{URL: "pulsar://localhost:6650"})
+	errNil(t, err)
+	defer client.Close()
+	_, err = client.CreateProducer(pulsar.ProducerOptions{})
+	code, status := pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+	equals(t, pulsardriver.ErrCodeInvalidTopicName, code)
+	equals(t, http.StatusUnprocessableEntity, status)
+
+	// the producer creation failure of an invalid Pulsar URL is unavailable with the cause
+	_, err = pulsardriver.SendToPulsar("invalid://mydomain.net:6650", "", "persistent://tenant1/ns/classify", []byte("payload"), pulsardriver.SendOptions{}, false, false, 0)
+	assert(t, errors.Is(err, pulsardriver.ErrProducerUnavailable), "producer creation failure")
+	assert(t, strings.HasPrefix(err.Error(), "Failed to create Pulsar producer: "), "the cause is in the message")
+	assert(t, pulsardriver.IsConnectionError(err), "a wrapped creation failure fails over")
+	code, _ = pulsardriver.ClassifyProduceError(err, http.StatusInternalServerError)
+	equals(t, pulsardriver.ErrCodeClusterUnavailable, code)
+}
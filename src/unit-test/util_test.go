@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
@@ -82,7 +83,8 @@ func TestLoadConfigFile(t *testing.T) {
 func TestEffectiveRoutes(t *testing.T) {
 	receiverRoutesLen := len(route.ReceiverRoutes)
 	restRoutesLen := len(route.RestRoutes)
-	prometheusLen := len(route.PrometheusRoute)
+	// prometheus and health routes are available in every mode
+	prometheusLen := len(route.PrometheusRoute) + len(route.HealthRoute)
 	mode := "hybrid"
 	assert(t, len(route.GetEffectiveRoutes(&mode)) == (receiverRoutesLen+restRoutesLen+prometheusLen), "check hybrid required routes")
 	mode = "rest"
@@ -104,6 +106,37 @@ func TestHTTPRouters(t *testing.T) {
 	routeName := "receive"
 	route := router.Get(routeName)
 	assert(t, route == nil, "get route name")
+
+	origins := util.CORSAllowedOrigins
+	defer func() { util.CORSAllowedOrigins = origins }()
+	util.CORSAllowedOrigins = []string{"*"}
+	req := httptest.NewRequest(http.MethodOptions, "/v2/poll/persistent/public/default/topic", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusNoContent, rr.Code)
+	equals(t, "GET, OPTIONS", rr.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestAuthExemptRoutes(t *testing.T) {
+	mode := "hybrid"
+	router := route.NewRouter(&mode)
+
+	// only the internal routes are exempt from the auth
+	for _, r := range route.GetEffectiveRoutes(&mode) {
+		switch r.Pattern {
+		case "/metrics", "/health", "/status":
+			assert(t, r.AuthExempt, "internal route "+r.Pattern+" is auth-exempt")
+		default:
+			assert(t, !r.AuthExempt && r.AuthFunc != nil, "route "+r.Pattern+" is authenticated")
+		}
+	}
+	for _, path := range []string{"/metrics", "/status"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		equals(t, http.StatusOK, rr.Code)
+	}
 }
 
 func TestMainControlMode(t *testing.T) {
@@ -173,6 +206,99 @@ func TestDefaultPulsarURLInReceiverHeader(t *testing.T) {
 	assert(t, "" == header.Get("PulsarUrl"), "ensure PulsarUrl is empty")
 }
 
+func TestAllowedPulsarURLMatch(t *testing.T) {
+	equals(t, "pulsar://broker.net:6650", NormalizePulsarURL(" PULSAR://Broker.NET/ "))
+	equals(t, "pulsar+ssl://broker.net:6651", NormalizePulsarURL("pulsar+ssl://broker.net"))
+	equals(t, "pulsar://[::1]:6650", NormalizePulsarURL("pulsar://[::1]"))
+	equals(t, "http://broker.net", NormalizePulsarURL("http://broker.net"))
+
+	allowed := []string{"pulsar://broker.net:6650", " pulsar+ssl://secure.net:6651"}
+	for _, pulsarURL := range []string{"pulsar://broker.net:6650", "pulsar://broker.net", "pulsar://broker.net:6650/", "Pulsar://BROKER.net:6650"} {
+		matched, ok := MatchPulsarURL(allowed, pulsarURL)
+		assert(t, ok, "allowed variant "+pulsarURL)
+		equals(t, "pulsar://broker.net:6650", matched)
+	}
+	matched, ok := MatchPulsarURL(allowed, "pulsar+ssl://Secure.net/")
+	assert(t, ok, "allowed pulsar+ssl variant")
+	equals(t, "pulsar+ssl://secure.net:6651", matched)
+
+	// normalization never widens the match to another cluster
+	for _, pulsarURL := range []string{
+		"pulsar+ssl://broker.net:6650", "pulsar://secure.net:6651", "pulsar://broker.net:6651", "pulsar://broker.net:6650/path",
+		"pulsar://user@broker.net:6650", "pulsar://broker.net.evil.com:6650", "http://broker.net:6650", "pulsar://broker.net:6650?x=1", ""} {
+		_, ok = MatchPulsarURL(allowed, pulsarURL)
+		assert(t, !ok, "not allowed "+pulsarURL)
+	}
+
+	header := http.Header{}
+	header.Set("PulsarUrl", "pulsar://Broker.net/")
+	_, _, pulsarURL, err := ReceiverHeader(allowed, &header)
+	errNil(t, err)
+	equals(t, "pulsar://broker.net:6650", pulsarURL)
+	header.Set("PulsarUrl", "pulsar+ssl://broker.net:6650")
+	_, _, _, err = ReceiverHeader(allowed, &header)
+	equals(t, "pulsar cluster pulsar+ssl://broker.net:6650 is not allowed", err.Error())
+}
+
+func TestTopicNameValidation(t *testing.T) {
+	valid := []struct{ topicFn, normalized string }{
+		{"persistent://public/default/topic1", "persistent://public/default/topic1"},
+		{"non-persistent://public/default/topic1", "non-persistent://public/default/topic1"},
+		{"Persistent://public/default/topic1", "persistent://public/default/topic1"},
+		{"p://public/default/topic1", "persistent://public/default/topic1"},
+		{"np://public/default/topic1", "non-persistent://public/default/topic1"},
+		{"public/default/topic1", "persistent://public/default/topic1"},
+		{" persistent://my-tenant/ns.v2/orders=eu:1_a-partition-0 ", "persistent://my-tenant/ns.v2/orders=eu:1_a-partition-0"},
+	}
+	for _, c := range valid {
+		topicFn, err := NormalizeTopicFn(c.topicFn)
+		errNil(t, err)
+		equals(t, c.normalized, topicFn)
+	}
+
+	for _, topicFn := range []string{
+		"", "persistent://", "persistent://public/default", "persistent://public/default/a/b", "persistent://public//topic1",
+		"persistent:///default/topic1", "persistent://public/default/", "persistent://public/default/my topic",
+		"persistent://public/default/topic?1", "persistent://public/default/topic#1", "persistent://pub lic/default/topic1",
+		"persistent://public/default/tøpic", "http://public/default/topic1", "persistent:/public/default/topic1",
+	} {
+		_, err := NormalizeTopicFn(topicFn)
+		assert(t, err != nil, "invalid topic "+topicFn)
+	}
+
+	topicFn, err := BuildTopicFn(" NP ", "public", "default", "topic1")
+	errNil(t, err)
+	equals(t, "non-persistent://public/default/topic1", topicFn)
+	_, err = BuildTopicFn("p", "public", "default", "topic/1")
+	equals(t, `invalid topic name "topic/1", only letters, digits, and -=:._ are allowed`, err.Error())
+	_, err = BuildTopicFn("p", "public", "", "topic1")
+	equals(t, "missing namespace name", err.Error())
+}
+
+func TestParseDefaultTopic(t *testing.T) {
+	allowed := []string{"pulsar://broker.net:6650", "pulsar+ssl://secure.net:6651"}
+	topic, pulsarURL, err := ParseDefaultTopic("", "", allowed)
+	errNil(t, err)
+	equals(t, "", topic+pulsarURL)
+
+	topic, pulsarURL, err = ParseDefaultTopic(" public/default/sink ", "", allowed)
+	errNil(t, err)
+	equals(t, "persistent://public/default/sink", topic)
+	equals(t, "", pulsarURL)
+
+	topic, pulsarURL, err = ParseDefaultTopic("non-persistent://public/default/sink", "pulsar+ssl://Secure.net", allowed)
+	errNil(t, err)
+	equals(t, "non-persistent://public/default/sink", topic)
+	equals(t, "pulsar+ssl://secure.net:6651", pulsarURL)
+
+	_, _, err = ParseDefaultTopic("persistent://public/default/my sink", "", allowed)
+	assert(t, err != nil, "invalid default topic")
+	_, _, err = ParseDefaultTopic("persistent://public/default/sink", "pulsar://other.net:6650", allowed)
+	assert(t, err != nil, "the default topic cluster must be allowed")
+	_, _, err = ParseDefaultTopic("", "pulsar://broker.net:6650", allowed)
+	assert(t, err != nil, "a cluster without a default topic")
+}
+
 func TestThreadSafeMap(t *testing.T) {
 	// TODO add more goroutine to test concurrency
 
@@ -228,6 +354,53 @@ func TestGetEnvInt(t *testing.T) {
 	equals(t, 946, GetEnvInt("Kopper", 946))
 }
 
+func TestQueryDefaults(t *testing.T) {
+	defaults, err := ParseQueryDefaults("includeHeaders=true&mode=async", ReceiverDefaultableParams)
+	errNil(t, err)
+
+	_, err = ParseQueryDefaults("key=abc", ReceiverDefaultableParams)
+	equals(t, "query parameter key does not support a default value", err.Error())
+
+	// an explicit parameter overrides its default value
+	params := ApplyQueryDefaults(url.Values{"mode": []string{"sync"}}, defaults)
+	equals(t, "sync", params.Get("mode"))
+	equals(t, "true", params.Get("includeHeaders"))
+
+	params = ApplyQueryDefaults(url.Values{}, url.Values{})
+	equals(t, 0, len(params))
+}
+
+func TestClusterTokens(t *testing.T) {
+	allowed := []string{"pulsar://cluster1:6650", "pulsar+ssl://cluster2:6651"}
+	tokens, err := ParseClusterTokens(" pulsar://cluster1:6650=token1, pulsar+ssl://cluster2:6651=token2 ", allowed)
+	errNil(t, err)
+	equals(t, "token1", tokens["pulsar://cluster1:6650"])
+	equals(t, "token2", tokens["pulsar+ssl://cluster2:6651"])
+
+	tokens, err = ParseClusterTokens("", allowed)
+	errNil(t, err)
+	equals(t, 0, len(tokens))
+
+	_, err = ParseClusterTokens("pulsar://cluster3:6650=token3", allowed)
+	equals(t, "pulsar cluster pulsar://cluster3:6650 in cluster tokens is not allowed", err.Error())
+
+	_, err = ParseClusterTokens("pulsar://cluster1:6650", allowed)
+	equals(t, "invalid cluster token mapping, expected format is url=token", err.Error())
+
+	_, err = ParseClusterTokens("pulsar://cluster1:6650=token1,pulsar://cluster1:6650=token2", allowed)
+	equals(t, "pulsar cluster pulsar://cluster1:6650 has more than one token", err.Error())
+}
+
+func TestClusterAdminURLs(t *testing.T) {
+	allowed := []string{"pulsar://cluster1:6650"}
+	adminURLs, err := ParseClusterAdminURLs("pulsar://cluster1:6650=http://admin1:8080", allowed)
+	errNil(t, err)
+	equals(t, "http://admin1:8080", adminURLs["pulsar://cluster1:6650"])
+
+	_, err = ParseClusterAdminURLs("pulsar://cluster3:6650=http://admin3:8080", allowed)
+	equals(t, "pulsar cluster pulsar://cluster3:6650 in cluster admin URLs is not allowed", err.Error())
+}
+
 type TestObj struct {
 	isClosed bool
 }
@@ -290,6 +463,35 @@ func TestExpiryTTLCache(t *testing.T) {
 
 }
 
+func TestDeleteOldestTTLCache(t *testing.T) {
+	cache := NewCache(CacheOption{
+		TTL:           time.Minute,
+		CleanInterval: time.Minute,
+		ExpireCallback: func(key string, value interface{}) {
+			value.(*TestObj).Close()
+		},
+	})
+
+	object1 := TestObj{}
+	object2 := TestObj{}
+	cache.Set("object1", &object1)
+	time.Sleep(time.Millisecond)
+	cache.Set("object2", &object2)
+	time.Sleep(time.Millisecond)
+
+	// object1 becomes the most recently used
+	_, ok := cache.Get("object1")
+	assert(t, ok, "object1 exists")
+
+	assert(t, cache.DeleteOldest(), "the least recently used object is deleted")
+	assert(t, object2.isClosed, "object2 has been Close() by the callback")
+	assert(t, !object1.isClosed, "object1 is still open")
+	equals(t, 1, cache.Count())
+
+	assert(t, cache.DeleteOldest(), "object1 is deleted")
+	assert(t, !cache.DeleteOldest(), "no object to delete in an empty cache")
+}
+
 func TestInfinityExpiryTTLCache(t *testing.T) {
 
 	cache := NewCache(CacheOption{
@@ -332,6 +534,50 @@ func TestInfinityExpiryTTLCache(t *testing.T) {
 	cache.Close()
 }
 
+func TestFlushTTLCache(t *testing.T) {
+	cache := NewCache(CacheOption{
+		TTL:           time.Minute,
+		CleanInterval: time.Minute,
+		ExpireCallback: func(key string, value interface{}) {
+			value.(*TestObj).Close()
+		},
+	})
+	object1, object2 := TestObj{}, TestObj{}
+	cache.Set("object1", &object1)
+	cache.SetWithTTL("object2", &object2, -1)
+
+	equals(t, 2, cache.Flush())
+	assert(t, object1.isClosed && object2.isClosed, "flushed objects are closed")
+	equals(t, 0, cache.Count())
+	equals(t, 0, cache.Flush())
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	var e MsgpackEncoder
+	e.WriteNil()
+	e.WriteBool(true)
+	e.WriteInt(5)
+	e.WriteInt(-3)
+	e.WriteInt(200)
+	e.WriteInt(-200)
+	e.WriteInt(70000)
+	e.WriteInt(1 << 40)
+	equals(t, []byte{0xc0, 0xc3, 0x05, 0xfd, 0xd1, 0x00, 0xc8, 0xd1, 0xff, 0x38, 0xd2, 0x00, 0x01, 0x11, 0x70,
+		0xd3, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}, e.Bytes())
+
+	e.Reset()
+	e.WriteArrayHeader(2)
+	e.WriteString("ab")
+	e.WriteBinary([]byte{1})
+	e.WriteMapHeader(16)
+	e.WriteString(strings.Repeat("x", 32))
+	equals(t, []byte{0x92, 0xa2, 'a', 'b', 0xc4, 0x01, 0x01, 0xde, 0x00, 0x10, 0xd9, 0x20}, e.Bytes()[:12])
+
+	e.Reset()
+	e.WriteTime(time.Unix(1, 2))
+	equals(t, []byte{0xc7, 12, 0xff, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1}, e.Bytes())
+}
+
 func TestConcurrencyTTLCache(t *testing.T) {
 
 	cache := NewCache(CacheOption{
@@ -436,7 +682,26 @@ func TestHTTPParams(t *testing.T) {
 	equals(t, QueryParamInt(params, "var2", 5), 48)
 	equals(t, QueryParamInt(params, "var22", 5), 5)
 
+	num, err := QueryParamIntRange(params, "var22", 5, 1, 48)
+	errNil(t, err)
+	equals(t, 5, num)
+	for value, expected := range map[string]int{"1": 1, "48": 48} {
+		num, err = QueryParamIntRange(url.Values{"var": []string{value}}, "var", 5, 1, 48)
+		errNil(t, err)
+		equals(t, expected, num)
+	}
+	for _, value := range []string{"0", "49", "testme"} {
+		_, err = QueryParamIntRange(url.Values{"var": []string{value}}, "var", 5, 1, 48)
+		assertErr(t, "var must be an integer between 1 and 48", err)
+	}
+
 	equals(t, QueryParamString(params, "var1", "48"), "testme")
 	equals(t, QueryParamString(params, "var2", "test"), "48")
 	equals(t, QueryParamString(params, "var22", "another"), "another")
 }
+
+func TestTopicTenant(t *testing.T) {
+	equals(t, "public", TopicTenant("persistent://public/default/test-topic"))
+	equals(t, "ming", TopicTenant("non-persistent://ming/default/test-topic"))
+	equals(t, "unknown", TopicTenant("public/default/test-topic"))
+}
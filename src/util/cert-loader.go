@@ -57,16 +57,16 @@ func watchFile(filePath string, updated chan *updatedChann) error {
 	}
 }
 
-// ListenAndServeTLS listens HTTP with TLS option just like the default http.ListenAndServeTLS
-// in addition it also watches certificate and key file changes and reloads them if necessary
-func ListenAndServeTLS(address, certFile, keyFile string, handler http.Handler) error {
+// ListenAndServeTLS listens HTTP with TLS option just like the default http.ListenAndServeTLS.
+// It serves on the server's address and handler, so that the caller can shut down the server.
+func ListenAndServeTLS(server *http.Server, certFile, keyFile string) error {
 	if len(certFile) > 1 && len(keyFile) > 1 {
-		return listenAndServeTLS(address, certFile, keyFile, handler)
+		return listenAndServeTLS(server, certFile, keyFile)
 	}
-	return http.ListenAndServe(address, handler)
+	return server.ListenAndServe()
 }
 
-func listenAndServeTLS(address, certFile, keyFile string, handler http.Handler) error {
+func listenAndServeTLS(server *http.Server, certFile, keyFile string) error {
 	log.Printf("load certs %s and key files %s\n", certFile, keyFile)
 	if err := loadCert(certFile, keyFile); err != nil {
 		return err
@@ -115,10 +115,10 @@ func listenAndServeTLS(address, certFile, keyFile string, handler http.Handler)
 	}
 
 	// listen on the port with TLS listener
-	l, err := tls.Listen("tcp", address, &tlsConfig)
+	l, err := tls.Listen("tcp", server.Addr, &tlsConfig)
 	if err != nil {
 		return err
 	}
 
-	return http.Serve(l, handler)
+	return server.Serve(l)
 }
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
     "strconv"
+	"time"
 
 	"unicode"
 
@@ -21,6 +23,38 @@ import (
 // it can be overwritten by env variable PULSAR_BEAM_CONFIG
 const DefaultConfigFile = "../config/pulsar_beam.yml"
 
+// DefaultMaxMessageSize is the default Pulsar message size limit of 5MB
+// https://pulsar.apache.org/docs/concepts-messaging/
+const DefaultMaxMessageSize = 5 * 1024 * 1024
+
+// DefaultPollMaxBatchSize and DefaultPollMaxPerMessageTimeoutMs are the default upper bounds of a poll request
+const (
+	DefaultPollMaxBatchSize           = 1000
+	DefaultPollMaxPerMessageTimeoutMs = 10000
+)
+
+// DefaultReplayMaxMessages and DefaultReplayMaxBytes are the default upper bounds of a replay reply
+const (
+	DefaultReplayMaxMessages = 1000
+	DefaultReplayMaxBytes    = 10 * 1024 * 1024
+)
+
+// DefaultMaxMessageProperties and DefaultMaxPropertiesBytes are the default limits of the properties or
+// the included headers of a message
+const (
+	DefaultMaxMessageProperties = 100
+	DefaultMaxPropertiesBytes   = 32 * 1024
+)
+
+// DefaultPulsarClientTimeout is the default operation and connection timeout in seconds of the Pulsar clients
+const DefaultPulsarClientTimeout = 30
+
+// DefaultMaxCompressionRatio is the default maximum compression ratio of a request body
+const DefaultMaxCompressionRatio = 100
+
+// DefaultSubscriptionNameMinLength is the default minimum length of a client specified subscription name
+const DefaultSubscriptionNameMinLength = 5
+
 // Configuration has a set of parameters to configure the beam server.
 // The same name can be used in environment variable to override yml or json values.
 type Configuration struct {
@@ -33,6 +67,9 @@ type Configuration struct {
 	// LogLevel is used to set the application log level
 	LogLevel string `json:"LogLevel"`
 
+	// LogFormat is the log format, `json` for a log pipeline or `text` (default: text)
+	LogFormat string `json:"LogFormat"`
+
 	// DbName is the database name in mongo or topic name when Pulsar is used as database
 	DbName string `json:"DbName"`
 
@@ -72,6 +109,11 @@ type Configuration struct {
 	// Pulsar CA certificate key store
 	TrustStore string `json:"TrustStore"`
 
+	// PulsarTLSCertFile and PulsarTLSKeyFile are the client certificate and private key in PEM to authenticate
+	// with the Pulsar cluster over mutual TLS. They replace the cluster's configured token if both are set and a request carries no token.
+	PulsarTLSCertFile string `json:"PulsarTLSCertFile"`
+	PulsarTLSKeyFile  string `json:"PulsarTLSKeyFile"`
+
 	// HTTPs certificate set up
 	CertFile string `json:"CertFile"`
 	KeyFile  string `json:"KeyFile"`
@@ -80,29 +122,197 @@ type Configuration struct {
 	// It is a comma separated pulsar URL string, so it can be a list of clusters
 	PulsarClusters string `json:"PulsarClusters"`
 
-	// HTTPAuthImpl specifies the jwt authen and authorization algorithm, `noauth` to skip JWT authentication
+	// HTTPAuthImpl specifies the jwt authen and authorization algorithm, `noauth` to skip JWT authentication,
+	// `jwks` to verify tokens issued by an external identity provider with the keys of JWKSURL
 	HTTPAuthImpl string `json:"HTTPAuthImpl"`
+
+	// JWKSURL is the JWKS endpoint of the identity provider for the `jwks` HTTPAuthImpl
+	JWKSURL string `json:"JWKSURL"`
+	// JWKSIssuer and JWKSAudience are the required iss and aud claims of a token, not verified if empty
+	JWKSIssuer   string `json:"JWKSIssuer"`
+	JWKSAudience string `json:"JWKSAudience"`
+	// JWKSRefreshInterval is how often the public keys of the JWKS endpoint are fetched again (default: 1h)
+	JWKSRefreshInterval string `json:"JWKSRefreshInterval"`
 	
-    // Limit concurency of receiver. Every worker will need to allocate a buffer memory (default is 5MB)
+    // Limit concurency of receiver. The workers share message buffers growing on demand up to MaxMessageSize
 	WorkerPoolSize int `json:"WorkerPoolSize"`
+
+	// MaxMessageSize is the maximum message size in bytes accepted by the receiver, it should match the broker's
+	// maxMessageSize. A worker's message buffer grows on demand up to the size (default: 5242880)
+	MaxMessageSize int `json:"MaxMessageSize"`
+
+	// MaxDecompressedSize is the maximum size in bytes of a compressed request body after the decompression,
+	// it is capped by MaxMessageSize (default: MaxMessageSize)
+	MaxDecompressedSize int `json:"MaxDecompressedSize"`
+
+	// MaxMessageProperties and MaxPropertiesBytes are the maximum number and the total size in bytes of the keys
+	// and values of a message's properties, they also limit the headers included with includeHeaders (default: 100 and 32768)
+	MaxMessageProperties int `json:"MaxMessageProperties"`
+	MaxPropertiesBytes   int `json:"MaxPropertiesBytes"`
+
+	// MaxCompressionRatio is the maximum ratio of the decompressed to the compressed size of a request body,
+	// enforced once 1MB has been decompressed (default: 100)
+	MaxCompressionRatio int `json:"MaxCompressionRatio"`
     
     // Name of the HTTP header to use for Pulsar token to authorize pulsar client, set tp empty to disable pulsar token authorization
     PulsarTokenHeaderName string `json:"PulsarTokenHeaderName"`
+
+	// SSEEventBufferSize is the maximum number of messages buffered for an SSE client.
+	// Beam stops reading from the Pulsar consumer when the buffer is full to apply backpressure (default: 100)
+	SSEEventBufferSize int `json:"SSEEventBufferSize"`
+
+	// SSEMaxConnections and SSEMaxConnectionsPerTopic cap the concurrent SSE connections in total
+	// and per topic, a connection over the cap is rejected with 429. 0 is unlimited (default: 0)
+	SSEMaxConnections         int `json:"SSEMaxConnections"`
+	SSEMaxConnectionsPerTopic int `json:"SSEMaxConnectionsPerTopic"`
+
+	// ReceiverQueryDefaults are URL query encoded default values of the receiver's query parameters,
+	// i.e. `includeHeaders=true&mode=async`. They are applied when a client does not specify the parameter.
+	ReceiverQueryDefaults string `json:"ReceiverQueryDefaults"`
+
+	// Producer batching of the batch publish endpoint, zero values use the Pulsar client defaults
+	// (default: 1000 messages, 131072 bytes, and 10ms publish delay)
+	BatchPublishMaxMessages     int    `json:"BatchPublishMaxMessages"`
+	BatchPublishMaxBytes        int    `json:"BatchPublishMaxBytes"`
+	BatchPublishMaxPublishDelay string `json:"BatchPublishMaxPublishDelay"`
+
+	// HealthCheckTopic is looked up on the first allowed Pulsar cluster by the /health endpoint
+	// (default: persistent://public/default/pulsar-beam-health)
+	HealthCheckTopic string `json:"HealthCheckTopic"`
+
+	// HealthCheckToken is the optional Pulsar token for the /health endpoint's topic lookup
+	HealthCheckToken string `json:"HealthCheckToken"`
+
+	// PulsarClientOperationTimeout and PulsarClientConnectionTimeout are the timeouts in seconds of the Pulsar
+	// client operations, such as creating a producer or a consumer, and of a broker connection (default: 30)
+	PulsarClientOperationTimeout  int `json:"PulsarClientOperationTimeout"`
+	PulsarClientConnectionTimeout int `json:"PulsarClientConnectionTimeout"`
+
+	// ProducerSendRetryLimit is the maximum number of retries of a retryable send error (default: 1)
+	ProducerSendRetryLimit int `json:"ProducerSendRetryLimit"`
+
+	// ProducerPoolMaxSize is the maximum number of cached producers, the least recently used producer is
+	// flushed and closed to make room for a new one. 0 is unlimited (default: 0)
+	ProducerPoolMaxSize int `json:"ProducerPoolMaxSize"`
+
+	// ProducerRetryBackoff is the initial retry backoff doubled on every retry up to 5s (default: 100ms)
+	ProducerRetryBackoff string `json:"ProducerRetryBackoff"`
+
+	// ProducerFailover set to `true` sends a message to the next allowed Pulsar clusters, in the order of
+	// PulsarBrokerURL and PulsarClusters, when the requested cluster cannot be connected (default: false)
+	ProducerFailover string `json:"ProducerFailover"`
+
+	// SubscriptionInactivityTimeout is the duration, i.e. `72h`, after which a durable subscription created by
+	// the poll, sse, and websocket endpoints is unsubscribed if no consumer has used it. Empty disables the policy.
+	SubscriptionInactivityTimeout string `json:"SubscriptionInactivityTimeout"`
+
+	// PollMaxBatchSize and PollMaxPerMessageTimeoutMs are the maximum batchSize and perMessageTimeoutMs
+	// a poll can request (default: 1000 and 10000)
+	PollMaxBatchSize           int `json:"PollMaxBatchSize"`
+	PollMaxPerMessageTimeoutMs int `json:"PollMaxPerMessageTimeoutMs"`
+
+	// ReplayMaxMessages and ReplayMaxBytes are the maximum number of messages and total payload bytes
+	// returned by a replay, a replay stopped by either cap is flagged truncated (default: 1000 and 10MB)
+	ReplayMaxMessages int `json:"ReplayMaxMessages"`
+	ReplayMaxBytes    int `json:"ReplayMaxBytes"`
+
+	// SubscriptionNameMinLength is the minimum length of a client specified subscription name (default: 5)
+	SubscriptionNameMinLength int `json:"SubscriptionNameMinLength"`
+
+	// NonResumableJanitorInterval is the interval, i.e. `10m`, of the scan that unsubscribes the auto-generated
+	// NonResumable subscriptions without consumers, such as left behind by a restart. Empty disables the janitor.
+	NonResumableJanitorInterval string `json:"NonResumableJanitorInterval"`
+
+	// NonResumableJanitorNamespaces is the comma separated list of namespaces, i.e. `tenant1/ns1,tenant2/ns2`,
+	// whose topics are scanned by the NonResumable subscription janitor on every allowed cluster
+	NonResumableJanitorNamespaces string `json:"NonResumableJanitorNamespaces"`
+
+	// TopicExpirySweepInterval is the interval, i.e. `5m`, of the sweeper that deletes the topic configs past
+	// their ExpiresAt. Empty disables the sweeper, but an expired config is still not found (default: 5m)
+	TopicExpirySweepInterval string `json:"TopicExpirySweepInterval"`
+
+	// PollConsumerIdleTimeout is the duration a consumer cached by a poll is kept open without
+	// any poll or ack, its unacknowledged messages are redelivered once it is closed (default: 5m)
+	PollConsumerIdleTimeout string `json:"PollConsumerIdleTimeout"`
+
+	// PulsarClusterTokens maps the allowed Pulsar clusters to their broker authentication tokens in the format of
+	// `pulsar://cluster1:6650=token1,pulsar+ssl://cluster2:6651=token2`. A token in the request overrides it.
+	PulsarClusterTokens string `json:"PulsarClusterTokens"`
+
+	// PulsarAdminURLs maps the allowed Pulsar clusters to their admin REST API URLs in the format of
+	// `pulsar://cluster1:6650=http://cluster1:8080`. The admin URL of a cluster not in the mapping is derived from
+	// the Pulsar URL with the http scheme and port 8080, or the https scheme and port 8443 for pulsar+ssl.
+	PulsarAdminURLs string `json:"PulsarAdminURLs"`
+
+	// TenantRateLimit is the default number of requests per second per tenant on the routes with a tenant,
+	// 0 disables the per-tenant rate limit and applies the global limit instead (default: 0)
+	TenantRateLimit int `json:"TenantRateLimit"`
+
+	// TenantRateLimits overrides TenantRateLimit for specific tenants, i.e. `tenant1=100,tenant2=20`
+	TenantRateLimits string `json:"TenantRateLimits"`
+
+	// ClientRateLimit is the number of requests per second per client IP, 0 disables the per-client rate limit (default: 0)
+	ClientRateLimit int `json:"ClientRateLimit"`
+
+	// TrustProxy set to `true` identifies a client by the last hop of X-Forwarded-For, or X-Real-IP, set by
+	// the proxy in front of beam instead of the remote address of the connection (default: false)
+	TrustProxy string `json:"TrustProxy"`
+
+	// CORSAllowedOrigins is a comma separated list of the origins allowed for cross-origin requests,
+	// such as `https://app.example.com`, where `*` allows any origin (default: *)
+	CORSAllowedOrigins string `json:"CORSAllowedOrigins"`
+
+	// CORSAllowCredentials set to `true` allows cross-origin requests with credentials, where the allowed
+	// request origin is echoed instead of the wildcard origin (default: false)
+	CORSAllowCredentials string `json:"CORSAllowCredentials"`
+
+	// DefaultTopic is the fully qualified topic of the send endpoint for a request without a topic in the route
+	// or the TopicFn header, such as from a webhook source that cannot set them. Empty rejects such a request.
+	DefaultTopic string `json:"DefaultTopic"`
+
+	// DefaultTopicPulsarURL is the allowed Pulsar cluster of DefaultTopic when the request has no PulsarUrl header
+	// (default: the first allowed cluster)
+	DefaultTopicPulsarURL string `json:"DefaultTopicPulsarURL"`
+
+	// TokenDefaultExpiry is the validity duration, i.e. `720h`, of a token issued by the token server
+	// when the request has no exp parameter. Empty issues tokens that never expire.
+	TokenDefaultExpiry string `json:"TokenDefaultExpiry"`
 }
 
 var (
 	// AllowedPulsarURLs specifies a list of allowed pulsar URL/cluster
 	AllowedPulsarURLs []string
 
+	// ClusterTokens are the broker authentication tokens of Pulsar clusters parsed from PulsarClusterTokens
+	ClusterTokens map[string]string
+
+	// ClusterAdminURLs are the admin REST API URLs of Pulsar clusters parsed from PulsarAdminURLs
+	ClusterAdminURLs map[string]string
+
+	// TenantRateLimits are the per-tenant requests per second parsed from Configuration.TenantRateLimits
+	TenantRateLimits map[string]int
+
 	// SuperRoles are admin level users for jwt authorization
 	SuperRoles []string
 
+	// CORSAllowedOrigins are the origins allowed for cross-origin requests parsed from Configuration.CORSAllowedOrigins
+	CORSAllowedOrigins []string
+
+	// ReceiverQueryDefaults are the parsed default values of the receiver's query parameters
+	ReceiverQueryDefaults url.Values
+
+	// ReceiverDefaultableParams are the receiver's query parameters that support a default value
+	ReceiverDefaultableParams = []string{"includeRequestLine", "includeHeaders", "joinHeaderValues", "mode", "compression"}
+
 	// Config - this server's configuration instance
 	Config Configuration
 
 	// JWTAuth is the RSA key pair for sign and verify JWT
 	JWTAuth *icrypto.RSAKeyPair
 
+	// JWKSAuth verifies JWT issued by an external identity provider when HTTPAuthImpl is `jwks`
+	JWKSAuth *icrypto.JWKS
+
 	// L is the logger
 	L *log.Logger
 )
@@ -114,13 +324,42 @@ func Init() {
     // Default config
     Config.WorkerPoolSize = 4
     Config.PulsarTokenHeaderName = "Authorization"
+	Config.SSEEventBufferSize = 100
+	Config.ProducerSendRetryLimit = 1
+	Config.ProducerRetryBackoff = "100ms"
+	Config.PollConsumerIdleTimeout = "5m"
+	Config.TopicExpirySweepInterval = "5m"
+	Config.MaxMessageSize = DefaultMaxMessageSize
+	Config.PollMaxBatchSize = DefaultPollMaxBatchSize
+	Config.PollMaxPerMessageTimeoutMs = DefaultPollMaxPerMessageTimeoutMs
+	Config.SubscriptionNameMinLength = DefaultSubscriptionNameMinLength
+	Config.ReplayMaxMessages = DefaultReplayMaxMessages
+	Config.ReplayMaxBytes = DefaultReplayMaxBytes
+	Config.MaxCompressionRatio = DefaultMaxCompressionRatio
+	Config.MaxMessageProperties = DefaultMaxMessageProperties
+	Config.MaxPropertiesBytes = DefaultMaxPropertiesBytes
+	Config.PulsarClientOperationTimeout = DefaultPulsarClientTimeout
+	Config.PulsarClientConnectionTimeout = DefaultPulsarClientTimeout
+	Config.JWKSRefreshInterval = "1h"
     
 	ReadConfigFile(configFile)
 
 	log.SetLevel(logLevel(Config.LogLevel))
+	log.SetFormatter(logFormatter(Config.LogFormat))
 
 	log.Warnf("Configuration built from file - %s", configFile)
 	JWTAuth = icrypto.NewRSAKeyPair(Config.PulsarPrivateKey, Config.PulsarPublicKey)
+
+	if Config.HTTPAuthImpl == "jwks" {
+		if Config.JWKSURL == "" {
+			panic("JWKSURL is required by the jwks HTTPAuthImpl")
+		}
+		refreshInterval, err := time.ParseDuration(Config.JWKSRefreshInterval)
+		if err != nil {
+			panic(err)
+		}
+		JWKSAuth = icrypto.NewJWKS(Config.JWKSURL, Config.JWKSIssuer, Config.JWKSAudience, refreshInterval)
+	}
 }
 
 // ReadConfigFile reads configuration file.
@@ -188,10 +427,46 @@ func ReadConfigFile(configFile string) {
 	if Config.PulsarBrokerURL != "" {
 		AllowedPulsarURLs = append([]string{Config.PulsarBrokerURL}, AllowedPulsarURLs...)
 	}
+	for i, cluster := range AllowedPulsarURLs {
+		AllowedPulsarURLs[i] = strings.TrimSpace(cluster)
+		if normalized := NormalizePulsarURL(cluster); cluster != "" && !strings.HasPrefix(normalized, "pulsar://") && !strings.HasPrefix(normalized, "pulsar+ssl://") {
+			log.Warnf("allowed Pulsar cluster %s is not a pulsar or pulsar+ssl URL, it only matches an identical URL", cluster)
+		}
+	}
 
 	superRoleStr := AssignString(Config.SuperRoles, "superuser")
 	SuperRoles = strings.Split(superRoleStr, ",")
 
+	CORSAllowedOrigins = ParseCORSAllowedOrigins(AssignString(Config.CORSAllowedOrigins, "*"))
+	if StringToBool(Config.CORSAllowCredentials) && StrContains(CORSAllowedOrigins, "*") {
+		panic("CORSAllowCredentials requires the allowed origins to be listed in CORSAllowedOrigins instead of *")
+	}
+
+	ReceiverQueryDefaults, err = ParseQueryDefaults(Config.ReceiverQueryDefaults, ReceiverDefaultableParams)
+	if err != nil {
+		panic(err)
+	}
+
+	ClusterTokens, err = ParseClusterTokens(Config.PulsarClusterTokens, AllowedPulsarURLs)
+	if err != nil {
+		panic(err)
+	}
+
+	ClusterAdminURLs, err = ParseClusterAdminURLs(Config.PulsarAdminURLs, AllowedPulsarURLs)
+	if err != nil {
+		panic(err)
+	}
+
+	TenantRateLimits, err = ParseTenantRateLimits(Config.TenantRateLimits)
+	if err != nil {
+		panic(err)
+	}
+
+	Config.DefaultTopic, Config.DefaultTopicPulsarURL, err = ParseDefaultTopic(Config.DefaultTopic, Config.DefaultTopicPulsarURL, AllowedPulsarURLs)
+	if err != nil {
+		panic(err)
+	}
+
 	fmt.Printf("port %s, PbDbType %s, DbRefreshInterval %s, TrustStore %s, DbName %s, DbConnectString %s\n",
 		Config.PORT, Config.PbDbType, Config.PbDbInterval, Config.TrustStore, Config.DbName, Config.DbConnectionStr)
 	fmt.Printf("PublicKey %s, PrivateKey %s\n",
@@ -220,6 +495,15 @@ func logLevel(level string) log.Level {
 	}
 }
 
+func logFormatter(format string) log.Formatter {
+	switch strings.TrimSpace(strings.ToLower(format)) {
+	case "json":
+		return &log.JSONFormatter{}
+	default:
+		return &log.TextFormatter{}
+	}
+}
+
 var jsonPrefix = []byte("{")
 
 func hasJSONPrefix(buf []byte) bool {
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ConsumerSubscriptions counts the consumers requested by HTTP clients.
+// All labels are enum valued to keep the cardinality fixed.
+var ConsumerSubscriptions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pulsar_beam_consumer_subscriptions_total",
+	Help: "The number of consumers requested by HTTP clients by endpoint, subscription type, and initial position",
+}, []string{"endpoint", "subscription_type", "initial_position"})
+
+// Message throughput metrics are labeled by the topic tenant rather than the full topic name to bound the cardinality.
+var (
+	// ReceivedMessages counts the messages received by the send endpoint
+	ReceivedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_received_messages_total",
+		Help: "The number of messages received by the send endpoint",
+	}, []string{"tenant"})
+
+	// ReceivedBytes counts the message payload bytes received by the send endpoint
+	ReceivedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_received_bytes_total",
+		Help: "The number of message payload bytes received by the send endpoint",
+	}, []string{"tenant"})
+
+	// ProduceErrors counts the messages failed to be sent to Pulsar
+	ProduceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_produce_errors_total",
+		Help: "The number of messages failed to be sent to Pulsar",
+	}, []string{"tenant"})
+
+	// DeliveredMessages counts the messages delivered to HTTP consumers
+	DeliveredMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_delivered_messages_total",
+		Help: "The number of messages delivered to HTTP consumers by endpoint",
+	}, []string{"endpoint", "tenant"})
+
+	// WebhookDeliveryFailures counts the webhook deliveries that failed all retries
+	WebhookDeliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_webhook_delivery_failures_total",
+		Help: "The number of webhook deliveries failed after all retries by tenant",
+	}, []string{"tenant"})
+
+	// ActiveSSEConnections is the number of open SSE streams
+	ActiveSSEConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pulsar_beam_active_sse_connections",
+		Help: "The number of active SSE connections",
+	})
+
+	// TopicSSEConnections is the number of open SSE streams per topic
+	TopicSSEConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pulsar_beam_topic_sse_connections",
+		Help: "The number of active SSE connections by topic",
+	}, []string{"topic"})
+
+	// ProducerPoolSize is the number of cached Pulsar producers
+	ProducerPoolSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pulsar_beam_producer_pool_size",
+		Help: "The number of Pulsar producers cached in the producer pool",
+	})
+
+	// ReapedSubscriptions counts the orphaned NonResumable subscriptions unsubscribed by the janitor
+	ReapedSubscriptions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_reaped_subscriptions_total",
+		Help: "The number of orphaned NonResumable subscriptions unsubscribed by the janitor by tenant",
+	}, []string{"tenant"})
+
+	// ExpiredTopicConfigs counts the expired topic configs deleted by the sweeper
+	ExpiredTopicConfigs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_expired_topic_configs_total",
+		Help: "The number of expired topic configs deleted by the sweeper by tenant",
+	}, []string{"tenant"})
+
+	// BroadcastDroppedMessages counts the broadcast messages dropped for the SSE clients with a full buffer
+	BroadcastDroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulsar_beam_broadcast_dropped_messages_total",
+		Help: "The number of broadcast messages dropped for slow SSE clients by tenant",
+	}, []string{"tenant"})
+
+	// SubscriptionBacklog is the message backlog of a subscription, updated whenever the lag endpoint is queried.
+	// The series of a subscription is deleted once it is unsubscribed by Beam or found to be removed.
+	SubscriptionBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pulsar_beam_subscription_backlog",
+		Help: "The message backlog of a subscription queried by the lag endpoint",
+	}, []string{"topic", "subscription"})
+
+	// ProduceLatency is the time to send a message until it is acknowledged by the broker in sync mode,
+	// or queued by the producer in async mode
+	ProduceLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pulsar_beam_produce_latency_seconds",
+		Help:    "The latency of sending a message to Pulsar by mode and result",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2},
+	}, []string{"mode", "result"})
+)
+
+// TopicTenant returns the tenant of a topic full name as a metrics label
+func TopicTenant(topicFN string) string {
+	_, tenant, _, _, err := TokenizeTopicFullName(topicFN)
+	if err != nil || tenant == "" {
+		return "unknown"
+	}
+	return tenant
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// MsgpackEncoder writes the MessagePack encoding of the basic types, see https://github.com/msgpack/msgpack/blob/master/spec.md
+// The encoding of a map or an array is its header followed by the encodings of its entries or elements.
+type MsgpackEncoder struct {
+	bytes.Buffer
+}
+
+// WriteNil writes nil
+func (e *MsgpackEncoder) WriteNil() {
+	e.WriteByte(0xc0)
+}
+
+// WriteBool writes a boolean
+func (e *MsgpackEncoder) WriteBool(v bool) {
+	if v {
+		e.WriteByte(0xc3)
+	} else {
+		e.WriteByte(0xc2)
+	}
+}
+
+// WriteInt writes an integer in the shortest format
+func (e *MsgpackEncoder) WriteInt(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		e.WriteByte(byte(v))
+	case v >= -32 && v < 0:
+		e.WriteByte(byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		e.Write([]byte{0xd0, byte(v)})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		e.WriteByte(0xd1)
+		e.writeUint(uint64(v), 2)
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.WriteByte(0xd2)
+		e.writeUint(uint64(v), 4)
+	default:
+		e.WriteByte(0xd3)
+		e.writeUint(uint64(v), 8)
+	}
+}
+
+// WriteString writes a UTF-8 string
+func (e *MsgpackEncoder) WriteString(v string) {
+	n := len(v)
+	switch {
+	case n <= 31:
+		e.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		e.WriteByte(0xda)
+		e.writeUint(uint64(n), 2)
+	default:
+		e.WriteByte(0xdb)
+		e.writeUint(uint64(n), 4)
+	}
+	e.Buffer.WriteString(v)
+}
+
+// WriteBinary writes a byte array
+func (e *MsgpackEncoder) WriteBinary(v []byte) {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		e.Write([]byte{0xc4, byte(n)})
+	case n <= math.MaxUint16:
+		e.WriteByte(0xc5)
+		e.writeUint(uint64(n), 2)
+	default:
+		e.WriteByte(0xc6)
+		e.writeUint(uint64(n), 4)
+	}
+	e.Write(v)
+}
+
+// WriteTime writes a time as the timestamp extension type in the 96-bit format
+func (e *MsgpackEncoder) WriteTime(v time.Time) {
+	e.Write([]byte{0xc7, 12, 0xff})
+	e.writeUint(uint64(v.Nanosecond()), 4)
+	e.writeUint(uint64(v.Unix()), 8)
+}
+
+// WriteArrayHeader writes the header of an array of n elements
+func (e *MsgpackEncoder) WriteArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(0xdc)
+		e.writeUint(uint64(n), 2)
+	default:
+		e.WriteByte(0xdd)
+		e.writeUint(uint64(n), 4)
+	}
+}
+
+// WriteMapHeader writes the header of a map of n key value pairs
+func (e *MsgpackEncoder) WriteMapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(0xde)
+		e.writeUint(uint64(n), 2)
+	default:
+		e.WriteByte(0xdf)
+		e.writeUint(uint64(n), 4)
+	}
+}
+
+// writeUint writes the size bytes of v in big-endian
+func (e *MsgpackEncoder) writeUint(v uint64, size int) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	e.Write(buf[8-size:])
+}
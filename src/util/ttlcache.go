@@ -113,6 +113,39 @@ func (c *Cache) Delete(key string) {
 	}
 }
 
+// DeleteOldest deletes the item closest to expiry, which is the least recently used item
+// when all items share the same TTL. It returns false if the cache has no item with expiry.
+func (c *Cache) DeleteOldest() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var oldest *item
+	for _, item := range c.items {
+		if item.ttl > 0 && (oldest == nil || item.expireAt.Before(oldest.expireAt)) {
+			oldest = item
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	c.opt.ExpireCallback(oldest.key, oldest.data)
+	delete(c.items, oldest.key)
+	return true
+}
+
+// Flush deletes all items with the expire callback and returns the number of deleted items
+func (c *Cache) Flush() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	flushed := len(c.items)
+	for key, item := range c.items {
+		c.opt.ExpireCallback(key, item.data)
+		delete(c.items, key)
+	}
+	return flushed
+}
+
 // Count returns the number of items in the cache
 func (c *Cache) Count() int {
 	c.mutex.RLock()
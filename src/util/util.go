@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -19,6 +21,12 @@ type ResponseErr struct {
 	Error string `json:"error"`
 }
 
+// ResponseCodeErr - Error struct for Http response with a machine-readable error code
+type ResponseCodeErr struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 // NewUUID generates a random UUID according to RFC 4122
 func NewUUID() (string, error) {
 	uuid := make([]byte, 16)
@@ -57,6 +65,19 @@ func ResponseErrorJSON(e error, w http.ResponseWriter, statusCode int) {
 	w.Write(jsonResponse)
 }
 
+// ResponseErrorCodeJSON builds a Http response with a machine-readable error code
+func ResponseErrorCodeJSON(code string, e error, w http.ResponseWriter, statusCode int) {
+	jsonResponse, err := json.Marshal(ResponseCodeErr{Code: code, Message: e.Error()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(jsonResponse)
+}
+
 // ReceiverHeader parses headers for Pulsar required configuration
 func ReceiverHeader(allowedClusters []string, h *http.Header) (token, topicFN, pulsarURL string, err error) {
     token = ""
@@ -68,7 +89,10 @@ func ReceiverHeader(allowedClusters []string, h *http.Header) (token, topicFN, p
 	if len(allowedClusters) > 1 || (len(allowedClusters) == 1 && allowedClusters[0] != "") {
 		if pulsarURL == "" {
 			pulsarURL = allowedClusters[0]
-		} else if !StrContains(allowedClusters, pulsarURL) {
+		} else if allowed, ok := MatchPulsarURL(allowedClusters, pulsarURL); ok {
+			// the configured form identifies the cluster in the producer cache and the cluster tokens
+			pulsarURL = allowed
+		} else {
 			return "", "", "", fmt.Errorf("pulsar cluster %s is not allowed", pulsarURL)
 		}
 	} else if pulsarURL == "" {
@@ -77,15 +101,95 @@ func ReceiverHeader(allowedClusters []string, h *http.Header) (token, topicFN, p
 	return token, topicFN, pulsarURL, nil
 }
 
+// NormalizePulsarURL returns the canonical form of a Pulsar URL for the comparison with the allowed clusters.
+// The scheme and the host are lower cased, the default port of the scheme is added, and a trailing slash is
+// removed. Anything else than a pulsar or pulsar+ssl URL of a host is only trimmed, so it only matches itself.
+func NormalizePulsarURL(pulsarURL string) string {
+	pulsarURL = strings.TrimSpace(pulsarURL)
+	u, err := url.Parse(pulsarURL)
+	if err != nil || u.Hostname() == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return pulsarURL
+	}
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	switch {
+	case scheme == "pulsar" && port == "":
+		port = "6650"
+	case scheme == "pulsar+ssl" && port == "":
+		port = "6651"
+	case scheme != "pulsar" && scheme != "pulsar+ssl":
+		return pulsarURL
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// MatchPulsarURL returns the allowed cluster URL, as configured, that is the same cluster as the Pulsar URL.
+// The scheme must match, so that a pulsar URL never matches an allowed pulsar+ssl cluster and vice versa.
+func MatchPulsarURL(allowedClusters []string, pulsarURL string) (string, bool) {
+	normalized := NormalizePulsarURL(pulsarURL)
+	for _, allowed := range allowedClusters {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && NormalizePulsarURL(allowed) == normalized {
+			return allowed, true
+		}
+	}
+	return "", false
+}
+
+// topicNamePart is Pulsar's allowed character set of a tenant, namespace, and topic name
+var topicNamePart = regexp.MustCompile(`^[-=:.\w]+$`)
+
+// ValidateTopicNameParts returns an error if a tenant, namespace, or topic name is empty or has
+// a character that is not allowed by Pulsar, such as a slash or a space
+func ValidateTopicNameParts(tenant, namespace, topic string) error {
+	for _, part := range []struct{ name, value string }{{"tenant", tenant}, {"namespace", namespace}, {"topic", topic}} {
+		if part.value == "" {
+			return fmt.Errorf("missing %s name", part.name)
+		}
+		if !topicNamePart.MatchString(part.value) {
+			return fmt.Errorf("invalid %s name %q, only letters, digits, and -=:._ are allowed", part.name, part.value)
+		}
+	}
+	return nil
+}
+
 // BuildTopicFn builds topic fullname.
+// nonpersistent is accepted as an alias of non-persistent since it used to be documented.
+// The persistent type is case insensitive, and the tenant, namespace, and topic names are validated.
 func BuildTopicFn(persistent, tenant, namespace, topic string) (string, error) {
-	if persistent == "persistent" || persistent == "p" {
-		return "persistent://" + tenant + "/" + namespace + "/" + topic, nil
-	} else if persistent == "non-persistent" || persistent == "np" {
-		return "non-persistent://" + tenant + "/" + namespace + "/" + topic, nil
-	} else {
+	var prefix string
+	switch strings.ToLower(strings.TrimSpace(persistent)) {
+	case "persistent", "p":
+		prefix = "persistent://"
+	case "non-persistent", "np", "nonpersistent":
+		prefix = "non-persistent://"
+	default:
 		return "", fmt.Errorf("supported persistent types are persistent, p, non-persistent, np")
 	}
+	if err := ValidateTopicNameParts(tenant, namespace, topic); err != nil {
+		return "", err
+	}
+	return prefix + tenant + "/" + namespace + "/" + topic, nil
+}
+
+// NormalizeTopicFn validates a topic full name, such as the one of the TopicFn header, and returns it
+// with the persistent prefix normalized. A name without a prefix is a persistent topic as in Pulsar.
+func NormalizeTopicFn(topicFn string) (string, error) {
+	persistent, name := "persistent", strings.TrimSpace(topicFn)
+	if i := strings.Index(name, "://"); i >= 0 {
+		persistent, name = name[:i], name[i+len("://"):]
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid topic %q, it must be a fully qualified topic name", topicFn)
+	}
+	return BuildTopicFn(persistent, parts[0], parts[1], parts[2])
+}
+
+// IsNonPersistentTopic returns true if the topic full name is a non-persistent topic.
+// Messages of a non-persistent topic are not stored, so there is nothing to seek to
+// and a subscription only lasts as long as it has a consumer.
+func IsNonPersistentTopic(topicFN string) bool {
+	return strings.HasPrefix(topicFN, "non-persistent://")
 }
 
 // AssignString returns the first non-empty string
@@ -155,6 +259,173 @@ func QueryParamInt(params url.Values, name string, defaultValue int) int {
 	return defaultValue
 }
 
+// QueryParamIntRange gets the integer value of a query parameter within min and max inclusively,
+// or the default value if it is absent. A value that is not an integer or out of the range is an error.
+func QueryParamIntRange(params url.Values, name string, defaultValue, min, max int) (int, error) {
+	str, ok := params[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	num, err := strconv.Atoi(str[0])
+	if err != nil || num < min || num > max {
+		return 0, fmt.Errorf("%s must be an integer between %d and %d", name, min, max)
+	}
+	return num, nil
+}
+
+// ParseQueryDefaults parses URL query encoded default values, such as `includeHeaders=true&mode=async`.
+// Only the supported query parameter names can have a default value.
+func ParseQueryDefaults(str string, supported []string) (url.Values, error) {
+	defaults, err := url.ParseQuery(strings.TrimSpace(str))
+	if err != nil {
+		return nil, err
+	}
+	for name := range defaults {
+		if !StrContains(supported, name) {
+			return nil, fmt.Errorf("query parameter %s does not support a default value", name)
+		}
+	}
+	return defaults, nil
+}
+
+// ApplyQueryDefaults adds the default values of query parameters absent in params.
+// A parameter specified in params always overrides its default value.
+func ApplyQueryDefaults(params, defaults url.Values) url.Values {
+	for name, values := range defaults {
+		if _, ok := params[name]; !ok {
+			params[name] = values
+		}
+	}
+	return params
+}
+
+// ParseClusterTokens parses the cluster to token mapping, such as `pulsar://cluster1:6650=token1,pulsar://cluster2:6650=token2`.
+// Every cluster must be one of the allowed clusters and can only be mapped once.
+func ParseClusterTokens(str string, allowedClusters []string) (map[string]string, error) {
+	return parseClusterMapping(str, allowedClusters, "token")
+}
+
+// ClusterToken returns the token of a request, or the cluster's configured token in PulsarClusterTokens when the
+// request carries none. The cluster token is Beam's own credential, so it must only be used once the subject of
+// the request is verified on the topic, or for Beam's own operations.
+func ClusterToken(pulsarURL, tokenStr string) string {
+	return AssignString(tokenStr, ClusterTokens[pulsarURL])
+}
+
+// ParseClusterAdminURLs parses the cluster to admin REST API URL mapping, such as
+// `pulsar://cluster1:6650=http://cluster1:8080`, with the same rules as ParseClusterTokens.
+func ParseClusterAdminURLs(str string, allowedClusters []string) (map[string]string, error) {
+	return parseClusterMapping(str, allowedClusters, "admin URL")
+}
+
+// parseClusterMapping parses a comma separated list of url=value pairs of the allowed clusters
+func parseClusterMapping(str string, allowedClusters []string, name string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSpace(str), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid cluster %s mapping, expected format is url=%s", name, strings.Replace(name, " ", "", -1))
+		}
+		cluster, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !StrContains(allowedClusters, cluster) {
+			return nil, fmt.Errorf("pulsar cluster %s in cluster %ss is not allowed", cluster, name)
+		}
+		if _, ok := values[cluster]; ok {
+			return nil, fmt.Errorf("pulsar cluster %s has more than one %s", cluster, name)
+		}
+		values[cluster] = value
+	}
+	return values, nil
+}
+
+// ParseTenantRateLimits parses the per-tenant rate limits, such as `tenant1=100,tenant2=20`
+func ParseTenantRateLimits(str string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(strings.TrimSpace(str), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid tenant rate limit %s, expected format is tenant=limit", pair)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid tenant rate limit %s, expected format is tenant=limit", pair)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
+
+// ParseDefaultTopic validates the default topic of the send endpoint and returns it normalized, with its
+// Pulsar URL as configured in the allowed clusters. An empty URL is the default cluster of the request.
+func ParseDefaultTopic(topic, pulsarURL string, allowedClusters []string) (string, string, error) {
+	topic, pulsarURL = strings.TrimSpace(topic), strings.TrimSpace(pulsarURL)
+	if topic == "" {
+		if pulsarURL != "" {
+			return "", "", fmt.Errorf("default topic pulsar URL %s requires a default topic", pulsarURL)
+		}
+		return "", "", nil
+	}
+	topicFN, err := NormalizeTopicFn(topic)
+	if err != nil {
+		return "", "", fmt.Errorf("default topic %v", err)
+	}
+	if pulsarURL == "" {
+		return topicFN, "", nil
+	}
+	allowed, ok := MatchPulsarURL(allowedClusters, pulsarURL)
+	if !ok {
+		return "", "", fmt.Errorf("pulsar cluster %s of the default topic is not allowed", pulsarURL)
+	}
+	return topicFN, allowed, nil
+}
+
+// ParseCORSAllowedOrigins parses a comma separated list of origins, such as `https://a.example.com,https://b.example.com`
+func ParseCORSAllowedOrigins(str string) []string {
+	origins := []string{}
+	for _, origin := range strings.Split(str, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// IsAllowedOrigin returns true if a request origin is in CORSAllowedOrigins or any origin is allowed
+func IsAllowedOrigin(origin string) bool {
+	for _, allowed := range CORSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsListedOrigin returns true if a request origin is one of CORSAllowedOrigins, not only allowed by the wildcard
+func IsListedOrigin(origin string) bool {
+	for _, allowed := range CORSAllowedOrigins {
+		if allowed != "*" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantRateLimit returns the requests per second allowed for a tenant, 0 means no per-tenant limit
+func TenantRateLimit(tenant string) int {
+	if limit, ok := TenantRateLimits[tenant]; ok {
+		return limit
+	}
+	return GetConfig().TenantRateLimit
+}
+
 // TokenizeTopicFullName tokenizes a topic full name into persistent, tenant, namespace, and topic name.
 func TokenizeTopicFullName(topicFn string) (isPersistent bool, tenant, namespace, topic string, err error) {
 	var topicRoute string